@@ -1,18 +1,48 @@
 module my2fback
 
+go 1.22
+
 require (
 	github.com/WangJiemin/jamintools v0.0.0-20190709081102-0345ca85b96c
 	github.com/davecgh/go-spew v1.1.1
 	github.com/dropbox/godropbox v0.0.0-20190501155911-5749d3b71cbe
 	github.com/go-errors/errors v1.0.1 // indirect
+	github.com/go-sql-driver/mysql v1.5.0
 	github.com/juju/errors v0.0.0-20190207033735-e65537c515d7
+	github.com/klauspost/compress v1.18.0
 	github.com/mailru/easyjson v0.0.0-20190626092158-b2ccc519800e // indirect
 	github.com/olivere/elastic v6.2.21+incompatible // indirect
 	github.com/orcaman/concurrent-map v0.0.0-20190314100340-2693aad1ed75 // indirect
 	github.com/pingcap/parser v0.0.0-20190710072914-6cd203114f2d
 	github.com/pingcap/tidb v3.0.0+incompatible
+	github.com/shopspring/decimal v0.0.0-20180709203117-cd690d0c9e24
 	github.com/siddontang/go-mysql v0.0.0-20190711035447-8b9c05ee162e
 	github.com/toolkits/file v0.0.0-20160325033739-a5b3c5147e07
 	github.com/toolkits/slice v0.0.0-20141116085117-e44a80af2484
 	gopkg.in/olivere/elastic.v6 v6.2.21 // indirect
+	gopkg.in/yaml.v2 v2.4.0
+)
+
+require (
+	github.com/StackExchange/wmi v0.0.0-20180725035823-b12b22c5341f // indirect
+	github.com/cznic/mathutil v0.0.0-20181122101859-297441e03548 // indirect
+	github.com/go-ole/go-ole v1.2.1 // indirect
+	github.com/golang/protobuf v1.3.1 // indirect
+	github.com/konsorten/go-windows-terminal-sequences v1.0.1 // indirect
+	github.com/pingcap/errors v0.11.4 // indirect
+	github.com/pingcap/log v0.0.0-20190307075452-bd41d9273596 // indirect
+	github.com/pingcap/tipb v0.0.0-20190428032612-535e1abaa330 // indirect
+	github.com/pkg/errors v0.8.1 // indirect
+	github.com/remyoudompheng/bigfft v0.0.0-20170806203942-52369c62f446 // indirect
+	github.com/satori/go.uuid v1.2.0 // indirect
+	github.com/shirou/gopsutil v2.18.10+incompatible // indirect
+	github.com/siddontang/go v0.0.0-20180604090527-bdc77568d726 // indirect
+	github.com/siddontang/go-log v0.0.0-20180807004314-8d05993dda07 // indirect
+	github.com/sirupsen/logrus v1.4.1 // indirect
+	go.uber.org/atomic v1.3.2 // indirect
+	go.uber.org/multierr v1.1.0 // indirect
+	go.uber.org/zap v1.9.1 // indirect
+	golang.org/x/sys v0.0.0-20190109145017-48ac38b7c8cb // indirect
+	golang.org/x/text v0.3.2 // indirect
+	gopkg.in/natefinch/lumberjack.v2 v2.0.0 // indirect
 )
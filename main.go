@@ -4,6 +4,7 @@ import (
 	my "my2fback/src"
 	"sync"
 
+	"github.com/shopspring/decimal"
 	"github.com/siddontang/go-mysql/replication"
 )
 
@@ -14,7 +15,23 @@ func main() {
 
 	my.GetTblDefFromDbAndMergeAndDump(my.GConfCmd)
 
-	if my.GConfCmd.WorkType != "stats" {
+	// decimals in json columns are numbers as they are, not quoted strings
+	decimal.MarshalJSONWithoutQuotes = true
+
+	if my.GConfCmd.WorkType == "check" {
+		my.CheckAllBinlogs(my.GConfCmd)
+		return
+	}
+	if my.GConfCmd.WorkType == "info" {
+		my.CollectAllBinlogsInfo(my.GConfCmd)
+		return
+	}
+	if my.GConfCmd.WorkType == "locate" {
+		my.LocateBinlogPosOfDatetimes(my.GConfCmd)
+		return
+	}
+
+	if my.GConfCmd.IfGenSql() {
 		my.G_HandlingBinEventIndex = &my.BinEventHandlingIndx{EventIdx: 1, Finished: false}
 	}
 
@@ -24,19 +41,21 @@ func main() {
 	sqlChan := make(chan my.ForwardRollbackSqlOfPrint, my.GConfCmd.Threads*2)
 	var wg, wgGenSql sync.WaitGroup
 
-	// stats file
-	statFH, ddlFH, biglongFH := my.OpenStatsResultFiles(my.GConfCmd)
-	defer statFH.Close()
-	defer ddlFH.Close()
-	defer biglongFH.Close()
-	wg.Add(1)
-	go my.ProcessBinEventStats(statFH, ddlFH, biglongFH, my.GConfCmd, statChan, &wg)
-	if my.GConfCmd.IfWriteOrgSql {
+	if my.GConfCmd.IfAnalyzeStats() {
+		// stats file
+		statFH, ddlFH, biglongFH := my.OpenStatsResultFiles(my.GConfCmd)
+		defer statFH.Close()
+		defer ddlFH.Close()
+		defer biglongFH.Close()
 		wg.Add(1)
-		go my.PrintOrgSqlToFile(my.GConfCmd.OutputDir, orgSqlChan, &wg)
+		go my.ProcessBinEventStats(statFH, ddlFH, biglongFH, my.GConfCmd, statChan, &wg)
+		if my.GConfCmd.IfWriteOrgSql {
+			wg.Add(1)
+			go my.PrintOrgSqlToFile(my.GConfCmd.OutputDir, orgSqlChan, &wg)
+		}
 	}
 
-	if my.GConfCmd.WorkType != "stats" {
+	if my.GConfCmd.IfGenSql() {
 		// write forward or rollback sql to file
 		wg.Add(1)
 		go my.PrintExtraInfoForForwardRollbackupSql(my.GConfCmd, sqlChan, &wg)
@@ -56,8 +75,10 @@ func main() {
 		myParser := my.BinFileParser{}
 		myParser.Parser = replication.NewBinlogParser()
 		myParser.Parser.SetTimestampStringLocation(my.GBinlogTimeLocation)
-		myParser.Parser.SetParseTime(false)  // donot parse mysql datetime/time column into go time structure, take it as string
-		myParser.Parser.SetUseDecimal(false) // sqlbuilder not support decimal type
+		myParser.Parser.SetParseTime(false) // donot parse mysql datetime/time column into go time structure, take it as string
+		myParser.Parser.SetUseDecimal(true) // decimal is exact, float64 loses precision
+		// damaged events are found by checksum for -tolerant
+		myParser.Parser.SetVerifyChecksum(my.GConfCmd.Tolerant)
 		myParser.MyParseAllBinlogFiles(my.GConfCmd, eventChan, statChan, orgSqlChan)
 	}
 
@@ -0,0 +1,190 @@
+package src
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/WangJiemin/jamintools/ehand"
+	"github.com/WangJiemin/jamintools/logging"
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+	"github.com/toolkits/file"
+)
+
+/*
+BinlogArchiver writes events received from master back into binlog files under -o, byte-identical to binlogs of master.
+Artificial events, such as fake rotate event, format description event resent when replication starts in the middle of binlog and heartbeat event,
+are not in binlogs of master and are not written.
+*/
+type BinlogArchiver struct {
+	Dir      string
+	FileName string // binlog being archived
+	Pos      uint32 // size of binlog being archived
+	fh       *os.File
+	bufFH    *bufio.Writer
+}
+
+func NewBinlogArchiver(dir string) *BinlogArchiver {
+	return &BinlogArchiver{Dir: dir}
+}
+
+// GetArchivedBinlogSize returns size of archived binlog, 0 if it is not archived
+func GetArchivedBinlogSize(dir string, binlog string) (int64, error) {
+	fileName := filepath.Join(dir, binlog)
+	if !file.IsExist(fileName) {
+		return 0, nil
+	}
+	st, err := os.Stat(fileName)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	return st.Size(), nil
+}
+
+/*
+SwitchBinlog closes binlog being archived and opens binlog to archive from pos. A new binlog file is created if pos is 4,
+otherwise the archived binlog is continued, content after pos is truncated since it will be received again.
+*/
+func (this *BinlogArchiver) SwitchBinlog(binlog string, pos uint32) error {
+	if this.fh != nil && this.FileName == binlog && this.Pos == pos {
+		return nil
+	}
+	if err := this.Close(); err != nil {
+		return err
+	}
+	fileName := filepath.Join(this.Dir, binlog)
+	var err error
+	if pos <= cBinlogStartPos {
+		this.fh, err = os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			return errors.Annotatef(err, "fail to create %s", fileName)
+		}
+		if _, err = this.fh.Write(replication.BinLogFileHeader); err != nil {
+			return errors.Annotatef(err, "fail to write %s", fileName)
+		}
+		pos = cBinlogStartPos
+	} else {
+		size, err := GetArchivedBinlogSize(this.Dir, binlog)
+		if err != nil {
+			return errors.Annotatef(err, "fail to get size of %s", fileName)
+		}
+		if size < int64(pos) {
+			return errors.Errorf("size of archived %s is %d, cannot continue archiving it from %d", fileName, size, pos)
+		}
+		this.fh, err = os.OpenFile(fileName, os.O_WRONLY, 0644)
+		if err != nil {
+			return errors.Annotatef(err, "fail to open %s", fileName)
+		}
+		if err = this.fh.Truncate(int64(pos)); err != nil {
+			return errors.Annotatef(err, "fail to truncate %s to %d", fileName, pos)
+		}
+		if _, err = this.fh.Seek(int64(pos), os.SEEK_SET); err != nil {
+			return errors.Annotatef(err, "fail to seek %s to %d", fileName, pos)
+		}
+	}
+	this.bufFH = bufio.NewWriterSize(this.fh, cReadBufferBytes)
+	this.FileName = binlog
+	this.Pos = pos
+	GLogger.WriteToLogByFieldsNormalOnlyMsg(fmt.Sprintf("start to archive %s from %d", fileName, pos), logging.INFO)
+	return nil
+}
+
+func (this *BinlogArchiver) ArchiveEvent(ev *replication.BinlogEvent) error {
+	h := ev.Header
+	ifArtificial := h.LogPos == 0 || h.Flags&replication.LOG_EVENT_ARTIFICIAL_F != 0
+	if h.EventType == replication.ROTATE_EVENT && ifArtificial {
+		rotateEv := ev.Event.(*replication.RotateEvent)
+		return this.SwitchBinlog(string(rotateEv.NextLogName), uint32(rotateEv.Position))
+	}
+	if ifArtificial || h.EventType == replication.HEARTBEAT_EVENT {
+		return nil
+	}
+	if this.fh == nil {
+		return errors.Errorf("binlog to archive is unknown, no rotate event is received before event at %d", h.LogPos)
+	}
+	if this.Pos+h.EventSize != h.LogPos {
+		return errors.Errorf("event at %s:%d is not continuous with archived binlog of size %d", this.FileName, h.LogPos, this.Pos)
+	}
+	if _, err := this.bufFH.Write(ev.RawData); err != nil {
+		return errors.Annotatef(err, "fail to write %s", this.fh.Name())
+	}
+	this.Pos = h.LogPos
+
+	switch h.EventType {
+	case replication.ROTATE_EVENT:
+		rotateEv := ev.Event.(*replication.RotateEvent)
+		return this.SwitchBinlog(string(rotateEv.NextLogName), uint32(rotateEv.Position))
+	case replication.XID_EVENT, replication.QUERY_EVENT, replication.FORMAT_DESCRIPTION_EVENT:
+		// flush when trx ends, master may be idle for a long time
+		if err := this.bufFH.Flush(); err != nil {
+			return errors.Annotatef(err, "fail to write %s", this.fh.Name())
+		}
+	}
+	return nil
+}
+
+func (this *BinlogArchiver) Close() error {
+	if this.fh == nil {
+		return nil
+	}
+	err := this.bufFH.Flush()
+	if err == nil {
+		err = this.fh.Close()
+	} else {
+		this.fh.Close()
+	}
+	this.fh = nil
+	this.bufFH = nil
+	return errors.Trace(err)
+}
+
+// IfReachArchiveStop checks -ebin/-epos and -edt before the event is archived
+func IfReachArchiveStop(cfg *ConfCmd, h *replication.EventHeader, binlog string) bool {
+	if h.LogPos == 0 || h.EventType == replication.HEARTBEAT_EVENT {
+		return false
+	}
+	if cfg.IfSetStopFilePos && CompareBinlogPosition(mysql.Position{Name: binlog, Pos: h.LogPos}, cfg.StopFilePos) >= 0 {
+		return true
+	}
+	if cfg.IfSetStopDateTime && h.Timestamp >= cfg.StopDatetime {
+		return true
+	}
+	return false
+}
+
+/*
+ResolveArchiveStartPos: -w=archive continues archived binlog under -o, so -spos is not needed.
+Binlog to start is -sbin, found by -snow/-sdt, or the last binlog archived.
+*/
+func (this *ConfCmd) ResolveArchiveStartPos() {
+	if this.StartFile == "" {
+		archived, err := filepath.Glob(filepath.Join(this.OutputDir, "*.[0-9]*"))
+		if err != nil {
+			GLogger.WriteToLogByFieldsErrorExtramsgExit(err, "fail to find archived binlogs in "+this.OutputDir, logging.ERROR, ehand.ERR_FILE_READ)
+		}
+		lastIdx := -1
+		for _, fileName := range archived {
+			if _, idx, ok := SplitBinlogBasenameAndIndex(fileName); ok && idx > lastIdx {
+				this.StartFile = filepath.Base(fileName)
+				lastIdx = idx
+			}
+		}
+		if this.StartFile == "" {
+			GLogger.WriteToLogByFieldsExitMsgNoErr("when -w=archive, -sbin, -snow or -sdt must be specified if no binlog is archived in -o",
+				logging.ERROR, ehand.ERR_MISSING_OPTION)
+		}
+	}
+	size, err := GetArchivedBinlogSize(this.OutputDir, this.StartFile)
+	if err != nil {
+		GLogger.WriteToLogByFieldsErrorExtramsgExit(err, "fail to get size of archived "+this.StartFile, logging.ERROR, ehand.ERR_FILE_READ)
+	}
+	this.StartPos = uint(cBinlogStartPos)
+	if size > int64(cBinlogStartPos) {
+		this.StartPos = uint(size)
+	}
+	this.StartFilePos = mysql.Position{Name: this.StartFile, Pos: uint32(this.StartPos)}
+	this.IfSetStartFilePos = true
+}
@@ -0,0 +1,298 @@
+package src
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/WangJiemin/jamintools/ehand"
+	"github.com/WangJiemin/jamintools/logging"
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+	"github.com/toolkits/file"
+	"github.com/toolkits/slice"
+)
+
+// BinlogFileInfo is got from the head of binlog file, to sort binlog files given by args
+type BinlogFileInfo struct {
+	FileName   string // full path
+	BaseName   string // mysql-bin of mysql-bin.000001
+	Index      int    // 1 of mysql-bin.000001
+	HasIndex   bool
+	CreateTime uint32 // timestamp of format description event, that is, when the binlog is created
+	FileType   string // binlog, gzip, zstd or tar
+	ServerId   uint32 // server id of format description event
+}
+
+// SplitBinlogBasenameAndIndex is like GetBinlogBasenameAndIndex, but returns false instead of exiting if binlog has no index number suffix
+func SplitBinlogBasenameAndIndex(binlog string) (string, int, bool) {
+	binlogFile := filepath.Base(binlog)
+	dotIdx := strings.LastIndex(binlogFile, ".")
+	if dotIdx <= 0 || dotIdx == len(binlogFile)-1 {
+		return binlogFile, 0, false
+	}
+	n, err := strconv.ParseUint(binlogFile[dotIdx+1:], 10, 32)
+	if err != nil {
+		return binlogFile, 0, false
+	}
+	return binlogFile[0:dotIdx], int(n), true
+}
+
+// CompareBinlogPosition compares binlog index number instead of string of binlog names, so mysql-bin.1000000 is greater than mysql-bin.999999.
+// 1: greater, -1: less, 0: equal
+func CompareBinlogPosition(p1 mysql.Position, p2 mysql.Position) int {
+	base1, idx1, ok1 := SplitBinlogBasenameAndIndex(p1.Name)
+	base2, idx2, ok2 := SplitBinlogBasenameAndIndex(p2.Name)
+	if !ok1 || !ok2 || base1 != base2 || idx1 == idx2 {
+		return p1.Compare(p2)
+	}
+	if idx1 > idx2 {
+		return 1
+	}
+	return -1
+}
+
+// ReadBinlogFileInfo only reads the header of format description event, of the first binlog for tar archive
+func ReadBinlogFileInfo(fileName string) (BinlogFileInfo, error) {
+	var binInfo BinlogFileInfo = BinlogFileInfo{FileName: fileName}
+	binInfo.BaseName, binInfo.Index, binInfo.HasIndex = SplitBinlogBasenameAndIndex(GetBinlogNameFromFileName(fileName))
+
+	binReader, err := OpenBinlogReader(fileName, "")
+	if err != nil {
+		return binInfo, errors.Trace(err)
+	}
+	defer binReader.Close()
+	binInfo.FileType = binReader.FileType
+
+	_, r, err := binReader.NextBinlog()
+	if err != nil {
+		return binInfo, errors.Annotatef(err, "fail to read binlog from %s", fileName)
+	}
+	buf := make([]byte, replication.EventHeaderSize)
+	if _, err = io.ReadFull(r, buf); err != nil {
+		return binInfo, errors.Annotatef(err, "fail to read head of %s", fileName)
+	}
+	h := &replication.EventHeader{}
+	if err = h.Decode(buf); err != nil {
+		return binInfo, errors.Annotatef(err, "fail to parse the first event header of %s", fileName)
+	}
+	if h.EventType != replication.FORMAT_DESCRIPTION_EVENT {
+		return binInfo, errors.Errorf("the first event of %s is %s, not FormatDescriptionEvent", fileName, h.EventType)
+	}
+	binInfo.CreateTime = h.Timestamp
+	binInfo.ServerId = h.ServerID
+	return binInfo, nil
+}
+
+// ReadBinlogIndexFile reads binlog files from mysql binlog index file, such as mysql-bin.index. files are in the order of the index file
+func ReadBinlogIndexFile(indexFile string) []string {
+	var binFiles []string
+	fh, err := os.Open(indexFile)
+	if err != nil {
+		GLogger.WriteToLogByFieldsErrorExtramsgExit(err, "fail to open binlog index file "+indexFile, logging.ERROR, ehand.ERR_FILE_OPEN)
+	}
+	defer fh.Close()
+
+	indexDir := filepath.Dir(indexFile)
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		// path in index file is relative to datadir of mysql, usually the same dir as the index file
+		binFile := line
+		if !filepath.IsAbs(binFile) {
+			binFile = filepath.Join(indexDir, binFile)
+		}
+		if !file.IsFile(binFile) {
+			binFile = filepath.Join(indexDir, filepath.Base(line))
+		}
+		if !file.IsFile(binFile) {
+			GLogger.WriteToLogByFieldsNormalOnlyMsg(fmt.Sprintf("%s in binlog index file %s not exists nor a file, skip it", line, indexFile), logging.WARNING)
+			continue
+		}
+		binFiles = append(binFiles, binFile)
+	}
+	if err = scanner.Err(); err != nil {
+		GLogger.WriteToLogByFieldsErrorExtramsgExit(err, "fail to read binlog index file "+indexFile, logging.ERROR, ehand.ERR_FILE_READ)
+	}
+	return binFiles
+}
+
+// ExpandBinlogFileArgs expands glob patterns of args, such as /data/binlog/mysql-bin.00001*
+func ExpandBinlogFileArgs(args []string) []string {
+	var binFiles []string
+	for _, arg := range args {
+		if arg == C_binlogFromStdin {
+			if len(args) > 1 {
+				GLogger.WriteToLogByFieldsExitMsgNoErr("binlog from stdin(-) cannot be specified together with other binlog files",
+					logging.ERROR, ehand.ERR_OPTION_MISMATCH)
+			}
+			return []string{C_binlogFromStdin}
+		}
+		matches, err := filepath.Glob(arg)
+		if err != nil {
+			GLogger.WriteToLogByFieldsErrorExtramsgExit(err, "invalid binlog file pattern "+arg, logging.ERROR, ehand.ERR_INVALID_OPTION)
+		}
+		if len(matches) == 0 {
+			GLogger.WriteToLogByFieldsExitMsgNoErr(fmt.Sprintf("%s doesnot exists nor a file\n", arg),
+				logging.ERROR, ehand.ERR_FILE_NOT_EXISTS)
+		}
+		for _, oneFile := range matches {
+			if !file.IsFile(oneFile) {
+				GLogger.WriteToLogByFieldsExitMsgNoErr(fmt.Sprintf("%s doesnot exists nor a file\n", oneFile),
+					logging.ERROR, ehand.ERR_FILE_NOT_EXISTS)
+			}
+			if !slice.ContainsString(binFiles, oneFile) {
+				binFiles = append(binFiles, oneFile)
+			}
+		}
+	}
+	return binFiles
+}
+
+// GetSiblingBinlogFiles returns binlog files having the same base name in the same dir of binlog, sorted by index number. compressed ones are included
+func GetSiblingBinlogFiles(binlog string) []string {
+	baseName, _, ok := SplitBinlogBasenameAndIndex(GetBinlogNameFromFileName(binlog))
+	if !ok {
+		return []string{binlog}
+	}
+	matches, err := filepath.Glob(filepath.Join(filepath.Dir(binlog), baseName+".*"))
+	if err != nil {
+		GLogger.WriteToLogByFieldsErrorExtramsgExit(err, "fail to list binlog files of "+binlog, logging.ERROR, ehand.ERR_FILE_READ)
+	}
+	var binInfos []BinlogFileInfo
+	for _, oneFile := range matches {
+		oneBase, oneIdx, oneOk := SplitBinlogBasenameAndIndex(GetBinlogNameFromFileName(oneFile))
+		if !oneOk || oneBase != baseName || !file.IsFile(oneFile) {
+			// mysql-bin.index
+			continue
+		}
+		binInfos = append(binInfos, BinlogFileInfo{FileName: oneFile, BaseName: oneBase, Index: oneIdx, HasIndex: true})
+	}
+	sort.SliceStable(binInfos, func(i, j int) bool {
+		return binInfos[i].Index < binInfos[j].Index
+	})
+	var binFiles []string
+	for i, binInfo := range binInfos {
+		// mysql-bin.000010 and mysql-bin.000010.gz, the plain one is sorted first by glob
+		if i > 0 && binInfo.Index == binInfos[i-1].Index {
+			GLogger.WriteToLogByFieldsNormalOnlyMsg(fmt.Sprintf("skip %s, it is the same binlog as %s", binInfo.FileName, binInfos[i-1].FileName), logging.WARNING)
+			continue
+		}
+		binFiles = append(binFiles, binInfo.FileName)
+	}
+	return binFiles
+}
+
+// SortBinlogFilesByCreateTime sorts binlog files by the timestamp of format description event, then by index number
+func SortBinlogFilesByCreateTime(binFiles []string) []string {
+	binInfos := make([]BinlogFileInfo, len(binFiles))
+	for i, oneFile := range binFiles {
+		binInfo, err := ReadBinlogFileInfo(oneFile)
+		if err != nil {
+			GLogger.WriteToLogByFieldsErrorExtramsgExit(err, "fail to read binlog file "+oneFile, logging.ERROR, ehand.ERR_NOT_BINLOG)
+		}
+		binInfos[i] = binInfo
+	}
+	sort.SliceStable(binInfos, func(i, j int) bool {
+		if binInfos[i].CreateTime != binInfos[j].CreateTime {
+			return binInfos[i].CreateTime < binInfos[j].CreateTime
+		}
+		if binInfos[i].BaseName == binInfos[j].BaseName && binInfos[i].HasIndex && binInfos[j].HasIndex {
+			return binInfos[i].Index < binInfos[j].Index
+		}
+		return false
+	})
+	sorted := make([]string, len(binInfos))
+	for i, binInfo := range binInfos {
+		sorted[i] = binInfo.FileName
+	}
+	return sorted
+}
+
+// WarnBinlogFileGaps prints warning for missing binlog files between two adjacent binlog files
+func WarnBinlogFileGaps(binFiles []string) {
+	for i := 1; i < len(binFiles); i++ {
+		lastBase, lastIdx, lastOk := SplitBinlogBasenameAndIndex(GetBinlogNameFromFileName(binFiles[i-1]))
+		curBase, curIdx, curOk := SplitBinlogBasenameAndIndex(GetBinlogNameFromFileName(binFiles[i]))
+		if !lastOk || !curOk || lastBase != curBase {
+			continue
+		}
+		if curIdx != lastIdx+1 {
+			GLogger.WriteToLogByFieldsNormalOnlyMsg(fmt.Sprintf("binlog files are not continuous, %d binlog file(s) missing between %s and %s",
+				curIdx-lastIdx-1, filepath.Base(binFiles[i-1]), filepath.Base(binFiles[i])), logging.WARNING)
+		}
+	}
+}
+
+/*
+GetBinlogFilesToParse returns binlog files to parse in order for -m=file:
+
+	-idx: files in the binlog index file, in the order of it.
+	-: binlog from stdin.
+	more than one arg or glob pattern: files sorted by create time in format description event.
+	only one file: this file and binlog files after it in the same dir, only this file is parsed if no stop point is specified.
+
+the result starts at -sbin if it is specified. binlog files may be gzip/zstd compressed or tar archives.
+*/
+func (this *ConfCmd) GetBinlogFilesToParse() []string {
+	var (
+		binFiles  []string
+		startFile string
+	)
+	if this.BinlogIndexFile == "" && this.GivenBinlogFiles[0] == C_binlogFromStdin {
+		this.IfMultiBinlogFiles = true
+		return []string{C_binlogFromStdin}
+	}
+
+	if this.BinlogIndexFile != "" {
+		binFiles = ReadBinlogIndexFile(this.BinlogIndexFile)
+		this.IfMultiBinlogFiles = true
+	} else if len(this.GivenBinlogFiles) > 1 {
+		binFiles = SortBinlogFilesByCreateTime(this.GivenBinlogFiles)
+		this.IfMultiBinlogFiles = true
+	} else {
+		binFiles = GetSiblingBinlogFiles(this.GivenBinlogFiles[0])
+		startFile = filepath.Base(this.GivenBinlogFiles[0])
+		this.IfMultiBinlogFiles = false
+	}
+
+	if len(binFiles) == 0 {
+		GLogger.WriteToLogByFieldsExitMsgNoErr("no binlog file found to parse", logging.ERROR, ehand.ERR_FILE_NOT_EXISTS)
+	}
+
+	// -sbin is binlog of master for relay log
+	if this.StartFile != "" && !this.RelayLogMode {
+		startFile = this.StartFile
+	}
+	if startFile != "" {
+		startIdx := -1
+		for i, oneFile := range binFiles {
+			if GetBinlogNameFromFileName(oneFile) == startFile {
+				startIdx = i
+				break
+			}
+		}
+		if startIdx >= 0 {
+			binFiles = binFiles[startIdx:]
+		} else if this.IfMultiBinlogFiles {
+			// binlog may be in tar archive, events before -sbin -spos are skipped anyway
+			GLogger.WriteToLogByFieldsNormalOnlyMsg(fmt.Sprintf("start binlog %s not found by file names, parse all binlog files given", startFile),
+				logging.WARNING)
+		} else {
+			GLogger.WriteToLogByFieldsExitMsgNoErr(fmt.Sprintf("start binlog %s not found in binlog files to parse", startFile),
+				logging.ERROR, ehand.ERR_FILE_NOT_EXISTS)
+		}
+	}
+
+	WarnBinlogFileGaps(binFiles)
+	return binFiles
+}
@@ -0,0 +1,55 @@
+package src
+
+import (
+	"testing"
+
+	"github.com/siddontang/go-mysql/mysql"
+)
+
+func TestSplitBinlogBasenameAndIndex(t *testing.T) {
+	cases := []struct {
+		binlog   string
+		baseName string
+		index    int
+		ok       bool
+	}{
+		{"mysql-bin.000001", "mysql-bin", 1, true},
+		{"/data/binlog/mysql-bin.1000000", "mysql-bin", 1000000, true},
+		{"my.bin.log.000012", "my.bin.log", 12, true},
+		{"mysql-bin", "mysql-bin", 0, false},
+		{"mysql-bin.", "mysql-bin.", 0, false},
+		{".000001", ".000001", 0, false},
+		{"mysql-bin.00000a", "mysql-bin.00000a", 0, false},
+	}
+	for _, c := range cases {
+		baseName, index, ok := SplitBinlogBasenameAndIndex(c.binlog)
+		if baseName != c.baseName || index != c.index || ok != c.ok {
+			t.Errorf("SplitBinlogBasenameAndIndex(%s) = (%s, %d, %v), expect (%s, %d, %v)",
+				c.binlog, baseName, index, ok, c.baseName, c.index, c.ok)
+		}
+	}
+}
+
+func TestCompareBinlogPosition(t *testing.T) {
+	cases := []struct {
+		p1     mysql.Position
+		p2     mysql.Position
+		result int
+	}{
+		{mysql.Position{Name: "mysql-bin.000001", Pos: 4}, mysql.Position{Name: "mysql-bin.000001", Pos: 4}, 0},
+		{mysql.Position{Name: "mysql-bin.000001", Pos: 120}, mysql.Position{Name: "mysql-bin.000001", Pos: 4}, 1},
+		{mysql.Position{Name: "mysql-bin.000001", Pos: 4}, mysql.Position{Name: "mysql-bin.000001", Pos: 120}, -1},
+		{mysql.Position{Name: "mysql-bin.000002", Pos: 4}, mysql.Position{Name: "mysql-bin.000001", Pos: 1000}, 1},
+		// index number is compared, not string of name
+		{mysql.Position{Name: "mysql-bin.1000000", Pos: 4}, mysql.Position{Name: "mysql-bin.999999", Pos: 4}, 1},
+		{mysql.Position{Name: "mysql-bin.999999", Pos: 1000}, mysql.Position{Name: "mysql-bin.1000000", Pos: 4}, -1},
+		// binlogs of different base names or without index are compared as string
+		{mysql.Position{Name: "a-bin.000002", Pos: 4}, mysql.Position{Name: "b-bin.000001", Pos: 4}, -1},
+		{mysql.Position{Name: "mysql-bin", Pos: 4}, mysql.Position{Name: "mysql-bin.000001", Pos: 4}, -1},
+	}
+	for _, c := range cases {
+		if result := CompareBinlogPosition(c.p1, c.p2); result != c.result {
+			t.Errorf("CompareBinlogPosition(%s, %s) = %d, expect %d", c.p1, c.p2, result, c.result)
+		}
+	}
+}
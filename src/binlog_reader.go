@@ -0,0 +1,254 @@
+package src
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/WangJiemin/jamintools/logging"
+	"github.com/juju/errors"
+	"github.com/klauspost/compress/zstd"
+	"github.com/siddontang/go-mysql/replication"
+)
+
+const (
+	C_binlogFileTypePlain = "binlog"
+	C_binlogFileTypeGzip  = "gzip"
+	C_binlogFileTypeZstd  = "zstd"
+	C_binlogFileTypeTar   = "tar"
+
+	C_binlogFromStdin = "-"
+
+	cTarMagicOffset  int = 257
+	cReadBufferBytes int = 1024 * 1024
+)
+
+var (
+	gGzipMagic          []byte   = []byte{0x1f, 0x8b}
+	gZstdMagic          []byte   = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	gTarMagic           []byte   = []byte("ustar")
+	gCompressedSuffixes []string = []string{".gz", ".zst", ".zstd"}
+)
+
+/*
+BinlogReader streams binlogs from plain binlog file, gzip/zstd compressed binlog file, members of tar archive(may be compressed too) or stdin,
+without decompressing them to disk. NextBinlog returns a reader positioned after the fe'bin' magic number of each binlog.
+*/
+type BinlogReader struct {
+	FileName  string // file given, "-" for stdin
+	FileType  string // type of the outer file, binlog, gzip, zstd or tar
+	stdinName string // binlog name for binlog read from stdin
+	fh        *os.File
+	closers   []io.Closer // decompressors of the outer file, followed by those of the current tar member
+	outerCnt  int         // count of decompressors of the outer file in closers
+	reader    *bufio.Reader
+	tarReader *tar.Reader
+	done      bool
+}
+
+// GetBinlogNameFromFileName strips compression suffix, mysql-bin.000010.gz => mysql-bin.000010
+func GetBinlogNameFromFileName(fileName string) string {
+	name := filepath.Base(fileName)
+	for _, suffix := range gCompressedSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return strings.TrimSuffix(name, suffix)
+		}
+	}
+	return name
+}
+
+// DetectStreamType checks magic number of the stream, without consuming it
+func DetectStreamType(br *bufio.Reader) (string, error) {
+	head, err := br.Peek(len(replication.BinLogFileHeader))
+	if err != nil {
+		return "", errors.Annotate(err, "fail to read magic number")
+	}
+	if bytes.Equal(head, replication.BinLogFileHeader) {
+		return C_binlogFileTypePlain, nil
+	}
+	if bytes.HasPrefix(head, gGzipMagic) {
+		return C_binlogFileTypeGzip, nil
+	}
+	if bytes.HasPrefix(head, gZstdMagic) {
+		return C_binlogFileTypeZstd, nil
+	}
+	head, _ = br.Peek(cTarMagicOffset + len(gTarMagic))
+	if len(head) == cTarMagicOffset+len(gTarMagic) && bytes.Equal(head[cTarMagicOffset:], gTarMagic) {
+		return C_binlogFileTypeTar, nil
+	}
+	return "", errors.Errorf("unknown file type, neither binlog(head 4 bytes must fe'bin') nor gzip/zstd/tar")
+}
+
+func OpenBinlogReader(fileName string, stdinName string) (*BinlogReader, error) {
+	var err error
+	this := &BinlogReader{FileName: fileName, stdinName: stdinName}
+	if fileName == C_binlogFromStdin {
+		this.reader = bufio.NewReaderSize(os.Stdin, cReadBufferBytes)
+	} else {
+		this.fh, err = os.Open(fileName)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		this.reader = bufio.NewReaderSize(this.fh, cReadBufferBytes)
+	}
+
+	this.reader, this.FileType, err = this.decompressStream(this.reader)
+	if err != nil {
+		this.Close()
+		return nil, errors.Annotatef(err, "fail to open %s", fileName)
+	}
+	if this.FileType == C_binlogFileTypeTar {
+		this.tarReader = tar.NewReader(this.reader)
+	}
+	this.outerCnt = len(this.closers)
+	return this, nil
+}
+
+/*
+decompressStream wraps gzip/zstd stream with decompressor, it returns the decompressed stream and its type,
+the type is that of the outer stream except for compressed tar, foo.tar.gz is regarded as tar.
+*/
+func (this *BinlogReader) decompressStream(br *bufio.Reader) (*bufio.Reader, string, error) {
+	fileType, err := DetectStreamType(br)
+	if err != nil {
+		return nil, "", err
+	}
+	switch fileType {
+	case C_binlogFileTypeGzip:
+		gzReader, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, "", errors.Annotate(err, "fail to read gzip stream")
+		}
+		this.closers = append(this.closers, gzReader)
+		br = bufio.NewReaderSize(gzReader, cReadBufferBytes)
+	case C_binlogFileTypeZstd:
+		zstdReader, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, "", errors.Annotate(err, "fail to read zstd stream")
+		}
+		zstdCloser := zstdReader.IOReadCloser()
+		this.closers = append(this.closers, zstdCloser)
+		br = bufio.NewReaderSize(zstdCloser, cReadBufferBytes)
+	default:
+		return br, fileType, nil
+	}
+
+	innerType, err := DetectStreamType(br)
+	if err != nil {
+		return nil, "", errors.Annotatef(err, "decompressed %s stream", fileType)
+	}
+	if innerType == C_binlogFileTypeTar {
+		return br, innerType, nil
+	}
+	if innerType != C_binlogFileTypePlain {
+		return nil, "", errors.Errorf("decompressed %s stream is %s, not binlog nor tar", fileType, innerType)
+	}
+	return br, fileType, nil
+}
+
+/*
+NextBinlog returns name of the next binlog and the reader of it, positioned after fe'bin'.
+Non binlog members of tar archive are skipped. io.EOF is returned when there is no more binlog.
+*/
+func (this *BinlogReader) NextBinlog() (string, io.Reader, error) {
+	if this.tarReader == nil {
+		if this.done {
+			return "", nil, io.EOF
+		}
+		this.done = true
+		name := GetBinlogNameFromFileName(this.FileName)
+		if this.FileName == C_binlogFromStdin {
+			name = this.stdinName
+		}
+		if _, err := this.reader.Discard(len(replication.BinLogFileHeader)); err != nil {
+			return name, nil, errors.Trace(err)
+		}
+		if this.fh != nil && this.FileType == C_binlogFileTypePlain {
+			return name, &BinlogSeekReader{Reader: this.reader, fh: this.fh}, nil
+		}
+		return name, this.reader, nil
+	}
+
+	for {
+		this.closeMemberDecompressors()
+		hdr, err := this.tarReader.Next()
+		if err == io.EOF {
+			return "", nil, io.EOF
+		} else if err != nil {
+			return "", nil, errors.Annotatef(err, "fail to read tar archive %s", this.FileName)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		memberReader := bufio.NewReaderSize(this.tarReader, cReadBufferBytes)
+		memberReader, memberType, err := this.decompressStream(memberReader)
+		if err != nil || memberType == C_binlogFileTypeTar {
+			GLogger.WriteToLogByFieldsNormalOnlyMsg(fmt.Sprintf("skip %s in %s, it is not binlog: %v", hdr.Name, this.FileName, err), logging.WARNING)
+			continue
+		}
+		if _, err = memberReader.Discard(len(replication.BinLogFileHeader)); err != nil {
+			return hdr.Name, nil, errors.Trace(err)
+		}
+		GLogger.WriteToLogByFieldsNormalOnlyMsg(fmt.Sprintf("start to parse %s in %s", hdr.Name, this.FileName), logging.INFO)
+		return GetBinlogNameFromFileName(hdr.Name), memberReader, nil
+	}
+}
+
+// closeMemberDecompressors closes decompressors of the previous tar member before moving to the next one
+func (this *BinlogReader) closeMemberDecompressors() {
+	for i := len(this.closers) - 1; i >= this.outerCnt; i-- {
+		this.closers[i].Close()
+	}
+	this.closers = this.closers[:this.outerCnt]
+}
+
+/*
+BinlogSeekReader is the reader of plain binlog file, SkipBytes seeks the file instead of reading the bytes skipped.
+Readers of compressed binlog, tar archive or stdin are *bufio.Reader, they are not seekable.
+*/
+type BinlogSeekReader struct {
+	*bufio.Reader
+	fh *os.File
+}
+
+func (this *BinlogSeekReader) SkipBytes(n int64) error {
+	buffered := int64(this.Buffered())
+	if n <= buffered {
+		_, err := this.Discard(int(n))
+		return errors.Trace(err)
+	}
+	if _, err := this.fh.Seek(n-buffered, os.SEEK_CUR); err != nil {
+		return errors.Trace(err)
+	}
+	this.Reset(this.fh)
+	return nil
+}
+
+// SkipBytes skips n bytes of reader returned by NextBinlog, it seeks for plain binlog file
+func SkipBytes(r io.Reader, n int64) error {
+	if seekReader, ok := r.(*BinlogSeekReader); ok {
+		return seekReader.SkipBytes(n)
+	}
+	if _, err := io.CopyN(ioutil.Discard, r, n); err != nil {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+func (this *BinlogReader) Close() {
+	for i := len(this.closers) - 1; i >= 0; i-- {
+		this.closers[i].Close()
+	}
+	this.closers = nil
+	if this.fh != nil {
+		this.fh.Close()
+		this.fh = nil
+	}
+}
@@ -0,0 +1,425 @@
+package src
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/WangJiemin/jamintools/ehand"
+	"github.com/WangJiemin/jamintools/logging"
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql/replication"
+)
+
+// issues found by -w=check
+const (
+	C_checkIssueChecksum  = "checksum_mismatch"
+	C_checkIssueHeader    = "invalid_header"
+	C_checkIssueTruncated = "truncated_event"
+	C_checkIssuePosition  = "position_discontinuity"
+	C_checkIssueRotate    = "rotate_mismatch"
+	C_checkIssueNoRotate  = "missing_rotate"
+	C_checkIssueDecode    = "undecodable_event"
+	C_checkIssueTrx       = "unbalanced_trx"
+
+	C_checkReportFile = "binlog_check.json"
+
+	// max_allowed_packet is at most 1G, so is binlog event
+	cMaxBinlogEventSize uint32 = 1024 * 1024 * 1024
+)
+
+type BinlogCheckIssue struct {
+	Binlog    string `json:"binlog"`
+	Pos       uint32 `json:"position"` // start position of the event
+	EventType string `json:"event_type,omitempty"`
+	Issue     string `json:"issue"`
+	Detail    string `json:"detail"`
+}
+
+type BinlogCheckFileResult struct {
+	Binlog   string `json:"binlog"`
+	StartPos uint32 `json:"start_position"`
+	EndPos   uint32 `json:"end_position"` // where check stops
+	Events   uint64 `json:"events"`
+	Checksum string `json:"checksum"`
+	Issues   int    `json:"issues"`
+}
+
+type BinlogCheckReport struct {
+	Binlogs   []*BinlogCheckFileResult `json:"binlogs"`
+	Issues    []BinlogCheckIssue       `json:"issues"`
+	Corrupted bool                     `json:"corrupted"`
+}
+
+/*
+BinlogChecker verifies integrity of binlog events one by one, it does not stop at the first bad event like parsing does:
+
+	crc32 checksum of events against checksum algorithm of format description event.
+	continuity of positions, end position of event = start position + event size.
+	binlog ends with rotate event to the next binlog, or stop event.
+	events are not truncated at the tail of binlog.
+	transactions are balanced, every BEGIN/GTID has its XID/COMMIT.
+*/
+type BinlogChecker struct {
+	Report BinlogCheckReport
+
+	parser      *replication.BinlogParser
+	current     *BinlogCheckFileResult
+	checksumAlg byte
+	ifRelayLog  bool // positions of relay log are of master and relay log rotates by slave, they are not checked
+
+	rotateTo   string // binlog in the rotate event of current binlog
+	ifStopped  bool   // stop event of current binlog, master shuts down
+	inTrx      bool
+	trxByGtid  bool   // trx of mariadb starts by gtid event without BEGIN
+	trxPos     uint32 // start position of current trx
+	lastEvType replication.EventType
+}
+
+func NewBinlogChecker(ifRelayLog bool) *BinlogChecker {
+	parser := replication.NewBinlogParser()
+	parser.SetTimestampStringLocation(GBinlogTimeLocation)
+	parser.SetParseTime(false)
+	parser.SetUseDecimal(false)
+	return &BinlogChecker{parser: parser, ifRelayLog: ifRelayLog, checksumAlg: replication.BINLOG_CHECKSUM_ALG_OFF}
+}
+
+func (this *BinlogChecker) AddIssue(pos uint32, evType string, issue string, detail string) {
+	binlog := ""
+	if this.current != nil {
+		binlog = this.current.Binlog
+		this.current.Issues++
+	}
+	this.Report.Issues = append(this.Report.Issues, BinlogCheckIssue{Binlog: binlog, Pos: pos, EventType: evType, Issue: issue, Detail: detail})
+	this.Report.Corrupted = true
+	GLogger.WriteToLogByFieldsNormalOnlyMsg(fmt.Sprintf("%s at %s %d %s: %s", issue, binlog, pos, evType, detail), logging.ERROR)
+}
+
+// StartBinlog starts to check the next binlog from pos, it also finishes the current binlog
+func (this *BinlogChecker) StartBinlog(binlog string, pos uint32) {
+	if this.current != nil {
+		this.FinishBinlog(binlog, true)
+	}
+	GLogger.WriteToLogByFieldsNormalOnlyMsg(fmt.Sprintf("start to check %s from %d", binlog, pos), logging.INFO)
+	this.current = &BinlogCheckFileResult{Binlog: binlog, StartPos: pos, EndPos: pos, Checksum: "NONE"}
+	this.Report.Binlogs = append(this.Report.Binlogs, this.current)
+	this.rotateTo = ""
+	this.ifStopped = false
+}
+
+/*
+FinishBinlog checks the end of current binlog, next is the binlog after it, empty if it is the last binlog to check.
+ifComplete is false when check stops in the middle of binlog, unfinished transaction is not an issue then.
+*/
+func (this *BinlogChecker) FinishBinlog(next string, ifComplete bool) {
+	if this.current == nil {
+		return
+	}
+	if ifComplete && this.inTrx {
+		this.AddIssue(this.current.EndPos, "", C_checkIssueTrx,
+			fmt.Sprintf("transaction starting at %d is not terminated at the end of binlog", this.trxPos))
+	}
+	this.inTrx = false
+	this.trxByGtid = false
+	if next != "" && !this.ifRelayLog {
+		if this.rotateTo != "" && this.rotateTo != next {
+			this.AddIssue(this.current.EndPos, "", C_checkIssueRotate,
+				fmt.Sprintf("binlog rotates to %s, but the next binlog is %s", this.rotateTo, next))
+		} else if this.rotateTo == "" && !this.ifStopped {
+			this.AddIssue(this.current.EndPos, "", C_checkIssueNoRotate,
+				fmt.Sprintf("binlog ends with %s, not rotate event, before the next binlog %s", this.lastEvType, next))
+		}
+	}
+	GLogger.WriteToLogByFieldsNormalOnlyMsg(fmt.Sprintf("finish checking %s at %d, %d events, %d issues",
+		this.current.Binlog, this.current.EndPos, this.current.Events, this.current.Issues), logging.INFO)
+	this.current = nil
+}
+
+// ReadFormatDescEvent takes checksum algorithm from format description event, it is in the event itself
+func (this *BinlogChecker) ReadFormatDescEvent(h *replication.EventHeader, rawData []byte, pos uint32) {
+	evType := h.EventType.String()
+	e, err := this.parser.ParseEvent(h, rawData[replication.EventHeaderSize:], rawData)
+	if err != nil {
+		this.AddIssue(pos, evType, C_checkIssueDecode, err.Error())
+		return
+	}
+	this.checksumAlg = e.(*replication.FormatDescriptionEvent).ChecksumAlgorithm
+	if this.checksumAlg == replication.BINLOG_CHECKSUM_ALG_CRC32 {
+		this.current.Checksum = "CRC32"
+		if err = VerifyBinEventChecksum(rawData); err != nil {
+			this.AddIssue(pos, evType, C_checkIssueChecksum, err.Error())
+		}
+	} else {
+		this.current.Checksum = "NONE"
+	}
+}
+
+/*
+CheckEvent checks one event, pos is its start position.
+The event is not decoded if its checksum mismatches, the body cannot be trusted.
+*/
+func (this *BinlogChecker) CheckEvent(rawData []byte, pos uint32) *replication.EventHeader {
+	h, err := this.parser.ParseHeader(rawData)
+	if err != nil {
+		this.AddIssue(pos, "", C_checkIssueHeader, err.Error())
+		return nil
+	}
+	evType := h.EventType.String()
+	this.current.Events++
+	this.current.EndPos = pos + h.EventSize
+	this.lastEvType = h.EventType
+	ifArtificial := h.LogPos == 0 || h.Flags&replication.LOG_EVENT_ARTIFICIAL_F != 0
+
+	if !this.ifRelayLog && !ifArtificial && h.LogPos != pos+h.EventSize {
+		this.AddIssue(pos, evType, C_checkIssuePosition,
+			fmt.Sprintf("end position in header is %d, but start position %d + event size %d is %d", h.LogPos, pos, h.EventSize, pos+h.EventSize))
+	}
+
+	if h.EventType == replication.FORMAT_DESCRIPTION_EVENT {
+		this.ReadFormatDescEvent(h, rawData, pos)
+		return h
+	}
+
+	if this.checksumAlg == replication.BINLOG_CHECKSUM_ALG_CRC32 {
+		if err = VerifyBinEventChecksum(rawData); err != nil {
+			this.AddIssue(pos, evType, C_checkIssueChecksum, err.Error())
+			return h
+		}
+	}
+
+	e, err := this.parser.ParseEvent(h, rawData[replication.EventHeaderSize:], rawData)
+	if err != nil {
+		this.AddIssue(pos, evType, C_checkIssueDecode, err.Error())
+		return h
+	}
+	switch h.EventType {
+	case replication.ROTATE_EVENT:
+		if !ifArtificial {
+			this.rotateTo = string(e.(*replication.RotateEvent).NextLogName)
+		}
+	case replication.STOP_EVENT:
+		this.ifStopped = true
+	case replication.TRANSACTION_PAYLOAD_EVENT:
+		for _, ev := range e.(*replication.TransactionPayloadEvent).Events {
+			this.CheckTrxBalance(ev.Header, ev.Event, pos)
+		}
+	default:
+		this.CheckTrxBalance(h, e, pos)
+	}
+	return h
+}
+
+// CheckTrxBalance checks BEGIN/GTID against XID/COMMIT
+func (this *BinlogChecker) CheckTrxBalance(h *replication.EventHeader, e replication.Event, pos uint32) {
+	evType := h.EventType.String()
+	switch h.EventType {
+	case replication.GTID_EVENT, replication.ANONYMOUS_GTID_EVENT, replication.MARIADB_GTID_EVENT:
+		if this.inTrx {
+			this.AddIssue(pos, evType, C_checkIssueTrx, fmt.Sprintf("transaction starting at %d is not terminated before gtid event", this.trxPos))
+		}
+		this.inTrx = false
+		this.trxByGtid = false
+		if gtidEv, ok := e.(*replication.MariadbGTIDEvent); ok && !gtidEv.IsStandalone() {
+			this.inTrx = true
+			this.trxByGtid = true
+			this.trxPos = pos
+		}
+	case replication.QUERY_EVENT:
+		query := strings.ToUpper(strings.TrimSpace(string(e.(*replication.QueryEvent).Query)))
+		if query == "BEGIN" || strings.HasPrefix(query, "XA START") || strings.HasPrefix(query, "XA BEGIN") {
+			if this.inTrx && !this.trxByGtid {
+				this.AddIssue(pos, evType, C_checkIssueTrx, fmt.Sprintf("transaction starting at %d is not terminated before %s", this.trxPos, query))
+			}
+			this.inTrx = true
+			this.trxByGtid = false
+			this.trxPos = pos
+		} else if query == "COMMIT" || query == "ROLLBACK" {
+			this.EndTrx(pos, evType)
+		}
+	case replication.XID_EVENT, replication.XA_PREPARE_LOG_EVENT:
+		this.EndTrx(pos, evType)
+	case replication.TABLE_MAP_EVENT,
+		replication.WRITE_ROWS_EVENTv0, replication.UPDATE_ROWS_EVENTv0, replication.DELETE_ROWS_EVENTv0,
+		replication.WRITE_ROWS_EVENTv1, replication.UPDATE_ROWS_EVENTv1, replication.DELETE_ROWS_EVENTv1,
+		replication.WRITE_ROWS_EVENTv2, replication.UPDATE_ROWS_EVENTv2, replication.DELETE_ROWS_EVENTv2,
+		replication.PARTIAL_UPDATE_ROWS_EVENT:
+		if !this.inTrx {
+			this.AddIssue(pos, evType, C_checkIssueTrx, "rows event out of transaction")
+		}
+	}
+}
+
+func (this *BinlogChecker) EndTrx(pos uint32, evType string) {
+	if !this.inTrx {
+		this.AddIssue(pos, evType, C_checkIssueTrx, "transaction ends without BEGIN")
+	}
+	this.inTrx = false
+	this.trxByGtid = false
+}
+
+/*
+CheckBinlogReader checks events of one binlog from reader, positioned after the magic number.
+It stops the binlog at invalid header, where the next event cannot be located, or at truncated event.
+*/
+func (this *BinlogChecker) CheckBinlogReader(r io.Reader, binlog string) error {
+	var pos uint32 = 4
+	headBuf := make([]byte, replication.EventHeaderSize)
+	this.StartBinlog(binlog, pos)
+	for {
+		n, err := io.ReadFull(r, headBuf)
+		if err == io.EOF {
+			return nil
+		} else if err == io.ErrUnexpectedEOF {
+			this.AddIssue(pos, "", C_checkIssueTruncated, fmt.Sprintf("only %d bytes of event header at the tail of binlog", n))
+			return nil
+		} else if err != nil {
+			return errors.Annotatef(err, "fail to read %s at %d", binlog, pos)
+		}
+
+		size := binary.LittleEndian.Uint32(headBuf[9:])
+		if size < uint32(replication.EventHeaderSize) || size > cMaxBinlogEventSize {
+			this.AddIssue(pos, replication.EventType(headBuf[4]).String(), C_checkIssueHeader,
+				fmt.Sprintf("invalid event size %d, events after it cannot be located", size))
+			return nil
+		}
+		rawData := make([]byte, size)
+		copy(rawData, headBuf)
+		if n, err = io.ReadFull(r, rawData[replication.EventHeaderSize:]); err == io.EOF || err == io.ErrUnexpectedEOF {
+			this.AddIssue(pos, replication.EventType(headBuf[4]).String(), C_checkIssueTruncated,
+				fmt.Sprintf("only %d bytes of event of %d bytes at the tail of binlog", n+replication.EventHeaderSize, size))
+			return nil
+		} else if err != nil {
+			return errors.Annotatef(err, "fail to read %s at %d", binlog, pos)
+		}
+		this.CheckEvent(rawData, pos)
+		pos += size
+	}
+}
+
+// VerifyBinEventChecksum verifies crc32 at the tail of event
+func VerifyBinEventChecksum(rawData []byte) error {
+	if len(rawData) < replication.EventHeaderSize+replication.BinlogChecksumLength {
+		return errors.Errorf("event of %d bytes is too short to have checksum", len(rawData))
+	}
+	dataLen := len(rawData) - replication.BinlogChecksumLength
+	expected := binary.LittleEndian.Uint32(rawData[dataLen:])
+	computed := crc32.ChecksumIEEE(rawData[:dataLen])
+	if expected != computed {
+		return errors.Errorf("checksum in event is %08x, but computed is %08x", expected, computed)
+	}
+	return nil
+}
+
+// CheckAllBinlogs is -w=check, checks binlog files or binlogs from master, writes report into -o and exits with error if any issue is found
+func CheckAllBinlogs(cfg *ConfCmd) {
+	checker := NewBinlogChecker(cfg.RelayLogMode)
+	if cfg.Mode == "repl" {
+		checker.CheckReplBinlogs(cfg)
+	} else {
+		checker.CheckBinlogFiles(cfg)
+	}
+
+	reportFile := filepath.Join(cfg.OutputDir, C_checkReportFile)
+	content, err := json.MarshalIndent(checker.Report, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(reportFile, append(content, '\n'), 0644)
+	}
+	GLogger.WriteToLogByFieldsErrorExtramsgExit(err, "fail to write "+reportFile, logging.ERROR, ehand.ERR_FILE_WRITE)
+
+	if checker.Report.Corrupted {
+		GLogger.WriteToLogByFieldsExitMsgNoErr(fmt.Sprintf("binlog is corrupted, %d issues are found in %d binlogs, see %s",
+			len(checker.Report.Issues), len(checker.Report.Binlogs), reportFile), logging.ERROR, ehand.ERR_BINLOG_EVENT)
+	}
+	GLogger.WriteToLogByFieldsNormalOnlyMsg(fmt.Sprintf("no issue is found in %d binlogs, see %s", len(checker.Report.Binlogs), reportFile), logging.INFO)
+}
+
+func (this *BinlogChecker) CheckBinlogFiles(cfg *ConfCmd) {
+	for _, name := range cfg.BinlogFiles {
+		binReader, err := OpenBinlogReader(name, cfg.StdinBinlogName)
+		if err != nil {
+			GLogger.WriteToLogByFieldsErrorExtramsgExit(err, "fail to open "+name, logging.ERROR, ehand.ERR_FILE_OPEN)
+		}
+		for {
+			binlog, r, err := binReader.NextBinlog()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				binReader.Close()
+				GLogger.WriteToLogByFieldsErrorExtramsgExit(err, "fail to read "+name, logging.ERROR, ehand.ERR_FILE_READ)
+			}
+			if err = this.CheckBinlogReader(r, binlog); err != nil {
+				binReader.Close()
+				GLogger.WriteToLogByFieldsErrorExtramsgExit(err, "fail to check "+binlog, logging.ERROR, ehand.ERR_FILE_READ)
+			}
+		}
+		binReader.Close()
+	}
+	this.FinishBinlog("", true)
+}
+
+/*
+CheckReplBinlogs checks binlogs sent by master from -sbin/-spos or -sgtid, events are not decoded by replication, but by the checker.
+It stops at -ebin/-epos or -edt, or at the end of the first binlog if no stop point is set.
+*/
+func (this *BinlogChecker) CheckReplBinlogs(cfg *ConfCmd) {
+	replSyncer, streamer := NewReplBinlogStreamer(cfg)
+	defer replSyncer.Close()
+	var (
+		binlog  string
+		nextPos uint32
+	)
+	GLogger.WriteToLogByFieldsNormalOnlyMsg("start to check binlog from mysql", logging.INFO)
+	for {
+		ev, err := streamer.GetEvent(context.Background())
+		if err != nil {
+			GLogger.WriteToLogByFieldsErrorExtramsgExitCode(err, "error to get binlog event", logging.ERROR, ehand.ERR_MYSQL_REPL)
+			this.FinishBinlog("", false)
+			return
+		}
+		h := ev.Header
+		if h.EventType == replication.HEARTBEAT_EVENT {
+			continue
+		}
+		// the fake rotate event tells the binlog and position events follow
+		if h.EventType == replication.ROTATE_EVENT && (h.LogPos == 0 || h.Flags&replication.LOG_EVENT_ARTIFICIAL_F != 0) {
+			rotateEv := ev.Event.(*replication.RotateEvent)
+			if string(rotateEv.NextLogName) != binlog {
+				binlog = string(rotateEv.NextLogName)
+				this.StartBinlog(binlog, uint32(rotateEv.Position))
+			}
+			nextPos = uint32(rotateEv.Position)
+			continue
+		}
+		if IfReachArchiveStop(cfg, h, binlog) {
+			break
+		}
+		if this.current == nil {
+			GLogger.WriteToLogByFieldsNormalOnlyMsg(fmt.Sprintf("binlog is unknown, no rotate event is received before event at %d", h.LogPos), logging.ERROR)
+			return
+		}
+		// artificial events are not in the binlog, like format description event sent when replication does not start at 4.
+		// only the checksum algorithm is taken from it, the position and count of events are not changed
+		if h.LogPos == 0 || h.Flags&replication.LOG_EVENT_ARTIFICIAL_F != 0 {
+			if h.EventType == replication.FORMAT_DESCRIPTION_EVENT {
+				this.ReadFormatDescEvent(h, ev.RawData, this.current.EndPos)
+			}
+			continue
+		}
+		this.CheckEvent(ev.RawData, nextPos)
+		nextPos = h.LogPos
+		this.current.EndPos = h.LogPos
+		if h.EventType == replication.ROTATE_EVENT && !cfg.IfSetStopParsPoint && !cfg.IfSetStopDateTime {
+			// just check one binlog
+			this.FinishBinlog("", true)
+			return
+		}
+	}
+	this.FinishBinlog("", false)
+	GLogger.WriteToLogByFieldsNormalOnlyMsg("finish checking binlog from mysql", logging.INFO)
+}
@@ -0,0 +1,280 @@
+package src
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/WangJiemin/jamintools/constvar"
+	"github.com/WangJiemin/jamintools/dsql"
+	"github.com/WangJiemin/jamintools/ehand"
+	"github.com/WangJiemin/jamintools/logging"
+	"github.com/WangJiemin/jamintools/myjson"
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/toolkits/file"
+)
+
+/*
+CheckpointBarrier is sent by the binlog reader after a transaction commits, through every channel whose consumer writes output files.
+Once all consumers have written everything before it and reported their output file sizes, the checkpoint is saved.
+*/
+type CheckpointBarrier struct {
+	Seq       uint64
+	Position  mysql.Position // end position of the commit event, -relay: position of master
+	RelayPos  mysql.Position // -relay: end position of the commit event in relay log
+	Gtid      string
+	Timestamp uint32
+}
+
+// CheckpointInfo is what saved in checkpoint file
+type CheckpointInfo struct {
+	Binlog      string           `json:"binlog"`
+	Pos         uint32           `json:"position"`
+	Gtid        string           `json:"gtid"`
+	RelayLog    string           `json:"relay_log,omitempty"`
+	RelayPos    uint32           `json:"relay_position,omitempty"`
+	DateTime    string           `json:"datetime"`
+	OutputFiles map[string]int64 `json:"output_files"` // output file => size when checkpoint is saved
+	Stats       *CheckpointStats `json:"stats,omitempty"`
+}
+
+/*
+CheckpointStats is stats of the print interval in progress at checkpoint. They are not in the stats file yet,
+and events before checkpoint are not read again after resuming, so they are saved to continue the interval.
+*/
+type CheckpointStats struct {
+	Binlog        string                         `json:"binlog"`
+	NextPrintTime uint32                         `json:"next_print_time"`
+	Tables        map[string]*BinEventStatsPrint `json:"tables"` // db.tb => stats
+}
+
+type BinlogCheckpoint struct {
+	dsql.PosSynced
+	Gtid            string
+	RelayPos        mysql.Position
+	DateTime        uint32
+	OutputFiles     map[string]int64
+	Stats           *CheckpointStats
+	Parties         int // consumers which must report before the checkpoint is saved
+	lastBarrierTime time.Time
+	seq             uint64
+	reported        map[uint64]int              // barrier seq => count of consumers reported
+	reportedSizes   map[uint64]map[string]int64 // barrier seq => output file sizes reported, applied when all consumers reported
+	reportedStats   map[uint64]*CheckpointStats // barrier seq => stats reported, applied when all consumers reported
+	reportLock      sync.Mutex
+	ifResumed       bool
+}
+
+var GCheckpoint *BinlogCheckpoint // nil if -ckpt is not set
+
+func NewBinlogCheckpoint(cfg *ConfCmd) *BinlogCheckpoint {
+	this := &BinlogCheckpoint{OutputFiles: map[string]int64{}, reported: map[uint64]int{},
+		reportedSizes: map[uint64]map[string]int64{}, reportedStats: map[uint64]*CheckpointStats{}, lastBarrierTime: time.Now()}
+	this.File = cfg.CheckpointFile
+	this.SlaveInterval = int64(cfg.CheckpointInterval)
+	// binlog stats consumer always works
+	this.Parties = 1
+	if cfg.IfGenSql() {
+		this.Parties++
+	}
+	if cfg.IfWriteOrgSql {
+		this.Parties++
+	}
+	return this
+}
+
+func (this *BinlogCheckpoint) LoadFromFile() error {
+	if !file.IsFile(this.File) {
+		return errors.Errorf("%s not exists nor a file", this.File)
+	}
+	info := CheckpointInfo{}
+	err := myjson.ReadJsonFileIntoVar(&info, this.File)
+	if err != nil {
+		return errors.Annotatef(err, "error to unmarshal checkpoint json from file %s", this.File)
+	}
+	if info.Binlog == "" || info.Pos == 0 {
+		return errors.Errorf("position %s:%d from %s is invalid", info.Binlog, info.Pos, this.File)
+	}
+	this.Lock.Lock()
+	defer this.Lock.Unlock()
+	this.Position = mysql.Position{Name: info.Binlog, Pos: info.Pos}
+	this.Gtid = info.Gtid
+	this.RelayPos = mysql.Position{Name: info.RelayLog, Pos: info.RelayPos}
+	if info.OutputFiles != nil {
+		this.OutputFiles = info.OutputFiles
+	}
+	this.Stats = info.Stats
+	this.ifResumed = true
+	return nil
+}
+
+// SaveToFile writes checkpoint into a tmp file then renames it, so the checkpoint file is always complete
+func (this *BinlogCheckpoint) SaveToFile() error {
+	this.Lock.RLock()
+	info := CheckpointInfo{Binlog: this.Position.Name, Pos: this.Position.Pos, Gtid: this.Gtid,
+		RelayLog: this.RelayPos.Name, RelayPos: this.RelayPos.Pos,
+		DateTime:    GetDatetimeStr(int64(this.DateTime), 0, constvar.DATETIME_FORMAT),
+		OutputFiles: this.OutputFiles, Stats: this.Stats}
+	err := myjson.DumpValueToJsonFile(info, this.File+".tmp")
+	this.Lock.RUnlock()
+	if err != nil {
+		return errors.Annotatef(err, "error to save checkpoint to %s", this.File+".tmp")
+	}
+	if err = os.Rename(this.File+".tmp", this.File); err != nil {
+		return errors.Annotatef(err, "error to rename %s to %s", this.File+".tmp", this.File)
+	}
+	this.LastSavedTime = time.Now()
+	return nil
+}
+
+// NewBarrier returns nil if it is not time to checkpoint yet, only the binlog reader calls it
+func (this *BinlogCheckpoint) NewBarrier(pos mysql.Position, relayPos mysql.Position, gtid string, ts uint32) *CheckpointBarrier {
+	if time.Since(this.lastBarrierTime) < time.Duration(this.SlaveInterval)*time.Second {
+		return nil
+	}
+	this.lastBarrierTime = time.Now()
+	this.seq++
+	return &CheckpointBarrier{Seq: this.seq, Position: pos, RelayPos: relayPos, Gtid: gtid, Timestamp: ts}
+}
+
+// ReportStats is called by the stats consumer before Report, with stats of the print interval in progress at the barrier
+func (this *BinlogCheckpoint) ReportStats(barrier *CheckpointBarrier, stats *CheckpointStats) {
+	this.reportLock.Lock()
+	defer this.reportLock.Unlock()
+	this.reportedStats[barrier.Seq] = stats
+}
+
+/*
+Report is called by consumer of binlog events once it has written everything before the barrier,
+with sizes of output files it writes. The checkpoint is saved when all consumers have reported.
+*/
+func (this *BinlogCheckpoint) Report(barrier *CheckpointBarrier, fileSizes map[string]int64) {
+	this.reportLock.Lock()
+	defer this.reportLock.Unlock()
+
+	// a consumer may report newer barriers before others report this one, sizes are kept apart by barrier
+	sizes, ok := this.reportedSizes[barrier.Seq]
+	if !ok {
+		sizes = map[string]int64{}
+		this.reportedSizes[barrier.Seq] = sizes
+	}
+	for fn, size := range fileSizes {
+		sizes[fn] = size
+	}
+
+	this.reported[barrier.Seq]++
+	if this.reported[barrier.Seq] < this.Parties {
+		return
+	}
+	for seq := range this.reported {
+		if seq <= barrier.Seq {
+			delete(this.reported, seq)
+		}
+	}
+	for seq := range this.reportedSizes {
+		if seq <= barrier.Seq {
+			delete(this.reportedSizes, seq)
+		}
+	}
+	stats := this.reportedStats[barrier.Seq]
+	for seq := range this.reportedStats {
+		if seq <= barrier.Seq {
+			delete(this.reportedStats, seq)
+		}
+	}
+
+	this.SetPosition(barrier.Position, 0)
+	this.Lock.Lock()
+	for fn, size := range sizes {
+		this.OutputFiles[fn] = size
+	}
+	this.Stats = stats
+	this.Gtid = barrier.Gtid
+	this.RelayPos = barrier.RelayPos
+	this.DateTime = barrier.Timestamp
+	this.Lock.Unlock()
+	if err := this.SaveToFile(); err != nil {
+		GLogger.WriteToLogByFieldsErrorExtramsgExitCode(err, "fail to save checkpoint", logging.ERROR, ehand.ERR_FILE_WRITE)
+		return
+	}
+	GLogger.WriteToLogByFieldsNormalOnlyMsg(fmt.Sprintf("checkpoint saved at %s gtid=%s", barrier.Position.String(),
+		GetGtidStrForPrint(barrier.Gtid)), logging.DEBUG)
+}
+
+// GetOutputFileSizes gets current sizes of files, buffered writer must be flushed before calling it
+func GetOutputFileSizes(fhs ...*os.File) map[string]int64 {
+	sizes := map[string]int64{}
+	for _, fh := range fhs {
+		if fh == nil {
+			continue
+		}
+		st, err := fh.Stat()
+		if err != nil {
+			GLogger.WriteToLogByFieldsErrorExtramsgExitCode(err, "fail to get size of "+fh.Name(), logging.ERROR, ehand.ERR_FILE_READ)
+			continue
+		}
+		sizes[fh.Name()] = st.Size()
+	}
+	return sizes
+}
+
+/*
+OpenOutputFile opens result file for writing. When resumed from checkpoint, file recorded in checkpoint has been truncated
+to its size at checkpoint, it is appended and ifNew is false, no header line should be written again.
+*/
+func OpenOutputFile(fileName string) (*os.File, bool, error) {
+	if GCheckpoint != nil && GCheckpoint.ifResumed {
+		GCheckpoint.Lock.RLock()
+		_, ok := GCheckpoint.OutputFiles[fileName]
+		GCheckpoint.Lock.RUnlock()
+		if ok {
+			fh, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+			return fh, false, err
+		}
+	}
+	fh, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	return fh, true, err
+}
+
+// TruncateOutputFiles truncates output files to their sizes at checkpoint, content after checkpoint will be written again
+func (this *BinlogCheckpoint) TruncateOutputFiles() error {
+	this.Lock.RLock()
+	defer this.Lock.RUnlock()
+	for fn, size := range this.OutputFiles {
+		if !file.IsFile(fn) {
+			return errors.Errorf("output file %s in checkpoint not exists", fn)
+		}
+		if err := os.Truncate(fn, size); err != nil {
+			return errors.Annotatef(err, "fail to truncate %s to %d", fn, size)
+		}
+	}
+	return nil
+}
+
+/*
+ResumeFromCheckpoint loads checkpoint and sets start position to it, output files are continued from the checkpoint too.
+It starts as usual if checkpoint file does not exist.
+*/
+func (this *ConfCmd) ResumeFromCheckpoint() {
+	if !file.IsFile(this.CheckpointFile) {
+		GLogger.WriteToLogByFieldsNormalOnlyMsg(fmt.Sprintf("checkpoint file %s not exists, start as usual", this.CheckpointFile), logging.WARNING)
+		return
+	}
+	err := GCheckpoint.LoadFromFile()
+	if err != nil {
+		GLogger.WriteToLogByFieldsErrorExtramsgExit(err, "fail to resume from checkpoint", logging.ERROR, ehand.ERR_FILE_READ)
+	}
+	err = GCheckpoint.TruncateOutputFiles()
+	if err != nil {
+		GLogger.WriteToLogByFieldsErrorExtramsgExit(err, "fail to resume output files from checkpoint", logging.ERROR, ehand.ERR_FILE_WRITE)
+	}
+	pos := GCheckpoint.GetPosition()
+	this.StartFile = pos.Name
+	this.StartPos = uint(pos.Pos)
+	this.StartFilePos = pos
+	this.IfSetStartFilePos = true
+	GLogger.WriteToLogByFieldsNormalOnlyMsg(fmt.Sprintf("resume from checkpoint %s gtid=%s", pos.String(),
+		GetGtidStrForPrint(GCheckpoint.Gtid)), logging.INFO)
+}
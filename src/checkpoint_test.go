@@ -0,0 +1,77 @@
+package src
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/WangJiemin/jamintools/logging"
+	"github.com/WangJiemin/jamintools/myjson"
+	"github.com/siddontang/go-mysql/mysql"
+)
+
+func TestBinlogCheckpointReport(t *testing.T) {
+	if GLogger.Logger == nil {
+		GLogger.CreateNewRawLogger()
+		GLogger.ResetLogLevel(logging.ERROR)
+	}
+	dir, err := ioutil.TempDir("", "my2fback_ckpt")
+	if err != nil {
+		t.Fatalf("fail to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ckpt := NewBinlogCheckpoint(&ConfCmd{CheckpointFile: filepath.Join(dir, "ckpt.json")})
+	ckpt.Parties = 2
+	barrier1 := &CheckpointBarrier{Seq: 1, Position: mysql.Position{Name: "mysql-bin.000001", Pos: 100}}
+	barrier2 := &CheckpointBarrier{Seq: 2, Position: mysql.Position{Name: "mysql-bin.000001", Pos: 200}}
+
+	// the first consumer runs ahead, its sizes of barrier 2 must not be saved with barrier 1
+	ckpt.Report(barrier1, map[string]int64{"a.sql": 10})
+	ckpt.Report(barrier2, map[string]int64{"a.sql": 20})
+	stats := &CheckpointStats{Binlog: "mysql-bin.000001", NextPrintTime: 1600000030, Tables: map[string]*BinEventStatsPrint{
+		"db1.t1": {Binlog: "mysql-bin.000001", StartTime: 1600000000, StopTime: 1600000005, StartPos: 4, StopPos: 100,
+			Database: "db1", Table: "t1", Inserts: 3}}}
+	ckpt.ReportStats(barrier1, stats)
+	ckpt.Report(barrier1, map[string]int64{"stats.txt": 5})
+	info := CheckpointInfo{}
+	if err = loadTestCheckpointInfo(ckpt.File, &info); err != nil {
+		t.Fatalf("fail to load checkpoint of barrier 1: %v", err)
+	}
+	expected := map[string]int64{"a.sql": 10, "stats.txt": 5}
+	if info.Pos != 100 || !reflect.DeepEqual(info.OutputFiles, expected) {
+		t.Errorf("checkpoint of barrier 1 is at %d with files %v, expect at 100 with files %v", info.Pos, info.OutputFiles, expected)
+	}
+	if !reflect.DeepEqual(info.Stats, stats) {
+		t.Errorf("stats in checkpoint of barrier 1 are %+v, expect %+v", info.Stats, stats)
+	}
+
+	ckpt.ReportStats(barrier2, &CheckpointStats{Binlog: "mysql-bin.000001", NextPrintTime: 1600000030, Tables: map[string]*BinEventStatsPrint{}})
+	ckpt.Report(barrier2, map[string]int64{"stats.txt": 7})
+	if err = loadTestCheckpointInfo(ckpt.File, &info); err != nil {
+		t.Fatalf("fail to load checkpoint of barrier 2: %v", err)
+	}
+	expected = map[string]int64{"a.sql": 20, "stats.txt": 7}
+	if info.Pos != 200 || !reflect.DeepEqual(info.OutputFiles, expected) {
+		t.Errorf("checkpoint of barrier 2 is at %d with files %v, expect at 200 with files %v", info.Pos, info.OutputFiles, expected)
+	}
+	if len(ckpt.reported) != 0 || len(ckpt.reportedSizes) != 0 || len(ckpt.reportedStats) != 0 {
+		t.Errorf("reports of completed barriers are kept: %v %v %v", ckpt.reported, ckpt.reportedSizes, ckpt.reportedStats)
+	}
+
+	// stats of the interval in progress are restored on resuming
+	resumed := NewBinlogCheckpoint(&ConfCmd{CheckpointFile: ckpt.File})
+	if err = resumed.LoadFromFile(); err != nil {
+		t.Fatalf("fail to load checkpoint: %v", err)
+	}
+	if resumed.Stats == nil || resumed.Stats.NextPrintTime != 1600000030 || len(resumed.Stats.Tables) != 0 {
+		t.Errorf("stats loaded from checkpoint are %+v", resumed.Stats)
+	}
+}
+
+func loadTestCheckpointInfo(fileName string, info *CheckpointInfo) error {
+	*info = CheckpointInfo{}
+	return myjson.ReadJsonFileIntoVar(info, fileName)
+}
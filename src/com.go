@@ -1,8 +1,8 @@
 package src
 
 import (
+	"encoding/binary"
 	"fmt"
-	"path/filepath"
 	"strings"
 	"sync"
 	"time"
@@ -41,9 +41,16 @@ type MyBinEvent struct {
 	SqlType     string // insert, update, delete
 	Timestamp   uint32
 	TrxIndex    uint64
-	TrxStatus   int           // 0:begin, 1: commit, 2: rollback, -1: in_progress
-	QuerySql    *dsql.SqlInfo // for ddl and binlog which is not row format
-	OrgSql      string        // for ddl and binlog which is not row format
+	TrxStatus   int                // 0:begin, 1: commit, 2: rollback, -1: in_progress
+	QuerySql    *dsql.SqlInfo      // for ddl and binlog which is not row format
+	OrgSql      string             // for ddl and binlog which is not row format
+	Gtid        string             // gtid of the trx, empty for anonymous trx
+	ServerId    uint32             // server_id in event header, where the trx is originated
+	Xid         uint64             // xid of the trx, only set for the trx end event
+	IfTrxEnd    bool               // end of trx, no sql for it, only to print trx info
+	RelayPos    mysql.Position     // for -relay, end position of the event in relay log
+	Checkpoint  *CheckpointBarrier // for trx end event, save checkpoint after the trx is written
+	Incomplete  bool               // for -tolerant, some events of the trx are damaged and skipped
 }
 
 var (
@@ -63,14 +70,14 @@ func CheckBinHeaderCondition(cfg *ConfCmd, header *replication.EventHeader, curr
 	myPos := mysql.Position{Name: currentBinlog, Pos: header.LogPos}
 	//fmt.Println(cfg.StartFilePos, cfg.IfSetStopFilePos, myPos)
 	if cfg.IfSetStartFilePos {
-		cmpRe := myPos.Compare(cfg.StartFilePos)
+		cmpRe := CompareBinlogPosition(myPos, cfg.StartFilePos)
 		if cmpRe == -1 {
 			return C_reContinue
 		}
 	}
 
 	if cfg.IfSetStopFilePos {
-		cmpRe := myPos.Compare(cfg.StopFilePos)
+		cmpRe := CompareBinlogPosition(myPos, cfg.StopFilePos)
 		if cmpRe >= 0 {
 			return C_reBreak
 		}
@@ -88,6 +95,11 @@ func CheckBinHeaderCondition(cfg *ConfCmd, header *replication.EventHeader, curr
 			return C_reBreak
 		}
 	}
+	// events of trx skipped by -sgtid/-igtid/-xgtid, gtid event itself decides whether to skip the trx
+	if GGtidTrxFilter.IfSkipCurrentTrx() && !IsGtidEventType(header.EventType) && header.EventType != replication.ROTATE_EVENT {
+		return C_reContinue
+	}
+
 	if cfg.FilterSqlLen == 0 {
 		return C_reProcess
 	}
@@ -100,7 +112,8 @@ func CheckBinHeaderCondition(cfg *ConfCmd, header *replication.EventHeader, curr
 		}
 	}
 
-	if header.EventType == replication.UPDATE_ROWS_EVENTv1 || header.EventType == replication.UPDATE_ROWS_EVENTv2 {
+	if header.EventType == replication.UPDATE_ROWS_EVENTv1 || header.EventType == replication.UPDATE_ROWS_EVENTv2 ||
+		header.EventType == replication.PARTIAL_UPDATE_ROWS_EVENT {
 		if cfg.IsTargetDml("update") {
 			return C_reProcess
 		} else {
@@ -134,14 +147,14 @@ func (this *MyBinEvent) CheckBinEvent(cfg *ConfCmd, ev *replication.BinlogEvent,
 		myPos.Pos = uint32(rotatEvent.Position)
 		GLogger.WriteToLogByFieldsNormalOnlyMsg(fmt.Sprintf("log rotate %s", myPos.String()), logging.INFO)
 		if cfg.IfSetStartFilePos {
-			cmpRe := myPos.Compare(cfg.StartFilePos)
+			cmpRe := CompareBinlogPosition(myPos, cfg.StartFilePos)
 			if cmpRe == -1 {
 				return C_reContinue
 			}
 		}
 
 		if cfg.IfSetStopFilePos {
-			cmpRe := myPos.Compare(cfg.StopFilePos)
+			cmpRe := CompareBinlogPosition(myPos, cfg.StopFilePos)
 			if cmpRe >= 0 {
 				return C_reBreak
 			}
@@ -154,7 +167,8 @@ func (this *MyBinEvent) CheckBinEvent(cfg *ConfCmd, ev *replication.BinlogEvent,
 		replication.DELETE_ROWS_EVENTv1,
 		replication.WRITE_ROWS_EVENTv2,
 		replication.UPDATE_ROWS_EVENTv2,
-		replication.DELETE_ROWS_EVENTv2:
+		replication.DELETE_ROWS_EVENTv2,
+		replication.PARTIAL_UPDATE_ROWS_EVENT:
 
 		//replication.XID_EVENT,
 		//replication.TABLE_MAP_EVENT:
@@ -270,8 +284,40 @@ func (this *MyBinEvent) CheckBinEvent(cfg *ConfCmd, ev *replication.BinlogEvent,
 	case replication.XID_EVENT:
 		this.IfRowsEvent = false
 
+	case replication.GTID_EVENT:
+		this.IfRowsEvent = false
+		if GGtidTrxFilter.CheckGtid(GetMysqlGtidStr(ev.Event.(*replication.GTIDEvent))) == C_reBreak {
+			return C_reBreak
+		}
+		return C_reContinue
+
+	case replication.ANONYMOUS_GTID_EVENT:
+		this.IfRowsEvent = false
+		if GGtidTrxFilter.CheckGtid("") == C_reBreak {
+			return C_reBreak
+		}
+		return C_reContinue
+
 	case replication.MARIADB_GTID_EVENT:
 		this.IfRowsEvent = false
+		// it is also the begin of trx for mariadb
+		return GGtidTrxFilter.CheckGtid(GetMariadbGtidStr(ev.Event.(*replication.MariadbGTIDEvent)))
+
+	case replication.MARIADB_GTID_LIST_EVENT:
+		this.IfRowsEvent = false
+		gtidList := ev.Event.(*replication.MariadbGTIDListEvent)
+		GLogger.WriteToLogByFieldsNormalOnlyMsg(fmt.Sprintf("gtid list of %s: %s", *currentBinlog, GetMariadbGtidListStr(gtidList)), logging.INFO)
+		GGtidTrxFilter.UpdateByGtidList(gtidList.GTIDs)
+		if GGtidTrxFilter.IfReachStopGtid() {
+			return C_reBreak
+		}
+		return C_reContinue
+
+	case replication.MARIADB_BINLOG_CHECKPOINT_EVENT:
+		this.IfRowsEvent = false
+		GLogger.WriteToLogByFieldsNormalOnlyMsg(fmt.Sprintf("binlog checkpoint %s at %s:%d",
+			string(ev.Event.(*replication.MariadbBinlogCheckPointEvent).Info), *currentBinlog, ev.Header.LogPos), logging.DEBUG)
+		return C_reContinue
 
 	default:
 		this.IfRowsEvent = false
@@ -281,19 +327,124 @@ func (this *MyBinEvent) CheckBinEvent(cfg *ConfCmd, ev *replication.BinlogEvent,
 	return C_reProcess
 }
 
-func GetFirstBinlogPosToParse(cfg *ConfCmd) (string, int64) {
-	var binlog string
-	var pos int64
-	if cfg.StartFile != "" {
-		binlog = filepath.Join(cfg.BinlogDir, cfg.StartFile)
-	} else {
-		binlog = cfg.GivenBinlogFile
+// status var codes of query event, see libbinlogevents/include/statement_events.h of mysql and sql/log_event.h of mariadb
+const (
+	cQFlags2Code                   byte = 0
+	cQSqlModeCode                  byte = 1
+	cQCatalogCode                  byte = 2
+	cQAutoIncrement                byte = 3
+	cQCharsetCode                  byte = 4
+	cQTimeZoneCode                 byte = 5
+	cQCatalogNzCode                byte = 6
+	cQLcTimeNamesCode              byte = 7
+	cQCharsetDatabaseCode          byte = 8
+	cQTableMapForUpdateCode        byte = 9
+	cQMasterDataWrittenCode        byte = 10
+	cQInvoker                      byte = 11
+	cQUpdatedDbNames               byte = 12
+	cQMicroseconds                 byte = 13
+	cQExplicitDefaultsForTimestamp byte = 16
+	cQDdlLoggedWithXid             byte = 17
+	cQDefaultCollationForUtf8mb4   byte = 18
+	cQSqlRequirePrimaryKey         byte = 19
+	cQDefaultTableEncryption       byte = 20
+	cQMariadbHrnow                 byte = 128
+	cQMariadbXid                   byte = 129
+
+	cOverMaxDbsInEventMts byte = 254
+)
+
+// GetTrxXidFromBinEvent returns xid of XID_EVENT, or xid of DDL logged with xid(mysql 8.0 atomic DDL, mariadb), otherwise 0
+func GetTrxXidFromBinEvent(ev *replication.BinlogEvent) uint64 {
+	switch ev.Header.EventType {
+	case replication.XID_EVENT:
+		return ev.Event.(*replication.XIDEvent).XID
+	case replication.QUERY_EVENT:
+		return GetXidFromQueryStatusVars(ev.Event.(*replication.QueryEvent).StatusVars)
 	}
-	if cfg.StartPos != 0 {
-		pos = int64(cfg.StartPos)
-	} else {
-		pos = 4
+	return 0
+}
+
+/*
+GetTrxPayloadEvents returns events of the trx wrapped in TRANSACTION_PAYLOAD_EVENT(mysql 8.0 binlog_transaction_compression=ON).
+Events in payload have no position of their own, they are all regarded as at the range of the payload event.
+*/
+func GetTrxPayloadEvents(h *replication.EventHeader, e replication.Event) []*replication.BinlogEvent {
+	payloadEv := e.(*replication.TransactionPayloadEvent)
+	for _, ev := range payloadEv.Events {
+		ev.Header.LogPos = h.LogPos
+		ev.Header.EventSize = h.EventSize
+		ev.RawData = nil
 	}
+	return payloadEv.Events
+}
 
-	return binlog, pos
+// GetXidFromQueryStatusVars walks through status vars of query event to find xid, 0 if not found
+func GetXidFromQueryStatusVars(vars []byte) uint64 {
+	var (
+		pos    int = 0
+		varLen int = len(vars)
+	)
+	for pos < varLen {
+		code := vars[pos]
+		pos++
+		switch code {
+		case cQFlags2Code, cQAutoIncrement, cQMasterDataWrittenCode:
+			pos += 4
+		case cQSqlModeCode, cQTableMapForUpdateCode:
+			pos += 8
+		case cQCharsetCode:
+			pos += 6
+		case cQLcTimeNamesCode, cQCharsetDatabaseCode, cQDefaultCollationForUtf8mb4:
+			pos += 2
+		case cQMicroseconds, cQMariadbHrnow:
+			pos += 3
+		case cQExplicitDefaultsForTimestamp, cQSqlRequirePrimaryKey, cQDefaultTableEncryption:
+			pos++
+		case cQCatalogCode:
+			// length, string, 0x00
+			if pos >= varLen {
+				return 0
+			}
+			pos += int(vars[pos]) + 2
+		case cQTimeZoneCode, cQCatalogNzCode:
+			if pos >= varLen {
+				return 0
+			}
+			pos += int(vars[pos]) + 1
+		case cQInvoker:
+			// user and host, both are length + string
+			for i := 0; i < 2; i++ {
+				if pos >= varLen {
+					return 0
+				}
+				pos += int(vars[pos]) + 1
+			}
+		case cQUpdatedDbNames:
+			if pos >= varLen {
+				return 0
+			}
+			dbCnt := vars[pos]
+			pos++
+			if dbCnt == cOverMaxDbsInEventMts {
+				continue
+			}
+			// null terminated db names
+			for i := 0; i < int(dbCnt); i++ {
+				for pos < varLen && vars[pos] != 0x00 {
+					pos++
+				}
+				pos++
+			}
+		case cQDdlLoggedWithXid, cQMariadbXid:
+			if pos+8 > varLen {
+				return 0
+			}
+			return binary.LittleEndian.Uint64(vars[pos : pos+8])
+		default:
+			// unknown status var, cannot know its length
+			return 0
+		}
+	}
+	return 0
 }
@@ -0,0 +1,57 @@
+package src
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func xidStatusVar(code byte, xid uint64) []byte {
+	buf := make([]byte, 9)
+	buf[0] = code
+	binary.LittleEndian.PutUint64(buf[1:], xid)
+	return buf
+}
+
+func joinStatusVars(vars ...[]byte) []byte {
+	var buf []byte
+	for _, v := range vars {
+		buf = append(buf, v...)
+	}
+	return buf
+}
+
+func TestGetXidFromQueryStatusVars(t *testing.T) {
+	var (
+		flags2   = []byte{cQFlags2Code, 0, 0, 0, 0}
+		sqlMode  = []byte{cQSqlModeCode, 0, 0, 0, 0, 0, 0, 0, 0}
+		catalog  = []byte{cQCatalogNzCode, 3, 's', 't', 'd'}
+		charset  = []byte{cQCharsetCode, 33, 0, 33, 0, 8, 0}
+		timeZone = []byte{cQTimeZoneCode, 6, 'S', 'Y', 'S', 'T', 'E', 'M'}
+		invoker  = []byte{cQInvoker, 4, 'r', 'o', 'o', 't', 9, 'l', 'o', 'c', 'a', 'l', 'h', 'o', 's', 't'}
+		dbNames  = []byte{cQUpdatedDbNames, 2, 'd', 'b', '1', 0, 'd', 'b', '2', 0}
+		mtsDbs   = []byte{cQUpdatedDbNames, cOverMaxDbsInEventMts}
+		micro    = []byte{cQMicroseconds, 1, 2, 3}
+		utf8mb4  = []byte{cQDefaultCollationForUtf8mb4, 255, 0}
+	)
+	cases := []struct {
+		name string
+		vars []byte
+		xid  uint64
+	}{
+		{"empty", nil, 0},
+		{"without xid", joinStatusVars(flags2, sqlMode, catalog, charset), 0},
+		{"mysql ddl logged with xid", joinStatusVars(flags2, sqlMode, catalog, charset, timeZone, invoker, dbNames, micro,
+			utf8mb4, xidStatusVar(cQDdlLoggedWithXid, 12345)), 12345},
+		{"db names over max", joinStatusVars(mtsDbs, xidStatusVar(cQDdlLoggedWithXid, 7)), 7},
+		{"mariadb xid", joinStatusVars(flags2, sqlMode, catalog, charset, []byte{cQMariadbHrnow, 1, 2, 3},
+			xidStatusVar(cQMariadbXid, 1<<40)), 1 << 40},
+		{"unknown status var before xid", joinStatusVars(flags2, []byte{200, 1}, xidStatusVar(cQDdlLoggedWithXid, 1)), 0},
+		{"truncated xid", joinStatusVars(flags2, xidStatusVar(cQDdlLoggedWithXid, 1)[:5]), 0},
+		{"truncated catalog", []byte{cQCatalogNzCode}, 0},
+	}
+	for _, c := range cases {
+		if xid := GetXidFromQueryStatusVars(c.vars); xid != c.xid {
+			t.Errorf("%s: xid %d, expect %d", c.name, xid, c.xid)
+		}
+	}
+}
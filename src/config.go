@@ -1,6 +1,7 @@
 package src
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -57,6 +58,25 @@ type ConfCmd struct {
 	Socket   string
 	ServerId uint
 
+	JobFile         string
+	JobProfile      string
+	CheckConfigOnly bool
+
+	DefaultsFile      string
+	DefaultsExtraFile string
+	NoDefaults        bool
+	LoginPath         string
+	PasswordEnv       string
+	PasswordPrompt    bool
+
+	SslMode       string
+	SslCa         string
+	SslCert       string
+	SslKey        string
+	SslServerName string
+	TLSConfig     *tls.Config // nil if not to use TLS
+	ReplTLSConfig *tls.Config // the same as TLSConfig
+
 	//Databases    []string
 	//Tables       []string
 	DatabaseRegs []*regexp.Regexp
@@ -70,11 +90,26 @@ type ConfCmd struct {
 	StartPos          uint
 	StartFilePos      mysql.Position
 	IfSetStartFilePos bool
+	StartFromNow      bool // -m=repl, start from current binlog position of master
 
 	StopFile         string
 	StopPos          uint
 	StopFilePos      mysql.Position
 	IfSetStopFilePos bool
+	StopAtMasterPos  bool // -m=repl with -sdt and no stop point, stop once the event ending at StopFilePos-1 is read, master may be idle
+
+	StartGtid      string
+	StartGtidSet   mysql.GTIDSet
+	IfSetStartGtid bool
+
+	StopGtid      string
+	StopGtidSet   mysql.GTIDSet
+	IfSetStopGtid bool
+
+	IncludeGtid    string
+	IncludeGtidSet mysql.GTIDSet
+	ExcludeGtid    string
+	ExcludeGtidSet mysql.GTIDSet
 
 	StartDatetime      uint32
 	StopDatetime       uint32
@@ -106,11 +141,34 @@ type ConfCmd struct {
 
 	ReadTblDefJsonFile string
 	OnlyColFromFile    bool
+	ReadTblDefSqlFile  string // schema-only mysqldump or dir of SHOW CREATE TABLE outputs
+	ReadTblDefSqlDb    string // database of tables not qualified in -rsql without use statement
 	DumpTblDefToFile   string
+	DdlHistory         string // build table definitions of binlog positions by ddls in binlogs, current or snapshot
+	UseTableMapMeta    bool   // table definitions from optional metadata of table map events instead of mysql
 
 	BinlogDir string
 
-	GivenBinlogFile string
+	GivenBinlogFile  string
+	GivenBinlogFiles []string // binlog files given as args, glob patterns are expanded
+	BinlogIndexFile  string
+	StdinBinlogName  string // binlog name for binlog read from stdin
+	RelayLogMode     bool   // binlog files are relay logs
+	Tolerant         bool   // skip damaged events and continue
+
+	BinlogFiles        []string // binlog files to parse in order for -m=file
+	IfMultiBinlogFiles bool     // binlog files are given by -idx or more than one arg, parse all of them
+
+	CheckpointFile     string
+	CheckpointInterval int
+	Resume             bool
+	ReplRetryTimes     int
+
+	ArchiveStats bool   // -w=archive, also analyze transactions while archiving
+	InfoFormat   string // -w=info, table or json
+
+	WriteSidecarIndex bool   // write sidecar index of binlogs parsed into -o
+	SidecarIndexDir   string // dir of sidecar index files, to skip binlogs and trxs not touching -dbs/-tbs
 
 	UseUniqueKeyFirst         bool
 	IgnorePrimaryKeyForInsert bool
@@ -131,16 +189,18 @@ var (
 	GUseDatabase string = ""
 
 	GOptsValidMode      []string = []string{"repl", "file"}
-	GOptsValidWorkType  []string = []string{"tbldef", "stats", "2sql", "rollback"}
+	GOptsValidWorkType  []string = []string{"tbldef", "stats", "2sql", "rollback", "archive", "check", "info", "locate"}
 	GOptsValidMysqlType []string = []string{"mysql", "mariadb"}
 	GOptsValidFilterSql []string = []string{"insert", "update", "delete"}
 
 	GOptsValueRange map[string][]int = map[string][]int{
-		"PrintInterval":  []int{1, 600, 30},
-		"BigTrxRowLimit": []int{10, 30000, 500},
-		"LongTrxSeconds": []int{1, 3600, 300},
-		"InsertRows":     []int{1, 500, 30},
-		"Threads":        []int{1, 16, 2},
+		"PrintInterval":      []int{1, 600, 30},
+		"BigTrxRowLimit":     []int{10, 30000, 500},
+		"LongTrxSeconds":     []int{1, 3600, 300},
+		"InsertRows":         []int{1, 500, 30},
+		"Threads":            []int{1, 16, 2},
+		"CheckpointInterval": []int{1, 3600, 10},
+		"ReplRetryTimes":     []int{0, 1000, 10},
 	}
 
 	GStatsColumns []string = []string{
@@ -171,15 +231,29 @@ func (this *ConfCmd) ParseCmdOptions() {
 	}
 
 	flag.BoolVar(&version, "v", false, "print version")
+	flag.StringVar(&this.JobFile, "job", "", "YAML job file, options in sections source/range/filter/output/threshold, and named profiles overriding them. options on command line take precedence")
+	flag.StringVar(&this.JobProfile, "profile", "", "works with -job, profile of job file to run, default the default_profile of job file")
+	flag.BoolVar(&this.CheckConfigOnly, "check-config", false, "only check options(including job file) and print them, without connecting to mysql nor parsing binlogs. default false")
 	flag.StringVar(&this.Mode, "m", "file", StrSliceToString(GOptsValidMode, C_joinSepComma, C_validOptMsg)+". repl: as a slave to get binlogs from master. file: get binlogs from local filesystem. default file")
-	flag.StringVar(&this.WorkType, "w", "stats", StrSliceToString(GOptsValidWorkType, C_joinSepComma, C_validOptMsg)+". tbldef: only get table definition structure; 2sql: convert binlog to sqls, rollback: generate rollback sqls, stats: analyze transactions. default: stats")
+	flag.StringVar(&this.WorkType, "w", "stats", StrSliceToString(GOptsValidWorkType, C_joinSepComma, C_validOptMsg)+". tbldef: only get table definition structure; 2sql: convert binlog to sqls, rollback: generate rollback sqls, stats: analyze transactions, archive: save binlogs of master into -o as they are(works with -m=repl), check: verify checksum, positions, rotate events, truncated tail and unbalanced transactions of binlogs, report into "+C_checkReportFile+" under -o and exit with error if binlog is corrupted, info: list binlogs with size, time range, positions, server version, checksum, gtids and counts of row/statement events into "+C_infoReportFileBaseName+".txt|json under -o(works with -m=file), locate: print binlog and start position of the first transaction at or after -sdt/-edt, by binary searching binlogs and reading event headers only(works with -m=file). default: stats")
 	flag.StringVar(&this.MysqlType, "M", "mysql", StrSliceToString(GOptsValidMysqlType, C_joinSepComma, C_validOptMsg)+". server of binlog, mysql or mariadb, default mysql")
 
 	flag.StringVar(&this.Host, "H", "127.0.0.1", "master host, DONOT need to specify when -w=stats. if mode is file, it can be slave or other mysql contains same schema and table structure, not only master. default 127.0.0.1")
 	flag.UintVar(&this.Port, "P", 3306, "master port, default 3306. DONOT need to specify when -w=stats")
 	flag.StringVar(&this.User, "u", "", "mysql user. DONOT need to specify when -w=stats")
-	flag.StringVar(&this.Passwd, "p", "", "mysql user password. DONOT need to specify when -w=stats")
+	flag.StringVar(&this.Passwd, "p", "", "mysql user password. DONOT need to specify when -w=stats. Attention, it is visible in ps output, better to set it in option file, login path, --password-env or --password-prompt")
+	flag.StringVar(&this.DefaultsFile, "defaults-file", "", "only read options to connect to mysql from this option file, instead of "+strings.Join(GDefaultOptionFiles, ", ")+". groups "+strings.Join(GOptionFileGroups, ", ")+" are read, options on command line take precedence")
+	flag.StringVar(&this.DefaultsExtraFile, "defaults-extra-file", "", "read this option file after the default option files(or --defaults-file)")
+	flag.BoolVar(&this.NoDefaults, "no-defaults", false, "do not read any option file nor login path file, except that --login-path is specified. default false")
+	flag.StringVar(&this.LoginPath, "login-path", "", "read options from this login path of ~/.mylogin.cnf(or $"+cLoginFileEnv+") created by mysql_config_editor, in addition to [client] of it")
+	flag.StringVar(&this.PasswordEnv, "password-env", "MYSQL_PWD", "read mysql user password from this environment variable if it is not set by -p, option files or login path")
+	flag.BoolVar(&this.PasswordPrompt, "password-prompt", false, "prompt for mysql user password on terminal. default false")
 	flag.StringVar(&this.Socket, "S", "", "mysql socket file")
+	flag.StringVar(&this.SslMode, "ssl-mode", C_sslModeDisabled, StrSliceToString(GOptsValidSslMode, C_joinSepComma, C_validOptMsg)+". the same as mysql client, applied to both connection to get table definition and replication. TLS is not used for -S. default DISABLED")
+	flag.StringVar(&this.SslCa, "ssl-ca", "", "works with --ssl-mode, file of CA certificates in PEM format to verify certificate of mysql, default system CAs")
+	flag.StringVar(&this.SslCert, "ssl-cert", "", "works with --ssl-mode=REQUIRED|VERIFY_CA|VERIFY_IDENTITY, file of client certificate in PEM format, must be specified together with --ssl-key")
+	flag.StringVar(&this.SslKey, "ssl-key", "", "works with --ssl-cert, file of client private key in PEM format")
+	flag.StringVar(&this.SslServerName, "ssl-server-name", "", "works with --ssl-mode=VERIFY_IDENTITY, host name to verify against certificate of mysql, default -H")
 	flag.UintVar(&this.ServerId, "mid", 1113306, "works with -m=repl, this program replicates from master as slave to read binlogs. Must set this server id unique from other slaves, default 1113306")
 
 	flag.StringVar(&dbs, "dbs", "", "only parse database which match any of these regular expressions. The regular expression should be in lower case because database name is translated into lower case and then matched against it. \n\tMulti regular expressions is seperated by comma, default parse all databases. Useless when -w=stats")
@@ -188,9 +262,23 @@ func (this *ConfCmd) ParseCmdOptions() {
 
 	flag.StringVar(&this.StartFile, "sbin", "", "binlog file to start reading")
 	flag.UintVar(&this.StartPos, "spos", 0, "start reading the binlog at position")
+	flag.BoolVar(&this.StartFromNow, "snow", false, "works with -m=repl, start reading the binlog at current binlog position of master(SHOW MASTER STATUS), instead of -sbin/-spos or -sgtid.\n\tWhen -m=repl and -sdt is set without -sbin/-spos/-sgtid, binlog to start is found by binary searching binlogs of master(SHOW BINARY LOGS), and it stops at current binlog position of master if no stop point is set. default false")
 	flag.StringVar(&this.StopFile, "ebin", "", "binlog file to stop reading")
 	flag.UintVar(&this.StopPos, "epos", 0, "Stop reading the binlog at position")
 
+	flag.StringVar(&this.StartGtid, "sgtid", "", "gtid set already executed, start reading the binlog at the first transaction whose gtid is not contained in it, like gtid_executed: \"3E11FA47-71CA-11E1-9E33-C80AA9429562:1-999\".\n\tWhen -m=repl, it is sent to master to start replication by auto position instead of -sbin/-spos")
+	flag.StringVar(&this.StopGtid, "egtid", "", "gtid set, stop reading the binlog once all transactions in it have been read, or at the first transaction whose gtid is greater than it, like \"3E11FA47-71CA-11E1-9E33-C80AA9429562:1-1050\"")
+	flag.StringVar(&this.IncludeGtid, "igtid", "", "gtid set, only parse transactions whose gtid is contained in it, like \"3E11FA47-71CA-11E1-9E33-C80AA9429562:1000-1050\". For mariadb, one gtid for each domain, transactions of a domain not greater than it are contained")
+	flag.StringVar(&this.ExcludeGtid, "xgtid", "", "gtid set, skip transactions whose gtid is contained in it")
+
+	flag.StringVar(&this.BinlogIndexFile, "idx", "", "works with -m=file, binlog index file of mysql, such as /data/mysql/mysql-bin.index. Parse binlog files listed in it in order, no need to specify binlog file as last arg")
+
+	flag.StringVar(&this.StdinBinlogName, "stdinbin", "", "works with -m=file and \"-\" as last arg to read binlog from stdin, binlog file name of it, such as mysql-bin.000010")
+
+	flag.BoolVar(&this.RelayLogMode, "relay", false, "works with -m=file, binlog files are relay logs of slave. Positions of master(like Relay_Master_Log_File/Exec_Master_Log_Pos) are used for -sbin/-spos/-ebin/-epos and outputs, positions in relay log are also printed. default false")
+
+	flag.BoolVar(&this.Tolerant, "tolerant", false, "works with -m=file, when a damaged event is met, log the damaged range, skip to the next valid event and continue. Transactions affected are marked as incomplete in outputs. default false")
+
 	flag.StringVar(&this.BinlogTimeLocation, "tl", "Local", "time location to parse timestamp/datetime column in binlog, such as Asia/Shanghai. default Local")
 	flag.StringVar(&startTime, "sdt", "", "Start reading the binlog at first event having a datetime equal or posterior to the argument, it should be like this: \"2004-12-25 11:25:56\"")
 	flag.StringVar(&stopTime, "edt", "", "Stop reading the binlog at first event having a datetime equal or posterior to the argument, it should be like this: \"2004-12-25 11:25:56\"")
@@ -206,6 +294,18 @@ func (this *ConfCmd) ParseCmdOptions() {
 	flag.BoolVar(&this.KeepTrx, "k", false, "Works with -w=2sql|rollback. wrap result statements with 'begin...commit|rollback'")
 	flag.BoolVar(&this.SqlTblPrefixDb, "d", true, "Works with -w=2sql|rollback. Prefix table name with database name in sql, ex: insert into db1.tb1 (x1, x1) values (y1, y1). Default true")
 
+	flag.StringVar(&this.CheckpointFile, "ckpt", "", "works with -w=2sql|stats, file to save checkpoint into periodically, the checkpoint is the position of the last transaction whose results are all written into result files. default not to save checkpoint")
+	flag.IntVar(&this.CheckpointInterval, "ckpti", this.GetDefaultValueOfRange("CheckpointInterval"), "works with -ckpt, save checkpoint every these seconds. "+this.GetDefaultAndRangeValueMsg("CheckpointInterval"))
+	flag.BoolVar(&this.Resume, "resume", false, "works with -ckpt, resume from the checkpoint instead of -sbin/-spos/-sgtid, result files are truncated to where the checkpoint is saved and continued. Start as usual if the checkpoint file not exists. default false")
+	flag.IntVar(&this.ReplRetryTimes, "retry", this.GetDefaultValueOfRange("ReplRetryTimes"), "works with -m=repl, reconnect to master at most these times if replication breaks, 0 to exit at once. "+this.GetDefaultAndRangeValueMsg("ReplRetryTimes"))
+
+	flag.BoolVar(&this.ArchiveStats, "astats", false, "works with -w=archive, also analyze transactions like -w=stats while archiving binlogs. default false")
+
+	flag.StringVar(&this.InfoFormat, "ifmt", C_infoFormatTable, "works with -w=info, "+StrSliceToString(GOptsValidInfoFormat, C_joinSepComma, C_validOptMsg)+". output format of binlog info. default "+C_infoFormatTable)
+
+	flag.BoolVar(&this.WriteSidecarIndex, "osidx", false, "works with -m=file, write sidecar index of each binlog parsed to the end into -o as <binlog>"+C_sidecarIndexFileSuffix+", with start positions, timestamps, gtids and tables of transactions. default false")
+	flag.StringVar(&this.SidecarIndexDir, "rsidx", "", "works with -m=file and -w=2sql|rollback, dir of sidecar index files written by -osidx. Binlogs and transactions not touching tables of -dbs/-tbs are skipped by them without parsing. default not to use sidecar index")
+
 	flag.StringVar(&this.OutputDir, "o", "", "result output dir, default current work dir. Attension, result files could be large, set it to a dir with large free space")
 	flag.BoolVar(&this.IfWriteOrgSql, "ors", false, "for mysql>=5.6.2 and binlog_rows_query_log_events=on, if set, output original sql. default false")
 
@@ -216,8 +316,13 @@ func (this *ConfCmd) ParseCmdOptions() {
 	flag.UintVar(&this.Threads, "t", uint(this.GetDefaultValueOfRange("Threads")), "Works with -w=2sql|rollback. threads to run, default 4")
 
 	flag.StringVar(&this.ReadTblDefJsonFile, "rj", "", "Works with -w=2sql|rollback, read table structure from this file and merge from mysql")
-	flag.BoolVar(&this.OnlyColFromFile, "oj", false, "Only use table structure from -rj, do not get or merge table struct from mysql")
+	flag.StringVar(&this.ReadTblDefSqlFile, "rsql", "", "Works with -w=2sql|rollback|tbldef, read table structure from create table statements in this schema-only mysqldump file, or in files of SHOW CREATE TABLE outputs in this dir, and merge from mysql")
+	flag.StringVar(&this.ReadTblDefSqlDb, "rsqldb", "", "Works with -rsql, database of tables in -rsql which are not qualified by database nor after use statement")
+	flag.BoolVar(&this.OnlyColFromFile, "oj", false, "Only use table structure from -rj|-rsql, do not get or merge table struct from mysql")
 	flag.StringVar(&this.DumpTblDefToFile, "dj", C_tblDefFile, "dump table structure to this file. default "+C_tblDefFile)
+	flag.BoolVar(&this.UseTableMapMeta, "tmeta", false, "Works with -w=2sql|rollback, use table structure in table map events written by mysql8.0 with binlog_row_metadata=FULL, instead of getting it from mysql. table structure of -rj is used for table map events without it. default false")
+	flag.StringVar(&this.DdlHistory, "ddlhist", "", "works with -m=file and -w=2sql|rollback, "+StrSliceToString(GOptsValidDdlHistory, C_joinSepComma, C_validOptMsg)+
+		". build table structure of each binlog position by replaying ddls in binlogs, for rows events before and after ddls.\n\tcurrent: table structure got is of now, ddls are inverted, some are lost such as type of dropped column.\n\tsnapshot: table structure of -rj|-rsql is of the start of the first binlog, works with -oj.\n\tdefault not to build")
 
 	flag.BoolVar(&this.UseUniqueKeyFirst, "U", false, "prefer to use unique key instead of primary key to build where condition for delete/update sql")
 	flag.BoolVar(&this.IgnorePrimaryKeyForInsert, "I", false, "for insert statement when -wtype=2sql, ignore primary key")
@@ -233,23 +338,42 @@ func (this *ConfCmd) ParseCmdOptions() {
 		os.Exit(0)
 	}
 
+	binlogArgs := flag.Args()
+	jobBinlogs := this.LoadJobFile()
+	if len(binlogArgs) == 0 {
+		binlogArgs = jobBinlogs
+	}
+
+	this.LoadMysqlOptionFiles()
+
 	if this.Mode != "repl" && this.Mode != "file" {
 		GLogger.WriteToLogByFieldsExitMsgNoErr(fmt.Sprintf("unsupported mode=%s, valid modes: file, repl\n", this.Mode),
 			logging.ERROR, ehand.ERR_INVALID_OPTION)
 	}
 
 	if this.Mode == "file" && this.WorkType != "tbldef" {
-		// the last arg should be binlog file
-		if flag.NArg() != 1 {
-			GLogger.WriteToLogByFieldsExitMsgNoErr(fmt.Sprintf("missing binlog file. binlog file as last arg must be specify when -m=file"),
-				logging.ERROR, ehand.ERR_MISSING_OPTION)
-
-		}
-		this.GivenBinlogFile = flag.Args()[0]
-		if !file.IsFile(this.GivenBinlogFile) {
-			GLogger.WriteToLogByFieldsExitMsgNoErr(fmt.Sprintf("%s doesnot exists nor a file\n", this.GivenBinlogFile),
-				logging.ERROR, ehand.ERR_FILE_NOT_EXISTS)
+		// the last args should be binlog files or glob patterns of them, unless -idx is specified
+		if this.BinlogIndexFile != "" {
+			if !file.IsFile(this.BinlogIndexFile) {
+				GLogger.WriteToLogByFieldsExitMsgNoErr(fmt.Sprintf("%s doesnot exists nor a file\n", this.BinlogIndexFile),
+					logging.ERROR, ehand.ERR_FILE_NOT_EXISTS)
+			}
+			if len(binlogArgs) > 0 {
+				GLogger.WriteToLogByFieldsExitMsgNoErr("binlog files as last args cannot be specified together with -idx",
+					logging.ERROR, ehand.ERR_OPTION_MISMATCH)
+			}
 		} else {
+			if len(binlogArgs) < 1 {
+				GLogger.WriteToLogByFieldsExitMsgNoErr(fmt.Sprintf("missing binlog file. binlog files as last args or -idx must be specify when -m=file"),
+					logging.ERROR, ehand.ERR_MISSING_OPTION)
+
+			}
+			this.GivenBinlogFiles = ExpandBinlogFileArgs(binlogArgs)
+			if this.GivenBinlogFiles[0] == C_binlogFromStdin && this.StdinBinlogName == "" {
+				GLogger.WriteToLogByFieldsExitMsgNoErr("-stdinbin must be specified when binlog is read from stdin(-)",
+					logging.ERROR, ehand.ERR_MISSING_OPTION)
+			}
+			this.GivenBinlogFile = this.GivenBinlogFiles[0]
 			this.BinlogDir = filepath.Dir(this.GivenBinlogFile)
 		}
 	}
@@ -362,6 +486,27 @@ func (this *ConfCmd) ParseCmdOptions() {
 		this.IfSetStopDateTime = false
 	}
 
+	if this.StartGtid != "" {
+		this.StartGtidSet = ParseGtidSetOption(this.MysqlType, this.StartGtid, "-sgtid")
+		this.IfSetStartGtid = true
+	} else {
+		this.IfSetStartGtid = false
+	}
+
+	if this.StopGtid != "" {
+		this.StopGtidSet = ParseGtidSetOption(this.MysqlType, this.StopGtid, "-egtid")
+		this.IfSetStopGtid = true
+	} else {
+		this.IfSetStopGtid = false
+	}
+
+	if this.IncludeGtid != "" {
+		this.IncludeGtidSet = ParseGtidSetOption(this.MysqlType, this.IncludeGtid, "-igtid")
+	}
+	if this.ExcludeGtid != "" {
+		this.ExcludeGtidSet = ParseGtidSetOption(this.MysqlType, this.ExcludeGtid, "-xgtid")
+	}
+
 	if startTime != "" && stopTime != "" {
 		if this.StartDatetime >= this.StopDatetime {
 			GLogger.WriteToLogByFieldsExitMsgNoErr("-sdt must be ealier than -edt", logging.ERROR, ehand.ERR_OPTION_MISMATCH)
@@ -383,6 +528,45 @@ func (this *ConfCmd) ParseCmdOptions() {
 
 	this.CheckCmdOptions()
 
+	if this.CheckConfigOnly {
+		PrintEffectiveOptions(binlogArgs)
+		fmt.Println("options are OK")
+		os.Exit(0)
+	}
+
+	this.SetupMysqlTLS()
+
+	if this.CheckpointFile != "" && this.WorkType != "tbldef" {
+		GCheckpoint = NewBinlogCheckpoint(this)
+		if this.Resume {
+			this.ResumeFromCheckpoint()
+		}
+	}
+
+	if this.Mode == "file" && this.WorkType != "tbldef" {
+		this.BinlogFiles = this.GetBinlogFilesToParse()
+		this.GivenBinlogFile = this.BinlogFiles[0]
+		this.BinlogDir = filepath.Dir(this.GivenBinlogFile)
+		if this.WorkType == "locate" && this.BinlogFiles[0] == C_binlogFromStdin {
+			GLogger.WriteToLogByFieldsExitMsgNoErr("binlog from stdin cannot be located by datetime", logging.ERROR, ehand.ERR_OPTION_MISMATCH)
+		}
+		// positions of relay log are not of master, -tolerant may meet damaged headers
+		// ddls of binlogs skipped are needed for -ddlhist=snapshot
+		if (this.IfGenSql() || this.WorkType == "stats") && this.IfSetStartDateTime && !this.IfSetStartFilePos &&
+			!this.IfSetStartGtid && !this.RelayLogMode && !this.Tolerant && this.DdlHistory != C_ddlHistorySnapshot {
+			this.ResolveFileStartPosByDatetime()
+		}
+	}
+	if this.Mode == "repl" && this.WorkType != "tbldef" && !this.IfSetStartFilePos && !this.IfSetStartGtid &&
+		(this.StartFromNow || this.IfSetStartDateTime) {
+		this.ResolveReplStartPos()
+	}
+	if this.WorkType == "archive" {
+		this.ResolveArchiveStartPos()
+	}
+
+	GGtidTrxFilter = NewGtidTrxFilter(this)
+
 }
 
 func (this *ConfCmd) CheckCmdOptions() {
@@ -398,8 +582,10 @@ func (this *ConfCmd) CheckCmdOptions() {
 	if this.Mode != "file" && this.WorkType != "stats" {
 		//check --user
 		this.CheckRequiredOption(this.User, "-u must be set", true)
-		//check --password
-		this.CheckRequiredOption(this.Passwd, "-p must be set", true)
+		//check --password, it may be supplied later by --password-prompt, or be empty in --password-env and login path
+		if !this.IfPasswordSupplied() {
+			this.CheckRequiredOption(this.Passwd, "-p must be set", true)
+		}
 
 	}
 
@@ -424,7 +610,7 @@ func (this *ConfCmd) CheckCmdOptions() {
 		this.StartFilePos = mysql.Position{Name: this.StartFile, Pos: uint32(this.StartPos)}
 
 	} else {
-		if this.StartFile != "" || this.StartPos != 0 {
+		if (this.StartFile != "" && this.WorkType != "archive") || this.StartPos != 0 {
 			GLogger.WriteToLogByFieldsExitMsgNoErr("-sbin and -spos must be set together",
 				logging.ERROR, ehand.ERR_MISSING_OPTION)
 		}
@@ -449,11 +635,28 @@ func (this *ConfCmd) CheckCmdOptions() {
 
 	}
 
+	if this.IfSetStopGtid {
+		this.IfSetStopParsPoint = true
+	}
+
 	if this.Mode == "repl" && this.WorkType != "tbldef" {
-		if this.StartFile == "" || this.StartPos == 0 {
-			GLogger.WriteToLogByFieldsExitMsgNoErr("when -m=repl, -sbin and -spos must be specified",
-				logging.ERROR, ehand.ERR_MISSING_OPTION)
+		if this.IfSetStartGtid {
+			if this.StartFile != "" || this.StartPos != 0 {
+				GLogger.WriteToLogByFieldsExitMsgNoErr("when -m=repl, -sgtid cannot be specified together with -sbin and -spos",
+					logging.ERROR, ehand.ERR_OPTION_MISMATCH)
+			}
+		} else if (this.StartFile == "" || this.StartPos == 0) && this.WorkType != "archive" {
+			if !this.StartFromNow && !this.IfSetStartDateTime {
+				GLogger.WriteToLogByFieldsExitMsgNoErr("when -m=repl, -sbin and -spos, -sgtid, -snow or -sdt must be specified",
+					logging.ERROR, ehand.ERR_MISSING_OPTION)
+			}
+		}
+		if this.StartFromNow && (this.IfSetStartGtid || this.StartFile != "" || this.IfSetStartDateTime) {
+			GLogger.WriteToLogByFieldsExitMsgNoErr("when -m=repl, -snow cannot be specified together with -sbin/-spos, -sgtid or -sdt",
+				logging.ERROR, ehand.ERR_OPTION_MISMATCH)
 		}
+	} else if this.StartFromNow {
+		GLogger.WriteToLogByFieldsExitMsgNoErr("-snow only works with -m=repl", logging.ERROR, ehand.ERR_OPTION_MISMATCH)
 	}
 
 	// check --interval
@@ -481,6 +684,152 @@ func (this *ConfCmd) CheckCmdOptions() {
 		this.CheckValueInRange("Threads", int(this.Threads), "value of -t out of range", true)
 	}
 
+	// check --checkpoint-interval
+	if this.CheckpointInterval != this.GetDefaultValueOfRange("CheckpointInterval") {
+		this.CheckValueInRange("CheckpointInterval", this.CheckpointInterval, "value of -ckpti out of range", true)
+	}
+
+	// check --retry
+	if this.ReplRetryTimes != this.GetDefaultValueOfRange("ReplRetryTimes") {
+		this.CheckValueInRange("ReplRetryTimes", this.ReplRetryTimes, "value of -retry out of range", true)
+	}
+
+	if this.CheckpointFile != "" && this.WorkType == "rollback" {
+		GLogger.WriteToLogByFieldsExitMsgNoErr("-ckpt does not work with -w=rollback, rollback sqls are reverted after all binlogs are parsed",
+			logging.ERROR, ehand.ERR_OPTION_MISMATCH)
+	}
+	if this.Resume && this.CheckpointFile == "" {
+		GLogger.WriteToLogByFieldsExitMsgNoErr("-resume must be specified with -ckpt", logging.ERROR, ehand.ERR_MISSING_OPTION)
+	}
+
+	// check --ssl-mode
+	this.SslMode = strings.ToUpper(this.SslMode)
+	CheckElementOfSliceStr(GOptsValidSslMode, this.SslMode, "invalid arg for --ssl-mode", true)
+	if (this.SslCert == "") != (this.SslKey == "") {
+		GLogger.WriteToLogByFieldsExitMsgNoErr("--ssl-cert and --ssl-key must be set together", logging.ERROR, ehand.ERR_MISSING_OPTION)
+	}
+	if this.SslServerName != "" && this.SslMode != C_sslModeVerifyIdentity {
+		GLogger.WriteToLogByFieldsExitMsgNoErr("--ssl-server-name only works with --ssl-mode=VERIFY_IDENTITY", logging.ERROR, ehand.ERR_OPTION_MISMATCH)
+	}
+
+	// check --archive
+	if this.WorkType == "archive" {
+		if this.Mode != "repl" {
+			GLogger.WriteToLogByFieldsExitMsgNoErr("-w=archive only works with -m=repl", logging.ERROR, ehand.ERR_OPTION_MISMATCH)
+		}
+		if this.IfSetStartGtid || this.StartPos != 0 {
+			GLogger.WriteToLogByFieldsExitMsgNoErr("-w=archive continues archived binlog in -o, -sgtid and -spos do not work with it",
+				logging.ERROR, ehand.ERR_OPTION_MISMATCH)
+		}
+		if this.CheckpointFile != "" {
+			GLogger.WriteToLogByFieldsExitMsgNoErr("-ckpt does not work with -w=archive, archived binlogs are continued when restarted",
+				logging.ERROR, ehand.ERR_OPTION_MISMATCH)
+		}
+		// keep archiving binlogs of master like -C, unless stop point is set
+		this.IfSetStopParsPoint = true
+	} else if this.ArchiveStats {
+		GLogger.WriteToLogByFieldsExitMsgNoErr("-astats only works with -w=archive", logging.ERROR, ehand.ERR_OPTION_MISMATCH)
+	}
+
+	// check --check
+	if this.WorkType == "check" && this.CheckpointFile != "" {
+		GLogger.WriteToLogByFieldsExitMsgNoErr("-ckpt does not work with -w=check", logging.ERROR, ehand.ERR_OPTION_MISMATCH)
+	}
+	// binlog files are always checked from the head to the tail, positions of events are not trusted before they are checked
+	if this.WorkType == "check" && this.Mode == "file" && (this.IfSetStartFilePos || this.IfSetStopFilePos ||
+		this.IfSetStartDateTime || this.IfSetStopDateTime || this.IfSetStartGtid || this.IfSetStopGtid || this.IncludeGtidSet != nil ||
+		this.ExcludeGtidSet != nil) {
+		GLogger.WriteToLogByFieldsExitMsgNoErr("-sbin/-spos, -ebin/-epos, -sdt, -edt and gtid options do not work with -w=check and -m=file, whole binlog files are checked",
+			logging.ERROR, ehand.ERR_OPTION_MISMATCH)
+	}
+
+	// check --info
+	CheckElementOfSliceStr(GOptsValidInfoFormat, this.InfoFormat, "invalid arg for -ifmt", true)
+	if this.WorkType == "info" {
+		if this.Mode != "file" {
+			GLogger.WriteToLogByFieldsExitMsgNoErr("-w=info only works with -m=file", logging.ERROR, ehand.ERR_OPTION_MISMATCH)
+		}
+		if this.CheckpointFile != "" {
+			GLogger.WriteToLogByFieldsExitMsgNoErr("-ckpt does not work with -w=info", logging.ERROR, ehand.ERR_OPTION_MISMATCH)
+		}
+	}
+
+	// check --locate
+	if this.WorkType == "locate" {
+		if this.Mode != "file" {
+			GLogger.WriteToLogByFieldsExitMsgNoErr("-w=locate only works with -m=file", logging.ERROR, ehand.ERR_OPTION_MISMATCH)
+		}
+		if !this.IfSetStartDateTime && !this.IfSetStopDateTime {
+			GLogger.WriteToLogByFieldsExitMsgNoErr("-w=locate needs -sdt or -edt", logging.ERROR, ehand.ERR_OPTION_MISMATCH)
+		}
+		if this.RelayLogMode {
+			GLogger.WriteToLogByFieldsExitMsgNoErr("-relay does not work with -w=locate", logging.ERROR, ehand.ERR_OPTION_MISMATCH)
+		}
+		if this.CheckpointFile != "" {
+			GLogger.WriteToLogByFieldsExitMsgNoErr("-ckpt does not work with -w=locate", logging.ERROR, ehand.ERR_OPTION_MISMATCH)
+		}
+	}
+
+	// check --sidecar index
+	if this.WriteSidecarIndex || this.SidecarIndexDir != "" {
+		if this.Mode != "file" {
+			GLogger.WriteToLogByFieldsExitMsgNoErr("-osidx and -rsidx only work with -m=file", logging.ERROR, ehand.ERR_OPTION_MISMATCH)
+		}
+		if this.RelayLogMode {
+			GLogger.WriteToLogByFieldsExitMsgNoErr("-osidx and -rsidx do not work with -relay", logging.ERROR, ehand.ERR_OPTION_MISMATCH)
+		}
+	}
+	if this.SidecarIndexDir != "" {
+		if !this.IfGenSql() {
+			GLogger.WriteToLogByFieldsExitMsgNoErr("-rsidx only works with -w=2sql|rollback", logging.ERROR, ehand.ERR_OPTION_MISMATCH)
+		}
+		// original sqls of all trxs are written, and gtid events of skipped trxs are needed to find -sgtid/-egtid
+		if this.IfWriteOrgSql || this.StartGtid != "" || this.StopGtid != "" {
+			GLogger.WriteToLogByFieldsExitMsgNoErr("-rsidx does not work with -ors, -sgtid or -egtid", logging.ERROR, ehand.ERR_OPTION_MISMATCH)
+		}
+		if ifExist, errMsg := CheckIsDir(this.SidecarIndexDir); !ifExist {
+			GLogger.WriteToLogByFieldsExitMsgNoErr(errMsg, logging.ERROR, ehand.ERR_DIR_NOT_EXISTS)
+		}
+	}
+
+	if this.UseTableMapMeta && !this.IfGenSql() {
+		GLogger.WriteToLogByFieldsExitMsgNoErr("-tmeta only works with -w=2sql|rollback", logging.ERROR, ehand.ERR_OPTION_MISMATCH)
+	}
+
+	// check --read schema file
+	if this.ReadTblDefSqlFile != "" {
+		if !this.IfGenSql() && this.WorkType != "tbldef" {
+			GLogger.WriteToLogByFieldsExitMsgNoErr("-rsql only works with -w=2sql|rollback|tbldef", logging.ERROR, ehand.ERR_OPTION_MISMATCH)
+		}
+		if _, err := os.Stat(this.ReadTblDefSqlFile); err != nil {
+			GLogger.WriteToLogByFieldsExitMsgNoErr(fmt.Sprintf("%s doesnot exists", this.ReadTblDefSqlFile), logging.ERROR, ehand.ERR_FILE_NOT_EXISTS)
+		}
+	} else if this.ReadTblDefSqlDb != "" {
+		GLogger.WriteToLogByFieldsExitMsgNoErr("-rsqldb only works with -rsql", logging.ERROR, ehand.ERR_OPTION_MISMATCH)
+	}
+
+	// check --ddl history
+	if this.DdlHistory != "" {
+		CheckElementOfSliceStr(GOptsValidDdlHistory, this.DdlHistory, "invalid arg for -ddlhist", true)
+		if this.Mode != "file" || !this.IfGenSql() {
+			GLogger.WriteToLogByFieldsExitMsgNoErr("-ddlhist only works with -m=file and -w=2sql|rollback", logging.ERROR, ehand.ERR_OPTION_MISMATCH)
+		}
+		if this.RelayLogMode || (len(this.GivenBinlogFiles) > 0 && this.GivenBinlogFiles[0] == C_binlogFromStdin) {
+			GLogger.WriteToLogByFieldsExitMsgNoErr("-ddlhist does not work with -relay or binlog from stdin", logging.ERROR, ehand.ERR_OPTION_MISMATCH)
+		}
+		if this.DdlHistory == C_ddlHistorySnapshot && ((this.ReadTblDefJsonFile == "" && this.ReadTblDefSqlFile == "") || !this.OnlyColFromFile) {
+			GLogger.WriteToLogByFieldsExitMsgNoErr("-ddlhist=snapshot needs -rj|-rsql and -oj, table structure from mysql is of now",
+				logging.ERROR, ehand.ERR_OPTION_MISMATCH)
+		}
+	}
+
+	if this.RelayLogMode && this.Mode != "file" {
+		GLogger.WriteToLogByFieldsExitMsgNoErr("-relay only works with -m=file", logging.ERROR, ehand.ERR_OPTION_MISMATCH)
+	}
+	if this.Tolerant && this.Mode != "file" {
+		GLogger.WriteToLogByFieldsExitMsgNoErr("-tolerant only works with -m=file", logging.ERROR, ehand.ERR_OPTION_MISMATCH)
+	}
+
 	// check --to-last-log
 	if this.ToLastLog {
 		if this.Mode != "repl" || this.WorkType != "stats" {
@@ -513,6 +862,19 @@ func (this *ConfCmd) CheckValueInRange(opt string, val int, prefix string, ifExt
 	return valOk
 }
 
+// IfPasswordSupplied: password is set, or will be supplied by --password-prompt, --password-env or --login-path
+func (this *ConfCmd) IfPasswordSupplied() bool {
+	if this.Passwd != "" || this.PasswordPrompt || this.LoginPath != "" {
+		return true
+	}
+	if this.PasswordEnv != "" {
+		if _, ok := os.LookupEnv(this.PasswordEnv); ok {
+			return true
+		}
+	}
+	return false
+}
+
 func (this *ConfCmd) CheckRequiredOption(v interface{}, prefix string, ifExt bool) bool {
 	// options must set, default value is not suitable
 	notOk := false
@@ -544,6 +906,7 @@ func (this *ConfCmd) PrintUsageMsg() {
 *	blog: {$url}																					*
 *		read binlog from master, work as a fake slave: ./my2fback -m repl opts...					*
 *		read binlog from local filesystem: ./my2fback -m file opts... mysql-bin.000010				*
+*		read binlog files in order: ./my2fback -m file opts... mysql-bin.00001* | -idx mysql-bin.index	*
 *****************************************************************************************************
 	`
 	arch := fmt.Sprint(runtime.GOARCH)
@@ -614,6 +977,29 @@ func (this *ConfCmd) IsTargetTable(db, tb string) bool {
 
 }
 
+// IfGenSql: -w=2sql|rollback, rows events are sent to generate sqls, table definitions are needed
+func (this *ConfCmd) IfGenSql() bool {
+	return this.WorkType == "2sql" || this.WorkType == "rollback"
+}
+
+// IfGetTblDefFromMysql: table definitions are got from mysql, not only from -rj/-rsql or table map events
+func (this *ConfCmd) IfGetTblDefFromMysql() bool {
+	if this.WorkType == "tbldef" {
+		return this.ReadTblDefSqlFile == "" || !this.OnlyColFromFile
+	}
+	return this.IfGenSql() && !this.OnlyColFromFile && !this.UseTableMapMeta
+}
+
+// IfNeedMysqlConnection: -m=repl, or table definitions are got from mysql
+func (this *ConfCmd) IfNeedMysqlConnection() bool {
+	return this.Mode == "repl" || this.IfGetTblDefFromMysql()
+}
+
+// IfAnalyzeStats: transactions are analyzed, except for -w=archive without -astats
+func (this *ConfCmd) IfAnalyzeStats() bool {
+	return this.WorkType != "archive" || this.ArchiveStats
+}
+
 func (this *ConfCmd) IsTargetDml(dml string) bool {
 	if this.FilterSqlLen < 1 {
 		return true
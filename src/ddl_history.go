@@ -0,0 +1,641 @@
+package src
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/WangJiemin/jamintools/dsql"
+	"github.com/WangJiemin/jamintools/ehand"
+	"github.com/WangJiemin/jamintools/logging"
+	"github.com/juju/errors"
+	"github.com/pingcap/parser/ast"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+)
+
+// values of -ddlhist
+const (
+	C_ddlHistoryCurrent  = "current"  // table definitions are of now, after all binlogs, ddls are inverted back to the first binlog
+	C_ddlHistorySnapshot = "snapshot" // table definitions are of the start of the first binlog, ddls are replayed
+)
+
+var GOptsValidDdlHistory []string = []string{C_ddlHistoryCurrent, C_ddlHistorySnapshot}
+
+// BinlogDdl is one ddl statement in query event of binlog
+type BinlogDdl struct {
+	Binlog   string
+	StartPos uint32
+	StopPos  uint32
+	Database string // default database of the ddl, of query event or the last use statement
+	Stmt     ast.StmtNode
+}
+
+func (this *BinlogDdl) String() string {
+	return fmt.Sprintf("%s at %s", this.Stmt.Text(), mysql.Position{Name: this.Binlog, Pos: this.StartPos}.String())
+}
+
+func (this *BinlogDdl) GetTableKey(table *ast.TableName) string {
+	db := table.Schema.O
+	if db == "" {
+		db = this.Database
+	}
+	return GetAbsTableName(db, table.Name.O)
+}
+
+// IfDdlStmtOfTableDef: statements changing table definitions, others are not collected
+func IfDdlStmtOfTableDef(stmt ast.StmtNode) bool {
+	switch st := stmt.(type) {
+	case *ast.CreateTableStmt, *ast.RenameTableStmt, *ast.AlterTableStmt, *ast.CreateIndexStmt, *ast.DropIndexStmt, *ast.DropDatabaseStmt:
+		return true
+	case *ast.DropTableStmt:
+		return !st.IsView
+	}
+	return false
+}
+
+/*
+CollectDdlsOfBinlogFile collects ddls changing table definitions in binlog file, binlogs in tar archive included.
+Only query events(compressed ones of mariadb are decompressed) are read and parsed, others are skipped by event header. useDb is the database of the last use statement, it is carried into the next binlog.
+sqls fail to parse are skipped with warning, they are handled as usual when the binlog is parsed.
+*/
+func (this BinFileParser) CollectDdlsOfBinlogFile(fileName string, useDb *string) ([]*BinlogDdl, error) {
+	var ddls []*BinlogDdl
+	binReader, err := OpenBinlogReader(fileName, "")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer binReader.Close()
+	for {
+		binlog, r, err := binReader.NextBinlog()
+		if err == io.EOF {
+			return ddls, nil
+		} else if err != nil {
+			return ddls, errors.Annotatef(err, "fail to read binlog from %s", fileName)
+		}
+		peeker, ok := r.(binlogPeeker)
+		if !ok {
+			return ddls, errors.Errorf("reader of %s does not support peek", fileName)
+		}
+
+		var pos uint32 = 4
+		for {
+			head, err := peeker.Peek(replication.EventHeaderSize)
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return ddls, errors.Annotatef(err, "fail to read event header at %d of %s", pos, binlog)
+			}
+			evType := replication.EventType(head[4])
+			size := binary.LittleEndian.Uint32(head[9:])
+			if size <= uint32(replication.EventHeaderSize) {
+				return ddls, errors.Errorf("invalid event header at %d of %s, event size is %d, too small", pos, binlog, size)
+			}
+			if evType != replication.QUERY_EVENT && evType != replication.MARIADB_QUERY_COMPRESSED_EVENT &&
+				evType != replication.FORMAT_DESCRIPTION_EVENT {
+				if err = SkipBytes(r, int64(size)); err != nil {
+					return ddls, errors.Annotatef(err, "fail to skip event at %d of %s", pos, binlog)
+				}
+				pos += size
+				continue
+			}
+			_, e, err := this.ReadBinEvent(r, binlog)
+			if err != nil {
+				return ddls, errors.Annotatef(err, "fail to read event at %d of %s", pos, binlog)
+			}
+			if queryEvent, ok := e.(*replication.QueryEvent); ok {
+				ddls = append(ddls, GetDdlsOfQueryEvent(queryEvent, binlog, pos, pos+size, useDb)...)
+			}
+			pos += size
+		}
+	}
+}
+
+// GetDdlsOfQueryEvent parses sql of query event for ddls changing table definitions
+func GetDdlsOfQueryEvent(queryEvent *replication.QueryEvent, binlog string, spos uint32, epos uint32, useDb *string) []*BinlogDdl {
+	sqlStr := string(queryEvent.Query)
+	lowerSqlStr := strings.TrimSpace(strings.ToLower(sqlStr))
+	if lowerSqlStr == "begin" || lowerSqlStr == "commit" || lowerSqlStr == "rollback" {
+		return nil
+	}
+	db := string(queryEvent.Schema)
+	if db == "" {
+		db = *useDb
+	}
+	stmts, _, err := GSqlParser.Parse(sqlStr, "", "")
+	if err != nil {
+		GLogger.WriteToLogByFieldsErrorExtramsgExitCode(err, fmt.Sprintf("skip it for table definition history, error to parse sql from query event at %s: %s",
+			mysql.Position{Name: binlog, Pos: spos}.String(), sqlStr), logging.WARNING, ehand.ERR_ERROR)
+		return nil
+	}
+	var ddls []*BinlogDdl
+	for _, stmt := range stmts {
+		if useStmt, ok := stmt.(*ast.UseStmt); ok {
+			db = useStmt.DBName
+			*useDb = useStmt.DBName
+		} else if IfDdlStmtOfTableDef(stmt) {
+			ddls = append(ddls, &BinlogDdl{Binlog: binlog, StartPos: spos, StopPos: epos, Database: db, Stmt: stmt})
+		}
+	}
+	return ddls
+}
+
+// GetBinlogFilesOfDdlHistory: ddls in binlogs parsed are replayed for -ddlhist=snapshot, all ddls up to now are inverted for -ddlhist=current
+func (this *ConfCmd) GetBinlogFilesOfDdlHistory() []string {
+	if this.DdlHistory == C_ddlHistoryCurrent {
+		return this.BinlogFiles
+	}
+	if !this.IfMultiBinlogFiles && !this.IfSetStopParsPoint && !this.IfSetStopDateTime {
+		return this.BinlogFiles[:1]
+	}
+	for i, binlog := range this.BinlogFiles {
+		if _, _, ok := SplitBinlogBasenameAndIndex(GetBinlogNameFromFileName(binlog)); ok && this.IfSetStopFilePos {
+			if CompareBinlogPosition(this.StopFilePos, mysql.Position{Name: GetBinlogNameFromFileName(binlog), Pos: 4}) < 1 {
+				return this.BinlogFiles[:i]
+			}
+		}
+	}
+	return this.BinlogFiles
+}
+
+// TblInfoJsonToTableDef converts table definition to dsql.TableDef to replay ddls on it. unique keys are named by their first columns like mysql does for keys without name
+func TblInfoJsonToTableDef(tbInfo *TblInfoJson) *dsql.TableDef {
+	tbDef := dsql.NewEmptyTableDef()
+	for _, col := range tbInfo.Columns {
+		tbDef.Columns = append(tbDef.Columns, &dsql.ColDef{Name: col.FieldName, TypeName: col.FieldType, Unsigned: col.Unsigned,
+			Elements: append([]string{}, col.EnumValues...), Generated: col.Generated})
+	}
+	if len(tbInfo.PrimaryKey) > 0 {
+		tbDef.PrimaryKey = &dsql.KeyDef{Name: dsql.CprimaryKeyName, ColumnNames: append([]string{}, tbInfo.PrimaryKey...),
+			ColumnIndices: GetColIndexFromKey(tbInfo.PrimaryKey, tbInfo.Columns)}
+	}
+	for _, uk := range tbInfo.UniqueKeys {
+		if len(uk) == 0 {
+			continue
+		}
+		name := GetDefaultUniqueKeyName(tbDef, uk[0])
+		tbDef.UniqueKeys[name] = &dsql.KeyDef{Name: name, ColumnNames: append([]string{}, uk...), ColumnIndices: GetColIndexFromKey(uk, tbInfo.Columns)}
+	}
+	return tbDef
+}
+
+// TableDefToTblInfoJson converts dsql.TableDef back, unique keys are sorted by name
+func TableDefToTblInfoJson(tbKey string, tbDef *dsql.TableDef, ddlInfo DdlPosInfo) *TblInfoJson {
+	db, tb := GetDbTbFromAbsTbName(tbKey)
+	tbInfo := &TblInfoJson{Database: db, Table: tb, Columns: []FieldInfo{}, PrimaryKey: KeyInfo{}, UniqueKeys: []KeyInfo{}, DdlInfo: ddlInfo}
+	for _, col := range tbDef.Columns {
+		tbInfo.Columns = append(tbInfo.Columns, FieldInfo{FieldName: col.Name, FieldType: col.TypeName, Unsigned: col.Unsigned,
+			EnumValues: col.Elements, Generated: col.Generated})
+	}
+	if tbDef.PrimaryKey != nil {
+		tbInfo.PrimaryKey = append(tbInfo.PrimaryKey, tbDef.PrimaryKey.ColumnNames...)
+	}
+	names := make([]string, 0, len(tbDef.UniqueKeys))
+	for name := range tbDef.UniqueKeys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		tbInfo.UniqueKeys = append(tbInfo.UniqueKeys, append(KeyInfo{}, tbDef.UniqueKeys[name].ColumnNames...))
+	}
+	return tbInfo
+}
+
+// GetDefaultUniqueKeyName: name of unique key without name is its first column, with suffix _2, _3... if the name is used
+func GetDefaultUniqueKeyName(tbDef *dsql.TableDef, colName string) string {
+	name := colName
+	for i := 2; ; i++ {
+		if _, ok := tbDef.UniqueKeys[name]; !ok {
+			return name
+		}
+		name = fmt.Sprintf("%s_%d", colName, i)
+	}
+}
+
+// SetDefaultNameOfConstraint names unique key without name in ddl
+func SetDefaultNameOfConstraint(tbDef *dsql.TableDef, cst *ast.Constraint) {
+	if cst.Name == "" && len(cst.Keys) > 0 && IfUniqueConstraint(cst) {
+		cst.Name = GetDefaultUniqueKeyName(tbDef, cst.Keys[0].Column.Name.O)
+	}
+}
+
+func IfUniqueConstraint(cst *ast.Constraint) bool {
+	return cst.Tp == ast.ConstraintUniq || cst.Tp == ast.ConstraintUniqKey || cst.Tp == ast.ConstraintUniqIndex
+}
+
+func GetColumnPositionOfTableDef(tbDef *dsql.TableDef, fullTb string, pos *ast.ColumnPosition) (int, error) {
+	if pos == nil || pos.Tp == ast.ColumnPositionNone {
+		return len(tbDef.Columns), nil
+	} else if pos.Tp == ast.ColumnPositionFirst {
+		return 0, nil
+	}
+	return tbDef.GetPositionForColumn(fullTb, pos.Tp, pos.RelativeColumn.Name.O)
+}
+
+// ReplaceColumnOfTableDef replaces column for alter table modify/change column, primary/unique keys of it are kept
+func ReplaceColumnOfTableDef(tbDef *dsql.TableDef, fullTb string, oldName string, colParsed *ast.ColumnDef, pos *ast.ColumnPosition) error {
+	idx := tbDef.GetColIndxByName(oldName)
+	if idx < 0 {
+		return errors.NotFoundf("column %s in table def of %s", oldName, fullTb)
+	}
+	tbDef.Columns = append(tbDef.Columns[:idx:idx], tbDef.Columns[idx+1:]...)
+	tbDef.ModifyColumnNameOfIndexByColumn(dsql.CalterColumnTypeChange, oldName, colParsed.Name.Name.O)
+	if pos != nil && pos.Tp != ast.ColumnPositionNone {
+		var err error
+		if idx, err = GetColumnPositionOfTableDef(tbDef, fullTb, pos); err != nil {
+			return err
+		}
+	}
+	if err := tbDef.AddColDefFromOneParsedCol(fullTb, colParsed, idx); err != nil {
+		return err
+	}
+	return tbDef.SetNewColumnPositionOfIndex(fullTb)
+}
+
+/*
+TableDefHistory builds table definitions of binlog positions for -ddlhist, so rows events before and after ddls are parsed by suitable definitions.
+Definitions before each ddl are added into G_TablesColumnsInfo keyed by position of the ddl, see GetTableInfoJsonOfBinPos.
+*/
+type TableDefHistory struct {
+	cfg      *ConfCmd
+	tables   map[string]*dsql.TableDef // db.tb => definition at the position replayed to
+	fixed    map[string]bool           // tables with definitions of positions in -rj already, they are kept as they are
+	versions int
+}
+
+func NewTableDefHistory(cfg *ConfCmd) *TableDefHistory {
+	history := &TableDefHistory{cfg: cfg, tables: map[string]*dsql.TableDef{}, fixed: map[string]bool{}}
+	for tbKey, tbDefs := range G_TablesColumnsInfo.tableInfos {
+		for binPosKey, tbInfo := range tbDefs {
+			if binPosKey != NoneBinlogPosKey {
+				history.fixed[tbKey] = true
+			} else if tbInfo != nil {
+				history.tables[tbKey] = TblInfoJsonToTableDef(tbInfo)
+			}
+		}
+		if history.fixed[tbKey] {
+			GLogger.WriteToLogByFieldsNormalOnlyMsg(fmt.Sprintf("%s has table definitions of binlog positions already, they are used instead of -ddlhist", tbKey),
+				logging.WARNING)
+		}
+	}
+	return history
+}
+
+// GetTableKey gets key of table in definitions, table names in ddl may be in different case with lower_case_table_names=1
+func (this *TableDefHistory) GetTableKey(ddl *BinlogDdl, table *ast.TableName) string {
+	tbKey := ddl.GetTableKey(table)
+	if _, ok := this.tables[tbKey]; ok {
+		return tbKey
+	}
+	for oneKey := range this.tables {
+		if strings.EqualFold(oneKey, tbKey) {
+			return oneKey
+		}
+	}
+	return tbKey
+}
+
+func (this *TableDefHistory) IfTargetTable(tbKey string) bool {
+	return this.cfg.IsTargetTable(GetDbTbFromAbsTbName(tbKey))
+}
+
+// WarnLostDefinition warns that definition of target table before ddl cannot be known by inverting it
+func (this *TableDefHistory) WarnLostDefinition(tbKey string, ddl *BinlogDdl, msg string) {
+	if this.IfTargetTable(tbKey) {
+		GLogger.WriteToLogByFieldsNormalOnlyMsg(fmt.Sprintf("%s of %s before ddl is unknown, table definition of it may be wrong: %s", msg, tbKey, ddl.String()),
+			logging.WARNING)
+	}
+}
+
+// GetTablesOfDdl returns tables whose definitions are changed by ddl
+func (this *TableDefHistory) GetTablesOfDdl(ddl *BinlogDdl) []string {
+	var tbKeys []string
+	switch st := ddl.Stmt.(type) {
+	case *ast.CreateTableStmt:
+		tbKeys = append(tbKeys, this.GetTableKey(ddl, st.Table))
+	case *ast.DropTableStmt:
+		for _, table := range st.Tables {
+			tbKeys = append(tbKeys, this.GetTableKey(ddl, table))
+		}
+	case *ast.RenameTableStmt:
+		for _, t2t := range st.TableToTables {
+			tbKeys = append(tbKeys, this.GetTableKey(ddl, t2t.OldTable), this.GetTableKey(ddl, t2t.NewTable))
+		}
+	case *ast.AlterTableStmt:
+		tbKeys = append(tbKeys, this.GetTableKey(ddl, st.Table))
+	case *ast.CreateIndexStmt:
+		tbKeys = append(tbKeys, this.GetTableKey(ddl, st.Table))
+	case *ast.DropIndexStmt:
+		tbKeys = append(tbKeys, this.GetTableKey(ddl, st.Table))
+	case *ast.DropDatabaseStmt:
+		for tbKey := range this.tables {
+			if db, _ := GetDbTbFromAbsTbName(tbKey); strings.EqualFold(db, st.Name) {
+				tbKeys = append(tbKeys, tbKey)
+			}
+		}
+	}
+	return tbKeys
+}
+
+// AddVersionsBeforeDdl adds definitions of target tables before ddl into G_TablesColumnsInfo
+func (this *TableDefHistory) AddVersionsBeforeDdl(ddl *BinlogDdl) {
+	for _, tbKey := range this.GetTablesOfDdl(ddl) {
+		tbDef, ok := this.tables[tbKey]
+		if !ok || this.fixed[tbKey] || !this.IfTargetTable(tbKey) {
+			continue
+		}
+		ddlInfo := DdlPosInfo{Binlog: ddl.Binlog, StartPos: ddl.StartPos, StopPos: ddl.StopPos, DdlSql: ddl.Stmt.Text()}
+		tbInfo := TableDefToTblInfoJson(tbKey, tbDef, ddlInfo)
+		G_TablesColumnsInfo.CheckAndCreateTblKey(tbInfo.Database, tbInfo.Table, ddl.Binlog, ddl.StartPos, ddl.StopPos)
+		G_TablesColumnsInfo.tableInfos[tbKey][GetBinlogPosAsKey(ddl.Binlog, ddl.StartPos, ddl.StopPos)] = tbInfo
+		this.versions++
+	}
+}
+
+// ReplayDdl applies ddl on table definitions
+func (this *TableDefHistory) ReplayDdl(ddl *BinlogDdl) {
+	switch st := ddl.Stmt.(type) {
+	case *ast.CreateTableStmt:
+		tbKey := this.GetTableKey(ddl, st.Table)
+		if _, ok := this.tables[tbKey]; ok && st.IfNotExists {
+			return
+		}
+		if st.ReferTable != nil {
+			if referDef, ok := this.tables[this.GetTableKey(ddl, st.ReferTable)]; ok {
+				this.tables[tbKey] = referDef.Copy()
+			} else {
+				delete(this.tables, tbKey)
+				this.WarnLostDefinition(tbKey, ddl, "definition of the table it is like")
+			}
+			return
+		}
+		if st.Select != nil {
+			delete(this.tables, tbKey)
+			this.WarnLostDefinition(tbKey, ddl, "definition of create table ... select")
+			return
+		}
+		tbDef := dsql.NewEmptyTableDef()
+		for _, cst := range st.Constraints {
+			SetDefaultNameOfConstraint(tbDef, cst)
+		}
+		if err := tbDef.GetTblDefFromCreateTableDirectly(tbKey, st); err != nil {
+			GLogger.WriteToLogByFieldsErrorExtramsgExitCode(err, "fail to get table definition from "+ddl.String(), logging.WARNING, ehand.ERR_ERROR)
+		}
+		this.tables[tbKey] = tbDef
+	case *ast.DropTableStmt:
+		for _, table := range st.Tables {
+			delete(this.tables, this.GetTableKey(ddl, table))
+		}
+	case *ast.RenameTableStmt:
+		for _, t2t := range st.TableToTables {
+			this.RenameTable(this.GetTableKey(ddl, t2t.OldTable), this.GetTableKey(ddl, t2t.NewTable))
+		}
+	case *ast.AlterTableStmt:
+		tbKey := this.GetTableKey(ddl, st.Table)
+		tbDef, ok := this.tables[tbKey]
+		if !ok {
+			return
+		}
+		for _, spec := range st.Specs {
+			if spec.Tp == ast.AlterTableRenameTable {
+				newKey := this.GetTableKey(ddl, spec.NewTable)
+				this.RenameTable(tbKey, newKey)
+				tbKey = newKey
+			} else if err := ReplayAlterTableSpec(tbDef, tbKey, spec); err != nil {
+				GLogger.WriteToLogByFieldsErrorExtramsgExitCode(err, "fail to replay "+ddl.String(), logging.WARNING, ehand.ERR_ERROR)
+			}
+		}
+	case *ast.CreateIndexStmt:
+		if tbDef, ok := this.tables[this.GetTableKey(ddl, st.Table)]; ok && st.Unique {
+			if err := tbDef.AddIndexFromCreateIndex(this.GetTableKey(ddl, st.Table), st); err != nil {
+				GLogger.WriteToLogByFieldsErrorExtramsgExitCode(err, "fail to replay "+ddl.String(), logging.WARNING, ehand.ERR_ERROR)
+			}
+		}
+	case *ast.DropIndexStmt:
+		if tbDef, ok := this.tables[this.GetTableKey(ddl, st.Table)]; ok {
+			tbDef.DropPrimaryUniqueIndex(st.IndexName)
+		}
+	case *ast.DropDatabaseStmt:
+		for _, tbKey := range this.GetTablesOfDdl(ddl) {
+			delete(this.tables, tbKey)
+		}
+	}
+}
+
+// ReplayAlterTableSpec applies one spec of alter table on table definition
+func ReplayAlterTableSpec(tbDef *dsql.TableDef, fullTb string, spec *ast.AlterTableSpec) error {
+	switch spec.Tp {
+	case ast.AlterTableAddColumns:
+		idx, err := GetColumnPositionOfTableDef(tbDef, fullTb, spec.Position)
+		if err != nil {
+			return err
+		}
+		for i, col := range spec.NewColumns {
+			if err = tbDef.AddColDefFromOneParsedCol(fullTb, col, idx+i); err != nil {
+				return err
+			}
+		}
+	case ast.AlterTableAddConstraint:
+		if spec.Constraint.Tp == ast.ConstraintPrimaryKey {
+			tbDef.PrimaryKey = dsql.NewEmptyKeyDef()
+		} else if !IfUniqueConstraint(spec.Constraint) {
+			return nil
+		}
+		SetDefaultNameOfConstraint(tbDef, spec.Constraint)
+		return tbDef.AddPrimayUniqueKeyFromConstraint(fullTb, spec.Constraint)
+	case ast.AlterTableDropColumn:
+		return tbDef.DropColumn(fullTb, spec.OldColumnName.Name.O)
+	case ast.AlterTableDropPrimaryKey:
+		tbDef.DropPrimaryUniqueIndex(dsql.CprimaryKeyName)
+	case ast.AlterTableDropIndex:
+		tbDef.DropPrimaryUniqueIndex(spec.Name)
+	case ast.AlterTableModifyColumn:
+		return ReplaceColumnOfTableDef(tbDef, fullTb, spec.NewColumns[0].Name.Name.O, spec.NewColumns[0], spec.Position)
+	case ast.AlterTableChangeColumn:
+		return ReplaceColumnOfTableDef(tbDef, fullTb, spec.OldColumnName.Name.O, spec.NewColumns[0], spec.Position)
+	case ast.AlterTableRenameIndex:
+		if keyDef, ok := tbDef.UniqueKeys[spec.FromKey.O]; ok {
+			delete(tbDef.UniqueKeys, spec.FromKey.O)
+			keyDef.Name = spec.ToKey.O
+			tbDef.UniqueKeys[spec.ToKey.O] = keyDef
+		}
+	}
+	return nil
+}
+
+func (this *TableDefHistory) RenameTable(oldKey string, newKey string) {
+	tbDef, ok := this.tables[oldKey]
+	delete(this.tables, oldKey)
+	if ok {
+		this.tables[newKey] = tbDef
+	} else {
+		delete(this.tables, newKey)
+	}
+}
+
+/*
+InvertDdl turns table definitions after ddl into the ones before it, for -ddlhist=current.
+Some are lost by ddl and cannot be inverted, such as definition of dropped table, type of dropped column, type of column before modify/change,
+and position of column before it is moved. They are warned and guessed, dropped column is added at the end with type of C_unknownColType.
+*/
+func (this *TableDefHistory) InvertDdl(ddl *BinlogDdl) {
+	switch st := ddl.Stmt.(type) {
+	case *ast.CreateTableStmt:
+		delete(this.tables, this.GetTableKey(ddl, st.Table))
+	case *ast.DropTableStmt:
+		for _, table := range st.Tables {
+			tbKey := this.GetTableKey(ddl, table)
+			delete(this.tables, tbKey)
+			this.WarnLostDefinition(tbKey, ddl, "definition of dropped table")
+		}
+	case *ast.RenameTableStmt:
+		for i := len(st.TableToTables) - 1; i >= 0; i-- {
+			this.RenameTable(this.GetTableKey(ddl, st.TableToTables[i].NewTable), this.GetTableKey(ddl, st.TableToTables[i].OldTable))
+		}
+	case *ast.AlterTableStmt:
+		oldKey := this.GetTableKey(ddl, st.Table)
+		tbKey := oldKey
+		for _, spec := range st.Specs {
+			if spec.Tp == ast.AlterTableRenameTable {
+				tbKey = this.GetTableKey(ddl, spec.NewTable)
+			}
+		}
+		this.RenameTable(tbKey, oldKey)
+		tbDef, ok := this.tables[oldKey]
+		if !ok {
+			return
+		}
+		for i := len(st.Specs) - 1; i >= 0; i-- {
+			if err := this.InvertAlterTableSpec(tbDef, oldKey, st.Specs[i], ddl); err != nil {
+				GLogger.WriteToLogByFieldsErrorExtramsgExitCode(err, "fail to invert "+ddl.String(), logging.WARNING, ehand.ERR_ERROR)
+			}
+		}
+	case *ast.CreateIndexStmt:
+		if tbDef, ok := this.tables[this.GetTableKey(ddl, st.Table)]; ok && st.Unique {
+			tbDef.DropPrimaryUniqueIndex(st.IndexName)
+		}
+	case *ast.DropIndexStmt:
+		if _, ok := this.tables[this.GetTableKey(ddl, st.Table)]; ok {
+			this.WarnLostDefinition(this.GetTableKey(ddl, st.Table), ddl, "dropped index")
+		}
+	case *ast.DropDatabaseStmt:
+		GLogger.WriteToLogByFieldsNormalOnlyMsg(fmt.Sprintf("definitions of tables of dropped database are unknown: %s", ddl.String()), logging.WARNING)
+	}
+}
+
+// InvertAlterTableSpec turns table definition after one spec of alter table into the one before it
+func (this *TableDefHistory) InvertAlterTableSpec(tbDef *dsql.TableDef, fullTb string, spec *ast.AlterTableSpec, ddl *BinlogDdl) error {
+	switch spec.Tp {
+	case ast.AlterTableAddColumns:
+		for _, col := range spec.NewColumns {
+			if err := tbDef.DropColumn(fullTb, col.Name.Name.O); err != nil {
+				return err
+			}
+		}
+	case ast.AlterTableAddConstraint:
+		if spec.Constraint.Tp == ast.ConstraintPrimaryKey {
+			tbDef.DropPrimaryUniqueIndex(dsql.CprimaryKeyName)
+		} else if IfUniqueConstraint(spec.Constraint) {
+			name := spec.Constraint.Name
+			if name == "" && len(spec.Constraint.Keys) > 0 {
+				name = spec.Constraint.Keys[0].Column.Name.O
+			}
+			tbDef.DropPrimaryUniqueIndex(name)
+		}
+	case ast.AlterTableDropColumn:
+		colName := spec.OldColumnName.Name.O
+		this.WarnLostDefinition(fullTb, ddl, fmt.Sprintf("type and position of dropped column %s", colName))
+		if tbDef.GetColIndxByName(colName) < 0 {
+			tbDef.Columns = append(tbDef.Columns, &dsql.ColDef{Name: colName, TypeName: C_unknownColType})
+		}
+	case ast.AlterTableDropPrimaryKey, ast.AlterTableDropIndex:
+		this.WarnLostDefinition(fullTb, ddl, "dropped index")
+	case ast.AlterTableModifyColumn, ast.AlterTableChangeColumn:
+		oldName := spec.NewColumns[0].Name.Name.O
+		if spec.Tp == ast.AlterTableChangeColumn {
+			oldName = spec.OldColumnName.Name.O
+		}
+		this.WarnLostDefinition(fullTb, ddl, fmt.Sprintf("type and position of column %s", oldName))
+		newName := spec.NewColumns[0].Name.Name.O
+		if idx := tbDef.GetColIndxByName(newName); idx >= 0 && oldName != newName {
+			tbDef.Columns[idx].Name = oldName
+			tbDef.ModifyColumnNameOfIndexByColumn(dsql.CalterColumnTypeChange, newName, oldName)
+		}
+	case ast.AlterTableRenameIndex:
+		if keyDef, ok := tbDef.UniqueKeys[spec.ToKey.O]; ok {
+			delete(tbDef.UniqueKeys, spec.ToKey.O)
+			keyDef.Name = spec.FromKey.O
+			tbDef.UniqueKeys[spec.FromKey.O] = keyDef
+		}
+	}
+	return nil
+}
+
+/*
+BuildTableDefHistoryFromBinlogs collects ddls in binlogs for -ddlhist, and adds table definitions before each ddl into G_TablesColumnsInfo.
+For -ddlhist=current, table definitions got are of now, ddls are inverted back to the first binlog, then replayed.
+For -ddlhist=snapshot, table definitions got are of the start of the first binlog, ddls are replayed,
+the definitions after the last ddl are the default ones.
+*/
+func BuildTableDefHistoryFromBinlogs(cfg *ConfCmd) {
+	var (
+		ddls     []*BinlogDdl
+		useDb    string
+		myParser BinFileParser = NewBinFileParserForLocate()
+	)
+	GLogger.WriteToLogByFieldsNormalOnlyMsg("start to collect ddls in binlogs for table definition history", logging.INFO)
+	for _, binlog := range cfg.GetBinlogFilesOfDdlHistory() {
+		oneDdls, err := myParser.CollectDdlsOfBinlogFile(binlog, &useDb)
+		if err != nil {
+			GLogger.WriteToLogByFieldsErrorExtramsgExit(err, "fail to collect ddls of "+binlog, logging.ERROR, ehand.ERR_BINLOG_EVENT)
+		}
+		ddls = append(ddls, oneDdls...)
+	}
+
+	history := NewTableDefHistory(cfg)
+	if cfg.DdlHistory == C_ddlHistoryCurrent {
+		for i := len(ddls) - 1; i >= 0; i-- {
+			history.InvertDdl(ddls[i])
+		}
+	}
+	for _, ddl := range ddls {
+		history.AddVersionsBeforeDdl(ddl)
+		history.ReplayDdl(ddl)
+	}
+	if cfg.DdlHistory == C_ddlHistorySnapshot {
+		for tbKey, tbDef := range history.tables {
+			if history.fixed[tbKey] || !history.IfTargetTable(tbKey) {
+				continue
+			}
+			tbInfo := TableDefToTblInfoJson(tbKey, tbDef, DdlPosInfo{Binlog: KEY_NONE_BINLOG, StartPos: KEY_NONE_POS, StopPos: KEY_NONE_POS})
+			G_TablesColumnsInfo.CheckAndCreateTblKey(tbInfo.Database, tbInfo.Table, KEY_NONE_BINLOG, KEY_NONE_POS, KEY_NONE_POS)
+			G_TablesColumnsInfo.tableInfos[tbKey][NoneBinlogPosKey] = tbInfo
+		}
+	} else {
+		history.WarnMismatchWithCurrent()
+	}
+	GLogger.WriteToLogByFieldsNormalOnlyMsg(fmt.Sprintf("%d ddls are found in binlogs, %d table definitions of binlog positions are added", len(ddls), history.versions),
+		logging.INFO)
+}
+
+// WarnMismatchWithCurrent warns if definitions replayed do not match the current ones, usually because of ddls not inverted exactly
+func (this *TableDefHistory) WarnMismatchWithCurrent() {
+	for tbKey, tbDef := range this.tables {
+		tbDefs, ok := G_TablesColumnsInfo.tableInfos[tbKey]
+		if this.fixed[tbKey] || !ok || tbDefs[NoneBinlogPosKey] == nil || !this.IfTargetTable(tbKey) {
+			continue
+		}
+		current := tbDefs[NoneBinlogPosKey].Columns
+		replayed := TableDefToTblInfoJson(tbKey, tbDef, DdlPosInfo{}).Columns
+		ifMatch := len(current) == len(replayed)
+		for i := 0; ifMatch && i < len(current); i++ {
+			ifMatch = current[i].FieldName == replayed[i].FieldName
+		}
+		if !ifMatch {
+			GLogger.WriteToLogByFieldsNormalOnlyMsg(fmt.Sprintf("columns of %s replayed by ddls do not match the current ones, table definition history of it may be wrong", tbKey),
+				logging.WARNING)
+		}
+	}
+}
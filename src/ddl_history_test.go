@@ -0,0 +1,150 @@
+package src
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/WangJiemin/jamintools/dsql"
+	"github.com/WangJiemin/jamintools/logging"
+	"github.com/pingcap/parser/ast"
+	"github.com/siddontang/go-mysql/replication"
+)
+
+// getTestDdls parses sqls of query events with default database db, positions are increasing
+func getTestDdls(t *testing.T, db string, sqls ...string) []*BinlogDdl {
+	if GLogger.Logger == nil {
+		GLogger.CreateNewRawLogger()
+		GLogger.ResetLogLevel(logging.ERROR)
+	}
+	var (
+		ddls  []*BinlogDdl
+		useDb string
+	)
+	for i, sql := range sqls {
+		queryEvent := &replication.QueryEvent{Schema: []byte(db), Query: []byte(sql)}
+		oneDdls := GetDdlsOfQueryEvent(queryEvent, "mysql-bin.000001", uint32(100*(i+1)), uint32(100*(i+1)+50), &useDb)
+		if len(oneDdls) == 0 {
+			t.Fatalf("no ddl is got from %s", sql)
+		}
+		ddls = append(ddls, oneDdls...)
+	}
+	return ddls
+}
+
+func newTestTableDefHistory(tbInfos ...*TblInfoJson) *TableDefHistory {
+	history := &TableDefHistory{cfg: &ConfCmd{}, tables: map[string]*dsql.TableDef{}, fixed: map[string]bool{}}
+	for _, tbInfo := range tbInfos {
+		history.tables[GetAbsTableName(tbInfo.Database, tbInfo.Table)] = TblInfoJsonToTableDef(tbInfo)
+	}
+	return history
+}
+
+// tableDefSummary is column names and keys of table definition, for comparison
+type tableDefSummary struct {
+	Columns    []string
+	PrimaryKey KeyInfo
+	UniqueKeys []KeyInfo
+}
+
+// getTableDefSummaries returns summaries of all tables in history
+func getTableDefSummaries(history *TableDefHistory) map[string]tableDefSummary {
+	summaries := map[string]tableDefSummary{}
+	for tbKey, tbDef := range history.tables {
+		tbInfo := TableDefToTblInfoJson(tbKey, tbDef, DdlPosInfo{})
+		summary := tableDefSummary{PrimaryKey: tbInfo.PrimaryKey, UniqueKeys: tbInfo.UniqueKeys}
+		for _, col := range tbInfo.Columns {
+			summary.Columns = append(summary.Columns, col.FieldName)
+		}
+		summaries[tbKey] = summary
+	}
+	return summaries
+}
+
+func TestGetDdlsOfQueryEvent(t *testing.T) {
+	var useDb string
+	queryEvent := &replication.QueryEvent{Query: []byte("use db1; create table t1(id int); insert into t1 values(1); drop view v1; alter table db2.t2 add c int")}
+	ddls := GetDdlsOfQueryEvent(queryEvent, "mysql-bin.000001", 4, 100, &useDb)
+	if useDb != "db1" {
+		t.Errorf("database of use statement is %s", useDb)
+	}
+	if len(ddls) != 2 {
+		t.Fatalf("ddls got are %v", ddls)
+	}
+	if createStmt, ok := ddls[0].Stmt.(*ast.CreateTableStmt); !ok || ddls[0].GetTableKey(createStmt.Table) != "db1.t1" {
+		t.Errorf("first ddl is %s of database %s", ddls[0].String(), ddls[0].Database)
+	}
+	if alterStmt, ok := ddls[1].Stmt.(*ast.AlterTableStmt); !ok || ddls[1].GetTableKey(alterStmt.Table) != "db2.t2" {
+		t.Errorf("second ddl is %s of database %s", ddls[1].String(), ddls[1].Database)
+	}
+
+	for _, sql := range []string{"BEGIN", "commit", "create view v1 as select 1", "insert into t1 values(1)"} {
+		if ddls := GetDdlsOfQueryEvent(&replication.QueryEvent{Query: []byte(sql)}, "mysql-bin.000001", 4, 100, &useDb); len(ddls) != 0 {
+			t.Errorf("ddls are got from %s: %v", sql, ddls)
+		}
+	}
+}
+
+// ddls of TestTableDefHistoryReplayAndInvert, they turn db1.t1 into db1.t2 with t3 created and dropped between
+var testDdlsOfTableDefHistory []string = []string{
+	"alter table t1 add column b int after id, add unique key (a)",
+	"create table t3 (x int primary key, y varchar(10), unique key uk_y(y))",
+	"alter table t1 change a a2 varchar(20), rename index a to uk_a2",
+	"rename table t1 to t2",
+	"drop table t3",
+	"create unique index uk_b on t2 (b)",
+}
+
+func TestTableDefHistoryReplayAndInvert(t *testing.T) {
+	before := &TblInfoJson{Database: "db1", Table: "t1", PrimaryKey: KeyInfo{"id"},
+		Columns: []FieldInfo{{FieldName: "id", FieldType: "int"}, {FieldName: "a", FieldType: "varchar"}}}
+	expectedBefore := map[string]tableDefSummary{
+		"db1.t1": {Columns: []string{"id", "a"}, PrimaryKey: KeyInfo{"id"}, UniqueKeys: []KeyInfo{}},
+	}
+	expectedAfter := map[string]tableDefSummary{
+		// unique keys are sorted by name: uk_a2, uk_b
+		"db1.t2": {Columns: []string{"id", "b", "a2"}, PrimaryKey: KeyInfo{"id"}, UniqueKeys: []KeyInfo{{"a2"}, {"b"}}},
+	}
+	ddls := getTestDdls(t, "db1", testDdlsOfTableDefHistory...)
+
+	// -ddlhist=snapshot replays ddls from definitions of the start
+	history := newTestTableDefHistory(before)
+	for _, ddl := range ddls {
+		history.ReplayDdl(ddl)
+	}
+	if summaries := getTableDefSummaries(history); !reflect.DeepEqual(summaries, expectedAfter) {
+		t.Errorf("table definitions after replaying ddls are %+v, expect %+v", summaries, expectedAfter)
+	}
+
+	// -ddlhist=current inverts ddls from definitions of now, back to the start
+	for i := len(ddls) - 1; i >= 0; i-- {
+		history.InvertDdl(ddls[i])
+	}
+	if summaries := getTableDefSummaries(history); !reflect.DeepEqual(summaries, expectedBefore) {
+		t.Errorf("table definitions after inverting ddls are %+v, expect %+v", summaries, expectedBefore)
+	}
+}
+
+func TestTableDefHistoryInvertLost(t *testing.T) {
+	// type and position of dropped column are lost, it is added at the end
+	after := &TblInfoJson{Database: "db1", Table: "t1", PrimaryKey: KeyInfo{"id"}, UniqueKeys: []KeyInfo{},
+		Columns: []FieldInfo{{FieldName: "id", FieldType: "int"}, {FieldName: "c", FieldType: "int"}}}
+	history := newTestTableDefHistory(after)
+	for _, ddl := range getTestDdls(t, "db1", "alter table t1 drop column b", "drop table t2") {
+		history.InvertDdl(ddl)
+	}
+	tbDef, ok := history.tables["db1.t1"]
+	if !ok {
+		t.Fatalf("definition of db1.t1 is lost")
+	}
+	var columns [][2]string
+	for _, col := range TableDefToTblInfoJson("db1.t1", tbDef, DdlPosInfo{}).Columns {
+		columns = append(columns, [2]string{col.FieldName, col.FieldType})
+	}
+	expectedColumns := [][2]string{{"id", "int"}, {"c", "int"}, {"b", C_unknownColType}}
+	if !reflect.DeepEqual(columns, expectedColumns) {
+		t.Errorf("columns after inverting drop column are %v, expect %v", columns, expectedColumns)
+	}
+	if _, ok := history.tables["db1.t2"]; ok {
+		t.Errorf("definition of dropped table db1.t2 is got by inverting")
+	}
+}
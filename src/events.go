@@ -14,20 +14,31 @@ import (
 	"github.com/WangJiemin/jamintools/logging"
 	"github.com/davecgh/go-spew/spew"
 	SQL "github.com/dropbox/godropbox/database/sqlbuilder"
-	//"github.com/toolkits/slice"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/toolkits/slice"
 )
 
 var G_Time_Column_Types []string = []string{"timestamp", "datetime"}
 
 type ExtraSqlInfoOfPrint struct {
-	schema    string
-	table     string
-	binlog    string
-	startpos  uint32
-	endpos    uint32
-	datetime  string
-	trxIndex  uint64
-	trxStatus int
+	schema     string
+	table      string
+	binlog     string
+	startpos   uint32
+	endpos     uint32
+	datetime   string
+	trxIndex   uint64
+	trxStatus  int
+	gtid       string
+	serverId   uint32
+	xid        uint64
+	ifTrxEnd   bool
+	relayPos   mysql.Position
+	checkpoint *CheckpointBarrier
+	// why rollback sql cannot be generated for the rows event
+	unrecoverable string
+	// for -tolerant, some events of the trx are damaged and skipped
+	incomplete bool
 }
 
 type ForwardRollbackSqlOfPrint struct {
@@ -58,13 +69,42 @@ func PrintExtraInfoForForwardRollbackupSql(cfg *ConfCmd, sqlChan chan ForwardRol
 		trxCommitStr string = "commit;\n"
 		// trxCommitStrLen int = len(trxCommitStr)
 		bytesCntFiles      map[string][][]int = map[string][][]int{} //{"file1":{{8, 0}, {8 , 0}}} {length of bytes, trxIndex}
+		trxFileNames       []string                                  // files which sqls of current trx are written into
+		lastFileTrxIndex   uint64             = 0
 		lastPrintPos       uint32             = 0
 		lastPrintFile      string             = ""
 		printBytesInterval uint32             = 1024 * 1024 * 10 //every 10MB print process info
+		unrecoverableEvs   []string
 	)
 	GLogger.WriteToLogByFieldsNormalOnlyMsg("start thread to write redo/rollback sql into file", logging.INFO)
 	for sc := range sqlChan {
 		//fmt.Println(sc.sqlInfo)
+		if sc.sqlInfo.ifTrxEnd {
+			// print trx info into every file the trx writes into, always for incomplete trx
+			if cfg.PrintExtraInfo || sc.sqlInfo.incomplete {
+				oneSqls = GetTrxEndContentLine(sc)
+				for _, fn := range trxFileNames {
+					fhArrBuf[fn].WriteString(oneSqls)
+					if cfg.WorkType == "rollback" {
+						bytesCntFiles[fn] = append(bytesCntFiles[fn], []int{len(oneSqls), int(sc.sqlInfo.trxIndex)})
+					}
+				}
+			}
+			trxFileNames = []string{}
+			if sc.sqlInfo.checkpoint != nil {
+				fhs := make([]*os.File, 0, len(fhArr))
+				for fn, bufFH := range fhArrBuf {
+					bufFH.Flush()
+					fhs = append(fhs, fhArr[fn])
+				}
+				GCheckpoint.Report(sc.sqlInfo.checkpoint, GetOutputFileSizes(fhs...))
+			}
+			continue
+		}
+		if sc.sqlInfo.unrecoverable != "" {
+			unrecoverableEvs = append(unrecoverableEvs, fmt.Sprintf("%s %s: %s", GetAbsTableName(sc.sqlInfo.schema, sc.sqlInfo.table),
+				GetPosStr(sc.sqlInfo.binlog, sc.sqlInfo.startpos, sc.sqlInfo.endpos), sc.sqlInfo.unrecoverable))
+		}
 		if cfg.WorkType == "rollback" {
 			tmpFileName = GetForwardRollbackSqlFileName(sc.sqlInfo.schema, sc.sqlInfo.table, cfg.FilePerTable, cfg.OutputDir, true, sc.sqlInfo.binlog, true)
 			rollbackFileName = GetForwardRollbackSqlFileName(sc.sqlInfo.schema, sc.sqlInfo.table, cfg.FilePerTable, cfg.OutputDir, true, sc.sqlInfo.binlog, false)
@@ -74,7 +114,7 @@ func PrintExtraInfoForForwardRollbackupSql(cfg *ConfCmd, sqlChan chan ForwardRol
 		}
 		if _, ok := fhArr[tmpFileName]; !ok {
 
-			FH, err = os.OpenFile(tmpFileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+			FH, _, err = OpenOutputFile(tmpFileName)
 			GLogger.WriteToLogByFieldsErrorExtramsgExit(err, "Fail to open file "+tmpFileName, logging.ERROR, ehand.ERR_FILE_OPEN)
 			bufFH = bufio.NewWriter(FH)
 			fhArrBuf[tmpFileName] = bufFH
@@ -103,7 +143,19 @@ func PrintExtraInfoForForwardRollbackupSql(cfg *ConfCmd, sqlChan chan ForwardRol
 		}
 
 		lastTrxIndex = sc.sqlInfo.trxIndex
-		oneSqls = GetForwardRollbackContentLineWithExtra(sc, cfg.PrintExtraInfo)
+		if sc.sqlInfo.trxIndex != lastFileTrxIndex {
+			trxFileNames = []string{}
+			lastFileTrxIndex = sc.sqlInfo.trxIndex
+		}
+		if !slice.ContainsString(trxFileNames, tmpFileName) {
+			trxFileNames = append(trxFileNames, tmpFileName)
+		}
+		if sc.sqlInfo.unrecoverable != "" {
+			// marker where the rollback sql should be, so the gap can be found in rollback sql file
+			oneSqls = GetUnrecoverableContentLine(sc)
+		} else {
+			oneSqls = GetForwardRollbackContentLineWithExtra(sc, cfg.PrintExtraInfo)
+		}
 		fhArrBuf[tmpFileName].WriteString(oneSqls)
 		if lastPrintFile == "" {
 			lastPrintFile = sc.sqlInfo.binlog
@@ -162,6 +214,10 @@ func PrintExtraInfoForForwardRollbackupSql(cfg *ConfCmd, sqlChan chan ForwardRol
 		close(filesChan)
 		reWg.Wait()
 		GLogger.WriteToLogByFieldsNormalOnlyMsg("finish reverting content order of tmp files", logging.INFO)
+		if len(unrecoverableEvs) > 0 {
+			GLogger.WriteToLogByFieldsNormalOnlyMsg(fmt.Sprintf("%d rows events cannot be rolled back because binlog_row_image is not full, no rollback sql is generated for them:\n\t%s",
+				len(unrecoverableEvs), strings.Join(unrecoverableEvs, "\n\t")), logging.WARNING)
+		}
 	} else {
 		GLogger.WriteToLogByFieldsNormalOnlyMsg("finish writing redo/forward sql into file", logging.INFO)
 	}
@@ -172,9 +228,10 @@ func PrintExtraInfoForForwardRollbackupSql(cfg *ConfCmd, sqlChan chan ForwardRol
 
 func GetForwardRollbackContentLineWithExtra(sq ForwardRollbackSqlOfPrint, ifExtra bool) string {
 	if ifExtra {
-		return fmt.Sprintf("# datetime=%s database=%s table=%s binlog=%s startpos=%d stoppos=%d\n%s;\n",
+		return fmt.Sprintf("# datetime=%s database=%s table=%s binlog=%s startpos=%d stoppos=%d gtid=%s server_id=%d%s%s\n%s;\n",
 			sq.sqlInfo.datetime, sq.sqlInfo.schema, sq.sqlInfo.table, sq.sqlInfo.binlog, sq.sqlInfo.startpos,
-			sq.sqlInfo.endpos, strings.Join(sq.sqls, ";\n"))
+			sq.sqlInfo.endpos, GetGtidStrForPrint(sq.sqlInfo.gtid), sq.sqlInfo.serverId, GetRelayPosExtraStr(sq.sqlInfo.relayPos),
+			GetIncompleteTrxExtraStr(sq.sqlInfo.incomplete), strings.Join(sq.sqls, ";\n"))
 	} else {
 
 		str := strings.Join(sq.sqls, ";\n") + ";\n"
@@ -184,6 +241,34 @@ func GetForwardRollbackContentLineWithExtra(sq ForwardRollbackSqlOfPrint, ifExtr
 
 }
 
+// GetUnrecoverableContentLine is the comment written instead of sqls of rows event which cannot be rolled back
+func GetUnrecoverableContentLine(sq ForwardRollbackSqlOfPrint) string {
+	return fmt.Sprintf("# unrecoverable datetime=%s database=%s table=%s binlog=%s startpos=%d stoppos=%d gtid=%s server_id=%d%s%s: %s, skipped\n",
+		sq.sqlInfo.datetime, sq.sqlInfo.schema, sq.sqlInfo.table, sq.sqlInfo.binlog, sq.sqlInfo.startpos,
+		sq.sqlInfo.endpos, GetGtidStrForPrint(sq.sqlInfo.gtid), sq.sqlInfo.serverId, GetRelayPosExtraStr(sq.sqlInfo.relayPos),
+		GetIncompleteTrxExtraStr(sq.sqlInfo.incomplete), sq.sqlInfo.unrecoverable)
+}
+
+func GetTrxEndContentLine(sq ForwardRollbackSqlOfPrint) string {
+	return fmt.Sprintf("# trx_end datetime=%s binlog=%s stoppos=%d gtid=%s server_id=%d xid=%d%s%s\n",
+		sq.sqlInfo.datetime, sq.sqlInfo.binlog, sq.sqlInfo.endpos, GetGtidStrForPrint(sq.sqlInfo.gtid),
+		sq.sqlInfo.serverId, sq.sqlInfo.xid, GetRelayPosExtraStr(sq.sqlInfo.relayPos), GetIncompleteTrxExtraStr(sq.sqlInfo.incomplete))
+}
+
+func GetIncompleteTrxExtraStr(incomplete bool) string {
+	if !incomplete {
+		return ""
+	}
+	return " incomplete_trx=true"
+}
+
+func GetRelayPosExtraStr(relayPos mysql.Position) string {
+	if relayPos.Name == "" {
+		return ""
+	}
+	return fmt.Sprintf(" relay_log=%s relay_pos=%d", relayPos.Name, relayPos.Pos)
+}
+
 func GetForwardRollbackSqlFileName(schema string, table string, filePerTable bool, outDir string, ifRollback bool, binlog string, ifTmp bool) string {
 
 	_, idx := GetBinlogBasenameAndIndex(binlog)
@@ -249,7 +334,13 @@ func GenForwardRollbackSqlFromBinEvent(i uint, cfg *ConfCmd, evChan chan MyBinEv
 
 	for ev := range evChan {
 		posStr = GetPosStr(ev.MyPos.Name, ev.StartPos, ev.MyPos.Pos)
-		if !ev.IfRowsEvent {
+		if ev.IfTrxEnd {
+			currentSqlForPrint = ForwardRollbackSqlOfPrint{sqls: []string{},
+				sqlInfo: ExtraSqlInfoOfPrint{binlog: ev.MyPos.Name, startpos: ev.StartPos, endpos: ev.MyPos.Pos,
+					datetime: GetDatetimeStr(int64(ev.Timestamp), int64(0), constvar.DATETIME_FORMAT_NOSPACE),
+					trxIndex: ev.TrxIndex, trxStatus: ev.TrxStatus, gtid: ev.Gtid, serverId: ev.ServerId, xid: ev.Xid, ifTrxEnd: true, relayPos: ev.RelayPos,
+					checkpoint: ev.Checkpoint, incomplete: ev.Incomplete}}
+		} else if !ev.IfRowsEvent {
 			/*
 				//only target query can be here, no need to double check
 				if !printStatementSql || ev.QuerySql == nil || ev.QuerySql.IsDml() {
@@ -260,13 +351,13 @@ func GenForwardRollbackSqlFromBinEvent(i uint, cfg *ConfCmd, evChan chan MyBinEv
 				sqlInfo: ExtraSqlInfoOfPrint{schema: ev.QuerySql.Tables[0].Database, table: ev.QuerySql.Tables[0].Table,
 					binlog: ev.MyPos.Name, startpos: ev.StartPos, endpos: ev.MyPos.Pos,
 					datetime: GetDatetimeStr(int64(ev.Timestamp), int64(0), constvar.DATETIME_FORMAT_NOSPACE),
-					trxIndex: ev.TrxIndex, trxStatus: ev.TrxStatus}}
+					trxIndex: ev.TrxIndex, trxStatus: ev.TrxStatus, gtid: ev.Gtid, serverId: ev.ServerId, relayPos: ev.RelayPos, incomplete: ev.Incomplete}}
 
 		} else {
 			db = string(ev.BinEvent.Table.Schema)
 			tb = string(ev.BinEvent.Table.Table)
 			fulltb = GetAbsTableName(db, tb)
-			tbInfo, err = G_TablesColumnsInfo.GetTableInfoJsonOfBinPos(db, tb, ev.MyPos.Name, ev.StartPos, ev.MyPos.Pos)
+			tbInfo, err = GetTableInfoOfRowsEvent(cfg, &ev)
 			if err != nil {
 				GLogger.WriteToLogByFieldsErrorExtramsgExit(err, fmt.Sprintf("error to found %s table structure for event %s",
 					fulltb, posStr), logging.ERROR, ehand.ERR_BINLOG_EVENT)
@@ -281,11 +372,13 @@ func GenForwardRollbackSqlFromBinEvent(i uint, cfg *ConfCmd, evChan chan MyBinEv
 			colsDef, colsTypeName = GetSqlFieldsEXpressions(colCnt, allColNames, ev.BinEvent.Table)
 			colsTypeNameFromMysql := make([]string, len(colsTypeName))
 			if len(colsTypeName) > len(tbInfo.Columns) {
-				GLogger.WriteToLogByFieldsExitMsgNoErr(fmt.Sprintf("column count %d in binlog > in table structure %d, usually means DDL in the middle, pls generate a suitable table structure conf %s\ntable=%s\nbinlog=%s\ntable structure:\n\t%s\nrow values:\n\t%s",
+				GLogger.WriteToLogByFieldsExitMsgNoErr(fmt.Sprintf("column count %d in binlog > in table structure %d, usually means DDL in the middle, pls generate a suitable table structure conf %s or try -ddlhist\ntable=%s\nbinlog=%s\ntable structure:\n\t%s\nrow values:\n\t%s",
 					len(colsTypeName), len(tbInfo.Columns), cfg.ReadTblDefJsonFile, fulltb, ev.MyPos.String(), spew.Sdump(tbInfo.Columns), spew.Sdump(ev.BinEvent.Rows[0])),
 					logging.ERROR, ehand.ERR_ERROR)
 			}
 
+			ConvertUnsignedColumnsOfRows(ev.BinEvent.Rows, tbInfo.Columns, ev.BinEvent.Table)
+
 			// convert datetime/timestamp type to string
 			for ci, colType := range colsTypeName {
 				colsTypeNameFromMysql[ci] = tbInfo.Columns[ci].FieldType
@@ -368,24 +461,50 @@ func GenForwardRollbackSqlFromBinEvent(i uint, cfg *ConfCmd, evChan chan MyBinEv
 				ifIgnorePrimary = false
 			}
 
-			if ev.SqlType == "insert" {
+			// generated columns are not inserted nor updated, and not in where conditions
+			rowsEv := ev.BinEvent
+			if genIdx := tbInfo.GetGeneratedColumnIndices(); len(genIdx) > 0 {
+				rowsEvCopy := *ev.BinEvent
+				rowsEvCopy.ColumnBitmap1 = ExcludeColumnsFromImage(ev.BinEvent.ColumnBitmap1, colCnt, genIdx)
+				if ev.SqlType == "update" {
+					rowsEvCopy.ColumnBitmap2 = ExcludeColumnsFromImage(ev.BinEvent.ColumnBitmap2, colCnt, genIdx)
+				}
+				rowsEv = &rowsEvCopy
+			}
+
+			unrecoverable := ""
+			if ifRollback {
+				if missingIdx := GetColumnsMissingForRollback(ev.BinEvent, ev.SqlType); len(missingIdx) > 0 {
+					missingCols := make([]string, len(missingIdx))
+					for k, ci := range missingIdx {
+						missingCols[k] = allColNames[ci].FieldName
+					}
+					unrecoverable = fmt.Sprintf("columns %s of %s are not logged in before image", strings.Join(missingCols, ","), ev.SqlType)
+					GLogger.WriteToLogByFieldsNormalOnlyMsg(fmt.Sprintf("cannot rollback %s %s, %s, binlog_row_image is not full",
+						fulltb, posStr, unrecoverable), logging.WARNING)
+				}
+			}
+
+			if unrecoverable != "" {
+				sqlArr = []string{}
+			} else if ev.SqlType == "insert" {
 				if ifRollback {
-					sqlArr = GenDeleteSqlsForOneRowsEventRollbackInsert(posStr, ev.BinEvent, colsDef, uniqueKeyIdx, cfg.FullColumns, cfg.SqlTblPrefixDb)
+					sqlArr = GenDeleteSqlsForOneRowsEventRollbackInsert(posStr, rowsEv, colsDef, uniqueKeyIdx, cfg.FullColumns, cfg.SqlTblPrefixDb)
 				} else {
-					sqlArr = GenInsertSqlsForOneRowsEvent(posStr, ev.BinEvent, colsDef, cfg.InsertRows, false, cfg.SqlTblPrefixDb, ifIgnorePrimary, primaryKeyIdx)
+					sqlArr = GenInsertSqlsForOneRowsEvent(posStr, rowsEv, colsDef, cfg.InsertRows, false, cfg.SqlTblPrefixDb, ifIgnorePrimary, primaryKeyIdx)
 				}
 
 			} else if ev.SqlType == "delete" {
 				if ifRollback {
-					sqlArr = GenInsertSqlsForOneRowsEventRollbackDelete(posStr, ev.BinEvent, colsDef, cfg.InsertRows, cfg.SqlTblPrefixDb)
+					sqlArr = GenInsertSqlsForOneRowsEventRollbackDelete(posStr, rowsEv, colsDef, cfg.InsertRows, cfg.SqlTblPrefixDb)
 				} else {
-					sqlArr = GenDeleteSqlsForOneRowsEvent(posStr, ev.BinEvent, colsDef, uniqueKeyIdx, cfg.FullColumns, false, cfg.SqlTblPrefixDb)
+					sqlArr = GenDeleteSqlsForOneRowsEvent(posStr, rowsEv, colsDef, uniqueKeyIdx, cfg.FullColumns, false, cfg.SqlTblPrefixDb)
 				}
 			} else if ev.SqlType == "update" {
 				if ifRollback {
-					sqlArr = GenUpdateSqlsForOneRowsEvent(posStr, colsTypeNameFromMysql, colsTypeName, ev.BinEvent, colsDef, uniqueKeyIdx, cfg.FullColumns, true, cfg.SqlTblPrefixDb)
+					sqlArr = GenUpdateSqlsForOneRowsEvent(posStr, colsTypeNameFromMysql, colsTypeName, rowsEv, colsDef, uniqueKeyIdx, cfg.FullColumns, true, cfg.SqlTblPrefixDb)
 				} else {
-					sqlArr = GenUpdateSqlsForOneRowsEvent(posStr, colsTypeNameFromMysql, colsTypeName, ev.BinEvent, colsDef, uniqueKeyIdx, cfg.FullColumns, false, cfg.SqlTblPrefixDb)
+					sqlArr = GenUpdateSqlsForOneRowsEvent(posStr, colsTypeNameFromMysql, colsTypeName, rowsEv, colsDef, uniqueKeyIdx, cfg.FullColumns, false, cfg.SqlTblPrefixDb)
 				}
 			} else {
 				fmt.Println("unsupported query type %s to generate 2sql|rollback sql, it should one of insert|update|delete. %s", ev.SqlType, ev.MyPos.String())
@@ -395,7 +514,8 @@ func GenForwardRollbackSqlFromBinEvent(i uint, cfg *ConfCmd, evChan chan MyBinEv
 			currentSqlForPrint = ForwardRollbackSqlOfPrint{sqls: sqlArr,
 				sqlInfo: ExtraSqlInfoOfPrint{schema: db, table: tb, binlog: ev.MyPos.Name, startpos: ev.StartPos, endpos: ev.MyPos.Pos,
 					datetime: GetDatetimeStr(int64(ev.Timestamp), int64(0), constvar.DATETIME_FORMAT_NOSPACE),
-					trxIndex: ev.TrxIndex, trxStatus: ev.TrxStatus}}
+					trxIndex: ev.TrxIndex, trxStatus: ev.TrxStatus, gtid: ev.Gtid, serverId: ev.ServerId, relayPos: ev.RelayPos, unrecoverable: unrecoverable,
+					incomplete: ev.Incomplete}}
 		}
 
 		for {
@@ -4,8 +4,6 @@ import (
 	"bytes"
 	"fmt"
 	"io"
-	"os"
-	"path/filepath"
 	"strings"
 
 	"github.com/WangJiemin/jamintools/ehand"
@@ -13,12 +11,12 @@ import (
 	"github.com/juju/errors"
 	"github.com/siddontang/go-mysql/mysql"
 	"github.com/siddontang/go-mysql/replication"
-	"github.com/toolkits/file"
 )
 
 var (
 	fileBinEventHandlingIndex uint64 = 0
 	fileTrxIndex              uint64 = 0
+	gRelayMasterBinlog        string = "" // binlog of master for -relay, it is across relay logs
 )
 
 type BinFileParser struct {
@@ -31,17 +29,20 @@ func (this BinFileParser) MyParseAllBinlogFiles(cfg *ConfCmd, evChan chan MyBinE
 	defer close(statChan)
 	defer close(orgSqlChan)
 	GLogger.WriteToLogByFieldsNormalOnlyMsg("start to parse binlog from local files", logging.INFO)
-	binlog, binpos := GetFirstBinlogPosToParse(cfg)
-	binBaseName, binBaseIndx := GetBinlogBasenameAndIndex(binlog)
-	for {
-		if cfg.IfSetStopFilePos {
-			if cfg.StopFilePos.Compare(mysql.Position{Name: filepath.Base(binlog), Pos: 4}) < 1 {
+	var binpos int64 = 4
+	if cfg.StartPos != 0 {
+		binpos = int64(cfg.StartPos)
+	}
+	for i, binlog := range cfg.BinlogFiles {
+		// file names of relay log have nothing to do with -ebin
+		if _, _, ok := SplitBinlogBasenameAndIndex(GetBinlogNameFromFileName(binlog)); ok && cfg.IfSetStopFilePos && !cfg.RelayLogMode {
+			if CompareBinlogPosition(cfg.StopFilePos, mysql.Position{Name: GetBinlogNameFromFileName(binlog), Pos: 4}) < 1 {
 				break
 			}
 		}
 		GLogger.WriteToLogByFieldsNormalOnlyMsg(fmt.Sprintf("start to parse %s %d\n", binlog, binpos), logging.INFO)
 
-		result, err := this.MyParseOneBinlogFile(cfg, binlog, evChan, statChan, orgSqlChan)
+		result, rotateTo, err := this.MyParseOneBinlogFile(cfg, binlog, evChan, statChan, orgSqlChan)
 		if err != nil {
 			GLogger.WriteToLogByFieldsErrorExtramsgExitCode(err, "error to parse binlog", logging.ERROR, ehand.ERR_BINLOG_EVENT)
 			break
@@ -49,16 +50,18 @@ func (this BinFileParser) MyParseAllBinlogFiles(cfg *ConfCmd, evChan chan MyBinE
 		if result == C_reBreak {
 			break
 		} else if result == C_reFileEnd {
-			if !cfg.IfSetStopParsPoint && !cfg.IfSetStopDateTime {
+			if !cfg.IfMultiBinlogFiles && !cfg.IfSetStopParsPoint && !cfg.IfSetStopDateTime {
 				//just parse one binlog
 				break
 			}
-			binlog = filepath.Join(cfg.BinlogDir, GetNextBinlog(binBaseName, binBaseIndx))
-			if !file.IsFile(binlog) {
-				GLogger.WriteToLogByFieldsNormalOnlyMsg(fmt.Sprintf("%s not exists nor a file\n", binlog), logging.WARNING)
+			if i+1 >= len(cfg.BinlogFiles) {
 				break
 			}
-			binBaseIndx++
+			// rotate event at the end of binlog tells the next binlog
+			if rotateTo != "" && rotateTo != GetBinlogNameFromFileName(binlog) && rotateTo != GetBinlogNameFromFileName(cfg.BinlogFiles[i+1]) {
+				GLogger.WriteToLogByFieldsNormalOnlyMsg(fmt.Sprintf("%s rotates to %s, but the next binlog file to parse is %s",
+					binlog, rotateTo, cfg.BinlogFiles[i+1]), logging.WARNING)
+			}
 			binpos = 4
 		} else {
 			GLogger.WriteToLogByFieldsNormalOnlyMsg(fmt.Sprintf("this should not happen: return value of MyParseOneBinlog is %d\n",
@@ -72,117 +75,320 @@ func (this BinFileParser) MyParseAllBinlogFiles(cfg *ConfCmd, evChan chan MyBinE
 
 }
 
-func (this BinFileParser) MyParseOneBinlogFile(cfg *ConfCmd, name string, evChan chan MyBinEvent, statChan chan BinEventStats, orgSqlChan chan OrgSqlPrint) (int, error) {
+// MyParseOneBinlogFile parses binlog file, gzip/zstd compressed binlog file, binlogs in tar archive or from stdin.
+// it also returns the binlog name in the last rotate event
+func (this BinFileParser) MyParseOneBinlogFile(cfg *ConfCmd, name string, evChan chan MyBinEvent, statChan chan BinEventStats, orgSqlChan chan OrgSqlPrint) (int, string, error) {
 	// process: 0, continue: 1, break: 2
-	f, err := os.Open(name)
-	if f != nil {
-		defer f.Close()
+	var (
+		result int = C_reFileEnd
+		binlog string
+		r      io.Reader
+	)
+	if ifSkip, rotateTo := SkipBinlogFileBySidecarIndex(cfg, name); ifSkip {
+		return C_reFileEnd, rotateTo, nil
 	}
+	binReader, err := OpenBinlogReader(name, cfg.StdinBinlogName)
 	if err != nil {
 		GLogger.WriteToLogByFieldsErrorExtramsgExitCode(err, "fail to open "+name, logging.ERROR, ehand.ERR_FILE_OPEN)
-		return C_reBreak, errors.Trace(err)
+		return C_reBreak, "", errors.Trace(err)
 	}
+	defer binReader.Close()
 
-	fileTypeBytes := int64(4)
-
-	b := make([]byte, fileTypeBytes)
-	if _, err = f.Read(b); err != nil {
-		GLogger.WriteToLogByFieldsErrorExtramsgExitCode(err, "fail to read "+name, logging.ERROR, ehand.ERR_FILE_READ)
-		return C_reBreak, errors.Trace(err)
-	} else if !bytes.Equal(b, replication.BinLogFileHeader) {
-		GLogger.WriteToLogByFieldsNormalOnlyMsg(name+" is not a valid binlog file, head 4 bytes must fe'bin' ", logging.WARNING)
-		return C_reBreak, errors.Trace(err)
+	for {
+		binlog, r, err = binReader.NextBinlog()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			GLogger.WriteToLogByFieldsErrorExtramsgExitCode(err, "fail to read "+name, logging.ERROR, ehand.ERR_FILE_READ)
+			return C_reBreak, binlog, errors.Trace(err)
+		}
+		result, err = this.MyParseReader(cfg, r, evChan, &binlog, statChan, orgSqlChan)
+		if err != nil || result != C_reFileEnd {
+			return result, binlog, err
+		}
 	}
+	return result, binlog, nil
+}
 
-	// must not seek to other position, otherwise the program may panic because formatevent, table map event is skipped
-	if _, err = f.Seek(fileTypeBytes, os.SEEK_SET); err != nil {
-		GLogger.WriteToLogByFieldsErrorExtramsgExitCode(err, fmt.Sprintf("error seek %s to %d", name, fileTypeBytes),
-			logging.ERROR, ehand.ERR_FILE_SEEK)
-		return C_reBreak, errors.Trace(err)
+/*
+CheckRelayLogEvent handles events only in relay log, returns C_reContinue for them:
+
+	format description event written by slave at the head of relay log, its server id is of the slave.
+	rotate event written by slave at the end of relay log, it switches to the next relay log.
+	rotate event from master, fake one at the head of relay log or real one when master rotates binlog, it switches binlog of master.
+
+events from master keep positions of master in their header, so they are used as positions of events like Exec_Master_Log_Pos.
+*/
+func CheckRelayLogEvent(cfg *ConfCmd, h *replication.EventHeader, e replication.Event, relayLog *string, relayServerId *uint32) int {
+	switch h.EventType {
+	case replication.FORMAT_DESCRIPTION_EVENT:
+		if *relayServerId == 0 {
+			*relayServerId = h.ServerID
+			return C_reContinue
+		}
+	case replication.ROTATE_EVENT:
+		rotateEvent := e.(*replication.RotateEvent)
+		if h.ServerID == *relayServerId {
+			*relayLog = string(rotateEvent.NextLogName)
+			GLogger.WriteToLogByFieldsNormalOnlyMsg(fmt.Sprintf("relay log rotate to %s", *relayLog), logging.INFO)
+			return C_reContinue
+		}
+		masterPos := mysql.Position{Name: string(rotateEvent.NextLogName), Pos: uint32(rotateEvent.Position)}
+		if gRelayMasterBinlog != masterPos.Name {
+			GLogger.WriteToLogByFieldsNormalOnlyMsg(fmt.Sprintf("binlog of master rotate to %s in relay log %s", masterPos.String(), *relayLog), logging.INFO)
+		}
+		gRelayMasterBinlog = masterPos.Name
+		if cfg.IfSetStopFilePos && CompareBinlogPosition(masterPos, cfg.StopFilePos) >= 0 {
+			return C_reBreak
+		}
+		return C_reContinue
 	}
-	var binlog string = filepath.Base(name)
-	return this.MyParseReader(cfg, f, evChan, &binlog, statChan, orgSqlChan)
+	return C_reProcess
 }
 
-func (this BinFileParser) MyParseReader(cfg *ConfCmd, r io.Reader, evChan chan MyBinEvent, binlog *string, statChan chan BinEventStats, orgSqlChan chan OrgSqlPrint) (int, error) {
-	// process: 0, continue: 1, break: 2, EOF: 3
+// ReadBinEvent reads and parses the next event, io.EOF if no more event.
+// *BinEventDamagedError is returned if the event is truncated or cannot be parsed
+func (this BinFileParser) ReadBinEvent(r io.Reader, binlog string) (*replication.EventHeader, replication.Event, error) {
+	headBuf := make([]byte, replication.EventHeaderSize)
+
+	if n, err := io.ReadFull(r, headBuf); err == io.EOF {
+		return nil, nil, io.EOF
+	} else if err == io.ErrUnexpectedEOF {
+		err = errors.Errorf("binlog event header is truncated, only %d bytes left", n)
+		GLogger.WriteToLogByFieldsErrorExtramsgExitCode(err, "fail to read binlog event header of "+binlog,
+			logging.ERROR, ehand.ERR_FILE_READ)
+		return nil, nil, &BinEventDamagedError{RawData: headBuf[:n], Err: err}
+	} else if err != nil {
+		GLogger.WriteToLogByFieldsErrorExtramsgExitCode(err, "fail to read binlog event header of "+binlog,
+			logging.ERROR, ehand.ERR_FILE_READ)
+		return nil, nil, errors.Trace(err)
+	}
 
-	var (
-		err         error
-		n           int64
-		db          string = ""
-		tb          string = ""
-		sql         string = ""
-		sqlType     string = ""
-		rowCnt      uint32 = 0
-		trxStatus   int    = 0
-		sqlLower    string = ""
-		tbMapPos    uint32 = 0
-		orgSqlEvent *replication.RowsQueryEvent
-	)
+	h, err := this.Parser.ParseHeader(headBuf)
+	if err != nil {
+		GLogger.WriteToLogByFieldsErrorExtramsgExitCode(err, "fail to parse binlog event header of "+binlog,
+			logging.ERROR, ehand.ERR_BINEVENT_HEADER)
+		return nil, nil, &BinEventDamagedError{RawData: headBuf, Err: errors.Trace(err)}
+	}
+	//fmt.Printf("parsing %s %d %s\n", binlog, h.LogPos, GetDatetimeStr(int64(h.Timestamp), int64(0), DATETIME_FORMAT))
 
-	for {
-		headBuf := make([]byte, replication.EventHeaderSize)
+	if h.EventSize <= uint32(replication.EventHeaderSize) {
+		err = errors.Errorf("invalid event header, event size is %d, too small", h.EventSize)
+		GLogger.WriteToLogByFieldsErrorExtramsgExitCode(err, "", logging.ERROR, ehand.ERR_BINEVENT_HEADER)
+		return nil, nil, &BinEventDamagedError{RawData: headBuf, Err: err}
 
-		if _, err = io.ReadFull(r, headBuf); err == io.EOF {
-			return C_reFileEnd, nil
-		} else if err != nil {
-			GLogger.WriteToLogByFieldsErrorExtramsgExitCode(err, "fail to read binlog event header of "+*binlog,
-				logging.ERROR, ehand.ERR_FILE_READ)
-			return C_reBreak, errors.Trace(err)
-		}
+	} else if h.EventSize > cMaxBinlogEventSize {
+		err = errors.Errorf("invalid event header, event size is %d, too large", h.EventSize)
+		GLogger.WriteToLogByFieldsErrorExtramsgExitCode(err, "", logging.ERROR, ehand.ERR_BINEVENT_HEADER)
+		return nil, nil, &BinEventDamagedError{RawData: headBuf, Err: err}
+	}
 
-		var h *replication.EventHeader
-		h, err = this.Parser.ParseHeader(headBuf)
-		if err != nil {
-			GLogger.WriteToLogByFieldsErrorExtramsgExitCode(err, "fail to parse binlog event header of "+*binlog,
-				logging.ERROR, ehand.ERR_BINEVENT_HEADER)
-			return C_reBreak, errors.Trace(err)
-		}
-		//fmt.Printf("parsing %s %d %s\n", *binlog, h.LogPos, GetDatetimeStr(int64(h.Timestamp), int64(0), DATETIME_FORMAT))
+	var buf bytes.Buffer
+	if n, err := io.CopyN(&buf, r, int64(h.EventSize)-int64(replication.EventHeaderSize)); err != nil {
+		err = errors.Errorf("get event body err %v, need %d - %d, but got %d", err, h.EventSize, replication.EventHeaderSize, n)
+		GLogger.WriteToLogByFieldsErrorExtramsgExitCode(err, "", logging.ERROR, ehand.ERR_BINEVENT_BODY)
+		return nil, nil, &BinEventDamagedError{RawData: append(headBuf, buf.Bytes()...), Err: err}
+	}
 
-		if h.EventSize <= uint32(replication.EventHeaderSize) {
-			err = errors.Errorf("invalid event header, event size is %d, too small", h.EventSize)
-			GLogger.WriteToLogByFieldsErrorExtramsgExitCode(err, "", logging.ERROR, ehand.ERR_BINEVENT_HEADER)
-			return C_reBreak, err
+	//h.Dump(os.Stdout)
 
-		}
+	data := buf.Bytes()
+	var rawData []byte
+	rawData = append(rawData, headBuf...)
+	rawData = append(rawData, data...)
 
-		var buf bytes.Buffer
-		if n, err = io.CopyN(&buf, r, int64(h.EventSize)-int64(replication.EventHeaderSize)); err != nil {
-			err = errors.Errorf("get event body err %v, need %d - %d, but got %d", err, h.EventSize, replication.EventHeaderSize, n)
-			GLogger.WriteToLogByFieldsErrorExtramsgExitCode(err, "", logging.ERROR, ehand.ERR_BINEVENT_BODY)
-			return C_reBreak, err
-		}
+	eventLen := int(h.EventSize) - replication.EventHeaderSize
 
-		//h.Dump(os.Stdout)
+	if len(data) != eventLen {
+		err = errors.Errorf("invalid data size %d in event %s, less event length %d", len(data), h.EventType, eventLen)
+		GLogger.WriteToLogByFieldsErrorExtramsgExitCode(err, "", logging.ERROR, ehand.ERR_BINEVENT_BODY)
+		return nil, nil, &BinEventDamagedError{RawData: rawData, Err: err}
+	}
 
-		data := buf.Bytes()
-		var rawData []byte
-		rawData = append(rawData, headBuf...)
-		rawData = append(rawData, data...)
+	e, err := this.Parser.ParseEvent(h, data, rawData)
+	if err != nil {
+		GLogger.WriteToLogByFieldsErrorExtramsgExitCode(err, "fail to parse binlog event body of "+binlog,
+			logging.ERROR, ehand.ERR_BINEVENT_BODY)
+		return nil, nil, &BinEventDamagedError{RawData: rawData, Err: errors.Trace(err)}
+	}
+	return h, e, nil
+}
 
-		eventLen := int(h.EventSize) - replication.EventHeaderSize
+func (this BinFileParser) MyParseReader(cfg *ConfCmd, r io.Reader, evChan chan MyBinEvent, binlog *string, statChan chan BinEventStats, orgSqlChan chan OrgSqlPrint) (int, error) {
+	// process: 0, continue: 1, break: 2, EOF: 3
 
-		if len(data) != eventLen {
-			err = errors.Errorf("invalid data size %d in event %s, less event length %d", len(data), h.EventType, eventLen)
-			GLogger.WriteToLogByFieldsErrorExtramsgExitCode(err, "", logging.ERROR, ehand.ERR_BINEVENT_BODY)
-			return C_reBreak, err
-		}
+	var (
+		err       error
+		db        string             = ""
+		tb        string             = ""
+		sql       string             = ""
+		sqlType   string             = ""
+		rowCnt    uint32             = 0
+		trxStatus int                = 0
+		sqlLower  string             = ""
+		tbMapPos  uint32             = 0
+		trxXid    uint64             = 0
+		trxEvSent bool               = false // any event of current trx is sent to generate sql
+		ckpt      *CheckpointBarrier         // to save checkpoint after current trx is written
+
+		posBinlog      *string = binlog // binlog of positions, it is binlog of master for relay log
+		relayPos       uint32  = 4      // end position of event in relay log
+		relayServerId  uint32  = 0      // server id of slave, who writes the relay log
+		relayEventPos  mysql.Position
+		ifWarnNoMaster bool = true
+
+		payloadEvs []*replication.BinlogEvent // events of TRANSACTION_PAYLOAD_EVENT not processed yet
+
+		resyncReader    *BinlogResyncReader // for -tolerant
+		ifIncompleteTrx bool                // current trx is affected by damaged events
+		lastTimestamp   uint32              // timestamp of the last event read
+
+		filePos   uint32 = 4 // end position of the last event read in binlog
+		ifFdeRead bool       // events before -spos are skipped by header after format description event is read
+	)
+	if cfg.RelayLogMode {
+		posBinlog = &gRelayMasterBinlog
+	}
+	if cfg.Tolerant {
+		resyncReader = NewBinlogResyncReader(r)
+		r = resyncReader
+	}
+	// positions of relay log are not of master, headers of damaged events cannot be trusted for -tolerant
+	ifSkipToStart := cfg.IfSetStartFilePos && *binlog == cfg.StartFilePos.Name && !cfg.RelayLogMode && resyncReader == nil
+	sidecarIndex := LoadSidecarIndexForParsing(cfg, *binlog) // -rsidx, trxs not touching target tables are skipped
+	var newSidecarIndex *BinlogSidecarIndex                  // -osidx
+	if cfg.WriteSidecarIndex {
+		newSidecarIndex = NewBinlogSidecarIndex(*binlog)
+	}
 
-		var e replication.Event
-		e, err = this.Parser.ParseEvent(h, data, rawData)
-		if err != nil {
-			GLogger.WriteToLogByFieldsErrorExtramsgExitCode(err, "fail to parse binlog event body of "+*binlog,
-				logging.ERROR, ehand.ERR_BINEVENT_BODY)
-			return C_reBreak, errors.Trace(err)
+	for {
+		var (
+			h *replication.EventHeader
+			e replication.Event
+		)
+		ifPayloadEv := len(payloadEvs) > 0
+		if ifPayloadEv {
+			h, e = payloadEvs[0].Header, payloadEvs[0].Event
+			payloadEvs = payloadEvs[1:]
+		} else {
+			var damageStart uint32
+			if resyncReader != nil {
+				damageStart = resyncReader.Pos
+			}
+			skipFrom := filePos
+			if ifSkipToStart && ifFdeRead && filePos < cfg.StartFilePos.Pos {
+				filePos, err = SkipBinEventsBeforePos(r, filePos, cfg.StartFilePos.Pos)
+				if err != nil {
+					GLogger.WriteToLogByFieldsErrorExtramsgExitCode(err, "fail to read "+*binlog, logging.ERROR, ehand.ERR_FILE_READ)
+					return C_reBreak, err
+				}
+			}
+			if sidecarIndex != nil && ifFdeRead {
+				filePos, err = sidecarIndex.SkipTrxs(r, filePos)
+				if err != nil {
+					GLogger.WriteToLogByFieldsErrorExtramsgExitCode(err, "fail to read "+*binlog, logging.ERROR, ehand.ERR_FILE_READ)
+					return C_reBreak, err
+				}
+			}
+			if newSidecarIndex != nil && filePos != skipFrom {
+				newSidecarIndex.incomplete = true
+			}
+			h, e, err = this.ReadBinEvent(r, *binlog)
+			if err == io.EOF {
+				if newSidecarIndex != nil && !newSidecarIndex.incomplete {
+					if err = newSidecarIndex.WriteSidecarIndexFile(cfg.OutputDir); err != nil {
+						GLogger.WriteToLogByFieldsErrorExtramsgExitCode(err, "", logging.WARNING, ehand.ERR_FILE_WRITE)
+					}
+				}
+				return C_reFileEnd, nil
+			} else if damagedErr, ok := err.(*BinEventDamagedError); ok && resyncReader != nil &&
+				damagedErr.EventType() != replication.FORMAT_DESCRIPTION_EVENT {
+				// events cannot be parsed without format description event, so it is not recoverable
+				err = resyncReader.Resync(damagedErr.RawData, !cfg.RelayLogMode)
+				if err != nil && err != io.EOF {
+					GLogger.WriteToLogByFieldsErrorExtramsgExitCode(err, "fail to read "+*binlog, logging.ERROR, ehand.ERR_FILE_READ)
+					return C_reBreak, err
+				}
+				if err == io.EOF {
+					GLogger.WriteToLogByFieldsNormalOnlyMsg(fmt.Sprintf("%s is damaged from %d to the end(%d), skip it",
+						*binlog, damageStart, resyncReader.Pos), logging.WARNING)
+				} else {
+					GLogger.WriteToLogByFieldsNormalOnlyMsg(fmt.Sprintf("%s is damaged from %d to %d, skip it and continue from %d",
+						*binlog, damageStart, resyncReader.Pos, resyncReader.Pos), logging.WARNING)
+				}
+				if cfg.RelayLogMode {
+					relayPos = resyncReader.Pos
+				}
+				filePos = resyncReader.Pos
+				if newSidecarIndex != nil {
+					newSidecarIndex.incomplete = true
+				}
+
+				// mark the trx in progress as incomplete, the events after the damaged ones are also of an incomplete trx
+				if cfg.IfGenSql() && trxEvSent && trxStatus != C_trxCommit && trxStatus != C_trxRollback {
+					fileBinEventHandlingIndex++
+					evChan <- MyBinEvent{MyPos: mysql.Position{Name: *posBinlog, Pos: damageStart}, StartPos: damageStart, RelayPos: relayEventPos,
+						EventIdx: fileBinEventHandlingIndex, Timestamp: lastTimestamp, TrxIndex: fileTrxIndex, TrxStatus: trxStatus,
+						Gtid: GGtidTrxFilter.CurrentGtid, IfTrxEnd: true, Incomplete: true}
+				}
+				if *posBinlog != "" {
+					statChan <- BinEventStats{Timestamp: lastTimestamp, Binlog: *posBinlog, RelayPos: relayEventPos,
+						StartPos: damageStart, StopPos: resyncReader.Pos, Damaged: true}
+				}
+				trxEvSent = false
+				trxStatus = C_trxProcess
+				fileTrxIndex++
+				ifIncompleteTrx = true
+				if err == io.EOF {
+					return C_reFileEnd, nil
+				}
+				continue
+			} else if err != nil {
+				return C_reBreak, err
+			}
+			lastTimestamp = h.Timestamp
+			if newSidecarIndex != nil {
+				newSidecarIndex.CollectEvent(h, e, filePos)
+			}
+			filePos += h.EventSize
+			if h.EventType == replication.FORMAT_DESCRIPTION_EVENT && !ifFdeRead {
+				ifFdeRead = true
+				if sidecarIndex != nil && !sidecarIndex.IfIndexOfBinlog(h.Timestamp, h.ServerID) {
+					sidecarIndex = nil
+				}
+			}
+			if resyncReader != nil && h.EventType == replication.FORMAT_DESCRIPTION_EVENT {
+				resyncReader.ChecksumAlg = e.(*replication.FormatDescriptionEvent).ChecksumAlgorithm
+			}
+		}
+		if cfg.RelayLogMode && !ifPayloadEv {
+			relayPos += h.EventSize
+			relayEventPos = mysql.Position{Name: *binlog, Pos: relayPos}
+			chRe := CheckRelayLogEvent(cfg, h, e, binlog, &relayServerId)
+			if chRe == C_reBreak {
+				return C_reBreak, nil
+			} else if chRe == C_reContinue {
+				continue
+			}
+			if gRelayMasterBinlog == "" {
+				if ifWarnNoMaster && h.EventType != replication.PREVIOUS_GTIDS_EVENT {
+					GLogger.WriteToLogByFieldsNormalOnlyMsg(fmt.Sprintf("binlog of master is unknown before the first rotate event from master in relay log, skip events before it. relay log position %s",
+						relayEventPos.String()), logging.WARNING)
+					ifWarnNoMaster = false
+				}
+				continue
+			}
+		}
+		if h.EventType == replication.TRANSACTION_PAYLOAD_EVENT {
+			payloadEvs = GetTrxPayloadEvents(h, e)
+			continue
 		}
 		if h.EventType == replication.TABLE_MAP_EVENT {
 			tbMapPos = h.LogPos - h.EventSize // avoid mysqlbing mask the row event as unknown table row event
 		}
 		//e.Dump(os.Stdout)
 		//can not advance this check, because we need to parse table map event or table may not found. Also we must seek ahead the read file position
-		chRe := CheckBinHeaderCondition(cfg, h, *binlog)
+		chRe := CheckBinHeaderCondition(cfg, h, *posBinlog)
 		if chRe == C_reBreak {
 			return C_reBreak, nil
 		} else if chRe == C_reContinue {
@@ -190,19 +396,19 @@ func (this BinFileParser) MyParseReader(cfg *ConfCmd, r io.Reader, evChan chan M
 		} else if chRe == C_reFileEnd {
 			return C_reFileEnd, nil
 		}
-		if cfg.IfWriteOrgSql && h.EventType == replication.ROWS_QUERY_EVENT {
-			orgSqlEvent = e.(*replication.RowsQueryEvent)
-			orgSqlChan <- OrgSqlPrint{Binlog: *binlog, DateTime: h.Timestamp,
-				StartPos: h.LogPos - h.EventSize, StopPos: h.LogPos, QuerySql: string(orgSqlEvent.Query)}
+		if orgSql, ok := GetOrgSqlFromBinEvent(h, e); ok && cfg.IfWriteOrgSql {
+			orgSqlChan <- OrgSqlPrint{Binlog: *posBinlog, DateTime: h.Timestamp, RelayPos: relayEventPos,
+				StartPos: h.LogPos - h.EventSize, StopPos: h.LogPos, QuerySql: orgSql,
+				ServerId: h.ServerID, Gtid: GGtidTrxFilter.CurrentGtid, Incomplete: ifIncompleteTrx}
 			continue
 		}
 
 		//binEvent := &replication.BinlogEvent{RawData: rawData, Header: h, Event: e}
 		binEvent := &replication.BinlogEvent{Header: h, Event: e} // we donnot need raw data
-		oneMyEvent := &MyBinEvent{MyPos: mysql.Position{Name: *binlog, Pos: h.LogPos},
-			StartPos: tbMapPos}
+		oneMyEvent := &MyBinEvent{MyPos: mysql.Position{Name: *posBinlog, Pos: h.LogPos},
+			StartPos: tbMapPos, RelayPos: relayEventPos, Incomplete: ifIncompleteTrx}
 		//StartPos: h.LogPos - h.EventSize}
-		chRe = oneMyEvent.CheckBinEvent(cfg, binEvent, binlog)
+		chRe = oneMyEvent.CheckBinEvent(cfg, binEvent, posBinlog)
 		if chRe == C_reBreak {
 			return C_reBreak, nil
 		} else if chRe == C_reContinue {
@@ -213,12 +419,16 @@ func (this BinFileParser) MyParseReader(cfg *ConfCmd, r io.Reader, evChan chan M
 
 			// output analysis result whatever the WorkType is
 			db, tb, sqlType, sql, rowCnt = GetDbTbAndQueryAndRowCntFromBinevent(binEvent)
+			trxXid = GetTrxXidFromBinEvent(binEvent)
 			if sqlType == "query" {
 				sqlLower = strings.ToLower(sql)
 
 				if sqlLower == "begin" {
 					trxStatus = C_trxBegin
 					fileTrxIndex++
+					trxEvSent = false
+					ifIncompleteTrx = false
+					oneMyEvent.Incomplete = false
 				} else if sqlLower == "commit" {
 					trxStatus = C_trxCommit
 				} else if sqlLower == "rollback" {
@@ -231,12 +441,12 @@ func (this BinFileParser) MyParseReader(cfg *ConfCmd, r io.Reader, evChan chan M
 				trxStatus = C_trxProcess
 			}
 
-			if cfg.WorkType != "stats" && oneMyEvent.IfRowsEvent {
+			if cfg.IfGenSql() && oneMyEvent.IfRowsEvent {
 				ifSendEvent := false
 				if oneMyEvent.IfRowsEvent {
 					tbKey := GetAbsTableName(string(oneMyEvent.BinEvent.Table.Schema),
 						string(oneMyEvent.BinEvent.Table.Table))
-					if _, ok := G_TablesColumnsInfo.tableInfos[tbKey]; ok {
+					if IfHasTableInfoOfRowsEvent(cfg, oneMyEvent.BinEvent.Table) {
 						ifSendEvent = true
 					} else {
 						GLogger.WriteToLogByFieldsNormalOnlyMsg(fmt.Sprintf("no table struct found for %s, it maybe dropped, skip it. RowsEvent position:%s",
@@ -253,32 +463,68 @@ func (this BinFileParser) MyParseReader(cfg *ConfCmd, r io.Reader, evChan chan M
 					oneMyEvent.Timestamp = h.Timestamp
 					oneMyEvent.TrxIndex = fileTrxIndex
 					oneMyEvent.TrxStatus = trxStatus
+					oneMyEvent.Gtid = GGtidTrxFilter.CurrentGtid
+					oneMyEvent.ServerId = h.ServerID
 					evChan <- *oneMyEvent
+					trxEvSent = true
 				}
 
 			}
 
+			ckpt = nil
+			if GCheckpoint != nil && trxStatus == C_trxCommit {
+				ckpt = GCheckpoint.NewBarrier(mysql.Position{Name: *posBinlog, Pos: h.LogPos}, relayEventPos, GGtidTrxFilter.CurrentGtid, h.Timestamp)
+			}
+
+			// trx end, to print gtid/xid of trx into sql files and to save checkpoint
+			if cfg.IfGenSql() && trxStatus == C_trxCommit && ((cfg.PrintExtraInfo || ifIncompleteTrx) && trxEvSent || ckpt != nil) {
+				fileBinEventHandlingIndex++
+				evChan <- MyBinEvent{MyPos: mysql.Position{Name: *posBinlog, Pos: h.LogPos}, StartPos: h.LogPos - h.EventSize, RelayPos: relayEventPos,
+					EventIdx: fileBinEventHandlingIndex, Timestamp: h.Timestamp, TrxIndex: fileTrxIndex, TrxStatus: trxStatus,
+					Gtid: GGtidTrxFilter.CurrentGtid, ServerId: h.ServerID, Xid: trxXid, IfTrxEnd: true, Checkpoint: ckpt,
+					Incomplete: ifIncompleteTrx}
+				trxEvSent = false
+			}
+
 			if sqlType != "" {
 				if sqlType == "query" {
 					if oneMyEvent.QuerySql != nil {
-						statChan <- BinEventStats{Timestamp: h.Timestamp, Binlog: *binlog, StartPos: h.LogPos - h.EventSize, StopPos: h.LogPos,
+						statChan <- BinEventStats{Timestamp: h.Timestamp, Binlog: *posBinlog, RelayPos: relayEventPos, StartPos: h.LogPos - h.EventSize, StopPos: h.LogPos,
 							Database: oneMyEvent.QuerySql.GetDatabasesAll(","), Table: oneMyEvent.QuerySql.GetFullTablesAll(","), QuerySql: sql,
-							RowCnt: rowCnt, QueryType: sqlType, ParsedSqlInfo: oneMyEvent.QuerySql.Copy()}
+							RowCnt: rowCnt, QueryType: sqlType, ParsedSqlInfo: oneMyEvent.QuerySql.Copy(),
+							ServerId: h.ServerID, Gtid: GGtidTrxFilter.CurrentGtid, Xid: trxXid, Incomplete: ifIncompleteTrx}
 					} else {
-						statChan <- BinEventStats{Timestamp: h.Timestamp, Binlog: *binlog, StartPos: h.LogPos - h.EventSize, StopPos: h.LogPos,
-							Database: db, Table: tb, QuerySql: sql, RowCnt: rowCnt, QueryType: sqlType}
+						statChan <- BinEventStats{Timestamp: h.Timestamp, Binlog: *posBinlog, RelayPos: relayEventPos, StartPos: h.LogPos - h.EventSize, StopPos: h.LogPos,
+							Database: db, Table: tb, QuerySql: sql, RowCnt: rowCnt, QueryType: sqlType,
+							ServerId: h.ServerID, Gtid: GGtidTrxFilter.CurrentGtid, Xid: trxXid, Incomplete: ifIncompleteTrx}
 					}
 				} else {
-					statChan <- BinEventStats{Timestamp: h.Timestamp, Binlog: *binlog, StartPos: tbMapPos, StopPos: h.LogPos,
-						Database: db, Table: tb, QuerySql: sql, RowCnt: rowCnt, QueryType: sqlType}
+					statChan <- BinEventStats{Timestamp: h.Timestamp, Binlog: *posBinlog, RelayPos: relayEventPos, StartPos: tbMapPos, StopPos: h.LogPos,
+						Database: db, Table: tb, QuerySql: sql, RowCnt: rowCnt, QueryType: sqlType,
+						ServerId: h.ServerID, Gtid: GGtidTrxFilter.CurrentGtid, Xid: trxXid, Incomplete: ifIncompleteTrx}
 				}
 
 			}
 
+			if ckpt != nil {
+				statChan <- BinEventStats{Checkpoint: ckpt}
+				if cfg.IfWriteOrgSql {
+					orgSqlChan <- OrgSqlPrint{Checkpoint: ckpt}
+				}
+			}
+
+			if trxStatus == C_trxCommit || trxStatus == C_trxRollback {
+				ifIncompleteTrx = false
+			}
+
+			// the last trx of -egtid is committed
+			if trxStatus == C_trxCommit && GGtidTrxFilter.IfReachStopGtid() {
+				return C_reBreak, nil
+			}
+
 		}
 
 	}
 
 	return C_reFileEnd, nil
 }
-
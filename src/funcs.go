@@ -74,7 +74,7 @@ func CompareBinlogPos(sBinFile string, sPos uint, eBinFile string, ePos uint) in
 	sp := MyPos.Position{Name: sBinFile, Pos: uint32(sPos)}
 	ep := MyPos.Position{Name: eBinFile, Pos: uint32(ePos)}
 
-	result := sp.Compare(ep)
+	result := CompareBinlogPosition(sp, ep)
 
 	return result
 }
@@ -102,13 +102,6 @@ func GetBinlogBasenameAndIndex(binlog string) (string, int) {
 	return baseName, indx
 }
 
-func GetNextBinlog(baseName string, indx int) string {
-	indx++
-	//idxStr := strconv.Itoa(indx)
-	idxStr := fmt.Sprintf("%06d", indx)
-	return baseName + "." + idxStr
-}
-
 func GetDatetimeStr(sec int64, nsec int64, timeFmt string) string {
 	return time.Unix(sec, nsec).Format(timeFmt)
 }
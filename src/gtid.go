@@ -0,0 +1,234 @@
+package src
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/WangJiemin/jamintools/ehand"
+	"github.com/WangJiemin/jamintools/logging"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+)
+
+/*
+GtidTrxFilter decides, transaction by transaction, whether a trx should be processed according to -sgtid/-egtid/-igtid/-xgtid.
+It is fed by the GTID event which starts every transaction(GTID_EVENT/ANONYMOUS_GTID_EVENT for mysql, MARIADB_GTID_EVENT for mariadb),
+all other events of the trx follow its decision.
+*/
+type GtidTrxFilter struct {
+	flavor     string
+	startSet   mysql.GTIDSet // trxs contained in it are executed already, start at the first trx not contained in it
+	stopSet    mysql.GTIDSet // stop once all trxs in it are read or a trx beyond it is met
+	includeSet mysql.GTIDSet // only trxs contained in it
+	excludeSet mysql.GTIDSet // skip trxs contained in it
+	seenSet    mysql.GTIDSet
+
+	started     bool
+	skipTrx     bool
+	CurrentGtid string
+}
+
+var (
+	GGtidTrxFilter *GtidTrxFilter = &GtidTrxFilter{}
+)
+
+func ParseGtidSetOption(flavor string, gtidStr string, optName string) mysql.GTIDSet {
+	gset, err := mysql.ParseGTIDSet(flavor, strings.TrimSpace(gtidStr))
+	if err != nil {
+		GLogger.WriteToLogByFieldsErrorExtramsgExit(err, fmt.Sprintf("invalid gtid set for %s: %s", optName, gtidStr),
+			logging.ERROR, ehand.ERR_INVALID_OPTION)
+	}
+	return gset
+}
+
+func NewGtidTrxFilter(cfg *ConfCmd) *GtidTrxFilter {
+	this := &GtidTrxFilter{flavor: cfg.MysqlType, started: true, skipTrx: false}
+	if cfg.IfSetStartGtid {
+		this.startSet = cfg.StartGtidSet
+		this.started = false
+	}
+	if cfg.IfSetStopGtid {
+		this.stopSet = cfg.StopGtidSet
+	}
+	if cfg.IncludeGtidSet != nil {
+		this.includeSet = cfg.IncludeGtidSet
+	}
+	if cfg.ExcludeGtidSet != nil {
+		this.excludeSet = cfg.ExcludeGtidSet
+	}
+	// the trxs before the start point are regarded as read, so -egtid can be an executed gtid set too
+	if this.startSet != nil {
+		this.seenSet = this.startSet.Clone()
+	} else {
+		this.seenSet, _ = mysql.ParseGTIDSet(this.flavor, "")
+	}
+	return this
+}
+
+func (this *GtidTrxFilter) IsEnabled() bool {
+	return this.startSet != nil || this.stopSet != nil || this.includeSet != nil || this.excludeSet != nil
+}
+
+func (this *GtidTrxFilter) IfSkipCurrentTrx() bool {
+	return this.skipTrx
+}
+
+// IfReachStopGtid returns true when all trxs of -egtid have been read
+func (this *GtidTrxFilter) IfReachStopGtid() bool {
+	if this.stopSet == nil {
+		return false
+	}
+	return this.seenSet.Contain(this.stopSet)
+}
+
+// CheckGtid is called with the gtid of a new trx, gtidStr is empty for anonymous trx.
+// process: 0, continue(skip this trx): 1, break: 2
+func (this *GtidTrxFilter) CheckGtid(gtidStr string) int {
+	this.CurrentGtid = gtidStr
+	if !this.IsEnabled() {
+		this.skipTrx = false
+		return C_reProcess
+	}
+
+	if this.IfReachStopGtid() {
+		return C_reBreak
+	}
+
+	if gtidStr == "" {
+		// anonymous trx, only pass it when no gtid condition is against it
+		this.skipTrx = !this.started || this.includeSet != nil
+		if this.skipTrx {
+			return C_reContinue
+		}
+		return C_reProcess
+	}
+
+	oneSet, err := mysql.ParseGTIDSet(this.flavor, gtidStr)
+	if err != nil {
+		GLogger.WriteToLogByFieldsErrorExtramsgExitCode(err, "fail to parse gtid "+gtidStr, logging.ERROR, ehand.ERR_BINLOG_EVENT)
+		this.skipTrx = false
+		return C_reProcess
+	}
+
+	if this.stopSet != nil && IsGtidBeyondSet(this.flavor, this.stopSet, gtidStr) {
+		return C_reBreak
+	}
+
+	this.skipTrx = false
+	if !this.started {
+		if this.startSet.Contain(oneSet) {
+			this.skipTrx = true
+		} else {
+			this.started = true
+		}
+	}
+	if this.includeSet != nil && !this.includeSet.Contain(oneSet) {
+		this.skipTrx = true
+	}
+	if this.excludeSet != nil && this.excludeSet.Contain(oneSet) {
+		this.skipTrx = true
+	}
+
+	err = this.seenSet.Update(gtidStr)
+	if err != nil {
+		GLogger.WriteToLogByFieldsErrorExtramsgExitCode(err, "fail to add gtid "+gtidStr+" into read gtid set", logging.WARNING, ehand.ERR_BINLOG_EVENT)
+	}
+
+	if this.skipTrx {
+		return C_reContinue
+	}
+	return C_reProcess
+}
+
+/*
+UpdateByGtidList is called with MARIADB_GTID_LIST_EVENT at the beginning of mariadb binlog, which lists the last gtid of every domain
+before the binlog. Those trxs are regarded as read, so -egtid of trxs in previous binlogs stops at once.
+*/
+func (this *GtidTrxFilter) UpdateByGtidList(gtids []mysql.MariadbGTID) {
+	mset, ok := this.seenSet.(*mysql.MariadbGTIDSet)
+	if !ok {
+		return
+	}
+	for i := range gtids {
+		if last, ok := mset.Sets[gtids[i].DomainID]; ok && last.SequenceNumber >= gtids[i].SequenceNumber {
+			continue
+		}
+		gtid := gtids[i]
+		if err := mset.AddSet(&gtid); err != nil {
+			GLogger.WriteToLogByFieldsErrorExtramsgExitCode(err, "fail to add gtid "+gtid.String()+" into read gtid set",
+				logging.WARNING, ehand.ERR_BINLOG_EVENT)
+		}
+	}
+}
+
+// GetMariadbGtidListStr returns gtids of MARIADB_GTID_LIST_EVENT separated by comma
+func GetMariadbGtidListStr(ev *replication.MariadbGTIDListEvent) string {
+	gtids := make([]string, len(ev.GTIDs))
+	for i := range ev.GTIDs {
+		gtids[i] = ev.GTIDs[i].String()
+	}
+	return strings.Join(gtids, C_joinSepComma)
+}
+
+// IsGtidBeyondSet returns true if the sequence of gtid is greater than the max sequence of the same uuid(mysql) or domain(mariadb) in gset
+func IsGtidBeyondSet(flavor string, gset mysql.GTIDSet, gtidStr string) bool {
+	if flavor == mysql.MariaDBFlavor {
+		mset, ok := gset.(*mysql.MariadbGTIDSet)
+		if !ok {
+			return false
+		}
+		gtid, err := mysql.ParseMariadbGTID(gtidStr)
+		if err != nil {
+			return false
+		}
+		last, ok := mset.Sets[gtid.DomainID]
+		if !ok {
+			return false
+		}
+		return gtid.SequenceNumber > last.SequenceNumber
+	}
+
+	mset, ok := gset.(*mysql.MysqlGTIDSet)
+	if !ok {
+		return false
+	}
+	arr := strings.Split(gtidStr, ":")
+	if len(arr) != 2 {
+		return false
+	}
+	gno, err := strconv.ParseInt(arr[1], 10, 64)
+	if err != nil {
+		return false
+	}
+	uuidSet, ok := mset.Sets[strings.ToLower(arr[0])]
+	if !ok || len(uuidSet.Intervals) == 0 {
+		return false
+	}
+	// Stop of interval is exclusive
+	return gno >= uuidSet.Intervals[len(uuidSet.Intervals)-1].Stop
+}
+
+func GetMysqlGtidStr(ev *replication.GTIDEvent) string {
+	if len(ev.SID) != replication.SidLength {
+		return ""
+	}
+	sid := ev.SID
+	return fmt.Sprintf("%x-%x-%x-%x-%x:%d", sid[0:4], sid[4:6], sid[6:8], sid[8:10], sid[10:16], ev.GNO)
+}
+
+func GetMariadbGtidStr(ev *replication.MariadbGTIDEvent) string {
+	return ev.GTID.String()
+}
+
+// GetGtidStrForPrint returns "-" for anonymous trx or binlog without gtid, so the columns of result files are always separated by space
+func GetGtidStrForPrint(gtid string) string {
+	if gtid == "" {
+		return "-"
+	}
+	return gtid
+}
+
+func IsGtidEventType(tp replication.EventType) bool {
+	return tp == replication.GTID_EVENT || tp == replication.ANONYMOUS_GTID_EVENT || tp == replication.MARIADB_GTID_EVENT
+}
@@ -0,0 +1,179 @@
+package src
+
+import (
+	"testing"
+
+	"github.com/siddontang/go-mysql/mysql"
+)
+
+const cTestUuid = "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+
+func mustParseGtidSet(t *testing.T, flavor string, gtidStr string) mysql.GTIDSet {
+	gset, err := mysql.ParseGTIDSet(flavor, gtidStr)
+	if err != nil {
+		t.Fatalf("fail to parse gtid set %s: %v", gtidStr, err)
+	}
+	return gset
+}
+
+func TestGtidTrxFilterCheckGtid(t *testing.T) {
+	type gtidCheck struct {
+		gtid   string
+		result int
+		skip   bool
+	}
+	cases := []struct {
+		name    string
+		flavor  string
+		start   string
+		stop    string
+		include string
+		exclude string
+		checks  []gtidCheck
+	}{
+		{
+			name:   "disabled",
+			flavor: mysql.MySQLFlavor,
+			checks: []gtidCheck{
+				{cTestUuid + ":1", C_reProcess, false},
+				{"", C_reProcess, false},
+			},
+		},
+		{
+			name:   "start gtid set is executed already",
+			flavor: mysql.MySQLFlavor,
+			start:  cTestUuid + ":1-3",
+			checks: []gtidCheck{
+				{cTestUuid + ":2", C_reContinue, true},
+				{cTestUuid + ":3", C_reContinue, true},
+				{cTestUuid + ":4", C_reProcess, false},
+				{cTestUuid + ":5", C_reProcess, false},
+			},
+		},
+		{
+			name:   "stop once all trxs of stop gtid set are read",
+			flavor: mysql.MySQLFlavor,
+			stop:   cTestUuid + ":1-2",
+			checks: []gtidCheck{
+				{cTestUuid + ":1", C_reProcess, false},
+				{cTestUuid + ":2", C_reProcess, false},
+				{cTestUuid + ":3", C_reBreak, false},
+			},
+		},
+		{
+			name:   "stop at trx beyond stop gtid set",
+			flavor: mysql.MySQLFlavor,
+			stop:   cTestUuid + ":1-5",
+			checks: []gtidCheck{
+				{cTestUuid + ":4", C_reProcess, false},
+				{cTestUuid + ":6", C_reBreak, false},
+			},
+		},
+		{
+			name:    "include and exclude",
+			flavor:  mysql.MySQLFlavor,
+			include: cTestUuid + ":1-10",
+			exclude: cTestUuid + ":3-4",
+			checks: []gtidCheck{
+				{cTestUuid + ":2", C_reProcess, false},
+				{cTestUuid + ":3", C_reContinue, true},
+				{cTestUuid + ":5", C_reProcess, false},
+				{cTestUuid + ":11", C_reContinue, true},
+				{"", C_reContinue, true},
+			},
+		},
+		{
+			name:   "anonymous trx before start",
+			flavor: mysql.MySQLFlavor,
+			start:  cTestUuid + ":1",
+			checks: []gtidCheck{
+				{"", C_reContinue, true},
+				{cTestUuid + ":2", C_reProcess, false},
+				{"", C_reProcess, false},
+			},
+		},
+		{
+			name:   "mariadb",
+			flavor: mysql.MariaDBFlavor,
+			start:  "0-1-10",
+			stop:   "0-1-12",
+			checks: []gtidCheck{
+				{"0-1-9", C_reContinue, true},
+				{"0-1-11", C_reProcess, false},
+				{"1-1-100", C_reProcess, false},
+				{"0-1-13", C_reBreak, false},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		cfg := &ConfCmd{MysqlType: c.flavor}
+		if c.start != "" {
+			cfg.StartGtidSet = mustParseGtidSet(t, c.flavor, c.start)
+			cfg.IfSetStartGtid = true
+		}
+		if c.stop != "" {
+			cfg.StopGtidSet = mustParseGtidSet(t, c.flavor, c.stop)
+			cfg.IfSetStopGtid = true
+		}
+		if c.include != "" {
+			cfg.IncludeGtidSet = mustParseGtidSet(t, c.flavor, c.include)
+		}
+		if c.exclude != "" {
+			cfg.ExcludeGtidSet = mustParseGtidSet(t, c.flavor, c.exclude)
+		}
+		filter := NewGtidTrxFilter(cfg)
+		for i, chk := range c.checks {
+			result := filter.CheckGtid(chk.gtid)
+			if result != chk.result {
+				t.Errorf("%s: check %d of gtid %q returns %d, expect %d", c.name, i, chk.gtid, result, chk.result)
+				continue
+			}
+			if result != C_reBreak && filter.IfSkipCurrentTrx() != chk.skip {
+				t.Errorf("%s: check %d of gtid %q skip trx %v, expect %v", c.name, i, chk.gtid, filter.IfSkipCurrentTrx(), chk.skip)
+			}
+		}
+	}
+}
+
+func TestGtidTrxFilterUpdateByGtidList(t *testing.T) {
+	cfg := &ConfCmd{MysqlType: mysql.MariaDBFlavor, StopGtidSet: mustParseGtidSet(t, mysql.MariaDBFlavor, "0-1-5,1-2-3"), IfSetStopGtid: true}
+	filter := NewGtidTrxFilter(cfg)
+	if filter.IfReachStopGtid() {
+		t.Fatalf("stop gtid is reached before any trx")
+	}
+	filter.UpdateByGtidList([]mysql.MariadbGTID{{DomainID: 0, ServerID: 1, SequenceNumber: 5}})
+	if filter.IfReachStopGtid() {
+		t.Fatalf("stop gtid is reached without trxs of domain 1")
+	}
+	filter.UpdateByGtidList([]mysql.MariadbGTID{{DomainID: 0, ServerID: 1, SequenceNumber: 4}, {DomainID: 1, ServerID: 2, SequenceNumber: 3}})
+	if !filter.IfReachStopGtid() {
+		t.Fatalf("stop gtid is not reached after gtid list of all domains")
+	}
+	if filter.CheckGtid("0-1-6") != C_reBreak {
+		t.Errorf("trx after stop gtid is not stopped")
+	}
+}
+
+func TestIsGtidBeyondSet(t *testing.T) {
+	cases := []struct {
+		flavor string
+		set    string
+		gtid   string
+		beyond bool
+	}{
+		{mysql.MySQLFlavor, cTestUuid + ":1-5", cTestUuid + ":5", false},
+		{mysql.MySQLFlavor, cTestUuid + ":1-5", cTestUuid + ":6", true},
+		{mysql.MySQLFlavor, cTestUuid + ":1-5:8-9", cTestUuid + ":7", false},
+		{mysql.MySQLFlavor, cTestUuid + ":1-5", "3e11fa47-71ca-11e1-9e33-c80aa9429563:100", false},
+		{mysql.MariaDBFlavor, "0-1-5", "0-2-6", true},
+		{mysql.MariaDBFlavor, "0-1-5", "0-1-5", false},
+		{mysql.MariaDBFlavor, "0-1-5", "1-1-6", false},
+	}
+	for _, c := range cases {
+		gset := mustParseGtidSet(t, c.flavor, c.set)
+		if beyond := IsGtidBeyondSet(c.flavor, gset, c.gtid); beyond != c.beyond {
+			t.Errorf("IsGtidBeyondSet(%s, %s) = %v, expect %v", c.set, c.gtid, beyond, c.beyond)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package src
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/WangJiemin/jamintools/constvar"
+	"github.com/WangJiemin/jamintools/ehand"
+	"github.com/WangJiemin/jamintools/logging"
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+)
+
+// output formats of -w=info
+const (
+	C_infoFormatTable = "table"
+	C_infoFormatJson  = "json"
+
+	C_infoReportFileBaseName = "binlog_info"
+)
+
+var (
+	GOptsValidInfoFormat []string = []string{C_infoFormatTable, C_infoFormatJson}
+
+	Info_Header_Column_names []string = []string{"binlog", "size", "starttime", "stoptime", "startpos", "stoppos", "version", "checksum",
+		"events", "rowevents", "stmtevents", "previous_gtids", "gtids"}
+)
+
+/*
+BinlogInfo is the inventory of one binlog for -w=info.
+Gtids is the gtid set of trxs in the binlog for mysql. For mariadb, it is the last gtid of every domain in the binlog,
+trxs of the binlog are those after PreviousGtids till it.
+*/
+type BinlogInfo struct {
+	Binlog          string `json:"binlog"`
+	Size            uint64 `json:"size"` // bytes of binlog, uncompressed for compressed binlog
+	FirstEventTime  string `json:"first_event_time"`
+	LastEventTime   string `json:"last_event_time"`
+	StartPos        uint32 `json:"start_position"`
+	EndPos          uint32 `json:"end_position"`
+	ServerVersion   string `json:"server_version"`
+	Checksum        string `json:"checksum"`
+	PreviousGtids   string `json:"previous_gtids"`
+	Gtids           string `json:"gtids"`
+	Events          uint64 `json:"events"`
+	RowEvents       uint64 `json:"row_events"`       // rows events of row format
+	StatementEvents uint64 `json:"statement_events"` // query events of statement format, except BEGIN/COMMIT/ROLLBACK. DDL is included
+	Complete        bool   `json:"complete"`         // false if the binlog is damaged and not read to the end
+
+	firstTs uint32
+	lastTs  uint32
+	gtidSet mysql.GTIDSet
+}
+
+// CollectEvent accumulates one event of the binlog, events in TRANSACTION_PAYLOAD_EVENT are counted as row/statement events too
+func (this *BinlogInfo) CollectEvent(h *replication.EventHeader, e replication.Event) {
+	this.Events++
+	if h.Timestamp > 0 {
+		if this.firstTs == 0 {
+			this.firstTs = h.Timestamp
+		}
+		this.lastTs = h.Timestamp
+	}
+	switch h.EventType {
+	case replication.FORMAT_DESCRIPTION_EVENT:
+		// relay log has format description events of both slave and master, the first one is of the writer of it
+		if this.ServerVersion == "" {
+			fde := e.(*replication.FormatDescriptionEvent)
+			this.ServerVersion = strings.TrimRight(string(fde.ServerVersion), "\x00")
+			if fde.ChecksumAlgorithm == replication.BINLOG_CHECKSUM_ALG_CRC32 {
+				this.Checksum = "CRC32"
+			}
+		}
+	case replication.PREVIOUS_GTIDS_EVENT:
+		this.PreviousGtids = e.(*replication.PreviousGTIDsEvent).GTIDSets
+	case replication.MARIADB_GTID_LIST_EVENT:
+		this.PreviousGtids = GetMariadbGtidListStr(e.(*replication.MariadbGTIDListEvent))
+	case replication.GTID_EVENT:
+		this.AddGtid(mysql.MySQLFlavor, GetMysqlGtidStr(e.(*replication.GTIDEvent)))
+	case replication.MARIADB_GTID_EVENT:
+		this.AddGtid(mysql.MariaDBFlavor, GetMariadbGtidStr(e.(*replication.MariadbGTIDEvent)))
+	case replication.TRANSACTION_PAYLOAD_EVENT:
+		for _, ev := range e.(*replication.TransactionPayloadEvent).Events {
+			this.CountRowOrStatementEvent(ev.Header, ev.Event)
+		}
+	default:
+		this.CountRowOrStatementEvent(h, e)
+	}
+}
+
+// CountRowOrStatementEvent counts rows events and query events. Compressed events of mariadb have type of uncompressed ones after parsing
+func (this *BinlogInfo) CountRowOrStatementEvent(h *replication.EventHeader, e replication.Event) {
+	switch h.EventType {
+	case replication.WRITE_ROWS_EVENTv0, replication.UPDATE_ROWS_EVENTv0, replication.DELETE_ROWS_EVENTv0,
+		replication.WRITE_ROWS_EVENTv1, replication.UPDATE_ROWS_EVENTv1, replication.DELETE_ROWS_EVENTv1,
+		replication.WRITE_ROWS_EVENTv2, replication.UPDATE_ROWS_EVENTv2, replication.DELETE_ROWS_EVENTv2,
+		replication.PARTIAL_UPDATE_ROWS_EVENT:
+		this.RowEvents++
+	case replication.QUERY_EVENT:
+		query := strings.ToUpper(strings.TrimSpace(string(e.(*replication.QueryEvent).Query)))
+		if query != "BEGIN" && query != "COMMIT" && query != "ROLLBACK" {
+			this.StatementEvents++
+		}
+	}
+}
+
+func (this *BinlogInfo) AddGtid(flavor string, gtidStr string) {
+	if gtidStr == "" {
+		return
+	}
+	if this.gtidSet == nil {
+		this.gtidSet = ParseGtidSetOption(flavor, "", "gtid set of binlog")
+	}
+	if err := this.gtidSet.Update(gtidStr); err != nil {
+		GLogger.WriteToLogByFieldsErrorExtramsgExitCode(err, fmt.Sprintf("fail to add gtid %s of %s into gtid set", gtidStr, this.Binlog),
+			logging.WARNING, ehand.ERR_BINLOG_EVENT)
+	}
+}
+
+// Finish fills fields for output after all events of the binlog are collected
+func (this *BinlogInfo) Finish() {
+	if this.firstTs > 0 {
+		this.FirstEventTime = GetDatetimeStr(int64(this.firstTs), int64(0), constvar.DATETIME_FORMAT_NOSPACE)
+		this.LastEventTime = GetDatetimeStr(int64(this.lastTs), int64(0), constvar.DATETIME_FORMAT_NOSPACE)
+	}
+	if this.gtidSet != nil {
+		this.Gtids = this.gtidSet.String()
+	}
+}
+
+// BinlogSizeReader counts bytes read
+type BinlogSizeReader struct {
+	r    io.Reader
+	Size uint64
+}
+
+func (this *BinlogSizeReader) Read(p []byte) (int, error) {
+	n, err := this.r.Read(p)
+	this.Size += uint64(n)
+	return n, err
+}
+
+/*
+CollectBinlogInfoOfReader reads all events of one binlog from reader, positioned after the magic number.
+A damaged event stops the binlog, the info is of events before it then, but the size is still of the whole binlog.
+*/
+func (this BinFileParser) CollectBinlogInfoOfReader(r io.Reader, binlog string) (*BinlogInfo, error) {
+	info := &BinlogInfo{Binlog: binlog, StartPos: 4, EndPos: 4, Checksum: "NONE"}
+	sizeReader := &BinlogSizeReader{r: r, Size: uint64(len(replication.BinLogFileHeader))}
+	for {
+		h, e, err := this.ReadBinEvent(sizeReader, binlog)
+		if err == io.EOF {
+			info.Complete = true
+			break
+		} else if _, ok := err.(*BinEventDamagedError); ok {
+			GLogger.WriteToLogByFieldsNormalOnlyMsg(fmt.Sprintf("stop reading %s at %d, info of it is incomplete, run -w=check to find out the damaged events",
+				binlog, info.EndPos), logging.WARNING)
+			if _, err = io.Copy(ioutil.Discard, sizeReader); err != nil {
+				return nil, errors.Annotatef(err, "fail to read %s", binlog)
+			}
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		info.CollectEvent(h, e)
+		info.EndPos += h.EventSize
+	}
+	info.Size = sizeReader.Size
+	info.Finish()
+	GLogger.WriteToLogByFieldsNormalOnlyMsg(fmt.Sprintf("finish reading %s at %d, %d events", binlog, info.EndPos, info.Events), logging.INFO)
+	return info, nil
+}
+
+// CollectAllBinlogsInfo is -w=info, lists binlog files with time range, positions, gtids and event counts into -o
+func CollectAllBinlogsInfo(cfg *ConfCmd) {
+	myParser := BinFileParser{Parser: replication.NewBinlogParser()}
+	myParser.Parser.SetTimestampStringLocation(GBinlogTimeLocation)
+	myParser.Parser.SetParseTime(false)
+	myParser.Parser.SetUseDecimal(false)
+
+	var infos []*BinlogInfo
+	for _, name := range cfg.BinlogFiles {
+		binReader, err := OpenBinlogReader(name, cfg.StdinBinlogName)
+		if err != nil {
+			GLogger.WriteToLogByFieldsErrorExtramsgExit(err, "fail to open "+name, logging.ERROR, ehand.ERR_FILE_OPEN)
+		}
+		for {
+			binlog, r, err := binReader.NextBinlog()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				binReader.Close()
+				GLogger.WriteToLogByFieldsErrorExtramsgExit(err, "fail to read "+name, logging.ERROR, ehand.ERR_FILE_READ)
+			}
+			info, err := myParser.CollectBinlogInfoOfReader(r, binlog)
+			if err != nil {
+				binReader.Close()
+				GLogger.WriteToLogByFieldsErrorExtramsgExit(err, "fail to read "+binlog, logging.ERROR, ehand.ERR_FILE_READ)
+			}
+			infos = append(infos, info)
+		}
+		binReader.Close()
+	}
+
+	var (
+		content []byte
+		err     error
+	)
+	reportFile := filepath.Join(cfg.OutputDir, C_infoReportFileBaseName)
+	if cfg.InfoFormat == C_infoFormatJson {
+		reportFile += ".json"
+		content, err = json.MarshalIndent(infos, "", "  ")
+		if err != nil {
+			GLogger.WriteToLogByFieldsErrorExtramsgExit(err, "fail to marshal info of binlogs", logging.ERROR, ehand.ERR_ERROR)
+		}
+		content = append(content, '\n')
+	} else {
+		reportFile += ".txt"
+		lines := []string{GetInfoPrintHeaderLine(Info_Header_Column_names)}
+		for _, info := range infos {
+			lines = append(lines, GetInfoPrintContentLine(info))
+		}
+		content = []byte(strings.Join(lines, ""))
+	}
+	err = ioutil.WriteFile(reportFile, content, 0644)
+	GLogger.WriteToLogByFieldsErrorExtramsgExit(err, "fail to write "+reportFile, logging.ERROR, ehand.ERR_FILE_WRITE)
+	GLogger.WriteToLogByFieldsNormalOnlyMsg(fmt.Sprintf("info of %d binlogs is written into %s", len(infos), reportFile), logging.INFO)
+}
+
+func GetInfoPrintHeaderLine(headers []string) string {
+	//[binlog, size, starttime, stoptime, startpos, stoppos, version, checksum, events, rowevents, stmtevents, previous_gtids, gtids]
+	return fmt.Sprintf("%-17s %-12s %-19s %-19s %-10s %-10s %-25s %-8s %-10s %-10s %-10s %-45s %s\n", ConvertStrArrToIntferfaceArrForPrint(headers)...)
+}
+
+func GetInfoPrintContentLine(info *BinlogInfo) string {
+	//[binlog, size, starttime, stoptime, startpos, stoppos, version, checksum, events, rowevents, stmtevents, previous_gtids, gtids]
+	return fmt.Sprintf("%-17s %-12d %-19s %-19s %-10d %-10d %-25s %-8s %-10d %-10d %-10d %-45s %s\n",
+		info.Binlog, info.Size, GetInfoStrForPrint(info.FirstEventTime), GetInfoStrForPrint(info.LastEventTime), info.StartPos, info.EndPos,
+		GetInfoStrForPrint(info.ServerVersion), info.Checksum, info.Events, info.RowEvents, info.StatementEvents,
+		GetGtidStrForPrint(info.PreviousGtids), GetGtidStrForPrint(info.Gtids))
+}
+
+// GetInfoStrForPrint returns "-" for empty value, such as binlog without any event
+func GetInfoStrForPrint(str string) string {
+	if str == "" {
+		return "-"
+	}
+	return str
+}
@@ -0,0 +1,233 @@
+package src
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/WangJiemin/jamintools/ehand"
+	"github.com/WangJiemin/jamintools/logging"
+	"github.com/juju/errors"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	cJobKeyBinlogs = "binlogs" // source.binlogs, binlog files or glob patterns, instead of last args
+)
+
+/*
+GJobFileKeys maps options of job file onto flags, section => option => flag.
+Values of job file are set as if they are given on command line, so they are checked the same way.
+*/
+var GJobFileKeys map[string]map[string]string = map[string]map[string]string{
+	"source": {
+		"mode": "m", "mysql_type": "M", "host": "H", "port": "P", "user": "u", "password": "p", "socket": "S", "server_id": "mid",
+		"defaults_file": "defaults-file", "defaults_extra_file": "defaults-extra-file", "no_defaults": "no-defaults",
+		"login_path": "login-path", "password_env": "password-env", "password_prompt": "password-prompt",
+		"ssl_mode": "ssl-mode", "ssl_ca": "ssl-ca", "ssl_cert": "ssl-cert", "ssl_key": "ssl-key", "ssl_server_name": "ssl-server-name",
+		"binlog_index": "idx", "stdin_binlog": "stdinbin", "relay_log": "relay", "time_location": "tl", "retry": "retry", "tolerant": "tolerant",
+		cJobKeyBinlogs: "",
+	},
+	"range": {
+		"start_binlog": "sbin", "start_pos": "spos", "stop_binlog": "ebin", "stop_pos": "epos",
+		"start_datetime": "sdt", "stop_datetime": "edt", "start_gtid": "sgtid", "stop_gtid": "egtid",
+		"start_from_now": "snow", "to_last_log": "C",
+		"checkpoint": "ckpt", "checkpoint_interval": "ckpti", "resume": "resume",
+	},
+	"filter": {
+		"databases": "dbs", "tables": "tbs", "sql_types": "sql", "include_gtid": "igtid", "exclude_gtid": "xgtid",
+		"statement_sql": "stsql", "ignore_parse_error": "ies",
+	},
+	"output": {
+		"work_type": "w", "dir": "o", "threads": "t", "full_columns": "a", "insert_rows": "r", "keep_trx": "k",
+		"prefix_db": "d", "extra_info": "e", "file_per_table": "f", "original_sql": "ors",
+		"unique_key_first": "U", "ignore_primary_key": "I", "archive_stats": "astats",
+		"read_table_def": "rj", "only_table_def_file": "oj", "dump_table_def": "dj", "info_format": "ifmt", "ddl_history": "ddlhist",
+		"write_sidecar_index": "osidx", "sidecar_index_dir": "rsidx", "use_table_map_meta": "tmeta",
+		"read_table_def_sql": "rsql", "read_table_def_sql_db": "rsqldb",
+	},
+	"threshold": {
+		"print_interval": "i", "big_trx_rows": "b", "long_trx_seconds": "l",
+	},
+}
+
+// JobSections is options of a job, section => option => value
+type JobSections map[string]map[string]interface{}
+
+/*
+JobFile is YAML file of jobs. Sections at top level are common to all profiles,
+sections of the selected profile override them.
+
+	source:
+	  mode: repl
+	  host: 10.0.0.1
+	profiles:
+	  stats:
+	    output: {work_type: stats}
+*/
+type JobFile struct {
+	Common         JobSections            `yaml:",inline"`
+	Profiles       map[string]JobSections `yaml:"profiles"`
+	DefaultProfile string                 `yaml:"default_profile"`
+}
+
+func ReadJobFile(fileName string) (*JobFile, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	job := &JobFile{}
+	if err = yaml.UnmarshalStrict(data, job); err != nil {
+		return nil, errors.Annotatef(err, "fail to parse job file %s", fileName)
+	}
+	return job, nil
+}
+
+// GetProfileSections merges sections of profile over common sections, profile "" for common sections only
+func (this *JobFile) GetProfileSections(profile string) (JobSections, error) {
+	merged := JobSections{}
+	for section, opts := range this.Common {
+		merged[section] = map[string]interface{}{}
+		for k, v := range opts {
+			merged[section][k] = v
+		}
+	}
+	if profile == "" {
+		return merged, nil
+	}
+	profSections, ok := this.Profiles[profile]
+	if !ok {
+		names := make([]string, 0, len(this.Profiles))
+		for name := range this.Profiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, errors.Errorf("profile %s not found, profiles are: %s", profile, strings.Join(names, ", "))
+	}
+	for section, opts := range profSections {
+		if _, ok := merged[section]; !ok {
+			merged[section] = map[string]interface{}{}
+		}
+		for k, v := range opts {
+			merged[section][k] = v
+		}
+	}
+	return merged, nil
+}
+
+// JobValueToString converts value of job file into value of flag, list is joined by comma
+func JobValueToString(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return ""
+	case []interface{}:
+		items := make([]string, len(val))
+		for i, item := range val {
+			items[i] = fmt.Sprint(item)
+		}
+		return strings.Join(items, C_joinSepComma)
+	default:
+		return fmt.Sprint(val)
+	}
+}
+
+// CheckJobSections checks sections and options of job are known
+func CheckJobSections(sections JobSections) error {
+	for section, opts := range sections {
+		keys, ok := GJobFileKeys[section]
+		if !ok {
+			return errors.Errorf("unknown section %s", section)
+		}
+		for k := range opts {
+			if _, ok := keys[k]; !ok {
+				return errors.Errorf("unknown option %s.%s", section, k)
+			}
+		}
+	}
+	return nil
+}
+
+/*
+ApplyJobSections sets flags by options of job, flags given on command line take precedence.
+It returns binlogs of source.binlogs.
+*/
+func ApplyJobSections(sections JobSections, flagsSet map[string]bool) ([]string, error) {
+	var binlogs []string
+	if err := CheckJobSections(sections); err != nil {
+		return nil, err
+	}
+	for section, opts := range sections {
+		for k, v := range opts {
+			flagName := GJobFileKeys[section][k]
+			if k == cJobKeyBinlogs {
+				if list, ok := v.([]interface{}); ok {
+					for _, item := range list {
+						binlogs = append(binlogs, fmt.Sprint(item))
+					}
+				} else {
+					binlogs = append(binlogs, JobValueToString(v))
+				}
+				continue
+			}
+			if flagsSet[flagName] {
+				continue
+			}
+			if err := flag.Set(flagName, JobValueToString(v)); err != nil {
+				return nil, errors.Annotatef(err, "invalid value of %s.%s", section, k)
+			}
+		}
+	}
+	return binlogs, nil
+}
+
+// LoadJobFile applies options of -job and -profile, it returns binlogs to parse if they are given in job file
+func (this *ConfCmd) LoadJobFile() []string {
+	if this.JobFile == "" {
+		if this.JobProfile != "" {
+			GLogger.WriteToLogByFieldsExitMsgNoErr("-profile must be specified with -job", logging.ERROR, ehand.ERR_MISSING_OPTION)
+		}
+		return nil
+	}
+	job, err := ReadJobFile(this.JobFile)
+	if err != nil {
+		GLogger.WriteToLogByFieldsErrorExtramsgExit(err, "invalid job file", logging.ERROR, ehand.ERR_FILE_READ)
+	}
+	for name, profSections := range job.Profiles {
+		if err = CheckJobSections(profSections); err != nil {
+			GLogger.WriteToLogByFieldsErrorExtramsgExit(err, fmt.Sprintf("invalid profile %s of job file %s", name, this.JobFile),
+				logging.ERROR, ehand.ERR_INVALID_OPTION)
+		}
+	}
+	profile := this.JobProfile
+	if profile == "" {
+		profile = job.DefaultProfile
+	}
+	sections, err := job.GetProfileSections(profile)
+	if err != nil {
+		GLogger.WriteToLogByFieldsErrorExtramsgExit(err, "invalid -profile", logging.ERROR, ehand.ERR_INVALID_OPTION)
+	}
+	binlogs, err := ApplyJobSections(sections, GetFlagsSetOnCmdLine())
+	if err != nil {
+		GLogger.WriteToLogByFieldsErrorExtramsgExit(err, "invalid job file "+this.JobFile, logging.ERROR, ehand.ERR_INVALID_OPTION)
+	}
+	if profile != "" {
+		GLogger.WriteToLogByFieldsNormalOnlyMsg(fmt.Sprintf("options of profile %s are loaded from %s", profile, this.JobFile), logging.INFO)
+	}
+	return binlogs
+}
+
+// PrintEffectiveOptions prints options given on command line or job file for -check-config, password is masked
+func PrintEffectiveOptions(binlogs []string) {
+	flag.Visit(func(f *flag.Flag) {
+		value := f.Value.String()
+		if f.Name == "p" && value != "" {
+			value = "******"
+		}
+		fmt.Printf("-%s=%s\n", f.Name, value)
+	})
+	if len(binlogs) > 0 {
+		fmt.Printf("binlogs: %s\n", strings.Join(binlogs, " "))
+	}
+}
@@ -0,0 +1,343 @@
+package src
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/WangJiemin/jamintools/ehand"
+	"github.com/WangJiemin/jamintools/logging"
+	SQL "github.com/dropbox/godropbox/database/sqlbuilder"
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql/replication"
+)
+
+/*
+PARTIAL_UPDATE_ROWS_EVENT of mysql 8.0(binlog_row_value_options=PARTIAL_JSON) logs json column of after image as diffs,
+forward sql applies the diffs by JSON_REPLACE/JSON_INSERT/JSON_ARRAY_INSERT/JSON_REMOVE,
+rollback sql applies the inverse diffs computed from the json document of before image.
+*/
+
+// JsonPathLeg is one leg of json path, member of object or cell of array
+type JsonPathLeg struct {
+	Key     string
+	Index   int
+	IsIndex bool
+	// Index is counted from the end, [last] or [last-N]
+	FromLast bool
+}
+
+// ParseJsonPath parses json path of json diff, such as $.a."b c"[2], wildcards are not allowed
+func ParseJsonPath(path string) ([]JsonPathLeg, error) {
+	path = strings.TrimSpace(path)
+	if !strings.HasPrefix(path, "$") {
+		return nil, errors.Errorf("json path %s not starts with $", path)
+	}
+	var legs []JsonPathLeg
+	for pos := 1; pos < len(path); {
+		switch path[pos] {
+		case '.':
+			pos++
+			if pos < len(path) && path[pos] == '"' {
+				end := pos + 1
+				for ; end < len(path) && path[end] != '"'; end++ {
+					if path[end] == '\\' {
+						end++
+					}
+				}
+				if end >= len(path) {
+					return nil, errors.Errorf("unterminated quoted key in json path %s", path)
+				}
+				var key string
+				if err := json.Unmarshal([]byte(path[pos:end+1]), &key); err != nil {
+					return nil, errors.Annotatef(err, "invalid quoted key in json path %s", path)
+				}
+				legs = append(legs, JsonPathLeg{Key: key})
+				pos = end + 1
+			} else {
+				end := pos
+				for ; end < len(path) && path[end] != '.' && path[end] != '['; end++ {
+				}
+				if end == pos || strings.ContainsAny(path[pos:end], "*") {
+					return nil, errors.Errorf("invalid key in json path %s", path)
+				}
+				legs = append(legs, JsonPathLeg{Key: path[pos:end]})
+				pos = end
+			}
+		case '[':
+			end := strings.IndexByte(path[pos:], ']')
+			if end < 0 {
+				return nil, errors.Errorf("unterminated array index in json path %s", path)
+			}
+			leg, err := ParseJsonArrayIndex(strings.TrimSpace(path[pos+1 : pos+end]))
+			if err != nil {
+				return nil, errors.Annotatef(err, "invalid array index in json path %s", path)
+			}
+			legs = append(legs, leg)
+			pos += end + 1
+		default:
+			return nil, errors.Errorf("unexpected %q at %d of json path %s", path[pos], pos, path)
+		}
+	}
+	return legs, nil
+}
+
+// ParseJsonArrayIndex parses N, last or last-N in [] of json path
+func ParseJsonArrayIndex(idxStr string) (JsonPathLeg, error) {
+	leg := JsonPathLeg{IsIndex: true}
+	if strings.HasPrefix(idxStr, "last") {
+		leg.FromLast = true
+		idxStr = strings.TrimSpace(strings.TrimPrefix(idxStr, "last"))
+		if idxStr == "" {
+			return leg, nil
+		}
+		if !strings.HasPrefix(idxStr, "-") {
+			return leg, errors.Errorf("invalid array index last%s", idxStr)
+		}
+		idxStr = strings.TrimSpace(idxStr[1:])
+	}
+	idx, err := strconv.Atoi(idxStr)
+	if err != nil || idx < 0 {
+		return leg, errors.Errorf("invalid array index %s", idxStr)
+	}
+	leg.Index = idx
+	return leg, nil
+}
+
+// FormatJsonPath formats legs into json path, key which is not an identifier is quoted
+func FormatJsonPath(legs []JsonPathLeg) string {
+	var buf bytes.Buffer
+	buf.WriteByte('$')
+	for _, leg := range legs {
+		if leg.IsIndex {
+			buf.WriteByte('[')
+			if leg.FromLast {
+				buf.WriteString("last")
+				if leg.Index > 0 {
+					buf.WriteString("-" + strconv.Itoa(leg.Index))
+				}
+			} else {
+				buf.WriteString(strconv.Itoa(leg.Index))
+			}
+			buf.WriteByte(']')
+			continue
+		}
+		buf.WriteByte('.')
+		if IfJsonPathIdentifier(leg.Key) {
+			buf.WriteString(leg.Key)
+		} else {
+			quoted, _ := json.Marshal(leg.Key)
+			buf.Write(quoted)
+		}
+	}
+	return buf.String()
+}
+
+func IfJsonPathIdentifier(key string) bool {
+	if key == "" {
+		return false
+	}
+	for i, r := range key {
+		if r == '_' || r == '$' || unicode.IsLetter(r) || i > 0 && unicode.IsDigit(r) {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// UnmarshalJsonText decodes json text into interface{}, numbers are kept as they are
+func UnmarshalJsonText(text []byte) (interface{}, error) {
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(text))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return v, nil
+}
+
+/*
+ApplyJsonDiffToDoc applies one diff onto json document decoded by UnmarshalJsonText, like Json_diff_vector is applied by mysql.
+Array index of legs is resolved against the document, so legs can be formatted into path of the inverse diff.
+It returns the new document, the old value at path and whether the old value exists.
+*/
+func ApplyJsonDiffToDoc(doc interface{}, legs []JsonPathLeg, op replication.JsonDiffOperation, value interface{}) (interface{}, interface{}, bool, error) {
+	if len(legs) == 0 {
+		if op != replication.JsonDiffOperationReplace {
+			return nil, nil, false, errors.Errorf("cannot %s the whole json document", op)
+		}
+		return value, doc, true, nil
+	}
+
+	leg := &legs[0]
+	if leg.IsIndex {
+		arr, ok := doc.([]interface{})
+		if !ok {
+			return nil, nil, false, errors.New("json path leg of array index on non array")
+		}
+		if leg.FromLast {
+			leg.Index = len(arr) - 1 - leg.Index
+			leg.FromLast = false
+		}
+		if len(legs) == 1 && op == replication.JsonDiffOperationInsert {
+			if leg.Index < 0 {
+				leg.Index = 0
+			} else if leg.Index > len(arr) {
+				leg.Index = len(arr)
+			}
+			newArr := make([]interface{}, 0, len(arr)+1)
+			newArr = append(newArr, arr[:leg.Index]...)
+			newArr = append(newArr, value)
+			return append(newArr, arr[leg.Index:]...), nil, false, nil
+		}
+		if leg.Index < 0 || leg.Index >= len(arr) {
+			return nil, nil, false, errors.Errorf("json array index %d out of range %d", leg.Index, len(arr))
+		}
+		if len(legs) > 1 {
+			child, old, existed, err := ApplyJsonDiffToDoc(arr[leg.Index], legs[1:], op, value)
+			if err != nil {
+				return nil, nil, false, err
+			}
+			arr[leg.Index] = child
+			return arr, old, existed, nil
+		}
+		old := arr[leg.Index]
+		if op == replication.JsonDiffOperationRemove {
+			newArr := make([]interface{}, 0, len(arr)-1)
+			newArr = append(newArr, arr[:leg.Index]...)
+			return append(newArr, arr[leg.Index+1:]...), old, true, nil
+		}
+		arr[leg.Index] = value
+		return arr, old, true, nil
+	}
+
+	obj, ok := doc.(map[string]interface{})
+	if !ok {
+		return nil, nil, false, errors.Errorf("json path leg of member %s on non object", leg.Key)
+	}
+	old, existed := obj[leg.Key]
+	if len(legs) > 1 {
+		if !existed {
+			return nil, nil, false, errors.Errorf("json member %s not exists", leg.Key)
+		}
+		child, old, existed, err := ApplyJsonDiffToDoc(old, legs[1:], op, value)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		obj[leg.Key] = child
+		return obj, old, existed, nil
+	}
+	switch op {
+	case replication.JsonDiffOperationRemove:
+		if !existed {
+			return nil, nil, false, errors.Errorf("json member %s not exists", leg.Key)
+		}
+		delete(obj, leg.Key)
+	case replication.JsonDiffOperationReplace:
+		if !existed {
+			return nil, nil, false, errors.Errorf("json member %s not exists", leg.Key)
+		}
+		obj[leg.Key] = value
+	default:
+		obj[leg.Key] = value
+	}
+	return obj, old, existed, nil
+}
+
+/*
+GetJsonDiffsRollback computes diffs to restore the json document of before image from that of after image,
+they are the inverse diffs in reverse order.
+*/
+func GetJsonDiffsRollback(before []byte, diffs replication.JsonDiffVector) (replication.JsonDiffVector, error) {
+	doc, err := UnmarshalJsonText(before)
+	if err != nil {
+		return nil, errors.Annotate(err, "invalid json document of before image")
+	}
+	inverse := make(replication.JsonDiffVector, 0, len(diffs))
+	for _, diff := range diffs {
+		legs, err := ParseJsonPath(diff.Path)
+		if err != nil {
+			return nil, err
+		}
+		var value interface{}
+		if diff.Op != replication.JsonDiffOperationRemove {
+			if value, err = UnmarshalJsonText(diff.Value); err != nil {
+				return nil, errors.Annotatef(err, "invalid json value of diff %s", diff.String())
+			}
+		}
+		var (
+			old     interface{}
+			existed bool
+		)
+		doc, old, existed, err = ApplyJsonDiffToDoc(doc, legs, diff.Op, value)
+		if err != nil {
+			return nil, errors.Annotatef(err, "fail to apply json diff %s", diff.String())
+		}
+		path := FormatJsonPath(legs)
+		if !existed {
+			inverse = append(inverse, replication.JsonDiff{Op: replication.JsonDiffOperationRemove, Path: path})
+			continue
+		}
+		oldText, err := json.Marshal(old)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if diff.Op == replication.JsonDiffOperationRemove {
+			inverse = append(inverse, replication.JsonDiff{Op: replication.JsonDiffOperationInsert, Path: path, Value: oldText})
+		} else {
+			inverse = append(inverse, replication.JsonDiff{Op: replication.JsonDiffOperationReplace, Path: path, Value: oldText})
+		}
+	}
+	for i, j := 0, len(inverse)-1; i < j; i, j = i+1, j-1 {
+		inverse[i], inverse[j] = inverse[j], inverse[i]
+	}
+	return inverse, nil
+}
+
+// GenJsonValueExpression converts json text into json value in sql
+func GenJsonValueExpression(value []byte) SQL.Expression {
+	return SQL.SqlFunc("JSON_EXTRACT", SQL.Literal(string(value)), SQL.Literal("$"))
+}
+
+// GenJsonDiffExpression generates expression applying diffs to json column in order
+func GenJsonDiffExpression(col SQL.NonAliasColumn, diffs replication.JsonDiffVector) SQL.Expression {
+	var expr SQL.Expression = col
+	for _, diff := range diffs {
+		switch diff.Op {
+		case replication.JsonDiffOperationReplace:
+			expr = SQL.SqlFunc("JSON_REPLACE", expr, SQL.Literal(diff.Path), GenJsonValueExpression(diff.Value))
+		case replication.JsonDiffOperationInsert:
+			// insert into array shifts the following cells, like JSON_ARRAY_INSERT
+			if strings.HasSuffix(strings.TrimSpace(diff.Path), "]") {
+				expr = SQL.SqlFunc("JSON_ARRAY_INSERT", expr, SQL.Literal(diff.Path), GenJsonValueExpression(diff.Value))
+			} else {
+				expr = SQL.SqlFunc("JSON_INSERT", expr, SQL.Literal(diff.Path), GenJsonValueExpression(diff.Value))
+			}
+		case replication.JsonDiffOperationRemove:
+			expr = SQL.SqlFunc("JSON_REMOVE", expr, SQL.Literal(diff.Path))
+		}
+	}
+	return expr
+}
+
+/*
+GenJsonDiffRollbackExpression generates expression restoring json column to before image, before is the json text of before image.
+The whole json document of before image is set with warning if the inverse diffs cannot be computed.
+*/
+func GenJsonDiffRollbackExpression(posStr string, col SQL.NonAliasColumn, before interface{}, diffs replication.JsonDiffVector) (SQL.Expression, error) {
+	beforeText, ok := before.([]byte)
+	if !ok {
+		return nil, errors.Errorf("json document of before image is %T, not []byte", before)
+	}
+	inverse, err := GetJsonDiffsRollback(beforeText, diffs)
+	if err != nil {
+		GLogger.WriteToLogByFieldsErrorExtramsgExitCode(err, fmt.Sprintf("fail to compute rollback of json diffs of column %s %s, set the whole json document of before image instead",
+			col.Name(), posStr), logging.WARNING, ehand.ERR_BINLOG_EVENT)
+		return SQL.Literal(beforeText), nil
+	}
+	return GenJsonDiffExpression(col, inverse), nil
+}
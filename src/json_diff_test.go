@@ -0,0 +1,301 @@
+package src
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	SQL "github.com/dropbox/godropbox/database/sqlbuilder"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+)
+
+func TestParseJsonPath(t *testing.T) {
+	cases := []struct {
+		path string
+		legs []JsonPathLeg
+	}{
+		{"$", nil},
+		{"$.a", []JsonPathLeg{{Key: "a"}}},
+		{`$.a[3]."k y"`, []JsonPathLeg{{Key: "a"}, {Index: 3, IsIndex: true}, {Key: "k y"}}},
+		{`$."a\"b".c_1`, []JsonPathLeg{{Key: `a"b`}, {Key: "c_1"}}},
+		{"$[0][ 12 ]", []JsonPathLeg{{Index: 0, IsIndex: true}, {Index: 12, IsIndex: true}}},
+		{"$.a[last]", []JsonPathLeg{{Key: "a"}, {IsIndex: true, FromLast: true}}},
+		{"$.a[last - 2].b", []JsonPathLeg{{Key: "a"}, {Index: 2, IsIndex: true, FromLast: true}, {Key: "b"}}},
+	}
+	for _, c := range cases {
+		legs, err := ParseJsonPath(c.path)
+		if err != nil {
+			t.Errorf("fail to parse json path %s: %v", c.path, err)
+			continue
+		}
+		if !reflect.DeepEqual(legs, c.legs) {
+			t.Errorf("legs of json path %s are %+v, expect %+v", c.path, legs, c.legs)
+		}
+	}
+
+	for _, path := range []string{"a.b", "$.", "$.*", "$.a[*]", "$[x]", "$[-1]", "$[last1]", "$.a[1", `$."k y`, "$a"} {
+		if legs, err := ParseJsonPath(path); err == nil {
+			t.Errorf("no error to parse invalid json path %s, legs: %+v", path, legs)
+		}
+	}
+}
+
+func TestFormatJsonPath(t *testing.T) {
+	for _, path := range []string{"$", "$.a", `$.a[3]."k y"`, `$."1a"[last-1]`, "$[last].b", `$."a\"b"`} {
+		legs, err := ParseJsonPath(path)
+		if err != nil {
+			t.Errorf("fail to parse json path %s: %v", path, err)
+			continue
+		}
+		if formatted := FormatJsonPath(legs); formatted != path {
+			t.Errorf("json path %s is formatted as %s", path, formatted)
+		}
+	}
+}
+
+// applyJsonDiffs applies diffs onto json text, like mysql applies PARTIAL_UPDATE_ROWS_EVENT
+func applyJsonDiffs(t *testing.T, text string, diffs replication.JsonDiffVector) interface{} {
+	doc, err := UnmarshalJsonText([]byte(text))
+	if err != nil {
+		t.Fatalf("invalid json %s: %v", text, err)
+	}
+	for _, diff := range diffs {
+		legs, err := ParseJsonPath(diff.Path)
+		if err != nil {
+			t.Fatalf("fail to parse json path of %s: %v", diff.String(), err)
+		}
+		var value interface{}
+		if diff.Op != replication.JsonDiffOperationRemove {
+			if value, err = UnmarshalJsonText(diff.Value); err != nil {
+				t.Fatalf("invalid json value of %s: %v", diff.String(), err)
+			}
+		}
+		if doc, _, _, err = ApplyJsonDiffToDoc(doc, legs, diff.Op, value); err != nil {
+			t.Fatalf("fail to apply %s onto %s: %v", diff.String(), text, err)
+		}
+	}
+	return doc
+}
+
+func TestGetJsonDiffsRollback(t *testing.T) {
+	var (
+		opReplace = replication.JsonDiffOperationReplace
+		opInsert  = replication.JsonDiffOperationInsert
+		opRemove  = replication.JsonDiffOperationRemove
+	)
+	cases := []struct {
+		name    string
+		before  string
+		diffs   replication.JsonDiffVector
+		after   string
+		inverse replication.JsonDiffVector
+	}{
+		{
+			name:    "replace member",
+			before:  `{"a": 1, "b": "x"}`,
+			diffs:   replication.JsonDiffVector{{Op: opReplace, Path: "$.a", Value: []byte(`{"c": 2}`)}},
+			after:   `{"a": {"c": 2}, "b": "x"}`,
+			inverse: replication.JsonDiffVector{{Op: opReplace, Path: "$.a", Value: []byte(`1`)}},
+		},
+		{
+			name:    "insert member",
+			before:  `{"a": 1}`,
+			diffs:   replication.JsonDiffVector{{Op: opInsert, Path: `$."k y"`, Value: []byte(`[1,2]`)}},
+			after:   `{"a": 1, "k y": [1, 2]}`,
+			inverse: replication.JsonDiffVector{{Op: opRemove, Path: `$."k y"`}},
+		},
+		{
+			name:    "remove member",
+			before:  `{"a": 1, "b": {"c": 1.50}}`,
+			diffs:   replication.JsonDiffVector{{Op: opRemove, Path: "$.b"}},
+			after:   `{"a": 1}`,
+			inverse: replication.JsonDiffVector{{Op: opInsert, Path: "$.b", Value: []byte(`{"c":1.50}`)}},
+		},
+		{
+			name:    "insert into array",
+			before:  `{"a": [1, 2, 3]}`,
+			diffs:   replication.JsonDiffVector{{Op: opInsert, Path: "$.a[1]", Value: []byte(`9`)}},
+			after:   `{"a": [1, 9, 2, 3]}`,
+			inverse: replication.JsonDiffVector{{Op: opRemove, Path: "$.a[1]"}},
+		},
+		{
+			name:    "insert beyond end of array",
+			before:  `[1]`,
+			diffs:   replication.JsonDiffVector{{Op: opInsert, Path: "$[5]", Value: []byte(`2`)}},
+			after:   `[1, 2]`,
+			inverse: replication.JsonDiffVector{{Op: opRemove, Path: "$[1]"}},
+		},
+		{
+			name:   "remove and replace cells of array from last",
+			before: `{"a": [1, {"b": 2}, 3]}`,
+			diffs: replication.JsonDiffVector{{Op: opRemove, Path: "$.a[last]"},
+				{Op: opReplace, Path: "$.a[last].b", Value: []byte(`"x"`)}},
+			after: `{"a": [1, {"b": "x"}]}`,
+			inverse: replication.JsonDiffVector{{Op: opReplace, Path: "$.a[1].b", Value: []byte(`2`)},
+				{Op: opInsert, Path: "$.a[2]", Value: []byte(`3`)}},
+		},
+		{
+			name:   "diffs on the same path in order",
+			before: `{"a": [3]}`,
+			diffs: replication.JsonDiffVector{{Op: opInsert, Path: "$.a[0]", Value: []byte(`1`)},
+				{Op: opInsert, Path: "$.a[1]", Value: []byte(`2`)}, {Op: opReplace, Path: "$.a[2]", Value: []byte(`4`)}},
+			after: `{"a": [1, 2, 4]}`,
+			inverse: replication.JsonDiffVector{{Op: opReplace, Path: "$.a[2]", Value: []byte(`3`)},
+				{Op: opRemove, Path: "$.a[1]"}, {Op: opRemove, Path: "$.a[0]"}},
+		},
+	}
+	for _, c := range cases {
+		after := applyJsonDiffs(t, c.before, c.diffs)
+		expectedAfter, _ := UnmarshalJsonText([]byte(c.after))
+		if !reflect.DeepEqual(after, expectedAfter) {
+			t.Errorf("%s: document after diffs is %v, expect %v", c.name, after, expectedAfter)
+			continue
+		}
+
+		inverse, err := GetJsonDiffsRollback([]byte(c.before), c.diffs)
+		if err != nil {
+			t.Errorf("%s: fail to get rollback of diffs: %v", c.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(inverse, c.inverse) {
+			t.Errorf("%s: rollback of diffs is %v, expect %v", c.name, inverse, c.inverse)
+		}
+
+		afterText, err := json.Marshal(after)
+		if err != nil {
+			t.Fatalf("%s: fail to marshal %v: %v", c.name, after, err)
+		}
+		restored := applyJsonDiffs(t, string(afterText), inverse)
+		expectedBefore, _ := UnmarshalJsonText([]byte(c.before))
+		if !reflect.DeepEqual(restored, expectedBefore) {
+			t.Errorf("%s: document restored by rollback is %v, expect %v", c.name, restored, expectedBefore)
+		}
+	}
+
+	errCases := []struct {
+		name   string
+		before string
+		diffs  replication.JsonDiffVector
+	}{
+		{"invalid before image", `{"a":`, replication.JsonDiffVector{{Op: opRemove, Path: "$.a"}}},
+		{"remove missing member", `{"a": 1}`, replication.JsonDiffVector{{Op: opRemove, Path: "$.b"}}},
+		{"replace missing member", `{"a": 1}`, replication.JsonDiffVector{{Op: opReplace, Path: "$.b", Value: []byte(`1`)}}},
+		{"index out of range", `[1]`, replication.JsonDiffVector{{Op: opReplace, Path: "$[1]", Value: []byte(`1`)}}},
+		{"member of array", `[1]`, replication.JsonDiffVector{{Op: opReplace, Path: "$.a", Value: []byte(`1`)}}},
+		{"remove whole document", `[1]`, replication.JsonDiffVector{{Op: opRemove, Path: "$"}}},
+	}
+	for _, c := range errCases {
+		if inverse, err := GetJsonDiffsRollback([]byte(c.before), c.diffs); err == nil {
+			t.Errorf("%s: no error to get rollback of invalid diffs, rollback: %v", c.name, inverse)
+		}
+	}
+}
+
+func TestGenJsonDiffExpression(t *testing.T) {
+	diffs := replication.JsonDiffVector{
+		{Op: replication.JsonDiffOperationReplace, Path: "$.a", Value: []byte(`"x"`)},
+		{Op: replication.JsonDiffOperationInsert, Path: "$.b", Value: []byte(`1`)},
+		{Op: replication.JsonDiffOperationInsert, Path: "$.c[1]", Value: []byte(`[2]`)},
+		{Op: replication.JsonDiffOperationRemove, Path: `$."d e"`},
+	}
+	expected := "JSON_REMOVE(JSON_ARRAY_INSERT(JSON_INSERT(JSON_REPLACE(`doc`,'$.a',JSON_EXTRACT('\\\"x\\\"','$'))," +
+		"'$.b',JSON_EXTRACT('1','$')),'$.c[1]',JSON_EXTRACT('[2]','$')),'$.\\\"d e\\\"')"
+	var buf bytes.Buffer
+	if err := GenJsonDiffExpression(SQL.BytesColumn("doc", SQL.Nullable), diffs).SerializeSql(&buf); err != nil {
+		t.Fatalf("fail to serialize json diff expression: %v", err)
+	}
+	if buf.String() != expected {
+		t.Errorf("json diff expression is\n%s\nexpect\n%s", buf.String(), expected)
+	}
+}
+
+// genTestEventData returns raw data of event without checksum
+func genTestEventData(evType replication.EventType, body []byte) []byte {
+	data := make([]byte, replication.EventHeaderSize, replication.EventHeaderSize+len(body))
+	binary.LittleEndian.PutUint32(data[0:], 1600000000)
+	data[4] = byte(evType)
+	binary.LittleEndian.PutUint32(data[5:], 1)
+	binary.LittleEndian.PutUint32(data[9:], uint32(replication.EventHeaderSize+len(body)))
+	return append(data, body...)
+}
+
+// newTestBinlogParser returns parser with format description event of mysql 5.5, so events are without checksum
+func newTestBinlogParser(t *testing.T) *replication.BinlogParser {
+	postHeaderLens := []byte{56, 13, 0, 8, 0, 18, 0, 4, 4, 4, 4, 18, 0, 0, 84, 0, 0, 0, 8, 0, 0, 0, 8, 8, 8, 0, 0, 0, 2,
+		10, 10, 10, 42, 42, 0, 0, 0, 0, 10, 40, 0}
+	var body bytes.Buffer
+	binary.Write(&body, binary.LittleEndian, uint16(4))
+	body.Write(append([]byte("5.5.50"), make([]byte, 44)...))
+	binary.Write(&body, binary.LittleEndian, uint32(1600000000))
+	body.WriteByte(byte(replication.EventHeaderSize))
+	body.Write(postHeaderLens)
+
+	parser := replication.NewBinlogParser()
+	if _, err := parser.Parse(genTestEventData(replication.FORMAT_DESCRIPTION_EVENT, body.Bytes())); err != nil {
+		t.Fatalf("fail to parse format description event: %v", err)
+	}
+	return parser
+}
+
+func TestDecodePartialUpdateRowsOfMinimalImage(t *testing.T) {
+	parser := newTestBinlogParser(t)
+	// table test.t(id int, j1 json, j2 json)
+	tableMap := []byte{77, 0, 0, 0, 0, 0, 1, 0, 4, 't', 'e', 's', 't', 0, 1, 't', 0, 3,
+		byte(mysql.MYSQL_TYPE_LONG), byte(mysql.MYSQL_TYPE_JSON), byte(mysql.MYSQL_TYPE_JSON), 2, 4, 4, 0x06}
+	if _, err := parser.Parse(genTestEventData(replication.TABLE_MAP_EVENT, tableMap)); err != nil {
+		t.Fatalf("fail to parse table map event: %v", err)
+	}
+
+	// json diff REPLACE $.a with 7
+	diffs := []byte{byte(replication.JsonDiffOperationReplace), 3, '$', '.', 'a', 3, 0x05, 7, 0}
+	jsonValue := func(data []byte) []byte {
+		return append([]byte{byte(len(data)), 0, 0, 0}, data...)
+	}
+	cases := []struct {
+		name    string
+		bitmap2 byte
+		after   []byte // null bitmap and values of after image
+		row     []interface{}
+	}{
+		{
+			// only j2 is in after image, its partial bit is the second one
+			name:    "minimal image",
+			bitmap2: 0x04,
+			after:   append([]byte{0}, jsonValue(diffs)...),
+			row: []interface{}{nil, nil, replication.JsonDiffVector{
+				{Op: replication.JsonDiffOperationReplace, Path: "$.a", Value: []byte("7")}}},
+		},
+		{
+			name:    "full json columns",
+			bitmap2: 0x06,
+			after:   append(append([]byte{0}, jsonValue([]byte{0x05, 1, 0})...), jsonValue(diffs)...),
+			row: []interface{}{nil, []byte("1"), replication.JsonDiffVector{
+				{Op: replication.JsonDiffOperationReplace, Path: "$.a", Value: []byte("7")}}},
+		},
+	}
+	for _, c := range cases {
+		// table id, flags without STMT_END_F to keep table map, extra data length, column count, bitmap of before and after image
+		body := []byte{77, 0, 0, 0, 0, 0, 0, 0, 2, 0, 3, 0x01, c.bitmap2}
+		// before image of primary key id=1
+		body = append(body, 0, 1, 0, 0, 0)
+		// value options PARTIAL_JSON_UPDATES, partial bits of j1 and j2
+		body = append(body, 1, 0x02)
+		body = append(body, c.after...)
+		ev, err := parser.Parse(genTestEventData(replication.PARTIAL_UPDATE_ROWS_EVENT, body))
+		if err != nil {
+			t.Errorf("%s: fail to parse partial update rows event: %v", c.name, err)
+			continue
+		}
+		rows := ev.Event.(*replication.RowsEvent).Rows
+		if len(rows) != 2 || !reflect.DeepEqual(rows[0], []interface{}{int32(1), nil, nil}) {
+			t.Errorf("%s: rows are %v", c.name, rows)
+			continue
+		}
+		if !reflect.DeepEqual(rows[1], c.row) {
+			t.Errorf("%s: after image is %#v, expect %#v", c.name, rows[1], c.row)
+		}
+	}
+}
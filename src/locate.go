@@ -0,0 +1,297 @@
+package src
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/WangJiemin/jamintools/constvar"
+	"github.com/WangJiemin/jamintools/ehand"
+	"github.com/WangJiemin/jamintools/logging"
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+)
+
+var Locate_Header_Column_names []string = []string{"option", "datetime", "binlog", "startpos", "trxtime", "file"}
+
+// BinlogDatetimePos is the position of the first trx at or after a datetime
+type BinlogDatetimePos struct {
+	FileIdx   int            // index of the binlog file in files searched
+	Pos       mysql.Position // start position of the first event of the trx
+	Timestamp uint32         // timestamp of the first event of the trx
+	Found     bool           // false if all trxs are before the datetime, Pos is the end of the last binlog then
+}
+
+/*
+TrxGroupTracker tells event groups of binlog, that is, trxs and statements like ddl, by event types and BEGIN/COMMIT.
+A group starts at gtid event, or at BEGIN or the statement if there is no gtid event before it.
+*/
+type TrxGroupTracker struct {
+	ifGroupOpen bool // in event group of a trx or a statement
+	ifTrxOpen   bool // BEGIN is read, or gtid event of mariadb trx
+}
+
+/*
+IfTrxGroupEventNeedBody: bodies of these events are needed by TrxGroupTracker, others are decided by event type.
+Compressed query event of mariadb is parsed into QueryEvent, tracked the same as query event.
+*/
+func IfTrxGroupEventNeedBody(evType replication.EventType) bool {
+	return evType == replication.FORMAT_DESCRIPTION_EVENT || evType == replication.QUERY_EVENT ||
+		evType == replication.MARIADB_QUERY_COMPRESSED_EVENT || evType == replication.MARIADB_GTID_EVENT
+}
+
+// Track returns whether the event starts a group and whether it ends the group, e may be nil if IfTrxGroupEventNeedBody is false
+func (this *TrxGroupTracker) Track(evType replication.EventType, e replication.Event) (bool, bool) {
+	var ifGroupStart, ifGroupEnd bool
+	switch ev := e.(type) {
+	case *replication.MariadbGTIDEvent:
+		ifGroupStart, this.ifGroupOpen, this.ifTrxOpen = true, true, !ev.IsStandalone()
+	case *replication.QueryEvent:
+		ifGroupStart = !this.ifGroupOpen
+		this.ifGroupOpen = true
+		query := strings.ToUpper(strings.TrimSpace(string(ev.Query)))
+		if query == "BEGIN" || strings.HasPrefix(query, "XA START") {
+			this.ifTrxOpen = true
+		} else if query == "COMMIT" || query == "ROLLBACK" || !this.ifTrxOpen {
+			ifGroupEnd = true
+		}
+	default:
+		switch evType {
+		case replication.GTID_EVENT, replication.ANONYMOUS_GTID_EVENT:
+			ifGroupStart, this.ifGroupOpen, this.ifTrxOpen = true, true, false
+		case replication.XID_EVENT, replication.XA_PREPARE_LOG_EVENT, replication.TRANSACTION_PAYLOAD_EVENT:
+			ifGroupEnd = this.ifGroupOpen
+		}
+	}
+	if ifGroupEnd {
+		this.ifGroupOpen, this.ifTrxOpen = false, false
+	}
+	return ifGroupStart, ifGroupEnd
+}
+
+// binlogPeeker is implemented by readers returned by NextBinlog
+type binlogPeeker interface {
+	Peek(n int) ([]byte, error)
+}
+
+func NewBinFileParserForLocate() BinFileParser {
+	myParser := BinFileParser{Parser: replication.NewBinlogParser()}
+	myParser.Parser.SetTimestampStringLocation(GBinlogTimeLocation)
+	myParser.Parser.SetParseTime(false)
+	myParser.Parser.SetUseDecimal(false)
+	return myParser
+}
+
+/*
+ScanBinlogByDatetime finds the first trx at or after dt in one binlog file.
+Only events deciding trx boundaries are read and parsed, that is, format description, query(compressed too) and mariadb gtid events,
+others are skipped by event header, plain binlog file is seeked instead of read.
+*/
+func (this BinFileParser) ScanBinlogByDatetime(fileName string, dt uint32) (BinlogDatetimePos, error) {
+	result := BinlogDatetimePos{Pos: mysql.Position{Name: GetBinlogNameFromFileName(fileName), Pos: 4}}
+	binReader, err := OpenBinlogReader(fileName, "")
+	if err != nil {
+		return result, errors.Trace(err)
+	}
+	defer binReader.Close()
+	if binReader.FileType == C_binlogFileTypeTar {
+		return result, errors.Errorf("%s is tar archive, binlogs in it cannot be located by datetime", fileName)
+	}
+
+	_, r, err := binReader.NextBinlog()
+	if err != nil {
+		return result, errors.Annotatef(err, "fail to read binlog from %s", fileName)
+	}
+	peeker, ok := r.(binlogPeeker)
+	if !ok {
+		return result, errors.Errorf("reader of %s does not support peek", fileName)
+	}
+
+	var (
+		pos     uint32 = 4
+		tracker TrxGroupTracker
+	)
+	for {
+		head, err := peeker.Peek(replication.EventHeaderSize)
+		if err == io.EOF {
+			// truncated tail is left to parsing to report
+			result.Pos.Pos = pos
+			return result, nil
+		} else if err != nil {
+			return result, errors.Annotatef(err, "fail to read event header at %d of %s", pos, fileName)
+		}
+		evType := replication.EventType(head[4])
+		timestamp := binary.LittleEndian.Uint32(head)
+		size := binary.LittleEndian.Uint32(head[9:])
+		if size <= uint32(replication.EventHeaderSize) {
+			return result, errors.Errorf("invalid event header at %d of %s, event size is %d, too small", pos, fileName, size)
+		}
+
+		var e replication.Event
+		if IfTrxGroupEventNeedBody(evType) {
+			_, e, err = this.ReadBinEvent(r, result.Pos.Name)
+			if err != nil {
+				return result, errors.Annotatef(err, "fail to read event at %d of %s", pos, fileName)
+			}
+		} else if err = SkipBytes(r, int64(size)); err != nil {
+			return result, errors.Annotatef(err, "fail to skip event at %d of %s", pos, fileName)
+		}
+		ifGroupStart, _ := tracker.Track(evType, e)
+		if ifGroupStart && timestamp >= dt {
+			result.Pos.Pos = pos
+			result.Timestamp = timestamp
+			result.Found = true
+			return result, nil
+		}
+		pos += size
+	}
+}
+
+/*
+LocateBinlogPosByDatetime binary searches binlog files for the last one created not later than dt, like SearchMasterBinlogByDatetime,
+then scans it and binlogs after it by event headers for the first trx at or after dt.
+Binlog files must be in order, tar archive and stdin are not supported.
+*/
+func (this BinFileParser) LocateBinlogPosByDatetime(binFiles []string, dt uint32) (BinlogDatetimePos, error) {
+	low, high := 0, len(binFiles)-1
+	found := 0
+	for low <= high {
+		mid := (low + high) / 2
+		binInfo, err := ReadBinlogFileInfo(binFiles[mid])
+		if err != nil {
+			return BinlogDatetimePos{}, err
+		}
+		if binInfo.FileType == C_binlogFileTypeTar {
+			return BinlogDatetimePos{}, errors.Errorf("%s is tar archive, binlogs in it cannot be located by datetime", binFiles[mid])
+		}
+		GLogger.WriteToLogByFieldsNormalOnlyMsg(fmt.Sprintf("binlog %s is created at %s",
+			binFiles[mid], GetDatetimeStr(int64(binInfo.CreateTime), 0, constvar.DATETIME_FORMAT)), logging.DEBUG)
+		if binInfo.CreateTime <= dt {
+			found = mid
+			low = mid + 1
+		} else {
+			high = mid - 1
+		}
+	}
+
+	var result BinlogDatetimePos
+	for i := found; i < len(binFiles); i++ {
+		var err error
+		result, err = this.ScanBinlogByDatetime(binFiles[i], dt)
+		if err != nil {
+			return result, err
+		}
+		result.FileIdx = i
+		if result.Found {
+			break
+		}
+	}
+	return result, nil
+}
+
+/*
+ResolveFileStartPosByDatetime is the fast path of -sdt for -m=file. Instead of reading all events before -sdt and discarding them,
+parsing starts at the position of the first trx at or after -sdt, it falls back to parsing from the beginning if it cannot be located.
+*/
+func (this *ConfCmd) ResolveFileStartPosByDatetime() {
+	binFiles := this.BinlogFiles
+	if binFiles[0] == C_binlogFromStdin {
+		return
+	}
+	if !this.IfMultiBinlogFiles && !this.IfSetStopParsPoint {
+		// only the binlog given is parsed
+		binFiles = binFiles[:1]
+	}
+	result, err := NewBinFileParserForLocate().LocateBinlogPosByDatetime(binFiles, this.StartDatetime)
+	if err != nil {
+		GLogger.WriteToLogByFieldsErrorExtramsgExitCode(err, "fail to locate -sdt in binlogs, parse them from the beginning",
+			logging.WARNING, ehand.ERR_FILE_READ)
+		return
+	}
+	if result.Found {
+		GLogger.WriteToLogByFieldsNormalOnlyMsg(fmt.Sprintf("the first trx at or after -sdt starts at %s, at %s",
+			result.Pos.String(), GetDatetimeStr(int64(result.Timestamp), 0, constvar.DATETIME_FORMAT)), logging.INFO)
+	} else {
+		GLogger.WriteToLogByFieldsNormalOnlyMsg(fmt.Sprintf("all trxs are before -sdt, the last binlog ends at %s",
+			result.Pos.String()), logging.WARNING)
+	}
+	this.BinlogFiles = this.BinlogFiles[result.FileIdx:]
+	this.StartFile = result.Pos.Name
+	this.StartPos = uint(result.Pos.Pos)
+	this.StartFilePos = result.Pos
+	this.IfSetStartFilePos = true
+}
+
+/*
+SkipBinEventsBeforePos skips events of binlog by header until the event ending at or after stopPos, it returns the position reached.
+Table map events are not skipped, they are needed for rows events after stopPos in the same trx.
+Only readers supporting peek are skipped, others are read as before.
+*/
+func SkipBinEventsBeforePos(r io.Reader, pos uint32, stopPos uint32) (uint32, error) {
+	peeker, ok := r.(binlogPeeker)
+	if !ok {
+		return pos, nil
+	}
+	for {
+		head, err := peeker.Peek(replication.EventHeaderSize)
+		if err != nil {
+			// EOF or truncated header is reported by ReadBinEvent
+			return pos, nil
+		}
+		size := binary.LittleEndian.Uint32(head[9:])
+		if replication.EventType(head[4]) == replication.TABLE_MAP_EVENT || size <= uint32(replication.EventHeaderSize) ||
+			pos+size >= stopPos {
+			return pos, nil
+		}
+		if err = SkipBytes(r, int64(size)); err != nil {
+			return pos, err
+		}
+		pos += size
+	}
+}
+
+// LocateBinlogPosOfDatetimes is -w=locate, it prints the binlog position of the first trx at or after -sdt and -edt
+func LocateBinlogPosOfDatetimes(cfg *ConfCmd) {
+	myParser := NewBinFileParserForLocate()
+	lines := []string{GetLocatePrintHeaderLine(Locate_Header_Column_names)}
+	for _, opt := range []struct {
+		name  string
+		ifSet bool
+		dt    uint32
+	}{
+		{"-sdt", cfg.IfSetStartDateTime, cfg.StartDatetime},
+		{"-edt", cfg.IfSetStopDateTime, cfg.StopDatetime},
+	} {
+		if !opt.ifSet {
+			continue
+		}
+		result, err := myParser.LocateBinlogPosByDatetime(cfg.BinlogFiles, opt.dt)
+		if err != nil {
+			GLogger.WriteToLogByFieldsErrorExtramsgExit(err, "fail to locate "+opt.name, logging.ERROR, ehand.ERR_FILE_READ)
+		}
+		lines = append(lines, GetLocatePrintContentLine(opt.name, opt.dt, cfg.BinlogFiles[result.FileIdx], result))
+		if !result.Found {
+			GLogger.WriteToLogByFieldsNormalOnlyMsg(fmt.Sprintf("all trxs are before %s, the last binlog ends at %s",
+				opt.name, result.Pos.String()), logging.WARNING)
+		}
+	}
+	fmt.Print(strings.Join(lines, ""))
+}
+
+func GetLocatePrintHeaderLine(headers []string) string {
+	//[option, datetime, binlog, startpos, trxtime, file]
+	return fmt.Sprintf("%-6s %-19s %-17s %-10s %-19s %s\n", ConvertStrArrToIntferfaceArrForPrint(headers)...)
+}
+
+// GetLocatePrintContentLine prints "-" as trxtime if all trxs are before the datetime, startpos is the end of the last binlog then
+func GetLocatePrintContentLine(opt string, dt uint32, fileName string, result BinlogDatetimePos) string {
+	//[option, datetime, binlog, startpos, trxtime, file]
+	trxTime := "-"
+	if result.Found {
+		trxTime = GetDatetimeStr(int64(result.Timestamp), 0, constvar.DATETIME_FORMAT_NOSPACE)
+	}
+	return fmt.Sprintf("%-6s %-19s %-17s %-10d %-19s %s\n", opt, GetDatetimeStr(int64(dt), 0, constvar.DATETIME_FORMAT_NOSPACE),
+		result.Pos.Name, result.Pos.Pos, trxTime, fileName)
+}
@@ -0,0 +1,43 @@
+package src
+
+import (
+	"testing"
+
+	"github.com/siddontang/go-mysql/replication"
+)
+
+func TestTrxGroupTracker(t *testing.T) {
+	for _, evType := range []replication.EventType{replication.QUERY_EVENT, replication.MARIADB_QUERY_COMPRESSED_EVENT, replication.MARIADB_GTID_EVENT} {
+		if !IfTrxGroupEventNeedBody(evType) {
+			t.Errorf("body of %s is not needed by TrxGroupTracker", evType)
+		}
+	}
+
+	query := func(sql string) *replication.QueryEvent {
+		return &replication.QueryEvent{Query: []byte(sql)}
+	}
+	// mariadb without gtid events, compressed query events are parsed into query events too
+	events := []struct {
+		evType replication.EventType
+		e      replication.Event
+		start  bool
+		end    bool
+	}{
+		{replication.MARIADB_QUERY_COMPRESSED_EVENT, query("BEGIN"), true, false},
+		{replication.TABLE_MAP_EVENT, nil, false, false},
+		{replication.WRITE_ROWS_EVENTv1, nil, false, false},
+		{replication.MARIADB_QUERY_COMPRESSED_EVENT, query("insert into t values(1)"), false, false},
+		{replication.XID_EVENT, nil, false, true},
+		{replication.MARIADB_QUERY_COMPRESSED_EVENT, query("create table t2(id int)"), true, true},
+		{replication.QUERY_EVENT, query("BEGIN"), true, false},
+		{replication.QUERY_EVENT, query("COMMIT"), false, true},
+		{replication.GTID_EVENT, nil, true, false},
+		{replication.QUERY_EVENT, query("drop table t2"), false, true},
+	}
+	var tracker TrxGroupTracker
+	for i, ev := range events {
+		if start, end := tracker.Track(ev.evType, ev.e); start != ev.start || end != ev.end {
+			t.Errorf("event %d %s: group start %v end %v, expect start %v end %v", i, ev.evType, start, end, ev.start, ev.end)
+		}
+	}
+}
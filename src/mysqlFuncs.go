@@ -39,8 +39,11 @@ type DdlPosInfo struct {
 //type FieldInfo map[string]string //{"name":"col1", "type":"int"}
 
 type FieldInfo struct {
-	FieldName string `json:"column_name"`
-	FieldType string `json:"column_type"`
+	FieldName  string   `json:"column_name"`
+	FieldType  string   `json:"column_type"`
+	Unsigned   bool     `json:"unsigned,omitempty"`
+	EnumValues []string `json:"enum_values,omitempty"` // values of enum/set column
+	Generated  bool     `json:"generated,omitempty"`   // virtual or stored generated column, not inserted nor updated
 }
 
 type KeyInfo []string //{colname1, colname2}
@@ -88,12 +91,12 @@ var (
 	`
 
 	columnNamesTypesSqlBatch string = `
-		select table_schema, table_name, COLUMN_NAME, DATA_TYPE, ORDINAL_POSITION from information_schema.columns
+		select table_schema, table_name, COLUMN_NAME, DATA_TYPE, COLUMN_TYPE, ORDINAL_POSITION from information_schema.columns
 		where table_schema in (%s) and table_name in (%s)
 		order by table_schema asc, table_name asc, ORDINAL_POSITION asc
 	`
 	columnNamesTypesSqlBatchSameDb string = `
-		select table_schema, table_name, COLUMN_NAME, DATA_TYPE, ORDINAL_POSITION from information_schema.columns
+		select table_schema, table_name, COLUMN_NAME, DATA_TYPE, COLUMN_TYPE, ORDINAL_POSITION from information_schema.columns
 		where table_schema ='%s' and table_name in (%s)
 		order by table_schema asc, table_name asc, ORDINAL_POSITION asc
 	`
@@ -110,8 +113,8 @@ func GetMysqlUrl(cfg *ConfCmd) string {
 		//	"%s:%s@tcp(%s:%d)/?autocommit=true&charset=utf8mb4,utf8&loc=Local&parseTime=true&writeTimeout=30s&readTimeout=60s&timeout=10s",
 		//	cfg.User, cfg.Passwd, cfg.Host, cfg.Port)
 		urlStr = fmt.Sprintf(
-			"%s:%s@tcp(%s:%d)/?autocommit=true&charset=utf8mb4,utf8,latin1&loc=Local&parseTime=true",
-			cfg.User, cfg.Passwd, cfg.Host, cfg.Port)
+			"%s:%s@tcp(%s:%d)/?autocommit=true&charset=utf8mb4,utf8,latin1&loc=Local&parseTime=true%s",
+			cfg.User, cfg.Passwd, cfg.Host, cfg.Port, GetMysqlUrlTLSParam(cfg))
 
 	} else {
 		//urlStr = fmt.Sprintf(
@@ -169,11 +172,11 @@ func (this TablesColumnsInfo) GetTableInfoJsonOfBinPos(schema string, table stri
 			continue
 		}
 		ddlPos := mysql.Position{Name: oneTbJson.DdlInfo.Binlog, Pos: oneTbJson.DdlInfo.StartPos}
-		if myPos.Compare(ddlPos) < 1 {
+		if CompareBinlogPosition(myPos, ddlPos) < 1 {
 			if nearestKey == "" {
 				nearestKey = k
 			} else {
-				cmpResult = ddlPos.Compare(mysql.Position{Name: tbDefsArr[nearestKey].DdlInfo.Binlog,
+				cmpResult = CompareBinlogPosition(ddlPos, mysql.Position{Name: tbDefsArr[nearestKey].DdlInfo.Binlog,
 					Pos: tbDefsArr[nearestKey].DdlInfo.StartPos})
 				if cmpResult == -1 {
 					nearestKey = k
@@ -253,6 +256,7 @@ func (this *TablesColumnsInfo) GetAllTableFieldsFromDb(db *sql.DB, dbTbs map[str
 		tbName         string
 		colName        string
 		dataType       string
+		columnType     string // with unsigned, DATA_TYPE is without it
 		colPos         int
 		ok             bool
 		querySqls      []string
@@ -272,7 +276,7 @@ func (this *TablesColumnsInfo) GetAllTableFieldsFromDb(db *sql.DB, dbTbs map[str
 		}
 
 		for rows.Next() {
-			err := rows.Scan(&dbName, &tbName, &colName, &dataType, &colPos)
+			err := rows.Scan(&dbName, &tbName, &colName, &dataType, &columnType, &colPos)
 
 			if err != nil {
 				GLogger.WriteToLogByFieldsErrorExtramsgExitCode(err, "error to get query result: "+oneQuery, logging.ERROR, ehand.ERR_MYSQL_QUERY)
@@ -287,7 +291,8 @@ func (this *TablesColumnsInfo) GetAllTableFieldsFromDb(db *sql.DB, dbTbs map[str
 			if !ok {
 				dbTbFieldsInfo[dbName][tbName] = []FieldInfo{}
 			}
-			dbTbFieldsInfo[dbName][tbName] = append(dbTbFieldsInfo[dbName][tbName], FieldInfo{FieldName: colName, FieldType: dataType})
+			dbTbFieldsInfo[dbName][tbName] = append(dbTbFieldsInfo[dbName][tbName], FieldInfo{FieldName: colName, FieldType: dataType,
+				Unsigned: strings.Contains(strings.ToLower(columnType), "unsigned")})
 
 		}
 		rows.Close()
@@ -0,0 +1,158 @@
+package src
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/WangJiemin/jamintools/ehand"
+	"github.com/WangJiemin/jamintools/logging"
+	gomysql "github.com/go-sql-driver/mysql"
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql/client"
+)
+
+// --ssl-mode, the same as mysql client
+const (
+	C_sslModeDisabled       = "DISABLED"
+	C_sslModePreferred      = "PREFERRED"
+	C_sslModeRequired       = "REQUIRED"
+	C_sslModeVerifyCa       = "VERIFY_CA"
+	C_sslModeVerifyIdentity = "VERIFY_IDENTITY"
+
+	cTLSConfigName = "my2fback" // registered into mysql driver for the schema connection
+)
+
+var GOptsValidSslMode []string = []string{C_sslModeDisabled, C_sslModePreferred, C_sslModeRequired, C_sslModeVerifyCa, C_sslModeVerifyIdentity}
+
+/*
+NewMysqlTLSConfig builds tls config by --ssl-mode, --ssl-ca, --ssl-cert, --ssl-key and --ssl-server-name, nil for DISABLED.
+REQUIRED and PREFERRED encrypt the connection without verifying certificate of server,
+VERIFY_CA verifies certificate of server is signed by --ssl-ca(or system CAs), VERIFY_IDENTITY also verifies host name in it.
+*/
+func NewMysqlTLSConfig(cfg *ConfCmd) (*tls.Config, error) {
+	if cfg.SslMode == C_sslModeDisabled {
+		return nil, nil
+	}
+	tlsCfg := &tls.Config{}
+
+	if cfg.SslCa != "" {
+		pem, err := ioutil.ReadFile(cfg.SslCa)
+		if err != nil {
+			return nil, errors.Annotatef(err, "fail to read --ssl-ca %s", cfg.SslCa)
+		}
+		tlsCfg.RootCAs = x509.NewCertPool()
+		if !tlsCfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no valid certificate found in --ssl-ca %s", cfg.SslCa)
+		}
+	}
+	if cfg.SslCert != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.SslCert, cfg.SslKey)
+		if err != nil {
+			return nil, errors.Annotatef(err, "fail to load --ssl-cert %s and --ssl-key %s", cfg.SslCert, cfg.SslKey)
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+
+	switch cfg.SslMode {
+	case C_sslModePreferred, C_sslModeRequired:
+		tlsCfg.InsecureSkipVerify = true
+	case C_sslModeVerifyCa:
+		// host name is not verified, so verify the certificate chain by ourselves
+		tlsCfg.InsecureSkipVerify = true
+		rootCAs := tlsCfg.RootCAs
+		tlsCfg.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return VerifyServerCertChain(rawCerts, rootCAs)
+		}
+	case C_sslModeVerifyIdentity:
+		tlsCfg.ServerName = cfg.SslServerName
+		if tlsCfg.ServerName == "" {
+			tlsCfg.ServerName = cfg.Host
+		}
+	}
+	return tlsCfg, nil
+}
+
+// VerifyServerCertChain verifies certificate chain sent by server against rootCAs, system CAs are used if rootCAs is nil
+func VerifyServerCertChain(rawCerts [][]byte, rootCAs *x509.CertPool) error {
+	if len(rawCerts) == 0 {
+		return errors.New("server sends no certificate")
+	}
+	certs := make([]*x509.Certificate, 0, len(rawCerts))
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return errors.Annotate(err, "fail to parse certificate of server")
+		}
+		certs = append(certs, cert)
+	}
+	opts := x509.VerifyOptions{Roots: rootCAs, Intermediates: x509.NewCertPool()}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(opts)
+	return errors.Annotate(err, "fail to verify certificate of server")
+}
+
+/*
+IfServerSupportTLS connects to mysql to check if it supports TLS, for --ssl-mode=PREFERRED,
+since the replication client and registered tls config of mysql driver fail if TLS is required by client but not supported by server.
+*/
+func IfServerSupportTLS(cfg *ConfCmd) (bool, error) {
+	conn, err := client.Connect(fmt.Sprintf("%s:%d", cfg.Host, cfg.Port), cfg.User, cfg.Passwd, "", func(c *client.Conn) {
+		c.SetTLSConfig(cfg.TLSConfig)
+	})
+	if err == nil {
+		conn.Close()
+		return true, nil
+	}
+	if strings.Contains(err.Error(), "does not support TLS") {
+		return false, nil
+	}
+	return false, errors.Trace(err)
+}
+
+/*
+SetupMysqlTLS builds tls config from options, registers it for the schema connection,
+and decides the tls config of replication. No TLS over unix socket, like mysql client.
+*/
+func (this *ConfCmd) SetupMysqlTLS() {
+	if this.SslMode == C_sslModeDisabled || this.Socket != "" {
+		return
+	}
+	var err error
+	this.TLSConfig, err = NewMysqlTLSConfig(this)
+	if err != nil {
+		GLogger.WriteToLogByFieldsErrorExtramsgExit(err, "invalid ssl options", logging.ERROR, ehand.ERR_INVALID_OPTION)
+	}
+
+	// tls=preferred of mysql driver falls back to plain connection, but without --ssl-cert/--ssl-key, so ask mysql by ourselves
+	if this.SslMode == C_sslModePreferred && this.IfNeedMysqlConnection() {
+		ok, err := IfServerSupportTLS(this)
+		if err != nil {
+			GLogger.WriteToLogByFieldsErrorExtramsgExit(err, fmt.Sprintf("fail to connect to mysql %s:%d", this.Host, this.Port),
+				logging.ERROR, ehand.ERR_MYSQL_CONNECTION)
+		}
+		if !ok {
+			GLogger.WriteToLogByFieldsNormalOnlyMsg("mysql does not support TLS, connect without TLS", logging.WARNING)
+			this.TLSConfig = nil
+		}
+	}
+	this.ReplTLSConfig = this.TLSConfig
+	if this.TLSConfig == nil {
+		return
+	}
+	if err = gomysql.RegisterTLSConfig(cTLSConfigName, this.TLSConfig); err != nil {
+		GLogger.WriteToLogByFieldsErrorExtramsgExit(err, "fail to register tls config", logging.ERROR, ehand.ERR_INVALID_OPTION)
+	}
+}
+
+// GetMysqlUrlTLSParam is the tls param of mysql dsn
+func GetMysqlUrlTLSParam(cfg *ConfCmd) string {
+	if cfg.TLSConfig == nil {
+		return ""
+	}
+	return "&tls=" + cTLSConfigName
+}
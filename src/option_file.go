@@ -0,0 +1,408 @@
+package src
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/WangJiemin/jamintools/ehand"
+	"github.com/WangJiemin/jamintools/logging"
+	"github.com/juju/errors"
+	"github.com/toolkits/file"
+)
+
+const (
+	cLoginFileUnusedLen = 4  // .mylogin.cnf starts with 4 unused bytes
+	cLoginFileKeyLen    = 20 // then the key to encrypt lines
+	cLoginFileEnv       = "MYSQL_TEST_LOGIN_FILE"
+)
+
+var (
+	// option files read in order when --defaults-file is not set, the latter overrides the former, like mysql client
+	GDefaultOptionFiles []string = []string{"/etc/my.cnf", "/etc/mysql/my.cnf", "~/.my.cnf"}
+	// sections of option files to read
+	GOptionFileGroups []string = []string{"client", "my2fback"}
+)
+
+// MysqlOptions is options of my.cnf-style option file, group => option => value. "-" and "_" in option names are the same, stored as "-"
+type MysqlOptions map[string]map[string]string
+
+func (this MysqlOptions) Merge(other MysqlOptions) {
+	for group, opts := range other {
+		if _, ok := this[group]; !ok {
+			this[group] = map[string]string{}
+		}
+		for k, v := range opts {
+			this[group][k] = v
+		}
+	}
+}
+
+// GetOptionsOfGroups returns options of groups, options of the latter group override the former
+func (this MysqlOptions) GetOptionsOfGroups(groups ...string) map[string]string {
+	opts := map[string]string{}
+	for _, group := range groups {
+		for k, v := range this[group] {
+			opts[k] = v
+		}
+	}
+	return opts
+}
+
+func ExpandHomeDir(fileName string) string {
+	if !strings.HasPrefix(fileName, "~/") {
+		return fileName
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return fileName
+	}
+	return filepath.Join(home, fileName[2:])
+}
+
+// UnquoteOptionValue strips quotes and trailing comment of option value, escapes in quoted value are interpreted like mysql
+func UnquoteOptionValue(value string) string {
+	value = strings.TrimSpace(value)
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') {
+		quote := value[0]
+		var buf bytes.Buffer
+		for i := 1; i < len(value); i++ {
+			c := value[i]
+			if c == quote {
+				return buf.String()
+			}
+			if c == '\\' && i+1 < len(value) {
+				i++
+				switch value[i] {
+				case 'n':
+					c = '\n'
+				case 't':
+					c = '\t'
+				case 'r':
+					c = '\r'
+				case 'b':
+					c = '\b'
+				case 's':
+					c = ' '
+				default:
+					c = value[i]
+				}
+			}
+			buf.WriteByte(c)
+		}
+		return buf.String()
+	}
+	if idx := strings.Index(value, " #"); idx >= 0 {
+		value = strings.TrimSpace(value[:idx])
+	}
+	return value
+}
+
+/*
+ParseMysqlOptions parses content of option file. !include and !includedir are followed, files in dir of !includedir
+are read only if they end with .cnf, like mysql.
+*/
+func ParseMysqlOptions(r io.Reader, fileName string) (MysqlOptions, error) {
+	var (
+		options MysqlOptions = MysqlOptions{}
+		group   string
+		lineNum int
+	)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if strings.HasPrefix(line, "!include") {
+			var (
+				included MysqlOptions
+				err      error
+			)
+			if strings.HasPrefix(line, "!includedir") {
+				included, err = ReadMysqlOptionDir(strings.TrimSpace(line[len("!includedir"):]))
+			} else {
+				included, err = ReadMysqlOptionFile(strings.TrimSpace(line[len("!include"):]))
+			}
+			if err != nil {
+				return nil, errors.Annotatef(err, "%s line %d", fileName, lineNum)
+			}
+			options.Merge(included)
+			continue
+		}
+		if line[0] == '[' {
+			if line[len(line)-1] != ']' {
+				return nil, errors.Errorf("%s line %d: invalid group %s", fileName, lineNum, line)
+			}
+			group = strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+			if _, ok := options[group]; !ok {
+				options[group] = map[string]string{}
+			}
+			continue
+		}
+		if group == "" {
+			return nil, errors.Errorf("%s line %d: option without preceding group", fileName, lineNum)
+		}
+		var key, value string
+		if idx := strings.Index(line, "="); idx >= 0 {
+			key = line[:idx]
+			value = UnquoteOptionValue(line[idx+1:])
+		} else {
+			key = line
+		}
+		key = strings.Replace(strings.ToLower(strings.TrimSpace(key)), "_", "-", -1)
+		options[group][key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Annotatef(err, "fail to read %s", fileName)
+	}
+	return options, nil
+}
+
+func ReadMysqlOptionFile(fileName string) (MysqlOptions, error) {
+	fh, err := os.Open(fileName)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer fh.Close()
+	return ParseMysqlOptions(fh, fileName)
+}
+
+func ReadMysqlOptionDir(dir string) (MysqlOptions, error) {
+	fileNames, err := filepath.Glob(filepath.Join(dir, "*.cnf"))
+	if err != nil {
+		return nil, errors.Annotatef(err, "fail to read dir %s", dir)
+	}
+	options := MysqlOptions{}
+	for _, fileName := range fileNames {
+		one, err := ReadMysqlOptionFile(fileName)
+		if err != nil {
+			return nil, err
+		}
+		options.Merge(one)
+	}
+	return options, nil
+}
+
+/*
+DecryptMysqlLoginFile decrypts .mylogin.cnf written by mysql_config_editor. After 4 unused bytes and 20 bytes key,
+each line is encrypted by AES-128-ECB with key folded from the 20 bytes key, and stored as 4 bytes length plus cipher text.
+*/
+func DecryptMysqlLoginFile(data []byte) ([]byte, error) {
+	if len(data) < cLoginFileUnusedLen+cLoginFileKeyLen {
+		return nil, errors.New("file is too short")
+	}
+	key := make([]byte, aes.BlockSize)
+	for i, b := range data[cLoginFileUnusedLen : cLoginFileUnusedLen+cLoginFileKeyLen] {
+		key[i%aes.BlockSize] ^= b
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var plain bytes.Buffer
+	data = data[cLoginFileUnusedLen+cLoginFileKeyLen:]
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return nil, errors.New("truncated length of line")
+		}
+		cipherLen := int(binary.LittleEndian.Uint32(data))
+		data = data[4:]
+		if cipherLen > len(data) || cipherLen == 0 || cipherLen%aes.BlockSize != 0 {
+			return nil, errors.Errorf("invalid length %d of line", cipherLen)
+		}
+		line := make([]byte, cipherLen)
+		for i := 0; i < cipherLen; i += aes.BlockSize {
+			block.Decrypt(line[i:i+aes.BlockSize], data[i:i+aes.BlockSize])
+		}
+		data = data[cipherLen:]
+		// pkcs padding
+		padLen := int(line[cipherLen-1])
+		if padLen == 0 || padLen > aes.BlockSize {
+			return nil, errors.New("invalid padding of line, wrong key")
+		}
+		plain.Write(line[:cipherLen-padLen])
+	}
+	return plain.Bytes(), nil
+}
+
+func ReadMysqlLoginFile(fileName string) (MysqlOptions, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	plain, err := DecryptMysqlLoginFile(data)
+	if err != nil {
+		return nil, errors.Annotatef(err, "fail to decrypt %s", fileName)
+	}
+	return ParseMysqlOptions(bytes.NewReader(plain), fileName)
+}
+
+func GetMysqlLoginFileName() string {
+	if fileName := os.Getenv(cLoginFileEnv); fileName != "" {
+		return fileName
+	}
+	return ExpandHomeDir("~/.mylogin.cnf")
+}
+
+// ReadPasswordFromTerminal prompts for password on terminal without echo, stdin may be binlog so /dev/tty is used
+func ReadPasswordFromTerminal(prompt string) (string, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return "", errors.Annotate(err, "no terminal to prompt for password")
+	}
+	defer tty.Close()
+
+	fmt.Fprint(tty, prompt)
+	if err = SetTerminalEcho(tty, false); err != nil {
+		return "", err
+	}
+	defer func() {
+		SetTerminalEcho(tty, true)
+		fmt.Fprintln(tty)
+	}()
+	line, err := bufio.NewReader(tty).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", errors.Annotate(err, "fail to read password")
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func SetTerminalEcho(tty *os.File, on bool) error {
+	arg := "-echo"
+	if on {
+		arg = "echo"
+	}
+	cmd := exec.Command("stty", arg)
+	cmd.Stdin = tty
+	return errors.Annotate(cmd.Run(), "fail to set echo of terminal")
+}
+
+// GetFlagsSetOnCmdLine returns names of flags given on command line, which options from option files cannot override
+func GetFlagsSetOnCmdLine() map[string]bool {
+	flagsSet := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		flagsSet[f.Name] = true
+	})
+	return flagsSet
+}
+
+/*
+LoadMysqlOptionFiles reads options to connect to mysql from option files and login path, in the same order as mysql client:
+default option files(or --defaults-file only), --defaults-extra-file, then .mylogin.cnf([client] and --login-path).
+Options given on command line take precedence. Password is read from --password-env if still not set,
+and prompted on terminal if --password-prompt and mysql is to be connected.
+*/
+func (this *ConfCmd) LoadMysqlOptionFiles() {
+	flagsSet := GetFlagsSetOnCmdLine()
+	options := MysqlOptions{}
+
+	if !this.NoDefaults {
+		var optFiles []string
+		if this.DefaultsFile != "" {
+			if !file.IsFile(this.DefaultsFile) {
+				GLogger.WriteToLogByFieldsExitMsgNoErr(fmt.Sprintf("--defaults-file %s not exists nor a file", this.DefaultsFile),
+					logging.ERROR, ehand.ERR_FILE_NOT_EXISTS)
+			}
+			optFiles = []string{this.DefaultsFile}
+		} else {
+			for _, fileName := range GDefaultOptionFiles {
+				if fileName = ExpandHomeDir(fileName); file.IsFile(fileName) {
+					optFiles = append(optFiles, fileName)
+				}
+			}
+		}
+		if this.DefaultsExtraFile != "" {
+			if !file.IsFile(this.DefaultsExtraFile) {
+				GLogger.WriteToLogByFieldsExitMsgNoErr(fmt.Sprintf("--defaults-extra-file %s not exists nor a file", this.DefaultsExtraFile),
+					logging.ERROR, ehand.ERR_FILE_NOT_EXISTS)
+			}
+			optFiles = append(optFiles, this.DefaultsExtraFile)
+		}
+		for _, fileName := range optFiles {
+			one, err := ReadMysqlOptionFile(fileName)
+			if err != nil {
+				GLogger.WriteToLogByFieldsErrorExtramsgExit(err, "fail to read option file "+fileName, logging.ERROR, ehand.ERR_FILE_READ)
+			}
+			options.Merge(one)
+			GLogger.WriteToLogByFieldsNormalOnlyMsg("read options from "+fileName, logging.DEBUG)
+		}
+	}
+	opts := options.GetOptionsOfGroups(GOptionFileGroups...)
+
+	loginFile := GetMysqlLoginFileName()
+	if file.IsFile(loginFile) && (!this.NoDefaults || this.LoginPath != "") {
+		loginOptions, err := ReadMysqlLoginFile(loginFile)
+		if err != nil {
+			GLogger.WriteToLogByFieldsErrorExtramsgExit(err, "fail to read login path file "+loginFile, logging.ERROR, ehand.ERR_FILE_READ)
+		}
+		if this.LoginPath != "" {
+			// group names are case insensitive
+			loginPath := strings.ToLower(this.LoginPath)
+			if _, ok := loginOptions[loginPath]; !ok {
+				GLogger.WriteToLogByFieldsExitMsgNoErr(fmt.Sprintf("login path %s not found in %s", this.LoginPath, loginFile),
+					logging.ERROR, ehand.ERR_INVALID_OPTION)
+			}
+			for k, v := range loginOptions.GetOptionsOfGroups("client", loginPath) {
+				opts[k] = v
+			}
+		} else {
+			for k, v := range loginOptions.GetOptionsOfGroups("client") {
+				opts[k] = v
+			}
+		}
+	} else if this.LoginPath != "" {
+		GLogger.WriteToLogByFieldsExitMsgNoErr(fmt.Sprintf("--login-path is specified, but %s not exists", loginFile),
+			logging.ERROR, ehand.ERR_FILE_NOT_EXISTS)
+	}
+
+	// option in option file => flag
+	strOpts := map[string]*string{"H": &this.Host, "u": &this.User, "p": &this.Passwd, "S": &this.Socket,
+		"ssl-mode": &this.SslMode, "ssl-ca": &this.SslCa, "ssl-cert": &this.SslCert, "ssl-key": &this.SslKey}
+	for optName, flagName := range map[string]string{"host": "H", "user": "u", "password": "p", "socket": "S",
+		"ssl-mode": "ssl-mode", "ssl-ca": "ssl-ca", "ssl-cert": "ssl-cert", "ssl-key": "ssl-key"} {
+		if v, ok := opts[optName]; ok && !flagsSet[flagName] {
+			*strOpts[flagName] = v
+		}
+	}
+	if v, ok := opts["port"]; ok && !flagsSet["P"] {
+		port, err := strconv.ParseUint(v, 10, 16)
+		if err != nil {
+			GLogger.WriteToLogByFieldsErrorExtramsgExit(err, "invalid port in option file: "+v, logging.ERROR, ehand.ERR_INVALID_OPTION)
+		}
+		this.Port = uint(port)
+	}
+	// socket is only used to connect to localhost or when host is not given, like mysql client, default of -H is not regarded as given
+	_, ifHostGiven := opts["host"]
+	ifHostGiven = ifHostGiven || flagsSet["H"]
+	if _, ok := opts["socket"]; ok && !flagsSet["S"] && ifHostGiven && this.Host != "localhost" {
+		this.Socket = ""
+	}
+
+	if this.PasswordPrompt && flagsSet["p"] {
+		GLogger.WriteToLogByFieldsExitMsgNoErr("-p and --password-prompt cannot be specified together", logging.ERROR, ehand.ERR_OPTION_MISMATCH)
+	}
+	if this.Passwd == "" && this.PasswordEnv != "" {
+		this.Passwd = os.Getenv(this.PasswordEnv)
+	}
+	// no prompt for -check-config or when mysql is not connected at all, such as -w=stats of binlog files
+	if this.PasswordPrompt && !this.CheckConfigOnly && this.IfNeedMysqlConnection() {
+		passwd, err := ReadPasswordFromTerminal("Enter password: ")
+		if err != nil {
+			GLogger.WriteToLogByFieldsErrorExtramsgExit(err, "fail to prompt for password", logging.ERROR, ehand.ERR_INVALID_OPTION)
+		}
+		this.Passwd = passwd
+	}
+}
@@ -0,0 +1,192 @@
+package src
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// encryptMysqlLoginFile is what mysql_config_editor does, the reverse of DecryptMysqlLoginFile
+func encryptMysqlLoginFile(t *testing.T, rawKey []byte, lines []string) []byte {
+	key := make([]byte, aes.BlockSize)
+	for i, b := range rawKey {
+		key[i%aes.BlockSize] ^= b
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatalf("fail to create cipher: %v", err)
+	}
+	var buf bytes.Buffer
+	buf.Write(make([]byte, cLoginFileUnusedLen))
+	buf.Write(rawKey)
+	for _, line := range lines {
+		padLen := aes.BlockSize - len(line)%aes.BlockSize
+		plain := append([]byte(line), bytes.Repeat([]byte{byte(padLen)}, padLen)...)
+		cipherText := make([]byte, len(plain))
+		for i := 0; i < len(plain); i += aes.BlockSize {
+			block.Encrypt(cipherText[i:i+aes.BlockSize], plain[i:i+aes.BlockSize])
+		}
+		lenBuf := make([]byte, 4)
+		binary.LittleEndian.PutUint32(lenBuf, uint32(len(cipherText)))
+		buf.Write(lenBuf)
+		buf.Write(cipherText)
+	}
+	return buf.Bytes()
+}
+
+func TestDecryptMysqlLoginFile(t *testing.T) {
+	rawKey := []byte("0123456789abcdefghij")
+	lines := []string{"[client]\n", "user = \"root\"\n", "password = \"pass word with 16\"\n", "[backup]\n", "host = \"10.0.0.1\"\n"}
+	data := encryptMysqlLoginFile(t, rawKey, lines)
+
+	plain, err := DecryptMysqlLoginFile(data)
+	if err != nil {
+		t.Fatalf("fail to decrypt: %v", err)
+	}
+	if string(plain) != strings.Join(lines, "") {
+		t.Fatalf("decrypted content is %q, expect %q", plain, strings.Join(lines, ""))
+	}
+
+	opts, err := ParseMysqlOptions(bytes.NewReader(plain), ".mylogin.cnf")
+	if err != nil {
+		t.Fatalf("fail to parse decrypted content: %v", err)
+	}
+	expected := MysqlOptions{
+		"client": {"user": "root", "password": "pass word with 16"},
+		"backup": {"host": "10.0.0.1"},
+	}
+	if !reflect.DeepEqual(opts, expected) {
+		t.Errorf("options are %v, expect %v", opts, expected)
+	}
+
+	errCases := []struct {
+		name string
+		data []byte
+	}{
+		{"too short", data[:cLoginFileUnusedLen+cLoginFileKeyLen-1]},
+		{"truncated length", data[:cLoginFileUnusedLen+cLoginFileKeyLen+2]},
+		{"truncated line", data[:len(data)-1]},
+		{"wrong key", append(append([]byte{}, data[:cLoginFileUnusedLen]...), append([]byte("jihgfedcba9876543210"), data[cLoginFileUnusedLen+cLoginFileKeyLen:]...)...)},
+	}
+	for _, c := range errCases {
+		if _, err := DecryptMysqlLoginFile(c.data); err == nil {
+			t.Errorf("%s: no error to decrypt invalid login file", c.name)
+		}
+	}
+}
+
+func TestUnquoteOptionValue(t *testing.T) {
+	cases := []struct {
+		value    string
+		expected string
+	}{
+		{" root ", "root"},
+		{"root # comment", "root"},
+		{"pass#word", "pass#word"},
+		{`"pass # word"`, "pass # word"},
+		{`'it\'s'`, "it's"},
+		{`"a\tb\nc\\d\se"`, "a\tb\nc\\d e"},
+		{`"unterminated`, "unterminated"},
+	}
+	for _, c := range cases {
+		if value := UnquoteOptionValue(c.value); value != c.expected {
+			t.Errorf("UnquoteOptionValue(%q) = %q, expect %q", c.value, value, c.expected)
+		}
+	}
+}
+
+func TestParseMysqlOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "my2fback_opt")
+	if err != nil {
+		t.Fatalf("fail to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	includedDir := filepath.Join(dir, "conf.d")
+	if err = os.Mkdir(includedDir, 0755); err != nil {
+		t.Fatalf("fail to create %s: %v", includedDir, err)
+	}
+	files := map[string]string{
+		filepath.Join(dir, "extra.cnf"):         "[client]\nport=3307\n",
+		filepath.Join(includedDir, "a.cnf"):     "[my2fback]\nssl_mode=REQUIRED\n",
+		filepath.Join(includedDir, "b.cnf.bak"): "[my2fback]\nssl_mode=DISABLED\n",
+	}
+	for fileName, content := range files {
+		if err = ioutil.WriteFile(fileName, []byte(content), 0644); err != nil {
+			t.Fatalf("fail to write %s: %v", fileName, err)
+		}
+	}
+
+	content := strings.Join([]string{
+		"# comment",
+		"; comment too",
+		"[Client]",
+		"user = root",
+		"password = \"p#ss\" # comment",
+		"socket_file=/tmp/mysql.sock",
+		"skip-ssl",
+		"!include " + filepath.Join(dir, "extra.cnf"),
+		"[mysqld]",
+		"port=3306",
+		"!includedir " + includedDir,
+	}, "\n")
+	opts, err := ParseMysqlOptions(strings.NewReader(content), "my.cnf")
+	if err != nil {
+		t.Fatalf("fail to parse options: %v", err)
+	}
+	expected := MysqlOptions{
+		"client":   {"user": "root", "password": "p#ss", "socket-file": "/tmp/mysql.sock", "skip-ssl": "", "port": "3307"},
+		"mysqld":   {"port": "3306"},
+		"my2fback": {"ssl-mode": "REQUIRED"},
+	}
+	if !reflect.DeepEqual(opts, expected) {
+		t.Errorf("options are %v, expect %v", opts, expected)
+	}
+	groupOpts := opts.GetOptionsOfGroups("client", "my2fback")
+	if groupOpts["port"] != "3307" || groupOpts["ssl-mode"] != "REQUIRED" || groupOpts["user"] != "root" {
+		t.Errorf("options of groups client and my2fback are %v", groupOpts)
+	}
+
+	for _, invalid := range []string{"user=root", "[client\nuser=root", "[client]\n!include " + filepath.Join(dir, "nosuch.cnf")} {
+		if _, err := ParseMysqlOptions(strings.NewReader(invalid), "my.cnf"); err == nil {
+			t.Errorf("no error to parse invalid option file %q", invalid)
+		}
+	}
+}
+
+func TestIfPasswordSupplied(t *testing.T) {
+	const envName string = "MY2FBACK_TEST_PWD"
+	os.Unsetenv(envName)
+	cases := []struct {
+		name     string
+		cfg      ConfCmd
+		expected bool
+	}{
+		{"-p", ConfCmd{Passwd: "secret", PasswordEnv: envName}, true},
+		{"--password-prompt", ConfCmd{PasswordPrompt: true, PasswordEnv: envName}, true},
+		{"--login-path", ConfCmd{LoginPath: "client", PasswordEnv: envName}, true},
+		{"--password-env not set", ConfCmd{PasswordEnv: envName}, false},
+		{"no --password-env", ConfCmd{}, false},
+	}
+	for _, c := range cases {
+		if supplied := c.cfg.IfPasswordSupplied(); supplied != c.expected {
+			t.Errorf("%s: password supplied is %v, expect %v", c.name, supplied, c.expected)
+		}
+	}
+
+	// empty password in environment variable is supplied too
+	defer os.Unsetenv(envName)
+	for _, value := range []string{"secret", ""} {
+		os.Setenv(envName, value)
+		cfg := &ConfCmd{PasswordEnv: envName}
+		if !cfg.IfPasswordSupplied() {
+			t.Errorf("password %q in --password-env %s is not supplied", value, envName)
+		}
+	}
+}
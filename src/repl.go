@@ -4,13 +4,20 @@ import (
 	"context"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/WangJiemin/jamintools/ehand"
 	"github.com/WangJiemin/jamintools/logging"
+	"github.com/juju/errors"
 	"github.com/siddontang/go-mysql/mysql"
 	"github.com/siddontang/go-mysql/replication"
 )
 
+const (
+	cReplRetryMinWait time.Duration = 1 * time.Second
+	cReplRetryMaxWait time.Duration = 60 * time.Second
+)
+
 /*
 type ReplBinlogStreamer struct {
 	cfg ConfCmd
@@ -25,14 +32,14 @@ func ParserAllBinEventsFromRepl(cfg *ConfCmd, eventChan chan MyBinEvent, statCha
 	defer close(eventChan)
 	defer close(statChan)
 	defer close(orgSqlChan)
-	replStreamer := NewReplBinlogStreamer(cfg)
+	replSyncer, replStreamer := NewReplBinlogStreamer(cfg)
 	GLogger.WriteToLogByFieldsNormalOnlyMsg("start to get binlog from mysql", logging.INFO)
-	SendBinlogEventRepl(cfg, replStreamer, eventChan, statChan, orgSqlChan)
+	SendBinlogEventRepl(cfg, replSyncer, replStreamer, eventChan, statChan, orgSqlChan)
 	GLogger.WriteToLogByFieldsNormalOnlyMsg("finish getting binlog from mysql", logging.INFO)
 
 }
 
-func NewReplBinlogStreamer(cfg *ConfCmd) *replication.BinlogStreamer {
+func NewReplBinlogSyncer(cfg *ConfCmd) *replication.BinlogSyncer {
 	replCfg := replication.BinlogSyncerConfig{
 		ServerID:                uint32(cfg.ServerId),
 		Flavor:                  cfg.MysqlType,
@@ -44,25 +51,89 @@ func NewReplBinlogStreamer(cfg *ConfCmd) *replication.BinlogStreamer {
 		SemiSyncEnabled:         false,
 		TimestampStringLocation: GBinlogTimeLocation,
 		ParseTime:               false, //donot parse mysql datetime/time column into go time structure, take it as string
-		UseDecimal:              false, // sqlbuilder not support decimal type
+		UseDecimal:              true,  // decimal is exact, float64 loses precision
+		TLSConfig:               cfg.ReplTLSConfig,
+		// -w=archive only writes raw data of events, no need to parse them. -w=check decodes events itself
+		RawModeEnabled: cfg.WorkType == "archive" && !cfg.ArchiveStats || cfg.WorkType == "check",
 	}
+	if cfg.MysqlType == mysql.MariaDBFlavor && cfg.IfWriteOrgSql {
+		// mariadb master sends annotate rows events only if slave asks for them
+		replCfg.DumpCommandFlag = replication.BINLOG_SEND_ANNOTATE_ROWS_EVENT
+	}
+
+	return replication.NewBinlogSyncer(replCfg)
+}
 
-	replSyncer := replication.NewBinlogSyncer(replCfg)
+func NewReplBinlogStreamer(cfg *ConfCmd) (*replication.BinlogSyncer, *replication.BinlogStreamer) {
+	replSyncer := NewReplBinlogSyncer(cfg)
 
-	syncPosition := mysql.Position{Name: cfg.StartFile, Pos: uint32(cfg.StartPos)}
-	replStreamer, err := replSyncer.StartSync(syncPosition)
+	var (
+		replStreamer *replication.BinlogStreamer
+		err          error
+	)
+	if cfg.IfSetStartGtid && !cfg.IfSetStartFilePos {
+		// COM_BINLOG_DUMP_GTID, master sends trxs not contained in -sgtid
+		replStreamer, err = replSyncer.StartSyncGTID(cfg.StartGtidSet)
+	} else {
+		syncPosition := mysql.Position{Name: cfg.StartFile, Pos: uint32(cfg.StartPos)}
+		replStreamer, err = replSyncer.StartSync(syncPosition)
+	}
 	if err != nil {
 		GLogger.WriteToLogByFieldsErrorExtramsgExit(err, fmt.Sprintf("error replication from master %s:%d ",
 			cfg.Host, cfg.Port), logging.ERROR, ehand.ERR_MYSQL_CONNECTION)
 	}
-	return replStreamer
+	return replSyncer, replStreamer
+}
+
+/*
+ReconnectReplBinlogStreamer closes the broken syncer and replicates from pos again,
+it retries -retry times, waiting twice as long as the last time before each retry.
+*/
+func ReconnectReplBinlogStreamer(cfg *ConfCmd, replSyncer *replication.BinlogSyncer, pos mysql.Position) (*replication.BinlogSyncer, *replication.BinlogStreamer, error) {
+	var (
+		replStreamer *replication.BinlogStreamer
+		err          error
+		wait         time.Duration = cReplRetryMinWait
+	)
+	replSyncer.Close()
+	for i := 1; i <= cfg.ReplRetryTimes; i++ {
+		GLogger.WriteToLogByFieldsNormalOnlyMsg(fmt.Sprintf("reconnect to master %s:%d after %s, retry %d/%d, replicate from %s",
+			cfg.Host, cfg.Port, wait, i, cfg.ReplRetryTimes, pos.String()), logging.WARNING)
+		time.Sleep(wait)
+		replSyncer = NewReplBinlogSyncer(cfg)
+		replStreamer, err = replSyncer.StartSync(pos)
+		if err == nil {
+			return replSyncer, replStreamer, nil
+		}
+		GLogger.WriteToLogByFieldsErrorExtramsgExitCode(err, "fail to reconnect to master", logging.WARNING, ehand.ERR_MYSQL_REPL)
+		replSyncer.Close()
+		wait *= 2
+		if wait > cReplRetryMaxWait {
+			wait = cReplRetryMaxWait
+		}
+	}
+	return nil, nil, errors.Errorf("fail to reconnect to master after %d retries", cfg.ReplRetryTimes)
+}
+
+// IfReplCanRestartAfterEvent: replication cannot restart after table map or rows event, rows events after it need the table map
+func IfReplCanRestartAfterEvent(evType replication.EventType) bool {
+	switch evType {
+	case replication.TABLE_MAP_EVENT,
+		replication.WRITE_ROWS_EVENTv0, replication.UPDATE_ROWS_EVENTv0, replication.DELETE_ROWS_EVENTv0,
+		replication.WRITE_ROWS_EVENTv1, replication.UPDATE_ROWS_EVENTv1, replication.DELETE_ROWS_EVENTv1,
+		replication.WRITE_ROWS_EVENTv2, replication.UPDATE_ROWS_EVENTv2, replication.DELETE_ROWS_EVENTv2,
+		replication.PARTIAL_UPDATE_ROWS_EVENT:
+		return false
+	}
+	return true
 }
 
-func SendBinlogEventRepl(cfg *ConfCmd, streamer *replication.BinlogStreamer, eventChan chan MyBinEvent, statChan chan BinEventStats, orgSqlChan chan OrgSqlPrint) {
+func SendBinlogEventRepl(cfg *ConfCmd, replSyncer *replication.BinlogSyncer, streamer *replication.BinlogStreamer, eventChan chan MyBinEvent, statChan chan BinEventStats, orgSqlChan chan OrgSqlPrint) {
 	//defer close(statChan)
 	//defer close(eventChan)
 
 	var (
+		err           error
 		chkRe         int
 		currentBinlog string = cfg.StartFile
 		binEventIdx   uint64 = 0
@@ -78,26 +149,113 @@ func SendBinlogEventRepl(cfg *ConfCmd, streamer *replication.BinlogStreamer, eve
 
 		tbMapPos uint32 = 0
 
-		justStart   bool = true
-		orgSqlEvent *replication.RowsQueryEvent
+		justStart bool               = true
+		trxXid    uint64             = 0
+		trxEvSent bool               = false // any event of current trx is sent to generate sql
+		ckpt      *CheckpointBarrier         // to save checkpoint after current trx is written
+
+		restartPos   mysql.Position = mysql.Position{Name: cfg.StartFile, Pos: uint32(cfg.StartPos)} // where to replicate from after reconnecting
+		lastEventPos mysql.Position                                                                  // events not after it are skipped after reconnecting
+		skipToPos    mysql.Position
+
+		archiver *BinlogArchiver // -w=archive
+
+		payloadEvs []*replication.BinlogEvent // events of TRANSACTION_PAYLOAD_EVENT not processed yet
 	)
 
+	if cfg.WorkType == "archive" {
+		archiver = NewBinlogArchiver(cfg.OutputDir)
+		defer func() {
+			if err := archiver.Close(); err != nil {
+				GLogger.WriteToLogByFieldsErrorExtramsgExitCode(err, "fail to close archived binlog", logging.ERROR, ehand.ERR_FILE_WRITE)
+			}
+		}()
+	}
+
 	//defer g_MaxBin_Event_Idx.SetMaxBinEventIdx()
 	for {
-		ev, err := streamer.GetEvent(context.Background())
-		if err != nil {
-			GLogger.WriteToLogByFieldsErrorExtramsgExitCode(err, "error to get binlog event", logging.ERROR, ehand.ERR_MYSQL_REPL)
-			break
-		}
+		var ev *replication.BinlogEvent
+		if len(payloadEvs) > 0 {
+			// positions of events in payload are those of the payload event, which is handled already
+			ev = payloadEvs[0]
+			payloadEvs = payloadEvs[1:]
+		} else {
+			// no more event is coming from an idle master, do not wait for the event after the stop position
+			if cfg.StopAtMasterPos && lastEventPos.Name != "" &&
+				CompareBinlogPosition(lastEventPos, mysql.Position{Name: cfg.StopFilePos.Name, Pos: cfg.StopFilePos.Pos - 1}) >= 0 {
+				break
+			}
+			ev, err = streamer.GetEvent(context.Background())
+			if err != nil {
+				if cfg.ReplRetryTimes == 0 || restartPos.Name == "" {
+					GLogger.WriteToLogByFieldsErrorExtramsgExitCode(err, "error to get binlog event", logging.ERROR, ehand.ERR_MYSQL_REPL)
+					break
+				}
+				GLogger.WriteToLogByFieldsErrorExtramsgExitCode(err, "error to get binlog event, try to reconnect", logging.WARNING, ehand.ERR_MYSQL_REPL)
+				replSyncer, streamer, err = ReconnectReplBinlogStreamer(cfg, replSyncer, restartPos)
+				if err != nil {
+					GLogger.WriteToLogByFieldsErrorExtramsgExitCode(err, "error to get binlog event", logging.ERROR, ehand.ERR_MYSQL_REPL)
+					break
+				}
+				skipToPos = lastEventPos
+				justStart = true
+				continue
+			}
 
-		if !cfg.IfSetStopParsPoint && !cfg.IfSetStopDateTime && !justStart {
-			//just parse one binlog. the first event is rotate event
+			if archiver != nil {
+				if IfReachArchiveStop(cfg, ev.Header, archiver.FileName) {
+					break
+				}
+				// the fake rotate event after reconnecting truncates archived binlog to where replication restarts
+				if err = archiver.ArchiveEvent(ev); err != nil {
+					GLogger.WriteToLogByFieldsErrorExtramsgExitCode(err, "fail to archive binlog event", logging.ERROR, ehand.ERR_FILE_WRITE)
+					break
+				}
+				if !cfg.ArchiveStats {
+					// events are not parsed, replication can restart after any event
+					currentBinlog = archiver.FileName
+					if archiver.FileName != "" {
+						restartPos = mysql.Position{Name: archiver.FileName, Pos: archiver.Pos}
+						lastEventPos = restartPos
+					}
+					continue
+				}
+			}
 
 			if ev.Header.EventType == replication.ROTATE_EVENT {
-				break
+				// the fake rotate event tells where replication starts, for -sgtid
+				if ev.Header.LogPos == 0 && restartPos.Name == "" {
+					rotateEv := ev.Event.(*replication.RotateEvent)
+					restartPos = mysql.Position{Name: string(rotateEv.NextLogName), Pos: uint32(rotateEv.Position)}
+				}
+			} else if skipToPos.Name != "" {
+				// events already processed before reconnecting
+				if CompareBinlogPosition(mysql.Position{Name: currentBinlog, Pos: ev.Header.LogPos}, skipToPos) <= 0 {
+					continue
+				}
+				skipToPos = mysql.Position{}
+			}
+			if ev.Header.LogPos > 0 {
+				lastEventPos = mysql.Position{Name: currentBinlog, Pos: ev.Header.LogPos}
+				if IfReplCanRestartAfterEvent(ev.Header.EventType) {
+					restartPos = lastEventPos
+				}
+			}
+
+			if !cfg.IfSetStopParsPoint && !cfg.IfSetStopDateTime && !justStart {
+				//just parse one binlog. the first event is rotate event
+
+				if ev.Header.EventType == replication.ROTATE_EVENT {
+					break
+				}
+			}
+			justStart = false
+
+			if ev.Header.EventType == replication.TRANSACTION_PAYLOAD_EVENT {
+				payloadEvs = GetTrxPayloadEvents(ev.Header, ev.Event)
+				continue
 			}
 		}
-		justStart = false
 
 		if ev.Header.EventType == replication.TABLE_MAP_EVENT {
 			tbMapPos = ev.Header.LogPos - ev.Header.EventSize // avoid mysqlbing mask the row event as unknown table row event
@@ -114,10 +272,10 @@ func SendBinlogEventRepl(cfg *ConfCmd, streamer *replication.BinlogStreamer, eve
 			continue
 		}
 
-		if cfg.IfWriteOrgSql && ev.Header.EventType == replication.ROWS_QUERY_EVENT {
-			orgSqlEvent = ev.Event.(*replication.RowsQueryEvent)
+		if orgSql, ok := GetOrgSqlFromBinEvent(ev.Header, ev.Event); ok && cfg.IfWriteOrgSql {
 			orgSqlChan <- OrgSqlPrint{Binlog: currentBinlog, DateTime: ev.Header.Timestamp,
-				StartPos: ev.Header.LogPos - ev.Header.EventSize, StopPos: ev.Header.LogPos, QuerySql: string(orgSqlEvent.Query)}
+				StartPos: ev.Header.LogPos - ev.Header.EventSize, StopPos: ev.Header.LogPos, QuerySql: orgSql,
+				ServerId: ev.Header.ServerID, Gtid: GGtidTrxFilter.CurrentGtid}
 			continue
 		}
 
@@ -133,6 +291,7 @@ func SendBinlogEventRepl(cfg *ConfCmd, streamer *replication.BinlogStreamer, eve
 		} else if chkRe == C_reProcess {
 
 			db, tb, sqlType, sql, rowCnt = GetDbTbAndQueryAndRowCntFromBinevent(ev)
+			trxXid = GetTrxXidFromBinEvent(ev)
 
 			if sqlType == "query" {
 				sqlLower = strings.ToLower(sql)
@@ -140,6 +299,7 @@ func SendBinlogEventRepl(cfg *ConfCmd, streamer *replication.BinlogStreamer, eve
 				if sqlLower == "begin" {
 					trxStatus = C_trxBegin
 					trxIndex++
+					trxEvSent = false
 				} else if sqlLower == "commit" {
 					trxStatus = C_trxCommit
 				} else if sqlLower == "rollback" {
@@ -153,13 +313,13 @@ func SendBinlogEventRepl(cfg *ConfCmd, streamer *replication.BinlogStreamer, eve
 				trxStatus = C_trxProcess
 			}
 
-			if cfg.WorkType != "stats" {
+			if cfg.IfGenSql() {
 				ifSendEvent := false
 				if oneMyEvent.IfRowsEvent {
 
 					tbKey := GetAbsTableName(string(oneMyEvent.BinEvent.Table.Schema),
 						string(oneMyEvent.BinEvent.Table.Table))
-					if _, ok := G_TablesColumnsInfo.tableInfos[tbKey]; ok {
+					if IfHasTableInfoOfRowsEvent(cfg, oneMyEvent.BinEvent.Table) {
 						ifSendEvent = true
 					} else {
 						GLogger.WriteToLogByFieldsNormalOnlyMsg(fmt.Sprintf("no table struct found for %s, it maybe dropped, skip it. RowsEvent position:%s",
@@ -178,11 +338,29 @@ func SendBinlogEventRepl(cfg *ConfCmd, streamer *replication.BinlogStreamer, eve
 					oneMyEvent.Timestamp = ev.Header.Timestamp
 					oneMyEvent.TrxIndex = trxIndex
 					oneMyEvent.TrxStatus = trxStatus
+					oneMyEvent.Gtid = GGtidTrxFilter.CurrentGtid
+					oneMyEvent.ServerId = ev.Header.ServerID
 					eventChan <- *oneMyEvent
+					trxEvSent = true
 
 				}
 			}
 
+			ckpt = nil
+			if GCheckpoint != nil && trxStatus == C_trxCommit {
+				ckpt = GCheckpoint.NewBarrier(mysql.Position{Name: currentBinlog, Pos: ev.Header.LogPos}, mysql.Position{},
+					GGtidTrxFilter.CurrentGtid, ev.Header.Timestamp)
+			}
+
+			// trx end, to print gtid/xid of trx into sql files and to save checkpoint
+			if cfg.IfGenSql() && trxStatus == C_trxCommit && (cfg.PrintExtraInfo && trxEvSent || ckpt != nil) {
+				binEventIdx++
+				eventChan <- MyBinEvent{MyPos: mysql.Position{Name: currentBinlog, Pos: ev.Header.LogPos}, StartPos: ev.Header.LogPos - ev.Header.EventSize,
+					EventIdx: binEventIdx, Timestamp: ev.Header.Timestamp, TrxIndex: trxIndex, TrxStatus: trxStatus,
+					Gtid: GGtidTrxFilter.CurrentGtid, ServerId: ev.Header.ServerID, Xid: trxXid, IfTrxEnd: true, Checkpoint: ckpt}
+				trxEvSent = false
+			}
+
 			// output analysis result whatever the WorkType is
 			if sqlType != "" {
 
@@ -191,19 +369,34 @@ func SendBinlogEventRepl(cfg *ConfCmd, streamer *replication.BinlogStreamer, eve
 						//gLogger.WriteToLogByFieldsNormalOnlyMsg(fmt.Sprintf("send dml/ddl event for statchan: %s", spew.Sdump(oneMyEvent.QuerySql)), logging.INFO)
 						statChan <- BinEventStats{Timestamp: ev.Header.Timestamp, Binlog: currentBinlog, StartPos: ev.Header.LogPos - ev.Header.EventSize, StopPos: ev.Header.LogPos,
 							Database: oneMyEvent.QuerySql.GetDatabasesAll(","), Table: oneMyEvent.QuerySql.GetFullTablesAll(","), QuerySql: sql,
-							RowCnt: rowCnt, QueryType: sqlType, ParsedSqlInfo: oneMyEvent.QuerySql.Copy()}
+							RowCnt: rowCnt, QueryType: sqlType, ParsedSqlInfo: oneMyEvent.QuerySql.Copy(),
+							ServerId: ev.Header.ServerID, Gtid: GGtidTrxFilter.CurrentGtid, Xid: trxXid}
 					} else {
 						statChan <- BinEventStats{Timestamp: ev.Header.Timestamp, Binlog: currentBinlog, StartPos: ev.Header.LogPos - ev.Header.EventSize, StopPos: ev.Header.LogPos,
-							Database: db, Table: tb, QuerySql: sql, RowCnt: rowCnt, QueryType: sqlType}
+							Database: db, Table: tb, QuerySql: sql, RowCnt: rowCnt, QueryType: sqlType,
+							ServerId: ev.Header.ServerID, Gtid: GGtidTrxFilter.CurrentGtid, Xid: trxXid}
 					}
 
 				} else {
 					statChan <- BinEventStats{Timestamp: ev.Header.Timestamp, Binlog: currentBinlog, StartPos: tbMapPos, StopPos: ev.Header.LogPos,
-						Database: db, Table: tb, QuerySql: sql, RowCnt: rowCnt, QueryType: sqlType}
+						Database: db, Table: tb, QuerySql: sql, RowCnt: rowCnt, QueryType: sqlType,
+						ServerId: ev.Header.ServerID, Gtid: GGtidTrxFilter.CurrentGtid, Xid: trxXid}
 				}
 
 			}
 
+			if ckpt != nil {
+				statChan <- BinEventStats{Checkpoint: ckpt}
+				if cfg.IfWriteOrgSql {
+					orgSqlChan <- OrgSqlPrint{Checkpoint: ckpt}
+				}
+			}
+
+			// the last trx of -egtid is committed
+			if trxStatus == C_trxCommit && GGtidTrxFilter.IfReachStopGtid() {
+				break
+			}
+
 		} else if chkRe == C_reFileEnd {
 			continue
 		} else {
@@ -0,0 +1,196 @@
+package src
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/WangJiemin/jamintools/constvar"
+	"github.com/WangJiemin/jamintools/ehand"
+	"github.com/WangJiemin/jamintools/logging"
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql/mysql"
+)
+
+const (
+	cReplProbeTimeout time.Duration = 30 * time.Second
+	cBinlogStartPos   uint32        = 4 // the first event of binlog, right after fe'bin'
+)
+
+// QueryRowsAsStringMaps returns rows as column name => value, for SHOW statements whose columns differ among versions
+func QueryRowsAsStringMaps(db *sql.DB, query string) ([]map[string]string, error) {
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, errors.Annotatef(err, "fail to execute %s", query)
+	}
+	defer rows.Close()
+
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, errors.Annotatef(err, "fail to get columns of %s", query)
+	}
+	var result []map[string]string
+	for rows.Next() {
+		values := make([]sql.RawBytes, len(cols))
+		dest := make([]interface{}, len(cols))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err = rows.Scan(dest...); err != nil {
+			return nil, errors.Annotatef(err, "fail to get result of %s", query)
+		}
+		oneRow := map[string]string{}
+		for i, col := range cols {
+			oneRow[col] = string(values[i])
+		}
+		result = append(result, oneRow)
+	}
+	return result, errors.Trace(rows.Err())
+}
+
+// GetMasterBinlogPosition gets current binlog position of master, SHOW MASTER STATUS is renamed to SHOW BINARY LOG STATUS since mysql 8.4
+func GetMasterBinlogPosition(db *sql.DB) (mysql.Position, error) {
+	var (
+		pos  mysql.Position
+		rows []map[string]string
+		err  error
+	)
+	for _, query := range []string{"SHOW MASTER STATUS", "SHOW BINARY LOG STATUS"} {
+		rows, err = QueryRowsAsStringMaps(db, query)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return pos, err
+	}
+	if len(rows) == 0 {
+		return pos, errors.Errorf("binlog is not enabled, SHOW MASTER STATUS returns empty result")
+	}
+	n, err := strconv.ParseUint(rows[0]["Position"], 10, 32)
+	if err != nil {
+		return pos, errors.Annotatef(err, "invalid binlog position %s", rows[0]["Position"])
+	}
+	pos.Name = rows[0]["File"]
+	pos.Pos = uint32(n)
+	return pos, nil
+}
+
+// GetMasterBinlogFiles gets binlog files of master in order by SHOW BINARY LOGS
+func GetMasterBinlogFiles(db *sql.DB) ([]string, error) {
+	rows, err := QueryRowsAsStringMaps(db, "SHOW BINARY LOGS")
+	if err != nil {
+		return nil, err
+	}
+	binlogs := make([]string, 0, len(rows))
+	for _, oneRow := range rows {
+		binlogs = append(binlogs, oneRow["Log_name"])
+	}
+	return binlogs, nil
+}
+
+/*
+GetBinlogStartTimeFromMaster replicates binlog from its beginning, and returns timestamp of its format description event,
+it is the time the binlog is created. The fake rotate event sent by master has zero timestamp and is skipped.
+*/
+func GetBinlogStartTimeFromMaster(cfg *ConfCmd, binlog string) (uint32, error) {
+	replSyncer := NewReplBinlogSyncer(cfg)
+	defer replSyncer.Close()
+
+	replStreamer, err := replSyncer.StartSync(mysql.Position{Name: binlog, Pos: cBinlogStartPos})
+	if err != nil {
+		return 0, errors.Annotatef(err, "fail to replicate %s from master", binlog)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cReplProbeTimeout)
+	defer cancel()
+	for {
+		ev, err := replStreamer.GetEvent(ctx)
+		if err != nil {
+			return 0, errors.Annotatef(err, "fail to get the first event of %s from master", binlog)
+		}
+		if ev.Header.Timestamp != 0 {
+			return ev.Header.Timestamp, nil
+		}
+	}
+}
+
+/*
+SearchMasterBinlogByDatetime binary searches binlogs of master for the last one created not later than dt,
+events at or after dt must be in it or binlogs after it. The first binlog is returned if all binlogs are created after dt.
+*/
+func SearchMasterBinlogByDatetime(cfg *ConfCmd, binlogs []string, dt uint32) (string, error) {
+	low, high := 0, len(binlogs)-1
+	found := 0
+	for low <= high {
+		mid := (low + high) / 2
+		ts, err := GetBinlogStartTimeFromMaster(cfg, binlogs[mid])
+		if err != nil {
+			return "", err
+		}
+		GLogger.WriteToLogByFieldsNormalOnlyMsg(fmt.Sprintf("binlog %s of master is created at %s",
+			binlogs[mid], GetDatetimeStr(int64(ts), 0, constvar.DATETIME_FORMAT)), logging.DEBUG)
+		if ts <= dt {
+			found = mid
+			low = mid + 1
+		} else {
+			high = mid - 1
+		}
+	}
+	if high < 0 {
+		GLogger.WriteToLogByFieldsNormalOnlyMsg(fmt.Sprintf("all binlogs of master are created after -sdt, start from the first one %s",
+			binlogs[0]), logging.WARNING)
+	}
+	return binlogs[found], nil
+}
+
+/*
+ResolveReplStartPos finds the position to start replication when -m=repl and neither -sbin/-spos nor -sgtid is given:
+-snow starts from current binlog position of master, -sdt starts from the binlog containing it.
+When found by -sdt and no stop point is given, it stops at current binlog position of master instead of the end of the first binlog.
+*/
+func (this *ConfCmd) ResolveReplStartPos() {
+	sqlCon, err := CreateMysqlCon(GetMysqlUrl(this))
+	if err != nil {
+		GLogger.WriteToLogByFieldsErrorExtramsgExit(err, "fail to connect to mysql", logging.ERROR, ehand.ERR_MYSQL_CONNECTION)
+	}
+	defer sqlCon.Close()
+
+	masterPos, err := GetMasterBinlogPosition(sqlCon)
+	if err != nil {
+		GLogger.WriteToLogByFieldsErrorExtramsgExit(err, "fail to get current binlog position of master", logging.ERROR, ehand.ERR_MYSQL_QUERY)
+	}
+
+	if this.StartFromNow {
+		this.StartFile = masterPos.Name
+		this.StartPos = uint(masterPos.Pos)
+	} else {
+		binlogs, err := GetMasterBinlogFiles(sqlCon)
+		if err != nil {
+			GLogger.WriteToLogByFieldsErrorExtramsgExit(err, "fail to get binlogs of master", logging.ERROR, ehand.ERR_MYSQL_QUERY)
+		}
+		if len(binlogs) == 0 {
+			GLogger.WriteToLogByFieldsExitMsgNoErr("no binlog found by SHOW BINARY LOGS", logging.ERROR, ehand.ERR_MYSQL_QUERY)
+		}
+		this.StartFile, err = SearchMasterBinlogByDatetime(this, binlogs, this.StartDatetime)
+		if err != nil {
+			GLogger.WriteToLogByFieldsErrorExtramsgExit(err, "fail to find binlog by -sdt", logging.ERROR, ehand.ERR_MYSQL_REPL)
+		}
+		this.StartPos = uint(cBinlogStartPos)
+
+		if !this.IfSetStopParsPoint {
+			// the last event ends at the position of master, plus one to include it
+			this.StopFile = masterPos.Name
+			this.StopPos = uint(masterPos.Pos) + 1
+			this.StopFilePos = mysql.Position{Name: this.StopFile, Pos: uint32(this.StopPos)}
+			this.IfSetStopFilePos = true
+			this.StopAtMasterPos = true
+			this.IfSetStopParsPoint = true
+			GLogger.WriteToLogByFieldsNormalOnlyMsg(fmt.Sprintf("stop at current binlog position of master %s", masterPos.String()), logging.INFO)
+		}
+	}
+	this.StartFilePos = mysql.Position{Name: this.StartFile, Pos: uint32(this.StartPos)}
+	this.IfSetStartFilePos = true
+	GLogger.WriteToLogByFieldsNormalOnlyMsg(fmt.Sprintf("start to replicate from master at %s", this.StartFilePos.String()), logging.INFO)
+}
@@ -0,0 +1,156 @@
+package src
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql/replication"
+)
+
+const (
+	cResyncReadBytes int    = 64 * 1024
+	C_incompleteTrx  string = "incomplete"
+)
+
+// BinEventDamagedError is returned by ReadBinEvent when event cannot be read or parsed, RawData is the bytes read of it
+type BinEventDamagedError struct {
+	RawData []byte
+	Err     error
+}
+
+func (this *BinEventDamagedError) Error() string {
+	return this.Err.Error()
+}
+
+// EventType is that in header of the damaged event, UNKNOWN_EVENT if header is incomplete
+func (this *BinEventDamagedError) EventType() replication.EventType {
+	if len(this.RawData) < replication.EventHeaderSize {
+		return replication.UNKNOWN_EVENT
+	}
+	return replication.EventType(this.RawData[4])
+}
+
+/*
+BinlogResyncReader is the reader of binlog for -tolerant, bytes of damaged event can be unread,
+then it scans forward byte by byte for the next valid event and parsing resumes there.
+*/
+type BinlogResyncReader struct {
+	Pos         uint32 // position in binlog of the next byte to read
+	ChecksumAlg byte   // from format description event of the binlog
+	r           io.Reader
+	buf         []byte // bytes read ahead or unread
+}
+
+func NewBinlogResyncReader(r io.Reader) *BinlogResyncReader {
+	return &BinlogResyncReader{Pos: 4, ChecksumAlg: replication.BINLOG_CHECKSUM_ALG_OFF, r: r}
+}
+
+func (this *BinlogResyncReader) Read(p []byte) (int, error) {
+	var (
+		n   int
+		err error
+	)
+	if len(this.buf) > 0 {
+		n = copy(p, this.buf)
+		this.buf = this.buf[n:]
+	} else {
+		n, err = this.r.Read(p)
+	}
+	this.Pos += uint32(n)
+	return n, err
+}
+
+// Unread puts data back, it is read again
+func (this *BinlogResyncReader) Unread(data []byte) {
+	this.buf = append(append(make([]byte, 0, len(data)+len(this.buf)), data...), this.buf...)
+	this.Pos -= uint32(len(data))
+}
+
+// peek returns the next n bytes without consuming them, io.ErrUnexpectedEOF if less than n bytes left
+func (this *BinlogResyncReader) peek(n int) ([]byte, error) {
+	for len(this.buf) < n {
+		chunk := make([]byte, cResyncReadBytes)
+		m, err := this.r.Read(chunk)
+		this.buf = append(this.buf, chunk[:m]...)
+		if err == io.EOF {
+			if len(this.buf) < n {
+				return this.buf, io.ErrUnexpectedEOF
+			}
+			break
+		} else if err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	return this.buf[:n], nil
+}
+
+/*
+Resync skips the first byte of damaged event and scans for the next valid event, which is read next.
+An event is valid if type is known, size is reasonable, end position in header matches(not for relay log) and checksum is right.
+It returns io.EOF if there is no valid event till the end of binlog.
+*/
+func (this *BinlogResyncReader) Resync(damaged []byte, ifCheckPos bool) error {
+	if len(damaged) > 0 {
+		this.Unread(damaged[1:])
+	} else {
+		// nothing read of the damaged event, skip one byte
+		if _, err := this.peek(1); err != nil {
+			return io.EOF
+		}
+		this.buf = this.buf[1:]
+		this.Pos++
+	}
+	for {
+		head, err := this.peek(replication.EventHeaderSize)
+		if err == io.ErrUnexpectedEOF {
+			this.Pos += uint32(len(this.buf))
+			this.buf = nil
+			return io.EOF
+		} else if err != nil {
+			return err
+		}
+		if this.IfPlausibleEventHeader(head, ifCheckPos) {
+			size := int(binary.LittleEndian.Uint32(head[9:]))
+			rawData, err := this.peek(size)
+			if err == nil && (this.ChecksumAlg != replication.BINLOG_CHECKSUM_ALG_CRC32 || VerifyBinEventChecksum(rawData) == nil) {
+				return nil
+			} else if err != nil && err != io.ErrUnexpectedEOF {
+				return err
+			}
+		}
+		this.buf = this.buf[1:]
+		this.Pos++
+	}
+}
+
+func (this *BinlogResyncReader) IfPlausibleEventHeader(head []byte, ifCheckPos bool) bool {
+	if !IfKnownEventType(replication.EventType(head[4])) {
+		return false
+	}
+	size := binary.LittleEndian.Uint32(head[9:])
+	minSize := uint32(replication.EventHeaderSize)
+	if this.ChecksumAlg == replication.BINLOG_CHECKSUM_ALG_CRC32 {
+		minSize += replication.BinlogChecksumLength
+	}
+	if size <= minSize || size > cMaxBinlogEventSize {
+		return false
+	}
+	if ifCheckPos && binary.LittleEndian.Uint32(head[13:]) != this.Pos+size {
+		return false
+	}
+	return true
+}
+
+func IfKnownEventType(tp replication.EventType) bool {
+	return tp > replication.UNKNOWN_EVENT && tp <= replication.HEARTBEAT_LOG_EVENT_V2 ||
+		tp >= replication.MARIADB_ANNOTATE_ROWS_EVENT && tp <= replication.MARIADB_DELETE_ROWS_COMPRESSED_EVENT
+}
+
+// GetIncompleteTrxStr is value of incomplete column of outputs for -tolerant
+func GetIncompleteTrxStr(incomplete bool) string {
+	if incomplete {
+		return "yes"
+	}
+	return "no"
+}
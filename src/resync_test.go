@@ -0,0 +1,138 @@
+package src
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"testing"
+
+	"github.com/siddontang/go-mysql/replication"
+)
+
+// genXidEventData returns raw data of xid event ending at endPos, with crc32 checksum if withChecksum
+func genXidEventData(endPos uint32, xid uint64, withChecksum bool) []byte {
+	size := replication.EventHeaderSize + 8
+	if withChecksum {
+		size += replication.BinlogChecksumLength
+	}
+	data := make([]byte, size)
+	binary.LittleEndian.PutUint32(data[0:], 1600000000)
+	data[4] = byte(replication.XID_EVENT)
+	binary.LittleEndian.PutUint32(data[5:], 1)
+	binary.LittleEndian.PutUint32(data[9:], uint32(size))
+	binary.LittleEndian.PutUint32(data[13:], endPos)
+	binary.LittleEndian.PutUint64(data[replication.EventHeaderSize:], xid)
+	if withChecksum {
+		binary.LittleEndian.PutUint32(data[size-replication.BinlogChecksumLength:],
+			crc32.ChecksumIEEE(data[:size-replication.BinlogChecksumLength]))
+	}
+	return data
+}
+
+// readRawEvent reads one event by size in header, like ReadBinEvent
+func readRawEvent(t *testing.T, r *BinlogResyncReader) []byte {
+	head := make([]byte, replication.EventHeaderSize)
+	if _, err := io.ReadFull(r, head); err != nil {
+		t.Fatalf("fail to read event header at %d: %v", r.Pos, err)
+	}
+	body := make([]byte, binary.LittleEndian.Uint32(head[9:])-uint32(replication.EventHeaderSize))
+	if _, err := io.ReadFull(r, body); err != nil {
+		t.Fatalf("fail to read event body at %d: %v", r.Pos, err)
+	}
+	return append(head, body...)
+}
+
+func TestBinlogResyncReaderResync(t *testing.T) {
+	const garbageLen = 7
+	ev1 := genXidEventData(4+31, 1, true)
+	garbage := bytes.Repeat([]byte{0xff}, garbageLen)
+	// checksum is broken, skipped by resync
+	ev2 := genXidEventData(4+31+garbageLen+31, 2, true)
+	ev2[replication.EventHeaderSize] ^= 0x01
+	ev3 := genXidEventData(4+31+garbageLen+31+31, 3, true)
+
+	var binlog []byte
+	for _, data := range [][]byte{ev1, garbage, ev2, ev3} {
+		binlog = append(binlog, data...)
+	}
+	r := NewBinlogResyncReader(bytes.NewReader(binlog))
+	r.ChecksumAlg = replication.BINLOG_CHECKSUM_ALG_CRC32
+
+	if data := readRawEvent(t, r); !bytes.Equal(data, ev1) || r.Pos != 4+31 {
+		t.Fatalf("first event is %v, position %d", data, r.Pos)
+	}
+	damaged := make([]byte, replication.EventHeaderSize)
+	if _, err := io.ReadFull(r, damaged); err != nil {
+		t.Fatalf("fail to read damaged event header: %v", err)
+	}
+	if err := r.Resync(damaged, true); err != nil {
+		t.Fatalf("fail to resync: %v", err)
+	}
+	if r.Pos != 4+31+garbageLen+31 {
+		t.Errorf("position after resync is %d, expect %d", r.Pos, 4+31+garbageLen+31)
+	}
+	if data := readRawEvent(t, r); !bytes.Equal(data, ev3) {
+		t.Errorf("event after resync is %v, expect %v", data, ev3)
+	}
+
+	// no valid event till the end
+	r = NewBinlogResyncReader(bytes.NewReader(append(append([]byte{}, ev1...), garbage...)))
+	if err := r.Resync(nil, true); err != io.EOF {
+		t.Errorf("resync without valid event returns %v, expect io.EOF", err)
+	}
+	if r.Pos != 4+uint32(len(ev1)+garbageLen) {
+		t.Errorf("position after resync to the end is %d, expect %d", r.Pos, 4+len(ev1)+garbageLen)
+	}
+}
+
+func TestBinlogResyncReaderResyncRelayLog(t *testing.T) {
+	// end positions in relay log are those of master binlog
+	ev1 := genXidEventData(1000, 1, false)
+	ev2 := genXidEventData(2000, 2, false)
+	binlog := append(append([]byte{0x00, 0x01, 0x02}, ev1...), ev2...)
+
+	r := NewBinlogResyncReader(bytes.NewReader(binlog))
+	if err := r.Resync(nil, true); err != io.EOF {
+		t.Errorf("resync with position check returns %v, expect io.EOF", err)
+	}
+
+	r = NewBinlogResyncReader(bytes.NewReader(binlog))
+	if err := r.Resync(nil, false); err != nil {
+		t.Fatalf("fail to resync without position check: %v", err)
+	}
+	if r.Pos != 4+3 {
+		t.Errorf("position after resync is %d, expect %d", r.Pos, 4+3)
+	}
+	if data := readRawEvent(t, r); !bytes.Equal(data, ev1) {
+		t.Errorf("event after resync is %v, expect %v", data, ev1)
+	}
+	if data := readRawEvent(t, r); !bytes.Equal(data, ev2) {
+		t.Errorf("second event after resync is %v, expect %v", data, ev2)
+	}
+}
+
+func TestIfPlausibleEventHeader(t *testing.T) {
+	r := NewBinlogResyncReader(bytes.NewReader(nil))
+	head := genXidEventData(4+27, 1, false)[:replication.EventHeaderSize]
+	if !r.IfPlausibleEventHeader(head, true) {
+		t.Errorf("valid event header %v is not plausible", head)
+	}
+
+	unknownType := append([]byte{}, head...)
+	unknownType[4] = 0xee
+	tooLarge := append([]byte{}, head...)
+	binary.LittleEndian.PutUint32(tooLarge[9:], cMaxBinlogEventSize+1)
+	tooSmall := append([]byte{}, head...)
+	binary.LittleEndian.PutUint32(tooSmall[9:], uint32(replication.EventHeaderSize))
+	wrongPos := append([]byte{}, head...)
+	binary.LittleEndian.PutUint32(wrongPos[13:], 4+28)
+	for name, h := range map[string][]byte{"unknown type": unknownType, "too large": tooLarge, "too small": tooSmall, "wrong position": wrongPos} {
+		if r.IfPlausibleEventHeader(h, true) {
+			t.Errorf("%s: invalid event header %v is plausible", name, h)
+		}
+	}
+	if !r.IfPlausibleEventHeader(wrongPos, false) {
+		t.Errorf("event header %v is not plausible without position check", wrongPos)
+	}
+}
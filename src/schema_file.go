@@ -0,0 +1,232 @@
+package src
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/WangJiemin/jamintools/dsql"
+	"github.com/WangJiemin/jamintools/ehand"
+	"github.com/WangJiemin/jamintools/logging"
+	"github.com/juju/errors"
+	"github.com/pingcap/parser/ast"
+)
+
+const (
+	C_defaultSqlDelimiter   = ";"
+	C_showCreateTablePrefix = "create table:"
+)
+
+var (
+	// lines of SHOW CREATE TABLE \G output other than the create table statement
+	GShowCreateTableRowReg  *regexp.Regexp = regexp.MustCompile(`^\*+ *\d+\. row *\*+$`)
+	GShowCreateTableNameReg *regexp.Regexp = regexp.MustCompile(`(?i)^table: `)
+	GRowsInSetReg           *regexp.Regexp = regexp.MustCompile(`(?i)^\d+ rows? in set`)
+	// only these statements are parsed, others such as insert and routines are skipped without parsing
+	GSchemaFileStmtReg        *regexp.Regexp = regexp.MustCompile(`(?i)^(use\s|create\s+(database|schema|table)\s)`)
+	GSchemaFileCreateTableReg *regexp.Regexp = regexp.MustCompile(`(?i)^create\s+table\s`)
+)
+
+/*
+SplitSqlsOfSchemaFile splits content of schema file into sql statements.
+Schema file is a schema-only mysqldump, or outputs of SHOW CREATE TABLE, with \G or ended with delimiter.
+comments of "--" and "#", DELIMITER of routines and triggers are handled, statement of "Create Table: " is without the prefix.
+*/
+func SplitSqlsOfSchemaFile(content string) []string {
+	var (
+		sqls      []string
+		oneSql    []string
+		delimiter string = C_defaultSqlDelimiter
+	)
+	addSql := func() {
+		sqlStr := strings.TrimSpace(strings.Join(oneSql, "\n"))
+		if sqlStr != "" {
+			sqls = append(sqls, sqlStr)
+		}
+		oneSql = nil
+	}
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimed := strings.TrimSpace(line)
+		if len(oneSql) == 0 {
+			if trimed == "" || strings.HasPrefix(trimed, "--") || strings.HasPrefix(trimed, "#") ||
+				GShowCreateTableNameReg.MatchString(trimed) {
+				continue
+			}
+			if strings.HasPrefix(strings.ToLower(trimed), "delimiter ") {
+				delimiter = strings.TrimSpace(trimed[len("delimiter "):])
+				continue
+			}
+			if strings.HasPrefix(strings.ToLower(trimed), C_showCreateTablePrefix) {
+				line = strings.TrimSpace(trimed[len(C_showCreateTablePrefix):])
+			}
+		}
+		if GShowCreateTableRowReg.MatchString(trimed) || GRowsInSetReg.MatchString(trimed) {
+			addSql()
+			continue
+		}
+		if strings.HasSuffix(trimed, delimiter) {
+			oneSql = append(oneSql, strings.TrimSuffix(strings.TrimRight(line, " \t\r"), delimiter))
+			addSql()
+			continue
+		}
+		oneSql = append(oneSql, line)
+	}
+	addSql()
+	return sqls
+}
+
+// GetSchemaFilesOfPath: the file itself, or all files in the dir, not recursive
+func GetSchemaFilesOfPath(fpath string) ([]string, error) {
+	fs, err := os.Stat(fpath)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if !fs.IsDir() {
+		return []string{fpath}, nil
+	}
+	fInfos, err := ioutil.ReadDir(fpath)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var files []string
+	for _, fInfo := range fInfos {
+		if fInfo.Mode().IsRegular() {
+			files = append(files, filepath.Join(fpath, fInfo.Name()))
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+/*
+GetTblDefsOfSchemaFile gets definitions of target tables from create table statements in schema file.
+database of table not qualified in create table is of the last use/create database statement in the file, or -rsqldb.
+statements fail to parse are skipped with warning.
+*/
+func GetTblDefsOfSchemaFile(cfg *ConfCmd, fileName string) (map[string]*dsql.TableDef, error) {
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var (
+		useDb  string = cfg.ReadTblDefSqlDb
+		tbDefs        = map[string]*dsql.TableDef{}
+	)
+	for _, sqlStr := range SplitSqlsOfSchemaFile(string(content)) {
+		if !GSchemaFileStmtReg.MatchString(sqlStr) {
+			continue
+		}
+		stmts, _, err := GSqlParser.Parse(sqlStr, "", "")
+		if err != nil {
+			// create database of mysqldump of mysql8.0 has options not supported by the parser, use statement follows it
+			level := logging.WARNING
+			if !GSchemaFileCreateTableReg.MatchString(sqlStr) {
+				level = logging.INFO
+			}
+			GLogger.WriteToLogByFieldsErrorExtramsgExitCode(err, fmt.Sprintf("skip it, error to parse sql in %s: %s", fileName, sqlStr),
+				level, ehand.ERR_ERROR)
+			continue
+		}
+		for _, stmt := range stmts {
+			switch st := stmt.(type) {
+			case *ast.UseStmt:
+				useDb = st.DBName
+			case *ast.CreateDatabaseStmt:
+				useDb = st.Name
+			case *ast.CreateTableStmt:
+				db := st.Table.Schema.O
+				if db == "" {
+					db = useDb
+				}
+				if db == "" {
+					GLogger.WriteToLogByFieldsNormalOnlyMsg(fmt.Sprintf("skip it, database of table %s in %s is unknown, pls specify -rsqldb",
+						st.Table.Name.O, fileName), logging.WARNING)
+					continue
+				}
+				if !cfg.IsTargetTable(db, st.Table.Name.O) {
+					continue
+				}
+				tbKey := GetAbsTableName(db, st.Table.Name.O)
+				if st.ReferTable != nil || st.Select != nil {
+					GLogger.WriteToLogByFieldsNormalOnlyMsg(fmt.Sprintf("skip it, create table like/select is not supported for %s in %s", tbKey, fileName),
+						logging.WARNING)
+					continue
+				}
+				tbDef := dsql.NewEmptyTableDef()
+				for _, cst := range st.Constraints {
+					SetDefaultNameOfConstraint(tbDef, cst)
+				}
+				if err = tbDef.GetTblDefFromCreateTableDirectly(tbKey, st); err != nil {
+					return tbDefs, errors.Annotatef(err, "fail to get table definition of %s from %s", tbKey, fileName)
+				}
+				tbDefs[tbKey] = tbDef
+			}
+		}
+	}
+	return tbDefs, nil
+}
+
+/*
+GetTblDefFromSchemaFiles reads table definitions of -rsql into G_TablesColumnsInfo as the default ones, like those of -rj.
+a table defined in more than one file takes the last one in order of file names.
+*/
+func GetTblDefFromSchemaFiles(cfg *ConfCmd) {
+	GLogger.WriteToLogByFieldsNormalOnlyMsg("start to get table structure from schema file "+cfg.ReadTblDefSqlFile, logging.INFO)
+	files, err := GetSchemaFilesOfPath(cfg.ReadTblDefSqlFile)
+	if err != nil {
+		GLogger.WriteToLogByFieldsErrorExtramsgExit(err, "fail to get schema files of "+cfg.ReadTblDefSqlFile, logging.ERROR, ehand.ERR_FILE_READ)
+	}
+	tbCnt := 0
+	for _, fileName := range files {
+		tbDefs, err := GetTblDefsOfSchemaFile(cfg, fileName)
+		if err != nil {
+			GLogger.WriteToLogByFieldsErrorExtramsgExit(err, "fail to read table structure from "+fileName, logging.ERROR, ehand.ERR_FILE_READ)
+		}
+		for tbKey, tbDef := range tbDefs {
+			tbInfo := TableDefToTblInfoJson(tbKey, tbDef, DdlPosInfo{Binlog: KEY_NONE_BINLOG, StartPos: KEY_NONE_POS, StopPos: KEY_NONE_POS})
+			if G_TablesColumnsInfo.CheckAndCreateTblKey(tbInfo.Database, tbInfo.Table, KEY_NONE_BINLOG, KEY_NONE_POS, KEY_NONE_POS) {
+				GLogger.WriteToLogByFieldsNormalOnlyMsg(fmt.Sprintf("table structure of %s is replaced by the one in %s", tbKey, fileName), logging.WARNING)
+			} else {
+				tbCnt++
+			}
+			G_TablesColumnsInfo.tableInfos[tbKey][NoneBinlogPosKey] = tbInfo
+		}
+	}
+	GLogger.WriteToLogByFieldsNormalOnlyMsg(fmt.Sprintf("successfully get table structure of %d tables from schema file %s", tbCnt, cfg.ReadTblDefSqlFile),
+		logging.INFO)
+}
+
+// GetGeneratedColumnIndices: values of generated columns cannot be inserted or updated
+func (this TblInfoJson) GetGeneratedColumnIndices() []int {
+	var idxes []int
+	for i, col := range this.Columns {
+		if col.Generated {
+			idxes = append(idxes, i)
+		}
+	}
+	return idxes
+}
+
+// ExcludeColumnsFromImage returns copy of bitmap of row image without columns of idxes, nil bitmap means all columns
+func ExcludeColumnsFromImage(bitmap []byte, colCnt int, idxes []int) []byte {
+	newBitmap := make([]byte, (colCnt+7)/8)
+	for i := 0; i < colCnt; i++ {
+		if IfColumnInImage(bitmap, i) {
+			newBitmap[i/8] |= 1 << uint(i%8)
+		}
+	}
+	for _, i := range idxes {
+		if i < colCnt {
+			newBitmap[i/8] &^= 1 << uint(i%8)
+		}
+	}
+	return newBitmap
+}
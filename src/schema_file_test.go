@@ -0,0 +1,167 @@
+package src
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/WangJiemin/jamintools/logging"
+)
+
+const testSchemaDumpFile string = `-- MySQL dump 10.13  Distrib 8.0.19, for Linux (x86_64)
+--
+-- Host: localhost    Database: db1
+/*!40101 SET @OLD_CHARACTER_SET_CLIENT=@@CHARACTER_SET_CLIENT */;
+
+--
+-- Current Database: ` + "`db1`" + `
+--
+
+CREATE DATABASE /*!32312 IF NOT EXISTS*/ ` + "`db1`" + ` /*!40100 DEFAULT CHARACTER SET utf8mb4 */ /*!80016 DEFAULT ENCRYPTION='N' */;
+
+USE ` + "`db1`" + `;
+
+--
+-- Table structure for table ` + "`t1`" + `
+--
+
+DROP TABLE IF EXISTS ` + "`t1`" + `;
+CREATE TABLE ` + "`t1`" + ` (
+  ` + "`id`" + ` int unsigned NOT NULL AUTO_INCREMENT,
+  ` + "`name`" + ` varchar(20) DEFAULT NULL COMMENT 'a;b',
+  ` + "`name_len`" + ` int GENERATED ALWAYS AS (length(` + "`name`" + `)) VIRTUAL,
+  PRIMARY KEY (` + "`id`" + `),
+  UNIQUE KEY ` + "`uk_name`" + ` (` + "`name`" + `)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+DELIMITER ;;
+CREATE TRIGGER ` + "`tr1`" + ` BEFORE INSERT ON ` + "`t1`" + ` FOR EACH ROW BEGIN
+  SET NEW.name = lower(NEW.name);
+END ;;
+DELIMITER ;
+
+CREATE TABLE db2.t2 (a int, b enum('x','y'));
+`
+
+const testShowCreateTableFile string = `*************************** 1. row ***************************
+       Table: t3
+Create Table: CREATE TABLE ` + "`t3`" + ` (
+  ` + "`k`" + ` bigint NOT NULL,
+  PRIMARY KEY (` + "`k`" + `)
+) ENGINE=InnoDB
+1 row in set (0.00 sec)
+`
+
+func TestSplitSqlsOfSchemaFile(t *testing.T) {
+	sqls := SplitSqlsOfSchemaFile(testSchemaDumpFile)
+	expected := []string{
+		"/*!40101 SET @OLD_CHARACTER_SET_CLIENT=@@CHARACTER_SET_CLIENT */",
+		"CREATE DATABASE /*!32312 IF NOT EXISTS*/ `db1` /*!40100 DEFAULT CHARACTER SET utf8mb4 */ /*!80016 DEFAULT ENCRYPTION='N' */",
+		"USE `db1`",
+		"DROP TABLE IF EXISTS `t1`",
+		"CREATE TABLE `t1` (\n  `id` int unsigned NOT NULL AUTO_INCREMENT,\n  `name` varchar(20) DEFAULT NULL COMMENT 'a;b',\n" +
+			"  `name_len` int GENERATED ALWAYS AS (length(`name`)) VIRTUAL,\n  PRIMARY KEY (`id`),\n  UNIQUE KEY `uk_name` (`name`)\n" +
+			") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4",
+		"CREATE TRIGGER `tr1` BEFORE INSERT ON `t1` FOR EACH ROW BEGIN\n  SET NEW.name = lower(NEW.name);\nEND",
+		"CREATE TABLE db2.t2 (a int, b enum('x','y'))",
+	}
+	if !reflect.DeepEqual(sqls, expected) {
+		t.Errorf("sqls of mysqldump file are:\n%q\nexpect:\n%q", sqls, expected)
+	}
+
+	sqls = SplitSqlsOfSchemaFile(testShowCreateTableFile)
+	expected = []string{"CREATE TABLE `t3` (\n  `k` bigint NOT NULL,\n  PRIMARY KEY (`k`)\n) ENGINE=InnoDB"}
+	if !reflect.DeepEqual(sqls, expected) {
+		t.Errorf("sqls of SHOW CREATE TABLE output are:\n%q\nexpect:\n%q", sqls, expected)
+	}
+
+	// outputs of SHOW CREATE TABLE ended with delimiter, one after another
+	sqls = SplitSqlsOfSchemaFile("Create Table: CREATE TABLE a (id int);\nCreate Table: CREATE TABLE b (id int)\n;\n")
+	expected = []string{"CREATE TABLE a (id int)", "CREATE TABLE b (id int)"}
+	if !reflect.DeepEqual(sqls, expected) {
+		t.Errorf("sqls of SHOW CREATE TABLE outputs ended with delimiter are %q, expect %q", sqls, expected)
+	}
+}
+
+func TestGetTblDefsOfSchemaFile(t *testing.T) {
+	if GLogger.Logger == nil {
+		GLogger.CreateNewRawLogger()
+		GLogger.ResetLogLevel(logging.ERROR)
+	}
+	dir, err := ioutil.TempDir("", "my2fback_rsql")
+	if err != nil {
+		t.Fatalf("fail to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{"a.sql": testSchemaDumpFile, "b.txt": testShowCreateTableFile}
+	for name, content := range files {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("fail to write %s: %v", name, err)
+		}
+	}
+	fileNames, err := GetSchemaFilesOfPath(dir)
+	if err != nil || !reflect.DeepEqual(fileNames, []string{filepath.Join(dir, "a.sql"), filepath.Join(dir, "b.txt")}) {
+		t.Fatalf("schema files of %s are %v, error: %v", dir, fileNames, err)
+	}
+
+	cfg := &ConfCmd{}
+	tbDefs, err := GetTblDefsOfSchemaFile(cfg, fileNames[0])
+	if err != nil {
+		t.Fatalf("fail to get table definitions of mysqldump file: %v", err)
+	}
+	if len(tbDefs) != 2 || tbDefs["db1.t1"] == nil || tbDefs["db2.t2"] == nil {
+		t.Fatalf("table definitions of mysqldump file are %v", tbDefs)
+	}
+	tbInfo := TableDefToTblInfoJson("db1.t1", tbDefs["db1.t1"], DdlPosInfo{})
+	expected := &TblInfoJson{Database: "db1", Table: "t1", PrimaryKey: KeyInfo{"id"}, UniqueKeys: []KeyInfo{{"name"}},
+		Columns: []FieldInfo{{FieldName: "id", FieldType: "int", Unsigned: true}, {FieldName: "name", FieldType: "varchar"},
+			{FieldName: "name_len", FieldType: "int", Generated: true}}}
+	for i := range tbInfo.Columns {
+		if len(tbInfo.Columns[i].EnumValues) == 0 {
+			tbInfo.Columns[i].EnumValues = nil
+		}
+	}
+	if !reflect.DeepEqual(tbInfo, expected) {
+		t.Errorf("table definition of db1.t1 is %+v, expect %+v", tbInfo, expected)
+	}
+	if idxes := tbInfo.GetGeneratedColumnIndices(); !reflect.DeepEqual(idxes, []int{2}) {
+		t.Errorf("generated columns of db1.t1 are %v", idxes)
+	}
+	if tbInfo = TableDefToTblInfoJson("db2.t2", tbDefs["db2.t2"], DdlPosInfo{}); !reflect.DeepEqual(tbInfo.Columns[1].EnumValues, []string{"x", "y"}) {
+		t.Errorf("values of enum column of db2.t2 are %v", tbInfo.Columns[1].EnumValues)
+	}
+
+	// table not qualified by database without use statement takes -rsqldb
+	if tbDefs, err = GetTblDefsOfSchemaFile(cfg, fileNames[1]); err != nil || len(tbDefs) != 0 {
+		t.Errorf("table definitions of SHOW CREATE TABLE output without -rsqldb are %v, error: %v", tbDefs, err)
+	}
+	cfg.ReadTblDefSqlDb = "db3"
+	if tbDefs, err = GetTblDefsOfSchemaFile(cfg, fileNames[1]); err != nil || len(tbDefs) != 1 || tbDefs["db3.t3"] == nil {
+		t.Errorf("table definitions of SHOW CREATE TABLE output with -rsqldb are %v, error: %v", tbDefs, err)
+	}
+}
+
+func TestExcludeColumnsFromImage(t *testing.T) {
+	cases := []struct {
+		bitmap   []byte
+		colCnt   int
+		idxes    []int
+		expected []byte
+	}{
+		{nil, 10, []int{2, 9}, []byte{0xfb, 0x01}},
+		{[]byte{0x0f}, 4, []int{1}, []byte{0x0d}},
+		{[]byte{0x05}, 4, nil, []byte{0x05}},
+		{[]byte{0x05}, 4, []int{1, 3, 8}, []byte{0x05}},
+	}
+	for _, c := range cases {
+		bitmap := append([]byte{}, c.bitmap...)
+		if newBitmap := ExcludeColumnsFromImage(c.bitmap, c.colCnt, c.idxes); !reflect.DeepEqual(newBitmap, c.expected) {
+			t.Errorf("ExcludeColumnsFromImage(%v, %d, %v) = %v, expect %v", c.bitmap, c.colCnt, c.idxes, newBitmap, c.expected)
+		}
+		if c.bitmap != nil && !reflect.DeepEqual(bitmap, c.bitmap) {
+			t.Errorf("bitmap %v is changed into %v", bitmap, c.bitmap)
+		}
+	}
+}
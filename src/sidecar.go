@@ -0,0 +1,249 @@
+package src
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/WangJiemin/jamintools/ehand"
+	"github.com/WangJiemin/jamintools/logging"
+	"github.com/juju/errors"
+	"github.com/siddontang/go-mysql/replication"
+)
+
+const C_sidecarIndexFileSuffix = ".trxidx.json"
+
+// SidecarTrx is one trx, or one statement like ddl, in sidecar index of binlog
+type SidecarTrx struct {
+	StartPos  uint32   `json:"start_position"`
+	EndPos    uint32   `json:"end_position"`
+	Timestamp uint32   `json:"timestamp"`
+	Gtid      string   `json:"gtid,omitempty"`
+	Tables    []string `json:"tables,omitempty"`    // db.tb of table map events
+	Statement bool     `json:"statement,omitempty"` // has query events other than BEGIN/COMMIT/ROLLBACK, such as ddl or dml of statement format, tables of them are unknown
+}
+
+// IfTargetTrx: trx touches any table of -dbs/-tbs, trx of statements is always target
+func (this SidecarTrx) IfTargetTrx(cfg *ConfCmd) bool {
+	if this.Statement {
+		return true
+	}
+	for _, tbKey := range this.Tables {
+		if cfg.IsTargetTable(GetDbTbFromAbsTbName(tbKey)) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+BinlogSidecarIndex is the sidecar index of one binlog written by -osidx, trx start positions, timestamps, gtids and tables touched.
+Later runs with -rsidx skip binlogs and trxs not touching -dbs/-tbs by it.
+*/
+type BinlogSidecarIndex struct {
+	Binlog     string       `json:"binlog"`
+	CreateTime uint32       `json:"create_time"` // timestamp of format description event, to verify the index is of the binlog
+	ServerId   uint32       `json:"server_id"`
+	EndPos     uint32       `json:"end_position"`
+	RotateTo   string       `json:"rotate_to,omitempty"`
+	Tables     []string     `json:"tables"` // tables of all trxs
+	Trxs       []SidecarTrx `json:"trxs"`
+
+	tracker    TrxGroupTracker
+	curTrx     int               // index of trx in progress in Trxs, -1 if not in trx
+	skipTrxs   map[uint32]uint32 // start => end position of trxs to skip for -rsidx
+	incomplete bool              // events are skipped or damaged while collecting, the index is not written
+}
+
+func NewBinlogSidecarIndex(binlog string) *BinlogSidecarIndex {
+	return &BinlogSidecarIndex{Binlog: binlog, EndPos: 4, curTrx: -1}
+}
+
+// CollectEvent adds the event starting at pos into index. Events in TRANSACTION_PAYLOAD_EVENT are collected with it
+func (this *BinlogSidecarIndex) CollectEvent(h *replication.EventHeader, e replication.Event, pos uint32) {
+	switch h.EventType {
+	case replication.FORMAT_DESCRIPTION_EVENT:
+		if this.CreateTime == 0 {
+			this.CreateTime = h.Timestamp
+			this.ServerId = h.ServerID
+		}
+	case replication.ROTATE_EVENT:
+		this.RotateTo = string(e.(*replication.RotateEvent).NextLogName)
+	}
+	ifGroupStart, ifGroupEnd := this.tracker.Track(h.EventType, e)
+	if ifGroupStart {
+		this.Trxs = append(this.Trxs, SidecarTrx{StartPos: pos, Timestamp: h.Timestamp})
+		this.curTrx = len(this.Trxs) - 1
+	}
+	if this.curTrx >= 0 {
+		trx := &this.Trxs[this.curTrx]
+		switch ev := e.(type) {
+		case *replication.GTIDEvent:
+			trx.Gtid = GetMysqlGtidStr(ev)
+		case *replication.MariadbGTIDEvent:
+			trx.Gtid = GetMariadbGtidStr(ev)
+		case *replication.TableMapEvent:
+			trx.AddTable(ev)
+		case *replication.QueryEvent:
+			query := strings.ToUpper(strings.TrimSpace(string(ev.Query)))
+			if query != "BEGIN" && query != "COMMIT" && query != "ROLLBACK" {
+				trx.Statement = true
+			}
+		case *replication.TransactionPayloadEvent:
+			for _, payloadEv := range ev.Events {
+				if tableMap, ok := payloadEv.Event.(*replication.TableMapEvent); ok {
+					trx.AddTable(tableMap)
+				}
+			}
+		}
+		trx.EndPos = pos + h.EventSize
+	}
+	if ifGroupEnd {
+		this.curTrx = -1
+	}
+	this.EndPos = pos + h.EventSize
+}
+
+func (this *SidecarTrx) AddTable(tableMap *replication.TableMapEvent) {
+	tbKey := GetAbsTableName(string(tableMap.Schema), string(tableMap.Table))
+	for _, oneTb := range this.Tables {
+		if oneTb == tbKey {
+			return
+		}
+	}
+	this.Tables = append(this.Tables, tbKey)
+}
+
+// WriteSidecarIndexFile writes index of binlog into dir as <binlog>.trxidx.json
+func (this *BinlogSidecarIndex) WriteSidecarIndexFile(dir string) error {
+	tables := map[string]bool{}
+	for _, trx := range this.Trxs {
+		for _, tbKey := range trx.Tables {
+			tables[tbKey] = true
+		}
+	}
+	this.Tables = make([]string, 0, len(tables))
+	for tbKey := range tables {
+		this.Tables = append(this.Tables, tbKey)
+	}
+	sort.Strings(this.Tables)
+
+	content, err := json.Marshal(this)
+	if err != nil {
+		return errors.Annotatef(err, "fail to marshal sidecar index of %s", this.Binlog)
+	}
+	indexFile := filepath.Join(dir, this.Binlog+C_sidecarIndexFileSuffix)
+	if err = ioutil.WriteFile(indexFile, content, 0644); err != nil {
+		return errors.Annotatef(err, "fail to write %s", indexFile)
+	}
+	GLogger.WriteToLogByFieldsNormalOnlyMsg(fmt.Sprintf("sidecar index of %s is written into %s, %d trxs", this.Binlog, indexFile, len(this.Trxs)),
+		logging.INFO)
+	return nil
+}
+
+// ReadSidecarIndexFile reads index of binlog in dir, nil if not exists
+func ReadSidecarIndexFile(dir string, binlog string) (*BinlogSidecarIndex, error) {
+	indexFile := filepath.Join(dir, binlog+C_sidecarIndexFileSuffix)
+	content, err := ioutil.ReadFile(indexFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Annotatef(err, "fail to read %s", indexFile)
+	}
+	index := NewBinlogSidecarIndex(binlog)
+	if err = json.Unmarshal(content, index); err != nil {
+		return nil, errors.Annotatef(err, "fail to parse %s", indexFile)
+	}
+	if index.Binlog != binlog {
+		return nil, errors.Errorf("%s is sidecar index of %s, not %s", indexFile, index.Binlog, binlog)
+	}
+	return index, nil
+}
+
+/*
+LoadSidecarIndexForParsing reads sidecar index of binlog for -rsidx, trxs not touching -dbs/-tbs are to be skipped.
+It returns nil if -rsidx is not set or there is no usable index, binlog is parsed as usual then.
+*/
+func LoadSidecarIndexForParsing(cfg *ConfCmd, binlog string) *BinlogSidecarIndex {
+	if cfg.SidecarIndexDir == "" {
+		return nil
+	}
+	index, err := ReadSidecarIndexFile(cfg.SidecarIndexDir, binlog)
+	if err != nil {
+		GLogger.WriteToLogByFieldsErrorExtramsgExitCode(err, "sidecar index is ignored", logging.WARNING, ehand.ERR_FILE_READ)
+		return nil
+	} else if index == nil {
+		GLogger.WriteToLogByFieldsNormalOnlyMsg(fmt.Sprintf("no sidecar index of %s found in %s, parse it without index", binlog, cfg.SidecarIndexDir),
+			logging.INFO)
+		return nil
+	}
+	index.skipTrxs = map[uint32]uint32{}
+	for _, trx := range index.Trxs {
+		if !trx.IfTargetTrx(cfg) {
+			index.skipTrxs[trx.StartPos] = trx.EndPos
+		}
+	}
+	GLogger.WriteToLogByFieldsNormalOnlyMsg(fmt.Sprintf("%d of %d trxs of %s do not touch target tables by sidecar index", len(index.skipTrxs), len(index.Trxs), binlog),
+		logging.INFO)
+	return index
+}
+
+// IfIndexOfBinlog checks the index is of the binlog by its format description event
+func (this *BinlogSidecarIndex) IfIndexOfBinlog(createTime uint32, serverId uint32) bool {
+	if createTime == this.CreateTime && serverId == this.ServerId {
+		return true
+	}
+	GLogger.WriteToLogByFieldsNormalOnlyMsg(fmt.Sprintf("sidecar index of %s is not of the binlog, the binlog is created at %d by server %d, but the index at %d by server %d. parse it without index",
+		this.Binlog, createTime, serverId, this.CreateTime, this.ServerId), logging.WARNING)
+	return false
+}
+
+// SkipTrxs skips trxs not touching -dbs/-tbs starting at pos, it returns the position reached
+func (this *BinlogSidecarIndex) SkipTrxs(r io.Reader, pos uint32) (uint32, error) {
+	for {
+		endPos, ok := this.skipTrxs[pos]
+		if !ok {
+			return pos, nil
+		}
+		if err := SkipBytes(r, int64(endPos-pos)); err != nil {
+			return pos, err
+		}
+		pos = endPos
+	}
+}
+
+/*
+SkipBinlogFileBySidecarIndex tells whether binlog file can be skipped for -rsidx, because no trx of it touches -dbs/-tbs.
+It also returns the binlog rotated to. Tar archive and stdin are never skipped, binlogs in them are skipped trx by trx.
+*/
+func SkipBinlogFileBySidecarIndex(cfg *ConfCmd, fileName string) (bool, string) {
+	if cfg.SidecarIndexDir == "" || fileName == C_binlogFromStdin {
+		return false, ""
+	}
+	binlog := GetBinlogNameFromFileName(fileName)
+	index, err := ReadSidecarIndexFile(cfg.SidecarIndexDir, binlog)
+	if err != nil || index == nil {
+		// reported when the binlog is parsed
+		return false, ""
+	}
+	for _, trx := range index.Trxs {
+		if trx.IfTargetTrx(cfg) {
+			return false, ""
+		}
+	}
+	binInfo, err := ReadBinlogFileInfo(fileName)
+	if err != nil || binInfo.FileType == C_binlogFileTypeTar {
+		return false, ""
+	}
+	if !index.IfIndexOfBinlog(binInfo.CreateTime, binInfo.ServerId) {
+		return false, ""
+	}
+	GLogger.WriteToLogByFieldsNormalOnlyMsg(fmt.Sprintf("skip %s, none of its %d trxs touches target tables by sidecar index", fileName, len(index.Trxs)),
+		logging.INFO)
+	return true, index.RotateTo
+}
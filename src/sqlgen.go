@@ -7,6 +7,7 @@ import (
 	"github.com/WangJiemin/jamintools/ehand"
 	"github.com/WangJiemin/jamintools/logging"
 	SQL "github.com/dropbox/godropbox/database/sqlbuilder"
+	"github.com/shopspring/decimal"
 	"github.com/siddontang/go-mysql/mysql"
 	"github.com/siddontang/go-mysql/replication"
 	sliceKits "github.com/toolkits/slice"
@@ -49,6 +50,7 @@ func GetMysqlDataTypeNameAndSqlColumn(tpDef string, colName string, tp byte, met
 		return "bigint", SQL.IntColumn(colName, SQL.NotNullable)
 
 	case mysql.MYSQL_TYPE_NEWDECIMAL:
+		// value is decimal.Decimal, rendered exactly
 		return "decimal", SQL.DoubleColumn(colName, SQL.NotNullable)
 
 	case mysql.MYSQL_TYPE_FLOAT:
@@ -152,17 +154,144 @@ func GetSqlFieldsEXpressions(colCnt int, colNames []FieldInfo, tbMap *replicatio
 	return colDefExps, colTypeNames
 }
 
-func GenEqualConditions(row []interface{}, colDefs []SQL.NonAliasColumn, uniKey []int, ifFullImage bool) []SQL.BoolExpression {
-	if !ifFullImage && len(uniKey) > 0 {
+/*
+IfUnsignedColumn tells whether the integer column is unsigned, by signedness in table map event written by mysql8.0 with binlog_row_metadata=MINIMAL|FULL,
+otherwise by table definition.
+*/
+func IfUnsignedColumn(colNames []FieldInfo, tbMap *replication.TableMapEvent, idx int) bool {
+	if len(tbMap.SignednessBitmap) > 0 {
+		return tbMap.IsUnsigned(idx)
+	}
+	return idx < len(colNames) && colNames[idx].Unsigned
+}
+
+// ConvertToUnsignedValue converts integer decoded from binlog as signed to unsigned of the same width
+func ConvertToUnsignedValue(v interface{}, tp byte) interface{} {
+	switch val := v.(type) {
+	case int8:
+		return uint8(val)
+	case int16:
+		return uint16(val)
+	case int32:
+		if tp == mysql.MYSQL_TYPE_INT24 {
+			return uint32(val) & 0xFFFFFF
+		}
+		return uint32(val)
+	case int64:
+		return uint64(val)
+	}
+	return v
+}
+
+// ConvertUnsignedColumnsOfRows converts values of unsigned integer columns, or they are negative in sqls and where conditions match nothing
+func ConvertUnsignedColumnsOfRows(rows [][]interface{}, colNames []FieldInfo, tbMap *replication.TableMapEvent) {
+	for ci, tp := range tbMap.ColumnType {
+		switch tp {
+		case mysql.MYSQL_TYPE_TINY, mysql.MYSQL_TYPE_SHORT, mysql.MYSQL_TYPE_INT24, mysql.MYSQL_TYPE_LONG, mysql.MYSQL_TYPE_LONGLONG:
+		default:
+			continue
+		}
+		if !IfUnsignedColumn(colNames, tbMap, ci) {
+			continue
+		}
+		for _, row := range rows {
+			if ci < len(row) {
+				row[ci] = ConvertToUnsignedValue(row[ci], tp)
+			}
+		}
+	}
+}
+
+// IfColumnInImage checks whether the column is logged in row image, binlog_row_image=minimal|noblob logs only part of columns
+func IfColumnInImage(bitmap []byte, idx int) bool {
+	if bitmap == nil {
+		return true
+	}
+	if idx/8 >= len(bitmap) {
+		return false
+	}
+	return bitmap[idx/8]&(1<<uint(idx%8)) != 0
+}
+
+func GetColumnsNotInImage(bitmap []byte, colCnt int) []int {
+	var idxes []int
+	for i := 0; i < colCnt; i++ {
+		if !IfColumnInImage(bitmap, i) {
+			idxes = append(idxes, i)
+		}
+	}
+	return idxes
+}
+
+/*
+GetRowImageAfterUpdate gets the row after update from both images of update rows event.
+column not logged in after image is not changed, its value is from before image.
+*/
+func GetRowImageAfterUpdate(rowBefore []interface{}, rowAfter []interface{}, bitmapBefore []byte, bitmapAfter []byte) ([]interface{}, []byte) {
+	row := make([]interface{}, len(rowAfter))
+	bitmap := make([]byte, (len(rowAfter)+7)/8)
+	for i := range rowAfter {
+		if IfColumnInImage(bitmapAfter, i) {
+			row[i] = rowAfter[i]
+		} else if IfColumnInImage(bitmapBefore, i) {
+			row[i] = rowBefore[i]
+		} else {
+			continue
+		}
+		bitmap[i/8] |= 1 << uint(i%8)
+	}
+	return row, bitmap
+}
+
+/*
+GetColumnsMissingForRollback returns columns which rollback of rows event needs but are not logged, binlog_row_image=minimal|noblob.
+rollback of insert is delete identified by columns logged, nothing is missing.
+rollback of delete is insert, all columns of before image are needed.
+rollback of update sets back every column logged in after image, their values of before image are needed.
+*/
+func GetColumnsMissingForRollback(rEv *replication.RowsEvent, sqlType string) []int {
+	colCnt := int(rEv.ColumnCount)
+	switch sqlType {
+	case "delete":
+		return GetColumnsNotInImage(rEv.ColumnBitmap1, colCnt)
+	case "update":
+		var idxes []int
+		for i := 0; i < colCnt; i++ {
+			if IfColumnInImage(rEv.ColumnBitmap2, i) && !IfColumnInImage(rEv.ColumnBitmap1, i) {
+				idxes = append(idxes, i)
+			}
+		}
+		return idxes
+	}
+	return nil
+}
+
+func GenEqualConditions(row []interface{}, colDefs []SQL.NonAliasColumn, uniKey []int, ifFullImage bool, bitmap []byte) []SQL.BoolExpression {
+	// unique key not logged in row image cannot identify the row
+	ifUniKeyInImage := len(uniKey) > 0
+	for _, idx := range uniKey {
+		if !IfColumnInImage(bitmap, idx) {
+			ifUniKeyInImage = false
+			break
+		}
+	}
+	if !ifFullImage && ifUniKeyInImage {
 		expArrs := make([]SQL.BoolExpression, len(uniKey))
 		for k, idx := range uniKey {
 			expArrs[k] = SQL.EqL(colDefs[idx], row[idx])
 		}
 		return expArrs
 	}
-	expArrs := make([]SQL.BoolExpression, len(row))
+	expArrs := make([]SQL.BoolExpression, 0, len(row))
 	for i, v := range row {
-		expArrs[i] = SQL.EqL(colDefs[i], v)
+		if !IfColumnInImage(bitmap, i) {
+			continue
+		}
+		// json diffs are not the value of column
+		if _, ok := v.(replication.JsonDiffVector); ok {
+			continue
+		}
+		expArrs = append(expArrs, SQL.EqL(colDefs[i], v))
 	}
 	return expArrs
 }
@@ -219,6 +348,7 @@ func GenInsertSqlsForOneRowsEvent(posStr string, rEv *replication.RowsEvent, col
 		table      string               = string(rEv.Table.Table)
 		sqlArr     []string
 		sqlType    string
+		ignoreIdx  []int
 	)
 
 	if ifRollback {
@@ -232,12 +362,18 @@ func GenInsertSqlsForOneRowsEvent(posStr string, rEv *replication.RowsEvent, col
 		ifIgnorePrimary = false
 	}
 	if ifIgnorePrimary {
-		newColDefs = GetColDefIgnorePrimary(colDefs, primaryIdx)
+		ignoreIdx = append(ignoreIdx, primaryIdx...)
+	}
+	// columns not logged in row image take their default values
+	ignoreIdx = append(ignoreIdx, GetColumnsNotInImage(rEv.ColumnBitmap1, len(colDefs))...)
+	if len(ignoreIdx) > 0 {
+		ifIgnorePrimary = true
+		newColDefs = GetColDefIgnorePrimary(colDefs, ignoreIdx)
 	}
 	for i = 0; i < rowCnt; i += rowsPerSql {
 		insertSql = SQL.NewTable(table, newColDefs...).Insert(newColDefs...)
 		endIndex = GetMinValue(rowCnt, i+rowsPerSql)
-		oneSql, err = GenInsertSqlForRows(rEv.Rows[i:endIndex], insertSql, schema, ifprefixDb, ifIgnorePrimary, primaryIdx)
+		oneSql, err = GenInsertSqlForRows(rEv.Rows[i:endIndex], insertSql, schema, ifprefixDb, ifIgnorePrimary, ignoreIdx)
 		if err != nil {
 			GLogger.WriteToLogByFieldsExitMsgNoErr(fmt.Sprintf("Fail to generate %s sql for %s %s \n\terror: %s\n\trows data:%v",
 				sqlType, GetAbsTableName(schema, table), posStr, err, rEv.Rows[i:endIndex]), logging.ERROR, ehand.ERR_ERROR)
@@ -249,7 +385,7 @@ func GenInsertSqlsForOneRowsEvent(posStr string, rEv *replication.RowsEvent, col
 
 	if endIndex < rowCnt {
 		insertSql = SQL.NewTable(table, newColDefs...).Insert(newColDefs...)
-		oneSql, err = GenInsertSqlForRows(rEv.Rows[endIndex:rowCnt], insertSql, schema, ifprefixDb, ifIgnorePrimary, primaryIdx)
+		oneSql, err = GenInsertSqlForRows(rEv.Rows[endIndex:rowCnt], insertSql, schema, ifprefixDb, ifIgnorePrimary, ignoreIdx)
 		if err != nil {
 			GLogger.WriteToLogByFieldsExitMsgNoErr(fmt.Sprintf("Fail to generate %s sql for %s %s \n\terror: %s\n\trows data:%v",
 				sqlType, GetAbsTableName(schema, table), posStr, err, rEv.Rows[endIndex:rowCnt]), logging.ERROR, ehand.ERR_ERROR)
@@ -284,7 +420,7 @@ func GenDeleteSqlsForOneRowsEvent(posStr string, rEv *replication.RowsEvent, col
 		sqlType = "delete"
 	}
 	for i, row := range rEv.Rows {
-		whereCond := GenEqualConditions(row, colDefs, uniKey, ifFullImage)
+		whereCond := GenEqualConditions(row, colDefs, uniKey, ifFullImage, rEv.ColumnBitmap1)
 
 		sql, err := SQL.NewTable(table, colDefs...).Delete().Where(SQL.And(whereCond...)).String(schemaInSql)
 		if err != nil {
@@ -302,14 +438,36 @@ func GenInsertSqlsForOneRowsEventRollbackDelete(posStr string, rEv *replication.
 	return GenInsertSqlsForOneRowsEvent(posStr, rEv, colDefs, rowsPerSql, true, ifprefixDb, false, []int{})
 }
 
-func GenUpdateSetPart(colsTypeNameFromMysql []string, colTypeNames []string, updateSql SQL.UpdateStatement, colDefs []SQL.NonAliasColumn, rowAfter []interface{}, rowBefore []interface{}, ifFullImage bool) SQL.UpdateStatement {
+func GenUpdateSetPart(posStr string, colsTypeNameFromMysql []string, colTypeNames []string, updateSql SQL.UpdateStatement, colDefs []SQL.NonAliasColumn, rowAfter []interface{}, rowBefore []interface{}, ifFullImage bool,
+	bitmapAfter []byte, bitmapBefore []byte) SQL.UpdateStatement {
 
 	ifUpdateCol := false
 	for i, v := range rowAfter {
 		ifUpdateCol = false
 		//fmt.Printf("type: %s\nbefore: %v\nafter: %v\n", colTypeNames[i], rowBefore[i], v)
 
-		if !ifFullImage {
+		// column not logged in after image is not changed
+		if !IfColumnInImage(bitmapAfter, i) {
+			continue
+		}
+
+		// json column logged as diffs by PARTIAL_UPDATE_ROWS_EVENT
+		if diffs, ok := v.(replication.JsonDiffVector); ok {
+			updateSql.Set(colDefs[i], GenJsonDiffExpression(colDefs[i], diffs))
+			continue
+		}
+		if diffs, ok := rowBefore[i].(replication.JsonDiffVector); ok {
+			jsonExp, err := GenJsonDiffRollbackExpression(posStr, colDefs[i], v, diffs)
+			if err != nil {
+				GLogger.WriteToLogByFieldsErrorExtramsgExitCode(err, fmt.Sprintf("fail to generate rollback of json diffs %v, skip the column", diffs),
+					logging.ERROR, ehand.ERR_ERROR)
+				continue
+			}
+			updateSql.Set(colDefs[i], jsonExp)
+			continue
+		}
+
+		if !ifFullImage && IfColumnInImage(bitmapBefore, i) {
 			// text is stored as blob in binlog
 			if sliceKits.ContainsString(G_Bytes_Column_Types, colTypeNames[i]) && !strings.Contains(strings.ToLower(colsTypeNameFromMysql[i]), "text") {
 				aArr, aOk := v.([]byte)
@@ -328,6 +486,10 @@ func GenUpdateSetPart(colsTypeNameFromMysql []string, colTypeNames []string, upd
 					ifUpdateCol = true
 				}
 
+			} else if aDec, ok := v.(decimal.Decimal); ok {
+				// decimal holds pointer, compare by value
+				bDec, bOk := rowBefore[i].(decimal.Decimal)
+				ifUpdateCol = !bOk || !aDec.Equal(bDec)
 			} else {
 				if v == rowBefore[i] {
 					//fmt.Println("compare equal")
@@ -375,11 +537,12 @@ func GenUpdateSqlsForOneRowsEvent(posStr string, colsTypeNameFromMysql []string,
 	for i := 0; i < rowCnt; i += 2 {
 		upSql := SQL.NewTable(table, colDefs...).Update()
 		if ifRollback {
-			upSql = GenUpdateSetPart(colsTypeNameFromMysql, colsTypeName, upSql, colDefs, rEv.Rows[i], rEv.Rows[i+1], ifFullImage)
-			wherePart = GenEqualConditions(rEv.Rows[i+1], colDefs, uniKey, ifFullImage)
+			upSql = GenUpdateSetPart(posStr, colsTypeNameFromMysql, colsTypeName, upSql, colDefs, rEv.Rows[i], rEv.Rows[i+1], ifFullImage, rEv.ColumnBitmap1, rEv.ColumnBitmap2)
+			whereRow, whereBitmap := GetRowImageAfterUpdate(rEv.Rows[i], rEv.Rows[i+1], rEv.ColumnBitmap1, rEv.ColumnBitmap2)
+			wherePart = GenEqualConditions(whereRow, colDefs, uniKey, ifFullImage, whereBitmap)
 		} else {
-			upSql = GenUpdateSetPart(colsTypeNameFromMysql, colsTypeName, upSql, colDefs, rEv.Rows[i+1], rEv.Rows[i], ifFullImage)
-			wherePart = GenEqualConditions(rEv.Rows[i], colDefs, uniKey, ifFullImage)
+			upSql = GenUpdateSetPart(posStr, colsTypeNameFromMysql, colsTypeName, upSql, colDefs, rEv.Rows[i+1], rEv.Rows[i], ifFullImage, rEv.ColumnBitmap2, rEv.ColumnBitmap1)
+			wherePart = GenEqualConditions(rEv.Rows[i], colDefs, uniKey, ifFullImage, rEv.ColumnBitmap1)
 		}
 
 		upSql.Where(SQL.And(wherePart...))
@@ -0,0 +1,229 @@
+package src
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	SQL "github.com/dropbox/godropbox/database/sqlbuilder"
+	"github.com/shopspring/decimal"
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+)
+
+func TestIfColumnInImage(t *testing.T) {
+	bitmap := []byte{0x05, 0x80} // columns 0, 2 and 15
+	cases := []struct {
+		bitmap []byte
+		idx    int
+		in     bool
+	}{
+		{nil, 0, true},
+		{nil, 100, true},
+		{bitmap, 0, true},
+		{bitmap, 1, false},
+		{bitmap, 2, true},
+		{bitmap, 8, false},
+		{bitmap, 15, true},
+		{bitmap, 16, false},
+	}
+	for _, c := range cases {
+		if in := IfColumnInImage(c.bitmap, c.idx); in != c.in {
+			t.Errorf("IfColumnInImage(%v, %d) = %v, expect %v", c.bitmap, c.idx, in, c.in)
+		}
+	}
+
+	if idxes := GetColumnsNotInImage(bitmap, 10); !reflect.DeepEqual(idxes, []int{1, 3, 4, 5, 6, 7, 8, 9}) {
+		t.Errorf("columns not in image are %v", idxes)
+	}
+	if idxes := GetColumnsNotInImage(nil, 10); idxes != nil {
+		t.Errorf("columns not in full image are %v", idxes)
+	}
+}
+
+func TestGetRowImageAfterUpdate(t *testing.T) {
+	// before image logs primary key a and blob c(noblob logs changed blob), after image logs b and c
+	rowBefore := []interface{}{1, nil, []byte("old"), nil}
+	rowAfter := []interface{}{nil, "x", []byte("new"), nil}
+	row, bitmap := GetRowImageAfterUpdate(rowBefore, rowAfter, []byte{0x05}, []byte{0x06})
+	if !reflect.DeepEqual(row, []interface{}{1, "x", []byte("new"), nil}) {
+		t.Errorf("row after update is %v", row)
+	}
+	if !reflect.DeepEqual(bitmap, []byte{0x07}) {
+		t.Errorf("bitmap of row after update is %v", bitmap)
+	}
+
+	// full images
+	row, bitmap = GetRowImageAfterUpdate([]interface{}{1, "a"}, []interface{}{1, "b"}, nil, nil)
+	if !reflect.DeepEqual(row, []interface{}{1, "b"}) || !reflect.DeepEqual(bitmap, []byte{0x03}) {
+		t.Errorf("row after update of full images is %v, bitmap %v", row, bitmap)
+	}
+}
+
+func TestGetColumnsMissingForRollback(t *testing.T) {
+	cases := []struct {
+		name    string
+		sqlType string
+		bitmap1 []byte
+		bitmap2 []byte
+		missing []int
+	}{
+		{"insert of minimal image", "insert", []byte{0x01}, nil, nil},
+		{"delete of full image", "delete", []byte{0x0f}, nil, nil},
+		{"delete of minimal image", "delete", []byte{0x01}, nil, []int{1, 2, 3}},
+		{"update of full image", "update", []byte{0x0f}, []byte{0x0f}, nil},
+		{"update of minimal image", "update", []byte{0x01}, []byte{0x06}, []int{1, 2}},
+		{"update of noblob image", "update", []byte{0x0b}, []byte{0x0e}, []int{2}},
+	}
+	for _, c := range cases {
+		rEv := &replication.RowsEvent{ColumnCount: 4, ColumnBitmap1: c.bitmap1, ColumnBitmap2: c.bitmap2}
+		if missing := GetColumnsMissingForRollback(rEv, c.sqlType); !reflect.DeepEqual(missing, c.missing) {
+			t.Errorf("%s: columns missing for rollback are %v, expect %v", c.name, missing, c.missing)
+		}
+	}
+}
+
+// genTestUpdateSql generates update sql of table db.t(id int, amount decimal) from both images, only id is in where condition
+func genTestUpdateSql(t *testing.T, rowAfter []interface{}, rowBefore []interface{}, ifFullImage bool) string {
+	_, idCol := GetMysqlDataTypeNameAndSqlColumn("int", "id", mysql.MYSQL_TYPE_LONG, 0)
+	_, amountCol := GetMysqlDataTypeNameAndSqlColumn("decimal(65,30)", "amount", mysql.MYSQL_TYPE_NEWDECIMAL, 0)
+	colDefs := []SQL.NonAliasColumn{idCol, amountCol}
+	upSql := SQL.NewTable("t", colDefs...).Update()
+	upSql = GenUpdateSetPart("mysql-bin.000001 4-100", []string{"int", "decimal(65,30)"}, []string{"int", "decimal"}, upSql, colDefs,
+		rowAfter, rowBefore, ifFullImage, nil, nil)
+	upSql.Where(SQL.EqL(idCol, rowBefore[0]))
+	sql, err := upSql.String("db")
+	if err != nil {
+		t.Fatalf("fail to generate update sql of %v => %v: %v", rowBefore, rowAfter, err)
+	}
+	return sql
+}
+
+func TestDecimalValueInSql(t *testing.T) {
+	// values are decoded from binlog as strings with all digits of scale
+	cases := []struct {
+		value    string
+		expected string
+	}{
+		{"123.4500", "123.45"},
+		{"-123.4500", "-123.45"},
+		{"99999999.99", "99999999.99"},
+		{"-0.0001", "-0.0001"},
+		{"0.0000", "0"},
+		{"-0.0000", "0"},
+		{"0", "0"},
+		{"10", "10"},
+		// decimal(65,30), beyond precision of float64
+		{"12345678901234567890123456789012345.123456789012345678901234567890", "12345678901234567890123456789012345.12345678901234567890123456789"},
+		{"-0.000000000000000000000000000001", "-0.000000000000000000000000000001"},
+	}
+	for _, c := range cases {
+		sql := genTestUpdateSql(t, []interface{}{1, decimal.RequireFromString(c.value)}, []interface{}{1, nil}, true)
+		expected := "UPDATE `db`.`t` SET `id`=1, `amount`=" + c.expected + " WHERE `id`=1"
+		if sql != expected {
+			t.Errorf("sql of decimal %s is %s, expect %s", c.value, sql, expected)
+		}
+	}
+}
+
+func TestGenUpdateSetPartOfDecimal(t *testing.T) {
+	// without full image, unchanged columns are not set
+	cases := []struct {
+		before   interface{}
+		after    interface{}
+		expected string
+	}{
+		{decimal.RequireFromString("1.50"), decimal.RequireFromString("1.5000"), "UPDATE `db`.`t` SET `id`=2 WHERE `id`=1"},
+		{decimal.RequireFromString("0.00"), decimal.RequireFromString("-0.0000"), "UPDATE `db`.`t` SET `id`=2 WHERE `id`=1"},
+		{decimal.RequireFromString("-12.3400"), decimal.RequireFromString("-12.34"), "UPDATE `db`.`t` SET `id`=2 WHERE `id`=1"},
+		{decimal.RequireFromString("1.5000"), decimal.RequireFromString("1.5001"), "UPDATE `db`.`t` SET `id`=2, `amount`=1.5001 WHERE `id`=1"},
+		{decimal.RequireFromString("12.34"), decimal.RequireFromString("-12.34"), "UPDATE `db`.`t` SET `id`=2, `amount`=-12.34 WHERE `id`=1"},
+		{decimal.RequireFromString("0.0001"), decimal.RequireFromString("0.0000"), "UPDATE `db`.`t` SET `id`=2, `amount`=0 WHERE `id`=1"},
+		{decimal.RequireFromString("12345678901234567890.000000000000000000000000000001"), decimal.RequireFromString("12345678901234567890.000000000000000000000000000002"),
+			"UPDATE `db`.`t` SET `id`=2, `amount`=12345678901234567890.000000000000000000000000000002 WHERE `id`=1"},
+		{nil, decimal.RequireFromString("0"), "UPDATE `db`.`t` SET `id`=2, `amount`=0 WHERE `id`=1"},
+	}
+	for _, c := range cases {
+		if sql := genTestUpdateSql(t, []interface{}{2, c.after}, []interface{}{1, c.before}, false); sql != c.expected {
+			t.Errorf("sql of decimal %v => %v is %s, expect %s", c.before, c.after, sql, c.expected)
+		}
+	}
+}
+
+func TestConvertToUnsignedValue(t *testing.T) {
+	cases := []struct {
+		value    interface{}
+		tp       byte
+		expected interface{}
+	}{
+		{int8(-1), mysql.MYSQL_TYPE_TINY, uint8(math.MaxUint8)},
+		{int8(math.MinInt8), mysql.MYSQL_TYPE_TINY, uint8(128)},
+		{int16(-1), mysql.MYSQL_TYPE_SHORT, uint16(math.MaxUint16)},
+		{int16(math.MinInt16), mysql.MYSQL_TYPE_SHORT, uint16(32768)},
+		{int32(-1), mysql.MYSQL_TYPE_INT24, uint32(16777215)},
+		{int32(-8388608), mysql.MYSQL_TYPE_INT24, uint32(8388608)},
+		{int32(-1), mysql.MYSQL_TYPE_LONG, uint32(math.MaxUint32)},
+		{int32(math.MinInt32), mysql.MYSQL_TYPE_LONG, uint32(2147483648)},
+		{int64(-1), mysql.MYSQL_TYPE_LONGLONG, uint64(math.MaxUint64)},
+		{int64(math.MinInt64), mysql.MYSQL_TYPE_LONGLONG, uint64(9223372036854775808)},
+		// non-negative values are kept
+		{int8(0), mysql.MYSQL_TYPE_TINY, uint8(0)},
+		{int8(math.MaxInt8), mysql.MYSQL_TYPE_TINY, uint8(math.MaxInt8)},
+		{int16(math.MaxInt16), mysql.MYSQL_TYPE_SHORT, uint16(math.MaxInt16)},
+		{int32(8388607), mysql.MYSQL_TYPE_INT24, uint32(8388607)},
+		{int32(math.MaxInt32), mysql.MYSQL_TYPE_LONG, uint32(math.MaxInt32)},
+		{int64(math.MaxInt64), mysql.MYSQL_TYPE_LONGLONG, uint64(math.MaxInt64)},
+		// null and values not of signed integers are passed through
+		{nil, mysql.MYSQL_TYPE_LONG, nil},
+		{uint32(5), mysql.MYSQL_TYPE_LONG, uint32(5)},
+		{float64(-1.5), mysql.MYSQL_TYPE_DOUBLE, float64(-1.5)},
+		{"-1", mysql.MYSQL_TYPE_VARCHAR, "-1"},
+	}
+	for _, c := range cases {
+		if v := ConvertToUnsignedValue(c.value, c.tp); !reflect.DeepEqual(v, c.expected) {
+			t.Errorf("ConvertToUnsignedValue(%T(%v), %d) = %T(%v), expect %T(%v)", c.value, c.value, c.tp, v, v, c.expected, c.expected)
+		}
+	}
+}
+
+func TestConvertUnsignedColumnsOfRows(t *testing.T) {
+	// id int unsigned, a tinyint, b smallint unsigned, c mediumint unsigned, d bigint unsigned, e varchar(10), f decimal(5,2) unsigned
+	colTypes := []byte{mysql.MYSQL_TYPE_LONG, mysql.MYSQL_TYPE_TINY, mysql.MYSQL_TYPE_SHORT, mysql.MYSQL_TYPE_INT24,
+		mysql.MYSQL_TYPE_LONGLONG, mysql.MYSQL_TYPE_VARCHAR, mysql.MYSQL_TYPE_NEWDECIMAL}
+	colNames := []FieldInfo{{FieldName: "id", FieldType: "int", Unsigned: true}, {FieldName: "a", FieldType: "tinyint"},
+		{FieldName: "b", FieldType: "smallint", Unsigned: true}, {FieldName: "c", FieldType: "mediumint", Unsigned: true},
+		{FieldName: "d", FieldType: "bigint", Unsigned: true}, {FieldName: "e", FieldType: "varchar"},
+		{FieldName: "f", FieldType: "decimal", Unsigned: true}}
+	dec := decimal.RequireFromString("1.25")
+	genRows := func() [][]interface{} {
+		return [][]interface{}{
+			{int32(-1), int8(-1), int16(-2), int32(-3), int64(-4), "x", dec},
+			{int32(5), nil, nil, int32(0), nil, nil, nil},
+		}
+	}
+	expected := [][]interface{}{
+		{uint32(math.MaxUint32), int8(-1), uint16(65534), uint32(16777213), uint64(math.MaxUint64 - 3), "x", dec},
+		{uint32(5), nil, nil, uint32(0), nil, nil, nil},
+	}
+
+	// signedness from table definition
+	rows := genRows()
+	ConvertUnsignedColumnsOfRows(rows, colNames, &replication.TableMapEvent{ColumnType: colTypes})
+	if !reflect.DeepEqual(rows, expected) {
+		t.Errorf("rows converted by table definition are %v, expect %v", rows, expected)
+	}
+
+	// signedness from optional metadata of table map event, for numeric columns only: id a b c d f
+	rows = genRows()
+	ConvertUnsignedColumnsOfRows(rows, nil, &replication.TableMapEvent{ColumnType: colTypes, SignednessBitmap: []byte{0xbc}})
+	if !reflect.DeepEqual(rows, expected) {
+		t.Errorf("rows converted by signedness of table map are %v, expect %v", rows, expected)
+	}
+
+	// no column is unsigned
+	rows = genRows()
+	ConvertUnsignedColumnsOfRows(rows, nil, &replication.TableMapEvent{ColumnType: colTypes})
+	if !reflect.DeepEqual(rows, genRows()) {
+		t.Errorf("rows of signed columns are converted into %v", rows)
+	}
+}
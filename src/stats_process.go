@@ -11,28 +11,41 @@ import (
 	"github.com/WangJiemin/jamintools/dsql"
 	"github.com/WangJiemin/jamintools/ehand"
 	"github.com/WangJiemin/jamintools/logging"
+	"github.com/siddontang/go-mysql/mysql"
 	"github.com/siddontang/go-mysql/replication"
 )
 
 const (
-	cOrgSqlFileBaseName string = "original_sql"
+	cOrgSqlFileBaseName  string = "original_sql"
+	C_relayPosColumnName string = "relaypos"
 )
 
+// GetRelayPosStr is like relay-bin.000003:1234, the end position of event in relay log
+func GetRelayPosStr(relayPos mysql.Position) string {
+	return fmt.Sprintf("%s:%d", relayPos.Name, relayPos.Pos)
+}
+
 var (
 	//gDdlRegexp *regexp.Regexp = regexp.MustCompile(C_ddlRegexp)
 
 	Stats_Result_Header_Column_names []string = []string{"binlog", "starttime", "stoptime",
 		"startpos", "stoppos", "inserts", "updates", "deletes", "database", "table"}
-	Stats_DDL_Header_Column_names        []string = []string{"datetime", "binlog", "startpos", "stoppos", "sql"}
-	Stats_BigLongTrx_Header_Column_names []string = []string{"binlog", "starttime", "stoptime", "startpos", "stoppos", "rows", "duration", "tables"}
+	Stats_DDL_Header_Column_names        []string = []string{"datetime", "binlog", "startpos", "stoppos", "serverid", "gtid", "xid", "sql"}
+	Stats_BigLongTrx_Header_Column_names []string = []string{"binlog", "starttime", "stoptime", "startpos", "stoppos", "rows", "duration",
+		"serverid", "gtid", "xid", "tables"}
 )
 
 type OrgSqlPrint struct {
-	Binlog   string
-	StartPos uint32
-	StopPos  uint32
-	DateTime uint32
-	QuerySql string
+	Binlog     string
+	StartPos   uint32
+	StopPos    uint32
+	DateTime   uint32
+	QuerySql   string
+	ServerId   uint32
+	Gtid       string
+	RelayPos   mysql.Position
+	Incomplete bool               // for -tolerant, the trx is affected by damaged events
+	Checkpoint *CheckpointBarrier // only the barrier, not an event
 }
 
 type BinEventStats struct {
@@ -46,19 +59,27 @@ type BinEventStats struct {
 	RowCnt        uint32
 	QuerySql      string        // for type=query
 	ParsedSqlInfo *dsql.SqlInfo // for ddl
+	ServerId      uint32
+	Gtid          string
+	Xid           uint64             // for commit and ddl
+	RelayPos      mysql.Position     // for -relay
+	Incomplete    bool               // for -tolerant, the trx is affected by damaged events
+	Damaged       bool               // for -tolerant, only a marker that events from StartPos to StopPos are damaged and skipped
+	Checkpoint    *CheckpointBarrier // only the barrier, not an event
 }
 
 type BinEventStatsPrint struct {
-	Binlog    string
-	StartTime uint32
-	StopTime  uint32
-	StartPos  uint32
-	StopPos   uint32
-	Database  string
-	Table     string
-	Inserts   uint32
-	Updates   uint32
-	Deletes   uint32
+	Binlog     string
+	StartTime  uint32
+	StopTime   uint32
+	StartPos   uint32
+	StopPos    uint32
+	Database   string
+	Table      string
+	Inserts    uint32
+	Updates    uint32
+	Deletes    uint32
+	Incomplete bool
 }
 
 /*
@@ -82,7 +103,23 @@ type BigLongTrxInfo struct {
 	RowCnt     uint32                       // total row count for all statement
 	Duration   uint32                       // how long the trx lasts
 	Statements map[string]map[string]uint32 // rowcnt for each type statment: insert, update, delete. {db1.tb1:{insert:0, update:2, delete:10}}
+	ServerId   uint32
+	Gtid       string
+	Xid        uint64
+	RelayPos   mysql.Position // start position of trx in relay log
+	Incomplete bool           // for -tolerant, some events of the trx are damaged and skipped
+
+}
 
+// GetOrgSqlFromBinEvent returns the original sql of rows events, from ROWS_QUERY_EVENT of mysql or MARIADB_ANNOTATE_ROWS_EVENT of mariadb
+func GetOrgSqlFromBinEvent(h *replication.EventHeader, e replication.Event) (string, bool) {
+	switch h.EventType {
+	case replication.ROWS_QUERY_EVENT:
+		return string(e.(*replication.RowsQueryEvent).Query), true
+	case replication.MARIADB_ANNOTATE_ROWS_EVENT:
+		return string(e.(*replication.MariadbAnnotateRowsEvent).Query), true
+	}
+	return "", false
 }
 
 func GetOrgSqlFileName(binFile string) string {
@@ -95,14 +132,28 @@ func PrintOrgSqlToFile(outputDir string, orgSqlChan chan OrgSqlPrint, wg *sync.W
 	var (
 		fh          *os.File
 		err         error
-		headerLine  string = GetDdlPrintHeaderLine(Stats_DDL_Header_Column_names)
+		headerLine  string = GetDdlPrintHeaderLine(GetDdlHeaderColumnNames())
 		lastBinFile string = ""
 		sqlFileFull string
+		ifNewFile   bool
+		fileSizes   map[string]int64 = map[string]int64{} // sizes of files closed, for checkpoint
 	)
 	GLogger.WriteToLogByFieldsNormalOnlyMsg("start a thread to print orginal sql", logging.INFO)
 	for pev := range orgSqlChan {
+		if pev.Checkpoint != nil {
+			for fn, size := range GetOutputFileSizes(fh) {
+				fileSizes[fn] = size
+			}
+			GCheckpoint.Report(pev.Checkpoint, fileSizes)
+			continue
+		}
 		if lastBinFile == "" || lastBinFile != pev.Binlog {
 			if fh != nil {
+				if GCheckpoint != nil {
+					for fn, size := range GetOutputFileSizes(fh) {
+						fileSizes[fn] = size
+					}
+				}
 				err = fh.Close()
 				if err != nil {
 					GLogger.WriteToLogByFieldsErrorExtramsgExitCode(err, "error to close file "+sqlFileFull,
@@ -110,43 +161,51 @@ func PrintOrgSqlToFile(outputDir string, orgSqlChan chan OrgSqlPrint, wg *sync.W
 				}
 			}
 			sqlFileFull = filepath.Join(outputDir, GetOrgSqlFileName(pev.Binlog))
-			fh, err = os.OpenFile(sqlFileFull, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+			fh, ifNewFile, err = OpenOutputFile(sqlFileFull)
 			if err != nil {
 				GLogger.WriteToLogByFieldsErrorExtramsgExit(err, "error to open file "+sqlFileFull,
 					logging.ERROR, ehand.ERR_ERROR)
 			}
-			fh.WriteString(headerLine)
+			if ifNewFile {
+				fh.WriteString(headerLine)
+			}
 		}
 		lastBinFile = pev.Binlog
-		fh.WriteString(GetDdlInfoContentLine(pev.Binlog, pev.StartPos, pev.StopPos, pev.DateTime, pev.QuerySql))
+		fh.WriteString(GetDdlInfoContentLine(pev.Binlog, pev.StartPos, pev.StopPos, pev.DateTime, pev.ServerId, pev.Gtid, 0, pev.RelayPos, pev.Incomplete, pev.QuerySql))
+	}
+	if fh != nil {
+		fh.Close()
 	}
-	fh.Close()
 	GLogger.WriteToLogByFieldsNormalOnlyMsg("exit thread to print orginal sql", logging.INFO)
 }
 
 func OpenStatsResultFiles(cfg *ConfCmd) (*os.File, *os.File, *os.File) {
 	// stat file
 	statFile := filepath.Join(cfg.OutputDir, "binlog_status.txt")
-	statFH, err := os.OpenFile(statFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	statFH, ifNewFile, err := OpenOutputFile(statFile)
 	if err != nil {
 		GLogger.WriteToLogByFieldsErrorExtramsgExit(err, "fail to open file "+statFile, logging.ERROR, ehand.ERR_FILE_OPEN)
 	}
 
-	statFH.WriteString(GetStatsPrintHeaderLine(Stats_Result_Header_Column_names))
+	if ifNewFile {
+		statFH.WriteString(GetStatsPrintHeaderLine(GetStatsHeaderColumnNames()))
+	}
 
 	// ddl file
 	ddlFile := filepath.Join(cfg.OutputDir, "ddl_info.txt")
-	ddlFH, err := os.OpenFile(ddlFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	ddlFH, ifNewFile, err := OpenOutputFile(ddlFile)
 	if err != nil {
 		statFH.Close()
 		GLogger.WriteToLogByFieldsErrorExtramsgExit(err, "fail to open file "+ddlFile, logging.ERROR, ehand.ERR_FILE_OPEN)
 	}
 
-	ddlFH.WriteString(GetDdlPrintHeaderLine(Stats_DDL_Header_Column_names))
+	if ifNewFile {
+		ddlFH.WriteString(GetDdlPrintHeaderLine(GetDdlHeaderColumnNames()))
+	}
 
 	// big/long trx info
 	biglongFile := filepath.Join(cfg.OutputDir, "binlog_biglong_trx.txt")
-	biglongFH, err := os.OpenFile(biglongFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	biglongFH, ifNewFile, err := OpenOutputFile(biglongFile)
 	if err != nil {
 		statFH.Close()
 		ddlFH.Close()
@@ -154,7 +213,9 @@ func OpenStatsResultFiles(cfg *ConfCmd) (*os.File, *os.File, *os.File) {
 
 	}
 
-	biglongFH.WriteString(GetBigLongTrxPrintHeaderLine(Stats_BigLongTrx_Header_Column_names))
+	if ifNewFile {
+		biglongFH.WriteString(GetBigLongTrxPrintHeaderLine(GetBigLongTrxHeaderColumnNames()))
+	}
 
 	return statFH, ddlFH, biglongFH
 	//return bufio.NewWriter(statFH), bufio.NewWriter(ddlFH), bufio.NewWriter(biglongFH)
@@ -176,7 +237,45 @@ func ProcessBinEventStats(statFH *os.File, ddlFH *os.File, biglongFH *os.File, c
 		ddlSql          string
 	)
 	GLogger.WriteToLogByFieldsNormalOnlyMsg("start thread to analyze statistics from binlog", logging.INFO)
+	if GCheckpoint != nil && GCheckpoint.ifResumed && GCheckpoint.Stats != nil {
+		// continue the interval in progress at checkpoint
+		lastBinlog = GCheckpoint.Stats.Binlog
+		lastPrintTime = GCheckpoint.Stats.NextPrintTime
+		for dbtbKey, oneSt := range GCheckpoint.Stats.Tables {
+			statsPrintArr[dbtbKey] = oneSt
+		}
+	}
 	for st := range statChan {
+		if st.Checkpoint != nil {
+			// stats of current interval are printed as usual when the interval ends, they are saved in checkpoint for resuming
+			ckptStats := &CheckpointStats{Binlog: lastBinlog, NextPrintTime: lastPrintTime, Tables: map[string]*BinEventStatsPrint{}}
+			for dbtbKey, oneSt := range statsPrintArr {
+				oneStCopy := *oneSt
+				ckptStats.Tables[dbtbKey] = &oneStCopy
+			}
+			GCheckpoint.ReportStats(st.Checkpoint, ckptStats)
+			GCheckpoint.Report(st.Checkpoint, GetOutputFileSizes(statFH, ddlFH, biglongFH))
+			continue
+		}
+		if st.Damaged {
+			// the trx in progress is cut off by damaged events, it is always printed as big/long trx to tell it is incomplete
+			if oneBigLong.StartTime > 0 && oneBigLong.StopTime == 0 {
+				oneBigLong.StopPos = st.StartPos
+				oneBigLong.StopTime = st.Timestamp
+				oneBigLong.Duration = oneBigLong.StopTime - oneBigLong.StartTime
+				oneBigLong.Incomplete = true
+				biglongFH.WriteString(GetBigLongTrxContentLine(oneBigLong))
+				for dbtbKey := range oneBigLong.Statements {
+					if oneSt, ok := statsPrintArr[dbtbKey]; ok {
+						oneSt.Incomplete = true
+					}
+				}
+			}
+			// events after the damaged ones till commit belong to a trx whose head is lost
+			oneBigLong = BigLongTrxInfo{Binlog: st.Binlog, StartPos: st.StopPos, Statements: map[string]map[string]uint32{},
+				RelayPos: st.RelayPos, Incomplete: true}
+			continue
+		}
 
 		if lastBinlog != st.Binlog {
 			// new binlog
@@ -203,14 +302,17 @@ func ProcessBinEventStats(statFH *os.File, ddlFH *os.File, biglongFH *os.File, c
 
 			// trx cannot spreads in different binlogs
 			if querySql == "begin" {
-				oneBigLong = BigLongTrxInfo{Binlog: st.Binlog, StartPos: st.StartPos, StartTime: 0, RowCnt: 0, Statements: map[string]map[string]uint32{}}
+				oneBigLong = BigLongTrxInfo{Binlog: st.Binlog, StartPos: st.StartPos, StartTime: 0, RowCnt: 0, Statements: map[string]map[string]uint32{},
+					ServerId: st.ServerId, Gtid: st.Gtid, RelayPos: st.RelayPos, Incomplete: st.Incomplete}
 			} else if querySql == "commit" || querySql == "rollback" {
 				if oneBigLong.StartTime > 0 { // the rows event may be skipped by --databases --tables
 					//big and long trx
 					oneBigLong.StopPos = st.StopPos
 					oneBigLong.StopTime = st.Timestamp
+					oneBigLong.Xid = st.Xid
 					oneBigLong.Duration = oneBigLong.StopTime - oneBigLong.StartTime
-					if oneBigLong.RowCnt >= bigTrxRowsLimit || oneBigLong.Duration >= longTrxSecs {
+					oneBigLong.Incomplete = oneBigLong.Incomplete || st.Incomplete
+					if oneBigLong.RowCnt >= bigTrxRowsLimit || oneBigLong.Duration >= longTrxSecs || oneBigLong.Incomplete {
 						biglongFH.WriteString(GetBigLongTrxContentLine(oneBigLong))
 					}
 				}
@@ -224,7 +326,7 @@ func ProcessBinEventStats(statFH *os.File, ddlFH *os.File, biglongFH *os.File, c
 						ddlSql = "use " + st.ParsedSqlInfo.UseDatabase + ";"
 					}
 					ddlSql += st.ParsedSqlInfo.SqlStr
-					ddlInfoStr = GetDdlInfoContentLine(st.Binlog, st.StartPos, st.StopPos, st.Timestamp, ddlSql)
+					ddlInfoStr = GetDdlInfoContentLine(st.Binlog, st.StartPos, st.StopPos, st.Timestamp, st.ServerId, st.Gtid, st.Xid, st.RelayPos, st.Incomplete, ddlSql)
 					ddlFH.WriteString(ddlInfoStr)
 
 				} else if st.ParsedSqlInfo.IsDml() {
@@ -265,6 +367,9 @@ func ProcessBinEventStats(statFH *os.File, ddlFH *os.File, biglongFH *os.File, c
 			case "delete":
 				statsPrintArr[oneTbKey].Deletes += st.RowCnt
 			}
+			if st.Incomplete {
+				statsPrintArr[oneTbKey].Incomplete = true
+			}
 			statsPrintArr[oneTbKey].StopTime = st.Timestamp
 			statsPrintArr[oneTbKey].StopPos = st.StopPos
 		}
@@ -292,42 +397,112 @@ func ProcessBinEventStats(statFH *os.File, ddlFH *os.File, biglongFH *os.File, c
 
 }
 
+// GetStatsHeaderColumnNames adds incomplete column at the end for -tolerant
+func GetStatsHeaderColumnNames() []string {
+	if !GConfCmd.Tolerant {
+		return Stats_Result_Header_Column_names
+	}
+	return append(append([]string{}, Stats_Result_Header_Column_names...), C_incompleteTrx)
+}
+
 func GetStatsPrintHeaderLine(headers []string) string {
-	//[binlog, starttime, stoptime, startpos, stoppos, inserts, updates, deletes, database, table,]
+	//[binlog, starttime, stoptime, startpos, stoppos, inserts, updates, deletes, database, table, [incomplete]]
+	if len(headers) > len(Stats_Result_Header_Column_names) {
+		return fmt.Sprintf("%-17s %-19s %-19s %-10s %-10s %-8s %-8s %-8s %-15s %-20s %s\n", ConvertStrArrToIntferfaceArrForPrint(headers)...)
+	}
 	return fmt.Sprintf("%-17s %-19s %-19s %-10s %-10s %-8s %-8s %-8s %-15s %-20s\n", ConvertStrArrToIntferfaceArrForPrint(headers)...)
 }
 
 func GetStatsPrintContentLine(st *BinEventStatsPrint) string {
-	//[binlog, starttime, stoptime, startpos, stoppos, inserts, updates, deletes, database, table]
-	return fmt.Sprintf("%-17s %-19s %-19s %-10d %-10d %-8d %-8d %-8d %-15s %-20s\n",
+	//[binlog, starttime, stoptime, startpos, stoppos, inserts, updates, deletes, database, table, [incomplete]]
+	line := fmt.Sprintf("%-17s %-19s %-19s %-10d %-10d %-8d %-8d %-8d %-15s %-20s",
 		st.Binlog, GetDatetimeStr(int64(st.StartTime), int64(0), constvar.DATETIME_FORMAT_NOSPACE),
 		GetDatetimeStr(int64(st.StopTime), int64(0), constvar.DATETIME_FORMAT_NOSPACE),
 		st.StartPos, st.StopPos, st.Inserts, st.Updates, st.Deletes, st.Database, st.Table)
+	if GConfCmd.Tolerant {
+		line += " " + GetIncompleteTrxStr(st.Incomplete)
+	}
+	return line + "\n"
+}
+
+// GetOptionalColumnNames is relaypos for -relay and incomplete for -tolerant, they are added before the last column
+func GetOptionalColumnNames() []string {
+	var headers []string
+	if GConfCmd.RelayLogMode {
+		headers = append(headers, C_relayPosColumnName)
+	}
+	if GConfCmd.Tolerant {
+		headers = append(headers, C_incompleteTrx)
+	}
+	return headers
+}
+
+func GetOptionalColumnsFormat() string {
+	format := ""
+	if GConfCmd.RelayLogMode {
+		format += "%-30s "
+	}
+	if GConfCmd.Tolerant {
+		format += "%-10s "
+	}
+	return format
+}
+
+func GetOptionalColumnsValues(relayPos mysql.Position, incomplete bool) []interface{} {
+	var values []interface{}
+	if GConfCmd.RelayLogMode {
+		values = append(values, GetRelayPosStr(relayPos))
+	}
+	if GConfCmd.Tolerant {
+		values = append(values, GetIncompleteTrxStr(incomplete))
+	}
+	return values
+}
+
+// GetDdlHeaderColumnNames adds relaypos column for -relay and incomplete column for -tolerant before sql
+func GetDdlHeaderColumnNames() []string {
+	cnt := len(Stats_DDL_Header_Column_names)
+	headers := append([]string{}, Stats_DDL_Header_Column_names[0:cnt-1]...)
+	headers = append(headers, GetOptionalColumnNames()...)
+	return append(headers, Stats_DDL_Header_Column_names[cnt-1])
 }
 
 func GetDdlPrintHeaderLine(headers []string) string {
-	//{"datetime", "binlog", "startpos", "stoppos", "sql"}
-	return fmt.Sprintf("%-19s %-17s %-10s %-10s %s\n", ConvertStrArrToIntferfaceArrForPrint(headers)...)
+	//{"datetime", "binlog", "startpos", "stoppos", "serverid", "gtid", "xid", ["relaypos",] ["incomplete",] "sql"}
+	return fmt.Sprintf("%-19s %-17s %-10s %-10s %-10s %-45s %-10s "+GetOptionalColumnsFormat()+"%s\n", ConvertStrArrToIntferfaceArrForPrint(headers)...)
 }
 
-func GetDdlInfoContentLine(binlog string, spos uint32, epos uint32, timeStamp uint32, sql string) string {
-	// datetime, binlog, startpos, stoppos, ddlsql
+func GetDdlInfoContentLine(binlog string, spos uint32, epos uint32, timeStamp uint32, serverId uint32, gtid string, xid uint64, relayPos mysql.Position, incomplete bool, sql string) string {
+	// datetime, binlog, startpos, stoppos, serverid, gtid, xid, [relaypos,] [incomplete,] ddlsql
 	tStr := GetDatetimeStr(int64(timeStamp), int64(0), constvar.DATETIME_FORMAT_NOSPACE)
-	return fmt.Sprintf("%-19s %-17s %-10d %-10d %s\n", tStr, binlog, spos, epos, sql)
+	values := []interface{}{tStr, binlog, spos, epos, serverId, GetGtidStrForPrint(gtid), xid}
+	values = append(values, GetOptionalColumnsValues(relayPos, incomplete)...)
+	return fmt.Sprintf("%-19s %-17s %-10d %-10d %-10d %-45s %-10d "+GetOptionalColumnsFormat()+"%s\n", append(values, sql)...)
+}
+
+// GetBigLongTrxHeaderColumnNames adds relaypos column for -relay and incomplete column for -tolerant before tables
+func GetBigLongTrxHeaderColumnNames() []string {
+	cnt := len(Stats_BigLongTrx_Header_Column_names)
+	headers := append([]string{}, Stats_BigLongTrx_Header_Column_names[0:cnt-1]...)
+	headers = append(headers, GetOptionalColumnNames()...)
+	return append(headers, Stats_BigLongTrx_Header_Column_names[cnt-1])
 }
 
 func GetBigLongTrxPrintHeaderLine(headers []string) string {
-	//{"binlog", "starttime", "stoptime", "startpos", "stoppos", "rows","duration", "tables"}
-	return fmt.Sprintf("%-17s %-19s %-19s %-10s %-10s %-8s %-10s %s\n", ConvertStrArrToIntferfaceArrForPrint(headers)...)
+	//{"binlog", "starttime", "stoptime", "startpos", "stoppos", "rows","duration", "serverid", "gtid", "xid", ["relaypos",] ["incomplete",] "tables"}
+	return fmt.Sprintf("%-17s %-19s %-19s %-10s %-10s %-8s %-10s %-10s %-45s %-10s "+GetOptionalColumnsFormat()+"%s\n", ConvertStrArrToIntferfaceArrForPrint(headers)...)
 }
 
 func GetBigLongTrxContentLine(blTrx BigLongTrxInfo) string {
-	//{"binlog", "starttime", "stoptime", "startpos", "stoppos", "rows", "duration", "tables"}
-	return fmt.Sprintf("%-17s %-19s %-19s %-10d %-10d %-8d %-10d %s\n", blTrx.Binlog,
+	//{"binlog", "starttime", "stoptime", "startpos", "stoppos", "rows", "duration", "serverid", "gtid", "xid", ["relaypos",] ["incomplete",] "tables"}
+	values := []interface{}{blTrx.Binlog,
 		GetDatetimeStr(int64(blTrx.StartTime), int64(0), constvar.DATETIME_FORMAT_NOSPACE),
 		GetDatetimeStr(int64(blTrx.StopTime), int64(0), constvar.DATETIME_FORMAT_NOSPACE),
 		blTrx.StartPos, blTrx.StopPos,
-		blTrx.RowCnt, blTrx.Duration, GetBigLongTrxStatementsStr(blTrx.Statements))
+		blTrx.RowCnt, blTrx.Duration, blTrx.ServerId, GetGtidStrForPrint(blTrx.Gtid), blTrx.Xid}
+	values = append(values, GetOptionalColumnsValues(blTrx.RelayPos, blTrx.Incomplete)...)
+	return fmt.Sprintf("%-17s %-19s %-19s %-10d %-10d %-8d %-10d %-10d %-45s %-10d "+GetOptionalColumnsFormat()+"%s\n",
+		append(values, GetBigLongTrxStatementsStr(blTrx.Statements))...)
 }
 
 func GetBigLongTrxStatementsStr(st map[string]map[string]uint32) string {
@@ -362,7 +537,8 @@ func GetDbTbAndQueryAndRowCntFromBinevent(ev *replication.BinlogEvent) (string,
 		rowCnt = uint32(len(wrEvent.Rows))
 
 	case replication.UPDATE_ROWS_EVENTv1,
-		replication.UPDATE_ROWS_EVENTv2:
+		replication.UPDATE_ROWS_EVENTv2,
+		replication.PARTIAL_UPDATE_ROWS_EVENT:
 
 		wrEvent := ev.Event.(*replication.RowsEvent)
 		db = string(wrEvent.Table.Schema)
@@ -9,14 +9,12 @@ import (
 
 func GetTblDefFromDbAndMergeAndDump(cfg *ConfCmd) {
 
-	ifNeedGetTblDefFromDb := false
-	if cfg.WorkType == "tbldef" {
-		ifNeedGetTblDefFromDb = true
-	}
-	if cfg.WorkType != "stats" && !cfg.OnlyColFromFile {
-		ifNeedGetTblDefFromDb = true
+	if cfg.ReadTblDefSqlFile != "" {
+		GetTblDefFromSchemaFiles(cfg)
 	}
 
+	ifNeedGetTblDefFromDb := cfg.IfGetTblDefFromMysql()
+
 	if ifNeedGetTblDefFromDb {
 		if (cfg.Socket == "") && (cfg.Host == "" || cfg.Port == 0) {
 			GLogger.WriteToLogByFieldsExitMsgNoErr("when (-w!=stats and not sepecify -oj) or -w=tbldef, must specify mysql addr and login user/password to get table definition",
@@ -40,12 +38,16 @@ func GetTblDefFromDbAndMergeAndDump(cfg *ConfCmd) {
 
 	}
 
-	if cfg.WorkType != "stats" && len(G_TablesColumnsInfo.tableInfos) == 0 {
+	if cfg.IfGenSql() && !cfg.UseTableMapMeta && len(G_TablesColumnsInfo.tableInfos) == 0 {
 		GLogger.WriteToLogByFieldsExitMsgNoErr(fmt.Sprintf("-w!=stats, but get no table definition info from mysql or local json file!!!\nError Exits!!"),
 			logging.ERROR, ehand.ERR_MYSQL_QUERY)
 	}
 
-	if cfg.DumpTblDefToFile != "" && ifNeedGetTblDefFromDb && len(G_TablesColumnsInfo.tableInfos) > 0 {
+	if cfg.DdlHistory != "" {
+		BuildTableDefHistoryFromBinlogs(cfg)
+	}
+
+	if cfg.DumpTblDefToFile != "" && (ifNeedGetTblDefFromDb || cfg.DdlHistory != "" || cfg.ReadTblDefSqlFile != "") && len(G_TablesColumnsInfo.tableInfos) > 0 {
 		(&G_TablesColumnsInfo).DumpTblInfoJsonToFile(cfg.DumpTblDefToFile)
 		GLogger.WriteToLogByFieldsNormalOnlyMsg("table definition has been dumped to "+cfg.DumpTblDefToFile, logging.INFO)
 	}
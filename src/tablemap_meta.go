@@ -0,0 +1,136 @@
+package src
+
+import (
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+)
+
+// collation id of binary charset, blob/binary/varbinary columns are of it
+const C_binaryCollationId uint64 = 63
+
+/*
+GetTblInfoJsonFromTableMap gets table definition from optional metadata of table map event for -tmeta, nil if it is not written.
+mysql 8.0 writes column names, signedness, charsets, enum/set values and primary key into table map event with binlog_row_metadata=FULL.
+There is no unique key in it, only primary key.
+*/
+func GetTblInfoJsonFromTableMap(tbMap *replication.TableMapEvent) *TblInfoJson {
+	if !tbMap.HasFullMeta() {
+		return nil
+	}
+	tbInfo := &TblInfoJson{Database: string(tbMap.Schema), Table: string(tbMap.Table), Columns: make([]FieldInfo, tbMap.ColumnCount),
+		PrimaryKey: KeyInfo{}, UniqueKeys: []KeyInfo{},
+		DdlInfo: DdlPosInfo{Binlog: KEY_NONE_BINLOG, StartPos: KEY_NONE_POS, StopPos: KEY_NONE_POS}}
+	// values are in order of enum columns and set columns, respectively
+	var enumIdx, setIdx int
+	for i := range tbInfo.Columns {
+		tbInfo.Columns[i] = FieldInfo{FieldName: string(tbMap.ColumnName[i]), FieldType: GetDataTypeOfTableMapColumn(tbMap, i),
+			Unsigned: tbMap.IsUnsigned(i)}
+		var values [][]byte
+		switch tbMap.RealType(i) {
+		case mysql.MYSQL_TYPE_ENUM:
+			if enumIdx < len(tbMap.EnumStrValue) {
+				values = tbMap.EnumStrValue[enumIdx]
+			}
+			enumIdx++
+		case mysql.MYSQL_TYPE_SET:
+			if setIdx < len(tbMap.SetStrValue) {
+				values = tbMap.SetStrValue[setIdx]
+			}
+			setIdx++
+		}
+		for _, v := range values {
+			tbInfo.Columns[i].EnumValues = append(tbInfo.Columns[i].EnumValues, string(v))
+		}
+	}
+	for _, idx := range tbMap.PrimaryKey {
+		if idx < tbMap.ColumnCount {
+			tbInfo.PrimaryKey = append(tbInfo.PrimaryKey, tbInfo.Columns[idx].FieldName)
+		}
+	}
+	return tbInfo
+}
+
+// GetDataTypeOfTableMapColumn returns type name of column like DATA_TYPE of information_schema.columns
+func GetDataTypeOfTableMapColumn(tbMap *replication.TableMapEvent, i int) string {
+	collation, ok := tbMap.Collation(i)
+	ifBinary := ok && collation == C_binaryCollationId
+	switch tbMap.RealType(i) {
+	case mysql.MYSQL_TYPE_TINY:
+		return "tinyint"
+	case mysql.MYSQL_TYPE_SHORT:
+		return "smallint"
+	case mysql.MYSQL_TYPE_INT24:
+		return "mediumint"
+	case mysql.MYSQL_TYPE_LONG:
+		return "int"
+	case mysql.MYSQL_TYPE_LONGLONG:
+		return "bigint"
+	case mysql.MYSQL_TYPE_DECIMAL, mysql.MYSQL_TYPE_NEWDECIMAL:
+		return "decimal"
+	case mysql.MYSQL_TYPE_FLOAT:
+		return "float"
+	case mysql.MYSQL_TYPE_DOUBLE:
+		return "double"
+	case mysql.MYSQL_TYPE_BIT:
+		return "bit"
+	case mysql.MYSQL_TYPE_YEAR:
+		return "year"
+	case mysql.MYSQL_TYPE_DATE, mysql.MYSQL_TYPE_NEWDATE:
+		return "date"
+	case mysql.MYSQL_TYPE_TIME, mysql.MYSQL_TYPE_TIME2:
+		return "time"
+	case mysql.MYSQL_TYPE_DATETIME, mysql.MYSQL_TYPE_DATETIME2:
+		return "datetime"
+	case mysql.MYSQL_TYPE_TIMESTAMP, mysql.MYSQL_TYPE_TIMESTAMP2:
+		return "timestamp"
+	case mysql.MYSQL_TYPE_JSON:
+		return "json"
+	case mysql.MYSQL_TYPE_GEOMETRY:
+		return "geometry"
+	case mysql.MYSQL_TYPE_ENUM:
+		return "enum"
+	case mysql.MYSQL_TYPE_SET:
+		return "set"
+	case mysql.MYSQL_TYPE_VARCHAR, mysql.MYSQL_TYPE_VAR_STRING:
+		if ifBinary {
+			return "varbinary"
+		}
+		return "varchar"
+	case mysql.MYSQL_TYPE_STRING:
+		if ifBinary {
+			return "binary"
+		}
+		return "char"
+	case mysql.MYSQL_TYPE_BLOB:
+		// meta is bytes of length of blob
+		prefix := map[uint16]string{1: "tiny", 3: "medium", 4: "long"}[tbMap.ColumnMeta[i]]
+		if ok && !ifBinary {
+			return prefix + "text"
+		}
+		return prefix + "blob"
+	}
+	return C_unknownColType
+}
+
+/*
+GetTableInfoOfRowsEvent gets table definition for rows event, from table map event for -tmeta if it has full metadata,
+otherwise from definitions got from mysql or -rj by binlog position.
+*/
+func GetTableInfoOfRowsEvent(cfg *ConfCmd, ev *MyBinEvent) (*TblInfoJson, error) {
+	if cfg.UseTableMapMeta {
+		if tbInfo := GetTblInfoJsonFromTableMap(ev.BinEvent.Table); tbInfo != nil {
+			return tbInfo, nil
+		}
+	}
+	return G_TablesColumnsInfo.GetTableInfoJsonOfBinPos(string(ev.BinEvent.Table.Schema), string(ev.BinEvent.Table.Table),
+		ev.MyPos.Name, ev.StartPos, ev.MyPos.Pos)
+}
+
+// IfHasTableInfoOfRowsEvent tells whether there is table definition for rows event, rows events without it are skipped
+func IfHasTableInfoOfRowsEvent(cfg *ConfCmd, tbMap *replication.TableMapEvent) bool {
+	if cfg.UseTableMapMeta && tbMap.HasFullMeta() {
+		return true
+	}
+	_, ok := G_TablesColumnsInfo.tableInfos[GetAbsTableName(string(tbMap.Schema), string(tbMap.Table))]
+	return ok
+}
@@ -0,0 +1,215 @@
+package src
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/siddontang/go-mysql/mysql"
+	"github.com/siddontang/go-mysql/replication"
+)
+
+// genTestLenEncInts returns length encoded ints, all less than 65536
+func genTestLenEncInts(vals ...uint64) []byte {
+	var data []byte
+	for _, v := range vals {
+		if v < 251 {
+			data = append(data, byte(v))
+		} else {
+			data = append(data, 0xfc, byte(v), byte(v>>8))
+		}
+	}
+	return data
+}
+
+// genTestLenEncStrs returns length encoded strings, all shorter than 251
+func genTestLenEncStrs(strs ...string) []byte {
+	var data []byte
+	for _, s := range strs {
+		data = append(append(data, byte(len(s))), s...)
+	}
+	return data
+}
+
+// genTestOptMetaField returns one field of optional metadata of table map event, in type, length, value format
+func genTestOptMetaField(tp byte, v []byte) []byte {
+	return append([]byte{tp, byte(len(v))}, v...)
+}
+
+/*
+genTestTableMapEvent parses table map event of db1.t with optional metadata, columns are:
+id int unsigned, name varchar(20), data varbinary(10), note text, big longblob,
+e enum('a','b'), s set('x','y','z'), e2 enum('on','off'), amount decimal(5,2), c char(4)
+*/
+func genTestTableMapEvent(t *testing.T, optMeta ...[]byte) *replication.TableMapEvent {
+	colTypes := []byte{mysql.MYSQL_TYPE_LONG, mysql.MYSQL_TYPE_VARCHAR, mysql.MYSQL_TYPE_VARCHAR, mysql.MYSQL_TYPE_BLOB,
+		mysql.MYSQL_TYPE_BLOB, mysql.MYSQL_TYPE_STRING, mysql.MYSQL_TYPE_STRING, mysql.MYSQL_TYPE_STRING,
+		mysql.MYSQL_TYPE_NEWDECIMAL, mysql.MYSQL_TYPE_STRING}
+	colMeta := []byte{80, 0, 10, 0, 2, 4, mysql.MYSQL_TYPE_ENUM, 1, mysql.MYSQL_TYPE_SET, 1, mysql.MYSQL_TYPE_ENUM, 1, 5, 2,
+		mysql.MYSQL_TYPE_STRING, 4}
+	body := []byte{88, 0, 0, 0, 0, 0, 1, 0, 3, 'd', 'b', '1', 0, 1, 't', 0, byte(len(colTypes))}
+	body = append(body, colTypes...)
+	body = append(append(body, byte(len(colMeta))), colMeta...)
+	body = append(body, 0xff, 0x03)
+	for _, field := range optMeta {
+		body = append(body, field...)
+	}
+
+	parser := newTestBinlogParser(t)
+	ev, err := parser.Parse(genTestEventData(replication.TABLE_MAP_EVENT, body))
+	if err != nil {
+		t.Fatalf("fail to parse table map event: %v", err)
+	}
+	return ev.Event.(*replication.TableMapEvent)
+}
+
+// genTestFullOptMeta returns optional metadata of binlog_row_metadata=FULL, collations are default ones with exceptions
+func genTestFullOptMeta() [][]byte {
+	return [][]byte{
+		genTestOptMetaField(replication.TABLE_MAP_OPT_META_SIGNEDNESS, []byte{0x80}),
+		// default utf8mb4_0900_ai_ci, binary for data and big, latin1_swedish_ci for c
+		genTestOptMetaField(replication.TABLE_MAP_OPT_META_DEFAULT_CHARSET, genTestLenEncInts(255, 1, 63, 3, 63, 4, 8)),
+		genTestOptMetaField(replication.TABLE_MAP_OPT_META_COLUMN_NAME,
+			genTestLenEncStrs("id", "name", "data", "note", "big", "e", "s", "e2", "amount", "c")),
+		genTestOptMetaField(replication.TABLE_MAP_OPT_META_SET_STR_VALUE, append([]byte{3}, genTestLenEncStrs("x", "y", "z")...)),
+		genTestOptMetaField(replication.TABLE_MAP_OPT_META_ENUM_STR_VALUE,
+			append(append([]byte{2}, genTestLenEncStrs("a", "b")...), append([]byte{2}, genTestLenEncStrs("on", "off")...)...)),
+		// unknown type is skipped
+		genTestOptMetaField(99, []byte{1, 2, 3}),
+		genTestOptMetaField(replication.TABLE_MAP_OPT_META_SIMPLE_PRIMARY_KEY, []byte{0}),
+		genTestOptMetaField(replication.TABLE_MAP_OPT_META_ENUM_AND_SET_DEFAULT_CHARSET, genTestLenEncInts(255)),
+	}
+}
+
+func TestDecodeTableMapOptionalMeta(t *testing.T) {
+	tbMap := genTestTableMapEvent(t, genTestFullOptMeta()...)
+	if !tbMap.HasFullMeta() {
+		t.Fatalf("table map event has no full metadata, column names are %q", tbMap.ColumnName)
+	}
+	if !reflect.DeepEqual(tbMap.EnumStrValue, [][][]byte{{[]byte("a"), []byte("b")}, {[]byte("on"), []byte("off")}}) {
+		t.Errorf("enum values are %q", tbMap.EnumStrValue)
+	}
+	if !reflect.DeepEqual(tbMap.SetStrValue, [][][]byte{{[]byte("x"), []byte("y"), []byte("z")}}) {
+		t.Errorf("set values are %q", tbMap.SetStrValue)
+	}
+	if !reflect.DeepEqual(tbMap.PrimaryKey, []uint64{0}) || !reflect.DeepEqual(tbMap.PrimaryKeyPrefix, []uint64{0}) {
+		t.Errorf("primary key is %v, prefix %v", tbMap.PrimaryKey, tbMap.PrimaryKeyPrefix)
+	}
+	for i, unsigned := range []bool{true, false, false, false, false, false, false, false, false, false} {
+		if tbMap.IsUnsigned(i) != unsigned {
+			t.Errorf("column %s is unsigned: %v, expect %v", tbMap.ColumnName[i], tbMap.IsUnsigned(i), unsigned)
+		}
+	}
+	// 0 for columns without collation
+	expectedCollations := []uint64{0, 255, 63, 255, 63, 255, 255, 255, 0, 8}
+	checkCollations := func(tbMap *replication.TableMapEvent, expected []uint64) {
+		for i, collation := range expected {
+			if c, ok := tbMap.Collation(i); c != collation || ok != (collation != 0) {
+				t.Errorf("collation of column %s is %d %v, expect %d", tbMap.ColumnName[i], c, ok, collation)
+			}
+		}
+	}
+	checkCollations(tbMap, expectedCollations)
+
+	// collations of every column, primary key with prefix, signedness of amount
+	tbMap = genTestTableMapEvent(t,
+		genTestOptMetaField(replication.TABLE_MAP_OPT_META_SIGNEDNESS, []byte{0xc0}),
+		genTestOptMetaField(replication.TABLE_MAP_OPT_META_COLUMN_CHARSET, genTestLenEncInts(255, 63, 45, 63, 8)),
+		genTestOptMetaField(replication.TABLE_MAP_OPT_META_COLUMN_NAME,
+			genTestLenEncStrs("id", "name", "data", "note", "big", "e", "s", "e2", "amount", "c")),
+		genTestOptMetaField(replication.TABLE_MAP_OPT_META_PRIMARY_KEY_WITH_PREFIX, []byte{0, 0, 1, 10}),
+		genTestOptMetaField(replication.TABLE_MAP_OPT_META_ENUM_AND_SET_COLUMN_CHARSET, genTestLenEncInts(255, 255, 8)),
+	)
+	checkCollations(tbMap, []uint64{0, 255, 63, 45, 63, 255, 255, 8, 0, 8})
+	if !reflect.DeepEqual(tbMap.PrimaryKey, []uint64{0, 1}) || !reflect.DeepEqual(tbMap.PrimaryKeyPrefix, []uint64{0, 10}) {
+		t.Errorf("primary key with prefix is %v, prefix %v", tbMap.PrimaryKey, tbMap.PrimaryKeyPrefix)
+	}
+	if !tbMap.IsUnsigned(0) || !tbMap.IsUnsigned(8) {
+		t.Errorf("columns id and amount are not unsigned with signedness %v", tbMap.SignednessBitmap)
+	}
+
+	// without optional metadata, or it is truncated
+	tbMap = genTestTableMapEvent(t)
+	if tbMap.HasFullMeta() || len(tbMap.SignednessBitmap) != 0 || tbMap.IsUnsigned(0) {
+		t.Errorf("table map event without optional metadata has column names %q, signedness %v", tbMap.ColumnName, tbMap.SignednessBitmap)
+	}
+	if _, ok := tbMap.Collation(1); ok {
+		t.Errorf("table map event without optional metadata has collation of column name")
+	}
+	truncated := genTestOptMetaField(replication.TABLE_MAP_OPT_META_COLUMN_NAME, genTestLenEncStrs("id", "name"))
+	truncated[1] = 50
+	if tbMap = genTestTableMapEvent(t, truncated); tbMap.HasFullMeta() {
+		t.Errorf("table map event with truncated optional metadata has column names %q", tbMap.ColumnName)
+	}
+}
+
+func TestGetTblInfoJsonFromTableMap(t *testing.T) {
+	tbInfo := GetTblInfoJsonFromTableMap(genTestTableMapEvent(t, genTestFullOptMeta()...))
+	expected := &TblInfoJson{Database: "db1", Table: "t", PrimaryKey: KeyInfo{"id"}, UniqueKeys: []KeyInfo{},
+		DdlInfo: DdlPosInfo{Binlog: KEY_NONE_BINLOG, StartPos: KEY_NONE_POS, StopPos: KEY_NONE_POS},
+		Columns: []FieldInfo{
+			{FieldName: "id", FieldType: "int", Unsigned: true},
+			{FieldName: "name", FieldType: "varchar"},
+			{FieldName: "data", FieldType: "varbinary"},
+			{FieldName: "note", FieldType: "text"},
+			{FieldName: "big", FieldType: "longblob"},
+			{FieldName: "e", FieldType: "enum", EnumValues: []string{"a", "b"}},
+			{FieldName: "s", FieldType: "set", EnumValues: []string{"x", "y", "z"}},
+			{FieldName: "e2", FieldType: "enum", EnumValues: []string{"on", "off"}},
+			{FieldName: "amount", FieldType: "decimal"},
+			{FieldName: "c", FieldType: "char"},
+		}}
+	if !reflect.DeepEqual(tbInfo, expected) {
+		t.Errorf("table definition from table map is %+v, expect %+v", tbInfo, expected)
+	}
+
+	if tbInfo = GetTblInfoJsonFromTableMap(genTestTableMapEvent(t)); tbInfo != nil {
+		t.Errorf("table definition from table map without optional metadata is %+v", tbInfo)
+	}
+}
+
+func TestGetDataTypeOfTableMapColumn(t *testing.T) {
+	cases := []struct {
+		tp        byte
+		meta      uint16
+		collation []uint64 // DEFAULT_CHARSET
+		expected  string
+	}{
+		{mysql.MYSQL_TYPE_TINY, 0, nil, "tinyint"},
+		{mysql.MYSQL_TYPE_SHORT, 0, nil, "smallint"},
+		{mysql.MYSQL_TYPE_INT24, 0, nil, "mediumint"},
+		{mysql.MYSQL_TYPE_LONG, 0, nil, "int"},
+		{mysql.MYSQL_TYPE_LONGLONG, 0, nil, "bigint"},
+		{mysql.MYSQL_TYPE_NEWDECIMAL, 0x0502, nil, "decimal"},
+		{mysql.MYSQL_TYPE_FLOAT, 4, nil, "float"},
+		{mysql.MYSQL_TYPE_DOUBLE, 8, nil, "double"},
+		{mysql.MYSQL_TYPE_BIT, 0x0100, nil, "bit"},
+		{mysql.MYSQL_TYPE_YEAR, 0, nil, "year"},
+		{mysql.MYSQL_TYPE_DATE, 0, nil, "date"},
+		{mysql.MYSQL_TYPE_TIME2, 0, nil, "time"},
+		{mysql.MYSQL_TYPE_DATETIME2, 6, nil, "datetime"},
+		{mysql.MYSQL_TYPE_TIMESTAMP2, 0, nil, "timestamp"},
+		{mysql.MYSQL_TYPE_JSON, 4, nil, "json"},
+		{mysql.MYSQL_TYPE_GEOMETRY, 4, nil, "geometry"},
+		{mysql.MYSQL_TYPE_STRING, uint16(mysql.MYSQL_TYPE_ENUM)<<8 | 1, nil, "enum"},
+		{mysql.MYSQL_TYPE_STRING, uint16(mysql.MYSQL_TYPE_SET)<<8 | 1, nil, "set"},
+		{mysql.MYSQL_TYPE_STRING, uint16(mysql.MYSQL_TYPE_STRING)<<8 | 4, []uint64{8}, "char"},
+		{mysql.MYSQL_TYPE_STRING, uint16(mysql.MYSQL_TYPE_STRING)<<8 | 4, []uint64{C_binaryCollationId}, "binary"},
+		{mysql.MYSQL_TYPE_VARCHAR, 80, []uint64{255}, "varchar"},
+		{mysql.MYSQL_TYPE_VARCHAR, 10, []uint64{C_binaryCollationId}, "varbinary"},
+		// collation of varchar is unknown without optional metadata
+		{mysql.MYSQL_TYPE_VARCHAR, 10, nil, "varchar"},
+		{mysql.MYSQL_TYPE_BLOB, 1, []uint64{C_binaryCollationId}, "tinyblob"},
+		{mysql.MYSQL_TYPE_BLOB, 2, []uint64{C_binaryCollationId}, "blob"},
+		{mysql.MYSQL_TYPE_BLOB, 3, []uint64{255}, "mediumtext"},
+		{mysql.MYSQL_TYPE_BLOB, 4, []uint64{255}, "longtext"},
+		// text is logged as blob, it is blob without optional metadata
+		{mysql.MYSQL_TYPE_BLOB, 2, nil, "blob"},
+		{mysql.MYSQL_TYPE_NULL, 0, nil, C_unknownColType},
+	}
+	for _, c := range cases {
+		tbMap := &replication.TableMapEvent{ColumnCount: 1, ColumnType: []byte{c.tp}, ColumnMeta: []uint16{c.meta}, DefaultCharset: c.collation}
+		if tp := GetDataTypeOfTableMapColumn(tbMap, 0); tp != c.expected {
+			t.Errorf("type of column of type %d, meta %d, collation %v is %s, expect %s", c.tp, c.meta, c.collation, tp, c.expected)
+		}
+	}
+}